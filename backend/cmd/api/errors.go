@@ -0,0 +1,78 @@
+package main
+
+import "net/http"
+
+// errorCode is a stable, machine-readable error identifier.
+// Clients should branch on the code, not on the message text, which may change.
+type errorCode string
+
+const (
+	// codeInvalidRequest: malformed body, bad path parameter or a field that failed validation
+	codeInvalidRequest errorCode = "INVALID_REQUEST"
+	// codeUnauthorized: no authenticated user
+	codeUnauthorized errorCode = "UNAUTHORIZED"
+	// codeNotFound: the resource doesn't exist or isn't visible to the caller
+	codeNotFound errorCode = "NOT_FOUND"
+	// codeInternal: unexpected server-side failure; safe to retry
+	codeInternal errorCode = "INTERNAL_ERROR"
+
+	// codeInvalidAppName: the app name is not allowed; details.suggestion holds a valid alternative
+	codeInvalidAppName errorCode = "INVALID_APP_NAME"
+	// codeAppNameTaken: another app already uses the name
+	codeAppNameTaken errorCode = "APP_NAME_TAKEN"
+	// codeRepositoryUnreachable: the repository or branch could not be cloned
+	codeRepositoryUnreachable errorCode = "REPOSITORY_UNREACHABLE"
+	// codeBranchNotFound: the repository has no such branch; details.available_branches lists those it has
+	codeBranchNotFound errorCode = "BRANCH_NOT_FOUND"
+	// codeDockerfileMissing: the repository has no Dockerfile at its root
+	codeDockerfileMissing errorCode = "DOCKERFILE_MISSING"
+	// codeInvalidBuildPath: a symlink in the repository leads context_dir or dockerfile_path out of it
+	codeInvalidBuildPath errorCode = "INVALID_BUILD_PATH"
+	// codeAppNotRunning: the operation needs a running deployment
+	codeAppNotRunning errorCode = "APP_NOT_RUNNING"
+	// codeNothingToPromote: the environment or deployment has no built image to promote
+	codeNothingToPromote errorCode = "NOTHING_TO_PROMOTE"
+	// codeAppStopped: the app was stopped by its owner and must be started first
+	codeAppStopped errorCode = "APP_STOPPED"
+	// codeAppAlreadyRunning: the app is already running
+	codeAppAlreadyRunning errorCode = "APP_ALREADY_RUNNING"
+	// codeHealthCheckFailed: the app did not pass its health check
+	codeHealthCheckFailed errorCode = "HEALTH_CHECK_FAILED"
+	// codeDomainInUse: the custom domain is attached to another app
+	codeDomainInUse errorCode = "DOMAIN_IN_USE"
+	// codeDomainNotVerified: DNS does not prove ownership of the domain yet
+	codeDomainNotVerified errorCode = "DOMAIN_NOT_VERIFIED"
+	// codeDeploymentInProgress: a deployment the request would conflict with is queued or building
+	codeDeploymentInProgress errorCode = "DEPLOYMENT_IN_PROGRESS"
+	// codeTooManyDeployments: the user already has the maximum number of deployments queued or building
+	codeTooManyDeployments errorCode = "TOO_MANY_DEPLOYMENTS"
+	// codeRequestInProgress: a request with the same Idempotency-Key is still running
+	codeRequestInProgress errorCode = "REQUEST_IN_PROGRESS"
+	// codeRateLimited: too many requests in a short time; the Retry-After header says when to try again
+	codeRateLimited errorCode = "RATE_LIMITED"
+	// codeSecretsNotConfigured: app secrets can't be set because the server has no SECRETS_KEY
+	codeSecretsNotConfigured errorCode = "SECRETS_NOT_CONFIGURED"
+	// codeExecDisabled: shell access to app containers is not enabled on this platform
+	codeExecDisabled errorCode = "EXEC_DISABLED"
+)
+
+// apiError is the body of every error response:
+//
+//	{"error": {"code": "NOT_FOUND", "message": "App not found", "details": {...}}}
+type apiError struct {
+	Code    errorCode              `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// respondError writes an error response with the given HTTP status and error code.
+func respondError(w http.ResponseWriter, status int, code errorCode, message string) {
+	respondErrorDetails(w, status, code, message, nil)
+}
+
+// respondErrorDetails writes an error response carrying extra machine-readable details.
+func respondErrorDetails(w http.ResponseWriter, status int, code errorCode, message string, details map[string]interface{}) {
+	respondJSON(w, status, map[string]apiError{
+		"error": {Code: code, Message: message, Details: details},
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"mvp-be/internal/apps"
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/environments"
+	"mvp-be/internal/websocket"
+)
+
+// execShell starts bash where the image has it, and sh otherwise
+var execShell = []string{"/bin/sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash; else exec sh; fi"}
+
+// execOutputBuffer is the most terminal output sent in one message
+const execOutputBuffer = 32 << 10
+
+// execControl is a text message from the client; binary messages are typed into the terminal
+type execControl struct {
+	// Type is "input", with Data to type, or "resize", with the terminal's new Rows and Cols
+	Type string `json:"type"`
+	Data string `json:"data"`
+	Rows uint   `json:"rows"`
+	Cols uint   `json:"cols"`
+}
+
+// originAllowed reports whether origin is exactly one of allowedOrigins (see ALLOWED_ORIGINS).
+// A "*" entry matches nothing here: it opens CORS to every site, but a shell must never be.
+func originAllowed(allowedOrigins []string, origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed != "*" && strings.TrimSuffix(allowed, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// execApp handles GET /api/v1/apps/{id}/exec
+// Upgrades to a WebSocket running an interactive shell in the app's running container.
+// Binary messages and {"type": "input"} text messages are typed into the shell, whose terminal
+// output comes back as binary messages; {"type": "resize"} resizes the terminal. Optional
+// query parameters: environment (default production), and rows and cols for the initial size.
+func execApp(appStore *apps.Store, deploymentStore *deployments.Store, runner *dockerrun.Runner, enabled bool, allowedOrigins []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+		if !enabled {
+			respondError(w, http.StatusForbidden, codeExecDisabled, "Shell access is not enabled on this platform")
+			return
+		}
+		// Browsers don't apply CORS to WebSockets, so other sites' pages must be turned away here.
+		// Browsers always send Origin on WebSocket handshakes; clients that don't aren't pages
+		// another site can drive with the user's credentials, so they are let through.
+		if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(allowedOrigins, origin) {
+			respondError(w, http.StatusForbidden, codeInvalidRequest, "Origin not allowed")
+			return
+		}
+
+		// Unlike the other endpoints, a shell is never opened for anonymous requests or into
+		// apps without an owner
+		userID, ok := getUserID(r)
+		if !ok {
+			respondError(w, http.StatusUnauthorized, codeUnauthorized, "Shell access needs an authenticated user")
+			return
+		}
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || app.UserID != userID {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		env := r.URL.Query().Get("environment")
+		if env == "" {
+			env = environments.Production
+		}
+		running, err := deploymentStore.GetRunningByEnvironment(r.Context(), id, env)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		if len(running) == 0 || !running[0].ContainerID.Valid {
+			respondError(w, http.StatusConflict, codeAppNotRunning, "App has no running deployment to open a shell in")
+			return
+		}
+		containerID := running[0].ContainerID.String
+
+		rows, _ := strconv.ParseUint(r.URL.Query().Get("rows"), 10, 16)
+		cols, _ := strconv.ParseUint(r.URL.Query().Get("cols"), 10, 16)
+		session, err := runner.Exec(r.Context(), containerID, execShell, uint(rows), uint(cols))
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		defer session.Close()
+
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			if errors.Is(err, websocket.ErrBadHandshake) {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+				return
+			}
+			log.Printf("Warning: failed to open shell for app %d: %v", id, err)
+			return
+		}
+		log.Printf("Shell opened in container %s of app %d", containerID, id)
+
+		// Terminal output goes to the client until the shell exits
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			buf := make([]byte, execOutputBuffer)
+			for {
+				n, err := session.Read(buf)
+				if n > 0 {
+					if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					if err == io.EOF {
+						conn.Close(websocket.CloseNormal, "shell exited")
+					} else {
+						conn.Close(websocket.CloseInternalError, "lost the shell")
+					}
+					return
+				}
+			}
+		}()
+
+		// Input goes to the shell until the client disconnects or the shell exits
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			input := data
+			if messageType == websocket.TextMessage {
+				var msg execControl
+				if err := json.Unmarshal(data, &msg); err != nil {
+					continue
+				}
+				switch msg.Type {
+				case "input":
+					input = []byte(msg.Data)
+				case "resize":
+					input = nil
+					if msg.Rows > 0 && msg.Cols > 0 {
+						if err := runner.ResizeExec(r.Context(), session.ID, msg.Rows, msg.Cols); err != nil {
+							log.Printf("Warning: failed to resize shell of app %d: %v", id, err)
+						}
+					}
+				default:
+					input = nil
+				}
+			}
+			if len(input) > 0 {
+				if _, err := session.Write(input); err != nil {
+					break
+				}
+			}
+		}
+		conn.Close(websocket.CloseNormal, "")
+		session.Close()
+		<-done
+		log.Printf("Shell closed in container %s of app %d", containerID, id)
+	}
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -16,7 +31,18 @@ import (
 	"mvp-be/internal/config"
 	"mvp-be/internal/db"
 	"mvp-be/internal/deployments"
+	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/domains"
+	"mvp-be/internal/environments"
 	"mvp-be/internal/gitrepo"
+	"mvp-be/internal/healthcheck"
+	"mvp-be/internal/idempotency"
+	"mvp-be/internal/logs"
+	"mvp-be/internal/maintenance"
+	"mvp-be/internal/metrics"
+	"mvp-be/internal/notify"
+	"mvp-be/internal/runtimelogs"
+	"mvp-be/internal/secrets"
 )
 
 // contextKey is a type for context keys to avoid collisions
@@ -26,9 +52,14 @@ const userIDKey contextKey = "user_id"
 
 func main() {
 	cfg := config.Load()
+	cfg.MustValidate()
 
 	// Initialize database
-	database, err := db.New(cfg.DatabaseURL)
+	database, err := db.New(cfg.DatabaseURL, db.Options{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+	})
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -40,43 +71,73 @@ func main() {
 	}
 
 	// Initialize stores
-	appStore := apps.NewStore(database.DB)
+	secretsCipher, err := secrets.NewCipher(cfg.SecretsKey)
+	if err != nil {
+		log.Fatalf("Invalid SECRETS_KEY: %v", err)
+	}
+	appStore := apps.NewStore(database.DB, secretsCipher)
 	deploymentStore := deployments.NewStore(database.DB)
+	metricsStore := metrics.NewStore(database.DB)
+	domainStore := domains.NewStore(database.DB)
+	envStore := environments.NewStore(database.DB)
+	secretStore := secrets.NewStore(database.DB, secretsCipher)
+	idempotencyStore := idempotency.NewStore(database.DB)
+	runtimeLogStore := runtimelogs.NewStore(database.DB)
+	// Stopping and starting apps writes and removes their maintenance routes right away
+	maintenanceRouter := maintenance.NewRouter(cfg.TraefikDynamicDir, cfg.CertResolver, cfg.MaintenancePageURL)
+
+	// Build secrets set before they were encrypted are encrypted once a key is configured
+	if n, err := appStore.EncryptBuildSecrets(context.Background()); err != nil {
+		log.Printf("Warning: failed to encrypt stored build secrets: %v", err)
+	} else if n > 0 {
+		log.Printf("Encrypted the build secrets of %d apps", n)
+	}
 
 	// Initialize git cloner for Dockerfile validation
 	workDir := "/tmp/mvp-api-validation"
 	if err := os.MkdirAll(workDir, 0755); err != nil {
 		log.Fatalf("Failed to create validation work directory: %v", err)
 	}
-	cloner := gitrepo.NewCloner(workDir)
+	cloner := gitrepo.NewCloner(workDir, cfg.CloneTimeout, cfg.CloneMaxSizeMB<<20)
+
+	// Initialize Docker runner for container lifecycle actions (restart, etc.)
+	runner, err := dockerrun.NewRunner(cfg.DockerHost, dockerrun.Options{CertResolver: cfg.CertResolver, Network: cfg.DockerNetwork, VolumeDriver: cfg.VolumeDriver})
+	if err != nil {
+		log.Fatalf("Failed to create Docker runner: %v", err)
+	}
+
+	// The API serves most endpoints without Docker, so an unreachable daemon is only a warning here
+	pingCtx, cancelPing := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := runner.Ping(pingCtx); err != nil {
+		log.Printf("Warning: Docker daemon at %s is not reachable: %v. Restart, stop/start and runtime logs will fail until it is.", cfg.DockerHost, err)
+	}
+	cancelPing()
+
+	// Health check policy shared with the worker's post-deploy check
+	healthOptions := healthcheck.Options{
+		Retries:      cfg.HealthCheckRetries,
+		InitialDelay: cfg.HealthCheckInitialDelay,
+		Interval:     cfg.HealthCheckInterval,
+	}
+
+	// Validated with the rest of the configuration at startup
+	trustedProxies, _ := cfg.TrustedProxyPrefixes()
+	// Volumes stay disabled unless the driver can cap their size
+	volumeMaxSizeMB := 0
+	if cfg.VolumesEnabled() {
+		volumeMaxSizeMB = cfg.VolumeMaxSizeMB
+	}
 
 	// Setup router
 	r := chi.NewRouter()
 	
 	// CORS middleware - must be first
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Set CORS headers
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
-			w.Header().Set("Access-Control-Allow-Credentials", "false")
-			w.Header().Set("Access-Control-Max-Age", "3600")
-			
-			// Handle preflight OPTIONS request
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusNoContent)
-				return
-			}
-			
-			next.ServeHTTP(w, r)
-		})
-	})
+	r.Use(corsMiddleware(cfg.AllowedOrigins))
 	
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(realIPMiddleware(trustedProxies))
 
 	// Required APIs
 	// GET : Fetch all apps
@@ -88,22 +149,72 @@ func main() {
 	// POST : add env var
 	// DELETE : env var
 
+	// Requests per minute by user or client IP; deploys are limited further below
+	rateWindow := time.Minute
+	deployRateLimit := rateLimitMiddleware(cfg.RateLimitDeploy, rateWindow)
+
 	// API routes
 	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(methodRateLimit(rateLimitMiddleware(cfg.RateLimitRead, rateWindow), rateLimitMiddleware(cfg.RateLimitWrite, rateWindow)))
+
 		// Apps endpoints
 		r.Route("/apps", func(r chi.Router) {
 			r.Get("/", listApps(appStore))
-			r.Post("/", createApp(appStore, deploymentStore, cloner))
-			r.Get("/{id}", getApp(appStore, deploymentStore))
-			r.Delete("/{id}", deleteApp(appStore))
-			r.Post("/{id}/redeploy", redeployApp(appStore, deploymentStore, cloner))
+			// Clients may send an Idempotency-Key header to make create safe to retry
+			r.With(deployRateLimit, idempotencyMiddleware(idempotencyStore)).Post("/", createApp(database, appStore, deploymentStore, cloner, cfg.MaxActiveDeploymentsPerUser, cfg.DefaultBranch))
+			r.Get("/{id}", getApp(appStore, deploymentStore, deployments.Retention{KeepLast: cfg.DeploymentKeepLast, MaxAge: cfg.DeploymentMaxAge}))
+			r.Delete("/{id}", deleteApp(appStore, deploymentStore, runner))
+			r.With(deployRateLimit).Patch("/{id}", patchApp(appStore, deploymentStore, cloner, cfg.MaxActiveDeploymentsPerUser))
+			r.With(deployRateLimit).Post("/{id}/redeploy", redeployApp(database, appStore, deploymentStore, envStore, cloner, cfg.MaxActiveDeploymentsPerUser))
+			r.With(deployRateLimit).Post("/{id}/promote", promoteApp(database, appStore, deploymentStore, envStore, cfg.MaxActiveDeploymentsPerUser))
+			r.Post("/{id}/restart", restartApp(appStore, deploymentStore, runner, healthOptions))
+			r.Post("/{id}/stop", stopApp(appStore, deploymentStore, domainStore, runner, maintenanceRouter, cfg.BaseDomain))
+			r.Post("/{id}/start", startApp(appStore, deploymentStore, runner, maintenanceRouter, healthOptions))
+			r.Put("/{id}/health-check", updateHealthCheck(appStore))
+			r.Put("/{id}/notify", updateNotify(appStore))
+			r.Put("/{id}/rollout", updateRollout(appStore))
+			r.Put("/{id}/clone-options", updateCloneOptions(appStore))
+			r.Put("/{id}/log-retention", updateLogRetention(appStore, cfg.RuntimeLogLines))
+			r.Put("/{id}/volume", updateVolume(appStore, volumeMaxSizeMB))
+
+			// Build args are passed to `docker build` as ARG values only;
+			// they are not set in the running container's environment
+			r.Get("/{id}/build-args", listBuildArgs(appStore))
+			r.Post("/{id}/build-args", setBuildArg(appStore))
+			r.Delete("/{id}/build-args/{key}", deleteBuildArg(appStore))
+			r.Get("/{id}/build-secrets", listBuildSecrets(appStore))
+			r.Post("/{id}/build-secrets", setBuildSecret(appStore))
+			r.Delete("/{id}/build-secrets/{key}", deleteBuildSecret(appStore))
+			r.Get("/{id}/secrets", listSecrets(appStore, secretStore))
+			r.Post("/{id}/secrets", setSecret(appStore, secretStore))
+			r.Delete("/{id}/secrets/{key}", deleteSecret(appStore, secretStore))
+			r.Get("/{id}/environments", listEnvironments(appStore, envStore, cfg.BaseDomain))
+			r.Put("/{id}/environments/{name}", putEnvironment(appStore, envStore, cfg.BaseDomain))
+			r.Delete("/{id}/environments/{name}", deleteEnvironment(database, appStore, deploymentStore, envStore, runner))
 			r.Get("/{id}/deployments", listDeployments(deploymentStore))
+			r.Get("/{id}/deployments/latest", getLatestDeployment(appStore, deploymentStore, cfg.BaseDomain))
+
+			// Custom domains are routed only once verified, starting with the next deploy
+			r.Get("/{id}/domains", listDomains(appStore, domainStore))
+			r.Post("/{id}/domains", addDomain(appStore, domainStore, cfg.BaseDomain))
+			r.Post("/{id}/domains/{domainID}/verify", verifyDomain(appStore, domainStore, cfg.BaseDomain))
+			r.Delete("/{id}/domains/{domainID}", deleteDomain(appStore, domainStore))
+			r.Get("/{id}/metrics", getAppMetrics(appStore, metricsStore, cfg.MetricsRetention))
+			r.Get("/{id}/stats/stream", streamAppStats(appStore, deploymentStore, runner))
+			r.Get("/{id}/exec", execApp(appStore, deploymentStore, runner, cfg.ExecEnabled, cfg.AllowedOrigins))
 		})
 
 		// Deployments endpoints
+		// Dry run of the repository checks; each run clones the repository, hence the limit
+		r.With(rateLimitMiddleware(validateRateLimit, validateRateWindow)).Post("/validate", validateRepo(cloner))
+
 		r.Route("/deployments", func(r chi.Router) {
 			r.Get("/{id}", getDeployment(deploymentStore))
-			r.Get("/{id}/logs", getDeploymentLogs(deploymentStore))
+			r.Get("/{id}/wait", waitDeployment(appStore, deploymentStore))
+			r.Get("/{id}/events", getDeploymentEvents(appStore, deploymentStore))
+			r.Get("/{id}/logs", getDeploymentLogs(deploymentStore, runtimeLogStore))
+			r.Get("/{id}/logs/search", searchDeploymentLogs(appStore, deploymentStore, runtimeLogStore))
+			r.Get("/{id}/logs/download", downloadDeploymentLogs(appStore, deploymentStore, runtimeLogStore, runner, cfg.LogArchiveDir))
 		})
 	})
 
@@ -116,116 +227,302 @@ func main() {
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
+	// Page Traefik shows on the hostnames of apps that aren't running
+	r.Get("/paused", pausedApp)
+
 	port := cfg.Port
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: r,
+	}
+
+	// Setup graceful shutdown
+	// On SIGTERM/SIGINT, stop accepting connections and let in-flight requests finish;
+	// their contexts (and the queries running under them) are cancelled if they outlast the grace period
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sig := <-sigChan
+		log.Printf("Received signal: %v, shutting down...", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Graceful shutdown timed out: %v", err)
+			server.Close()
+		}
+	}()
+
 	log.Printf("API server starting on port %s", port)
-	if err := http.ListenAndServe(":"+port, r); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed: %v", err)
 	}
+	// ListenAndServe returns as soon as shutdown starts; wait for in-flight requests
+	<-shutdownDone
+	log.Println("API server stopped")
 }
 
+// shutdownTimeout is how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 30 * time.Second
+
 func listApps(store *apps.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		apps, err := store.List()
+		apps, err := store.List(r.Context())
 		if err != nil {
-			respondError(w, http.StatusInternalServerError, err.Error())
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
 			return
 		}
 		respondJSON(w, http.StatusOK, apps)
 	}
 }
 
-func createApp(appStore *apps.Store, deploymentStore *deployments.Store, cloner *gitrepo.Cloner) http.HandlerFunc {
+func createApp(database *db.DB, appStore *apps.Store, deploymentStore *deployments.Store, cloner *gitrepo.Cloner, maxActiveDeployments int, defaultBranch string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
-			Name    string `json:"name"`
-			RepoURL string `json:"repo_url"`
-			Branch  string `json:"branch"`
+			Name              string `json:"name"`
+			RepoURL           string `json:"repo_url"`
+			Branch            string `json:"branch"`
+			HealthCheckPath   string `json:"health_check_path"`
+			HealthCheckStatus int    `json:"health_check_status"`
+			BuildType         string `json:"build_type"`
+			ContextDir        string `json:"context_dir"`
+			DockerfilePath    string `json:"dockerfile_path"`
+			RolloutStrategy   string `json:"rollout_strategy"`
+			Submodules        bool   `json:"submodules"`
+			LFS               bool   `json:"lfs"`
+			// Deploy queues the initial deployment; false creates the app without one, to be
+			// configured first and deployed with a redeploy
+			Deploy *bool `json:"deploy"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
-				"error": "Invalid request body",
-				"app":   nil,
-			})
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
 			return
 		}
 
-		if req.Name == "" || req.RepoURL == "" || req.Branch == "" {
-			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
-				"error": "name, repo_url, and branch are required",
-				"app":   nil,
-			})
+		if req.Name == "" || req.RepoURL == "" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "name and repo_url are required")
+			return
+		}
+		if err := gitrepo.ValidateRepoURL(req.RepoURL); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
 			return
 		}
 
-		// Create app first
-		app, err := appStore.Create(req.Name, req.RepoURL, req.Branch)
-		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"error": err.Error(),
-				"app":   nil,
+		req.Name = strings.TrimSpace(req.Name)
+		if err := apps.ValidateName(req.Name); err != nil {
+			respondErrorDetails(w, http.StatusBadRequest, codeInvalidAppName, err.Error(), map[string]interface{}{
+				"suggestion": apps.Slugify(req.Name),
 			})
 			return
 		}
 
-		// Create initial deployment
-		// Convert app.ID (string) to int for deployment creation
-		appID, err := strconv.Atoi(app.ID)
+		if req.BuildType == "" {
+			req.BuildType = apps.BuildTypeDockerfile
+		}
+		if !apps.IsValidBuildType(req.BuildType) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("build_type must be %q or %q", apps.BuildTypeDockerfile, apps.BuildTypeBuildpack))
+			return
+		}
+
+		if req.RolloutStrategy == "" {
+			req.RolloutStrategy = apps.RolloutImmediate
+		}
+		if !apps.IsValidRolloutStrategy(req.RolloutStrategy) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("rollout_strategy must be %q or %q", apps.RolloutImmediate, apps.RolloutGradual))
+			return
+		}
+
+		if msg := validateHealthCheck(req.HealthCheckPath, req.HealthCheckStatus); msg != "" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, msg)
+			return
+		}
+
+		// Monorepos deploy each app from its own subdirectory
+		contextDir, err := apps.CleanRepoPath(req.ContextDir)
 		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"error": fmt.Sprintf("Invalid app ID format: %v", err),
-				"app":   app,
-			})
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "context_dir "+err.Error())
 			return
 		}
-		deployment, err := deploymentStore.Create(appID)
+		dockerfilePath, err := apps.CleanRepoPath(req.DockerfilePath)
 		if err != nil {
-			log.Printf("Warning: failed to create deployment: %v", err)
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"error": fmt.Sprintf("Failed to create deployment: %v", err),
-				"app":   app,
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "dockerfile_path "+err.Error())
+			return
+		}
+		if dockerfilePath == "" {
+			dockerfilePath = apps.DefaultDockerfilePath
+		}
+
+		// Check the branch before creating anything, so a typo gets the branches to pick from
+		// instead of a failed clone. If the repository can't be queried, the clone reports why.
+		req.Branch = strings.TrimSpace(req.Branch)
+		if req.Branch == "" {
+			branch, err := gitrepo.DefaultBranch(r.Context(), req.RepoURL)
+			if err != nil {
+				log.Printf("Warning: failed to detect the default branch of %s, using %s: %v", req.RepoURL, defaultBranch, err)
+				branch = defaultBranch
+			}
+			req.Branch = branch
+		} else if exists, branches, err := gitrepo.RemoteBranchExists(r.Context(), req.RepoURL, req.Branch); err == nil && !exists {
+			respondErrorDetails(w, http.StatusBadRequest, codeBranchNotFound, fmt.Sprintf("Branch %q does not exist in the repository", req.Branch), map[string]interface{}{
+				"available_branches": branches,
 			})
 			return
 		}
-		
-		// Update app status to "Pending" when deployment is created
-		if err := appStore.UpdateStatus(appID, "Pending"); err != nil {
-			log.Printf("Warning: failed to update app status to Pending: %v", err)
+
+		deploy := req.Deploy == nil || *req.Deploy
+		if deploy && !checkDeploymentLimit(w, r, deploymentStore, maxActiveDeployments) {
+			return
+		}
+
+		// Create the app and its initial deployment atomically, so a failure
+		// can't leave an app behind that has no deployment
+		userID, _ := getUserID(r)
+		var app *apps.App
+		var deployment *deployments.Deployment
+		var appID int
+		err = database.WithTx(r.Context(), func(tx *sql.Tx) error {
+			txApps := appStore.WithTx(tx)
+			txDeployments := deploymentStore.WithTx(tx)
+
+			// Owned by the authenticated user if there is one
+			var err error
+			app, err = txApps.Create(r.Context(), userID, req.Name, req.RepoURL, req.Branch)
+			if err != nil {
+				return err
+			}
+			// Convert app.ID (string) to int for deployment creation
+			if appID, err = strconv.Atoi(app.ID); err != nil {
+				return fmt.Errorf("invalid app ID format: %w", err)
+			}
+
+			if req.HealthCheckPath != "" || req.HealthCheckStatus != 0 {
+				path := req.HealthCheckPath
+				if path == "" {
+					path = "/"
+				}
+				if err := txApps.UpdateHealthCheck(r.Context(), appID, path, req.HealthCheckStatus); err != nil {
+					return fmt.Errorf("failed to save health check settings: %w", err)
+				}
+				app.HealthCheckPath = path
+				app.HealthCheckStatus = req.HealthCheckStatus
+			}
+
+			if req.BuildType != apps.BuildTypeDockerfile {
+				if err := txApps.UpdateBuildType(r.Context(), appID, req.BuildType); err != nil {
+					return fmt.Errorf("failed to save build type: %w", err)
+				}
+			}
+			app.BuildType = req.BuildType
+
+			if contextDir != "" || dockerfilePath != apps.DefaultDockerfilePath {
+				if err := txApps.UpdateBuildContext(r.Context(), appID, contextDir, dockerfilePath); err != nil {
+					return fmt.Errorf("failed to save build context: %w", err)
+				}
+			}
+			app.ContextDir = contextDir
+			app.DockerfilePath = dockerfilePath
+
+			if req.RolloutStrategy != apps.RolloutImmediate {
+				if err := txApps.UpdateRolloutStrategy(r.Context(), appID, req.RolloutStrategy); err != nil {
+					return fmt.Errorf("failed to save rollout strategy: %w", err)
+				}
+			}
+			app.RolloutStrategy = req.RolloutStrategy
+
+			if req.Submodules || req.LFS {
+				if err := txApps.UpdateCloneOptions(r.Context(), appID, req.Submodules, req.LFS); err != nil {
+					return fmt.Errorf("failed to save clone options: %w", err)
+				}
+			}
+			app.Submodules = req.Submodules
+			app.LFS = req.LFS
+
+			if !deploy {
+				if err := txApps.UpdateStatus(r.Context(), appID, "Created"); err != nil {
+					return fmt.Errorf("failed to update app status: %w", err)
+				}
+				app.Status = "Created"
+				return nil
+			}
+
+			// Create initial deployment
+			if deployment, err = txDeployments.Create(r.Context(), appID, environments.Production, "", false); err != nil {
+				return fmt.Errorf("failed to create deployment: %w", err)
+			}
+
+			// Update app status to "Pending" when deployment is created
+			if err := txApps.UpdateStatus(r.Context(), appID, "Pending"); err != nil {
+				return fmt.Errorf("failed to update app status: %w", err)
+			}
+			app.Status = "Pending"
+			return nil
+		})
+		if err == apps.ErrDuplicate {
+			respondError(w, http.StatusConflict, codeAppNameTaken, fmt.Sprintf("An app named %q already exists", req.Name))
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		// Without a deployment there is nothing to validate yet; the first redeploy checks the repository
+		if !deploy {
+			respondJSON(w, http.StatusCreated, map[string]interface{}{
+				"app":        app,
+				"deployment": nil,
+			})
+			return
 		}
 
 		// Validate repository has Dockerfile after creating app and deployment
 		// Use a temporary deployment ID for validation
 		tempDeploymentID := int(time.Now().Unix())
-		repoPath, err := cloner.Clone(req.RepoURL, tempDeploymentID, req.Branch)
+		// The Dockerfile may be in a submodule; LFS files aren't needed to find it
+		repoPath, err := cloner.Clone(r.Context(), req.RepoURL, tempDeploymentID, req.Branch, "", gitrepo.CloneOptions{Submodules: req.Submodules})
 		if err != nil {
 			// Update deployment with error
 			errorMsg := fmt.Sprintf("Failed to clone repository: %v", err)
-			deploymentStore.UpdateError(deployment.ID, errorMsg)
+			deploymentStore.UpdateError(r.Context(), deployment.ID, errorMsg)
 			// Update app status to "Failed"
-			appStore.UpdateStatus(appID, "Failed")
+			appStore.UpdateStatus(r.Context(), appID, "Failed")
 			// Refresh deployment to get updated status
-			deployment, _ = deploymentStore.GetByID(deployment.ID)
-			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
-				"error":      errorMsg,
+			deployment, _ = deploymentStore.GetByID(r.Context(), deployment.ID)
+			respondErrorDetails(w, http.StatusBadRequest, codeRepositoryUnreachable, errorMsg, map[string]interface{}{
+				"app":        app,
+				"deployment": deployment,
+			})
+			return
+		}
+
+		// Nothing may be built from outside the repository through a symlink
+		if err := gitrepo.CheckBuildPaths(repoPath, app.ContextDir, app.Dockerfile()); err != nil {
+			os.RemoveAll(repoPath)
+			errorMsg := fmt.Sprintf("Invalid build path: %v", err)
+			deploymentStore.UpdateError(r.Context(), deployment.ID, errorMsg)
+			appStore.UpdateStatus(r.Context(), appID, "Failed")
+			deployment, _ = deploymentStore.GetByID(r.Context(), deployment.ID)
+			respondErrorDetails(w, http.StatusBadRequest, codeInvalidBuildPath, errorMsg, map[string]interface{}{
 				"app":        app,
 				"deployment": deployment,
 			})
 			return
 		}
 
-		// Check if Dockerfile exists
-		if err := gitrepo.CheckDockerfile(repoPath); err != nil {
+		// Check if Dockerfile exists (buildpack apps are built without one)
+		if err := gitrepo.CheckDockerfile(filepath.Join(repoPath, app.ContextDir), app.Dockerfile()); req.BuildType == apps.BuildTypeDockerfile && err != nil {
 			// Clean up cloned repository
 			os.RemoveAll(repoPath)
 			// Update deployment with error
-			errorMsg := "Dockerfile is not available in the repository root directory. Please ensure your repository contains a Dockerfile."
-			deploymentStore.UpdateError(deployment.ID, errorMsg)
+			errorMsg := fmt.Sprintf("Dockerfile is not available in the repository (%v). Please ensure your repository contains %s, or set build_type to \"buildpack\".", err, path.Join(app.ContextDir, app.Dockerfile()))
+			deploymentStore.UpdateError(r.Context(), deployment.ID, errorMsg)
 			// Update app status to "Failed"
-			appStore.UpdateStatus(appID, "Failed")
+			appStore.UpdateStatus(r.Context(), appID, "Failed")
 			// Refresh deployment to get updated status
-			deployment, _ = deploymentStore.GetByID(deployment.ID)
-			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
-				"error":      errorMsg,
+			deployment, _ = deploymentStore.GetByID(r.Context(), deployment.ID)
+			respondErrorDetails(w, http.StatusBadRequest, codeDockerfileMissing, errorMsg, map[string]interface{}{
 				"app":        app,
 				"deployment": deployment,
 			})
@@ -243,22 +540,174 @@ func createApp(appStore *apps.Store, deploymentStore *deployments.Store, cloner
 	}
 }
 
-func getApp(appStore *apps.Store, deploymentStore *deployments.Store) http.HandlerFunc {
+// validateRateLimit and validateRateWindow cap how often a user may run POST /api/v1/validate
+const (
+	validateRateLimit  = 10
+	validateRateWindow = time.Minute
+)
+
+// validateRepo handles POST /api/v1/validate
+// Dry-runs the checks createApp and the worker make on a repository, without creating an app
+// or deployment: clones the branch, looks for the Dockerfile, detects the port and flags
+// signs of a background worker (which would fail the HTTP health check).
+// Problems with the repository are reported in the body with a 200; the request itself
+// failing validation is a 400.
+// Response format:
+//
+//	{"valid": false, "commit_sha": "...", "port": 8000, "port_source": "detected",
+//	 "errors": [{"code": "DOCKERFILE_MISSING", "message": "..."}], "warnings": ["..."], ...}
+func validateRepo(cloner *gitrepo.Cloner) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		var req struct {
+			RepoURL        string `json:"repo_url"`
+			Branch         string `json:"branch"`
+			BuildType      string `json:"build_type"`
+			ContextDir     string `json:"context_dir"`
+			DockerfilePath string `json:"dockerfile_path"`
+			Submodules     bool   `json:"submodules"`
+			LFS            bool   `json:"lfs"`
+		}
+
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		if req.RepoURL == "" || req.Branch == "" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "repo_url and branch are required")
+			return
+		}
+		if err := gitrepo.ValidateRepoURL(req.RepoURL); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if req.BuildType == "" {
+			req.BuildType = apps.BuildTypeDockerfile
+		}
+		if !apps.IsValidBuildType(req.BuildType) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("build_type must be %q or %q", apps.BuildTypeDockerfile, apps.BuildTypeBuildpack))
+			return
+		}
+		contextDir, err := apps.CleanRepoPath(req.ContextDir)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "context_dir "+err.Error())
+			return
+		}
+		dockerfilePath, err := apps.CleanRepoPath(req.DockerfilePath)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "dockerfile_path "+err.Error())
+			return
+		}
+		if dockerfilePath == "" {
+			dockerfilePath = apps.DefaultDockerfilePath
+		}
+
+		problems := []map[string]interface{}{}
+		warnings := []string{}
+		report := map[string]interface{}{
+			"repo_url":        req.RepoURL,
+			"branch":          req.Branch,
+			"build_type":      req.BuildType,
+			"context_dir":     contextDir,
+			"dockerfile_path": dockerfilePath,
+		}
+
+		// Nanosecond clone IDs can't collide with real deployment IDs or with each other
+		tempDeploymentID := int(time.Now().UnixNano())
+		defer cloner.Remove(tempDeploymentID)
+		// LFS files are downloaded by the worker; this host may not even have git-lfs
+		repoPath, err := cloner.Clone(r.Context(), req.RepoURL, tempDeploymentID, req.Branch, "", gitrepo.CloneOptions{Submodules: req.Submodules})
 		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid app ID")
+			problems = append(problems, map[string]interface{}{
+				"code":    codeRepositoryUnreachable,
+				"message": fmt.Sprintf("Failed to clone repository: %v", err),
+			})
+			report["valid"] = false
+			report["errors"] = problems
+			report["warnings"] = warnings
+			respondJSON(w, http.StatusOK, report)
+			return
+		}
+
+		if sha, subject, err := gitrepo.HeadCommit(r.Context(), repoPath); err == nil {
+			report["commit_sha"] = sha
+			report["commit_message"] = subject
+		}
+
+		if !req.LFS && gitrepo.UsesLFS(repoPath) {
+			warnings = append(warnings, "The repository uses Git LFS; set lfs to build with its files instead of their pointers")
+		}
+
+		// Nothing else is read from the checkout if a symlink leads the build out of it
+		if err := gitrepo.CheckBuildPaths(repoPath, contextDir, dockerfilePath); err != nil {
+			problems = append(problems, map[string]interface{}{
+				"code":    codeInvalidBuildPath,
+				"message": fmt.Sprintf("Invalid build path: %v", err),
+			})
+			report["valid"] = false
+			report["errors"] = problems
+			report["warnings"] = warnings
+			respondJSON(w, http.StatusOK, report)
 			return
 		}
 
-		app, err := appStore.GetByID(id)
+		contextPath := filepath.Join(repoPath, contextDir)
+		dockerfileErr := gitrepo.CheckDockerfile(contextPath, dockerfilePath)
+		report["dockerfile_found"] = dockerfileErr == nil
+		if dockerfileErr != nil && req.BuildType == apps.BuildTypeDockerfile {
+			problems = append(problems, map[string]interface{}{
+				"code":    codeDockerfileMissing,
+				"message": fmt.Sprintf("Dockerfile is not available in the repository (%v). Please ensure your repository contains %s, or set build_type to \"buildpack\".", dockerfileErr, path.Join(contextDir, dockerfilePath)),
+			})
+		}
+
+		// Same port choice as the worker: EXPOSE first, then the detected framework's default
+		info := gitrepo.DetectApp(contextPath)
+		report["language"] = info.Language
+		report["framework"] = info.Framework
+		if port := gitrepo.ExposedPort(filepath.Join(contextPath, dockerfilePath)); port != 0 {
+			report["port"] = port
+			report["port_source"] = "expose"
+		} else {
+			report["port"] = info.Port
+			report["port_source"] = "detected"
+			warnings = append(warnings, fmt.Sprintf("No EXPOSE in the Dockerfile; assuming the app listens on port %d", info.Port))
+		}
+
+		// Buildpack builds ignore any Dockerfile in the repository
+		hintsDockerfile := dockerfilePath
+		if req.BuildType != apps.BuildTypeDockerfile {
+			hintsDockerfile = ""
+		}
+		hints := gitrepo.WorkerHints(contextPath, hintsDockerfile)
+		report["worker_app"] = len(hints) > 0
+		for _, hint := range hints {
+			warnings = append(warnings, "Looks like a background worker: "+hint+". Apps must serve HTTP to pass the health check.")
+		}
+
+		report["valid"] = len(problems) == 0
+		report["errors"] = problems
+		report["warnings"] = warnings
+		respondJSON(w, http.StatusOK, report)
+	}
+}
+
+func getApp(appStore *apps.Store, deploymentStore *deployments.Store, retention deployments.Retention) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
 		if err != nil {
-			respondError(w, http.StatusNotFound, "App not found")
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
 			return
 		}
 
 		// Get the latest deployment for this app
-		appDeployments, err := deploymentStore.ListByAppID(id)
+		appDeployments, err := deploymentStore.ListByAppID(r.Context(), id)
 		var activeDeployment *deployments.Deployment
 		if err == nil && len(appDeployments) > 0 {
 			activeDeployment = appDeployments[0] // First one is the latest (ordered by created_at DESC)
@@ -273,6 +722,20 @@ func getApp(appStore *apps.Store, deploymentStore *deployments.Store) http.Handl
 			"url":       app.URL,
 			"repo_url":  app.RepoURL,
 			"branch":    app.Branch,
+			"health_check_path":   app.HealthCheckPath,
+			"health_check_status": app.HealthCheckStatus,
+			"build_type":          app.BuildType,
+			"context_dir":         app.ContextDir,
+			"dockerfile_path":     app.DockerfilePath,
+			"rollout_strategy":    app.RolloutStrategy,
+			"desired_state":       app.DesiredState,
+			"notify_url":          app.NotifyURL,
+			"log_retention_lines": app.LogRetentionLines,
+			// How far back deployment history goes; older finished deployments are purged
+			"deployment_retention": map[string]interface{}{
+				"keep_last":    retention.KeepLast,
+				"max_age_days": int(retention.MaxAge.Hours() / 24),
+			},
 			"created_at": app.CreatedAt,
 			"updated_at": app.UpdatedAt,
 		}
@@ -288,6 +751,8 @@ func getApp(appStore *apps.Store, deploymentStore *deployments.Store) http.Handl
 				"active_deployment_id": activeDeploymentID,
 				"last_deployed_at":     activeDeployment.UpdatedAt,
 				"state":                state,
+				"commit_sha":           activeDeployment.CommitSHA.String,
+				"commit_message":       activeDeployment.CommitMessage.String,
 			}
 		} else {
 			// No deployment found
@@ -302,85 +767,253 @@ func getApp(appStore *apps.Store, deploymentStore *deployments.Store) http.Handl
 	}
 }
 
-func redeployApp(appStore *apps.Store, deploymentStore *deployments.Store, cloner *gitrepo.Cloner) http.HandlerFunc {
+// patchApp handles PATCH /api/v1/apps/{id}
+// Changes the repository and/or branch the app is deployed from: {"repo_url": "...", "branch": "..."}.
+// The new source is cloned and checked for a Dockerfile before it is saved, and the change is
+// refused while a deployment is queued or building, since it would build one source or the other.
+// With "redeploy": true a production deployment of the new source is queued right away.
+func patchApp(appStore *apps.Store, deploymentStore *deployments.Store, cloner *gitrepo.Cloner, maxActiveDeployments int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			RepoURL  *string `json:"repo_url"`
+			Branch   *string `json:"branch"`
+			Redeploy bool    `json:"redeploy"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if req.RepoURL == nil && req.Branch == nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "repo_url or branch is required")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+		repoURL, branch := app.RepoURL, app.Branch
+		if req.RepoURL != nil {
+			repoURL = strings.TrimSpace(*req.RepoURL)
+		}
+		if req.Branch != nil {
+			branch = strings.TrimSpace(*req.Branch)
+		}
+		if repoURL == "" || branch == "" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "repo_url and branch must not be empty")
+			return
+		}
+		if err := gitrepo.ValidateRepoURL(repoURL); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		active, err := deploymentStore.HasActive(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		if active {
+			respondError(w, http.StatusConflict, codeDeploymentInProgress, "A deployment of this app is queued or building; change the repository once it finishes")
+			return
+		}
+
+		// Check the new source the way a deployment will use it
+		tempDeploymentID := int(time.Now().UnixNano())
+		defer cloner.Remove(tempDeploymentID)
+		repoPath, err := cloner.Clone(r.Context(), repoURL, tempDeploymentID, branch, "", gitrepo.CloneOptions{Submodules: app.Submodules})
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeRepositoryUnreachable, fmt.Sprintf("Failed to clone repository: %v", err))
+			return
+		}
+		if err := gitrepo.CheckBuildPaths(repoPath, app.ContextDir, app.Dockerfile()); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidBuildPath, fmt.Sprintf("Invalid build path: %v", err))
+			return
+		}
+		if err := gitrepo.CheckDockerfile(filepath.Join(repoPath, app.ContextDir), app.Dockerfile()); app.BuildType != apps.BuildTypeBuildpack && err != nil {
+			respondError(w, http.StatusBadRequest, codeDockerfileMissing, fmt.Sprintf("Dockerfile is not available in the repository (%v). Please ensure your repository contains %s, or set build_type to \"buildpack\".", err, path.Join(app.ContextDir, app.Dockerfile())))
+			return
+		}
+
+		if req.Redeploy && !checkDeploymentLimit(w, r, deploymentStore, maxActiveDeployments) {
+			return
+		}
+
+		if err := appStore.UpdateSource(r.Context(), id, repoURL, branch); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		app.RepoURL, app.Branch = repoURL, branch
+
+		var deployment *deployments.Deployment
+		if req.Redeploy {
+			deployment, err = deploymentStore.Create(r.Context(), id, environments.Production, "", false)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Source updated, but failed to create deployment: %v", err))
+				return
+			}
+			if err := appStore.UpdateStatus(r.Context(), id, "Pending"); err != nil {
+				log.Printf("Warning: failed to update app status to Pending: %v", err)
+			}
+			app.Status = "Pending"
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"app":        app,
+			"deployment": deployment,
+		})
+	}
+}
+
+func redeployApp(database *db.DB, appStore *apps.Store, deploymentStore *deployments.Store, envStore *environments.Store, cloner *gitrepo.Cloner, maxActiveDeployments int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(chi.URLParam(r, "id"))
 		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid app ID")
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		// Optional body: {"commit": "<sha>"} pins the deployment to a specific commit,
+		// {"no_cache": true} builds it without reusing cached layers, and
+		// {"environment": "staging"} deploys to another environment than production
+		var req struct {
+			Commit      string `json:"commit"`
+			NoCache     bool   `json:"no_cache"`
+			Environment string `json:"environment"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil && err != errEmptyBody {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
 			return
 		}
+		if req.Commit != "" && !gitrepo.IsValidCommit(req.Commit) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "commit must be a hexadecimal commit SHA")
+			return
+		}
+		if req.Environment == "" {
+			req.Environment = environments.Production
+		}
 
 		// Get the app
-		app, err := appStore.GetByID(id)
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+		env, err := envStore.Get(r.Context(), id, req.Environment)
 		if err != nil {
-			respondError(w, http.StatusNotFound, "App not found")
+			if err == sql.ErrNoRows {
+				respondError(w, http.StatusNotFound, codeNotFound, "Environment not found")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
 			return
 		}
+		// The app's status is its production environment's
+		production := env.Name == environments.Production
 
 		// Create new deployment
 		appID, err := strconv.Atoi(app.ID)
 		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"error": fmt.Sprintf("Invalid app ID format: %v", err),
-				"app":   app,
+			respondErrorDetails(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Invalid app ID format: %v", err), map[string]interface{}{
+				"app": app,
 			})
 			return
 		}
 
-		deployment, err := deploymentStore.Create(appID)
+		if !checkNotBuilding(w, r, deploymentStore, appID, env.Name) {
+			return
+		}
+		// Repeated clicks shouldn't queue a build each; the newest request replaces any queued one
+		pending, err := deploymentStore.HasPending(r.Context(), appID, env.Name)
+		if err != nil {
+			log.Printf("Warning: failed to check for pending deployments: %v", err)
+		}
+		// Replacing a queued deployment doesn't add to the user's active deployments
+		if !pending && !checkDeploymentLimit(w, r, deploymentStore, maxActiveDeployments) {
+			return
+		}
+		deployment, err := replacePending(r.Context(), database, appStore, deploymentStore, appID, env.Name, func(store *deployments.Store) (*deployments.Deployment, error) {
+			return store.Create(r.Context(), appID, env.Name, req.Commit, req.NoCache)
+		})
 		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"error": fmt.Sprintf("Failed to create deployment: %v", err),
-				"app":   app,
+			respondErrorDetails(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to create deployment: %v", err), map[string]interface{}{
+				"app": app,
 			})
 			return
 		}
 		
 		// Update app status to "Pending" when redeployment is initiated
-		if err := appStore.UpdateStatus(appID, "Pending"); err != nil {
-			log.Printf("Warning: failed to update app status to Pending: %v", err)
+		if production {
+			if err := appStore.UpdateStatus(r.Context(), appID, "Pending"); err != nil {
+				log.Printf("Warning: failed to update app status to Pending: %v", err)
+			}
 		}
 
 		// Validate repository has Dockerfile
 		// Use a temporary deployment ID for validation
 		tempDeploymentID := int(time.Now().Unix())
 		
-		// Use branch from app, default to "main" if empty
-		branch := app.Branch
+		// Use branch from the environment or app, default to "main" if empty
+		branch := env.BranchOr(app.Branch)
 		if branch == "" {
 			branch = "main"
 		}
 
-		repoPath, err := cloner.Clone(app.RepoURL, tempDeploymentID, branch)
+		repoPath, err := cloner.Clone(r.Context(), app.RepoURL, tempDeploymentID, branch, req.Commit, gitrepo.CloneOptions{Submodules: app.Submodules})
 		if err != nil {
 			// Update deployment with error
 			errorMsg := fmt.Sprintf("Failed to clone repository: %v", err)
-			deploymentStore.UpdateError(deployment.ID, errorMsg)
+			deploymentStore.UpdateError(r.Context(), deployment.ID, errorMsg)
 			// Update app status to "Failed"
-			appStore.UpdateStatus(appID, "Failed")
+			if production {
+				appStore.UpdateStatus(r.Context(), appID, "Failed")
+			}
 			// Refresh deployment to get updated status
-			deployment, _ = deploymentStore.GetByID(deployment.ID)
-			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
-				"error":      errorMsg,
+			deployment, _ = deploymentStore.GetByID(r.Context(), deployment.ID)
+			respondErrorDetails(w, http.StatusBadRequest, codeRepositoryUnreachable, errorMsg, map[string]interface{}{
+				"app":        app,
+				"deployment": deployment,
+			})
+			return
+		}
+
+		// Nothing may be built from outside the repository through a symlink
+		if err := gitrepo.CheckBuildPaths(repoPath, app.ContextDir, app.Dockerfile()); err != nil {
+			os.RemoveAll(repoPath)
+			errorMsg := fmt.Sprintf("Invalid build path: %v", err)
+			deploymentStore.UpdateError(r.Context(), deployment.ID, errorMsg)
+			if production {
+				appStore.UpdateStatus(r.Context(), appID, "Failed")
+			}
+			deployment, _ = deploymentStore.GetByID(r.Context(), deployment.ID)
+			respondErrorDetails(w, http.StatusBadRequest, codeInvalidBuildPath, errorMsg, map[string]interface{}{
 				"app":        app,
 				"deployment": deployment,
 			})
 			return
 		}
 
-		// Check if Dockerfile exists
-		if err := gitrepo.CheckDockerfile(repoPath); err != nil {
+		// Check if Dockerfile exists (buildpack apps are built without one)
+		if err := gitrepo.CheckDockerfile(filepath.Join(repoPath, app.ContextDir), app.Dockerfile()); app.BuildType != apps.BuildTypeBuildpack && err != nil {
 			// Clean up cloned repository
 			os.RemoveAll(repoPath)
 			// Update deployment with error
-			errorMsg := "Dockerfile is not available in the repository root directory. Please ensure your repository contains a Dockerfile."
-			deploymentStore.UpdateError(deployment.ID, errorMsg)
+			errorMsg := fmt.Sprintf("Dockerfile is not available in the repository (%v). Please ensure your repository contains %s, or set build_type to \"buildpack\".", err, path.Join(app.ContextDir, app.Dockerfile()))
+			deploymentStore.UpdateError(r.Context(), deployment.ID, errorMsg)
 			// Update app status to "Failed"
-			appStore.UpdateStatus(appID, "Failed")
+			if production {
+				appStore.UpdateStatus(r.Context(), appID, "Failed")
+			}
 			// Refresh deployment to get updated status
-			deployment, _ = deploymentStore.GetByID(deployment.ID)
-			respondJSON(w, http.StatusBadRequest, map[string]interface{}{
-				"error":      errorMsg,
+			deployment, _ = deploymentStore.GetByID(r.Context(), deployment.ID)
+			respondErrorDetails(w, http.StatusBadRequest, codeDockerfileMissing, errorMsg, map[string]interface{}{
 				"app":        app,
 				"deployment": deployment,
 			})
@@ -399,52 +1032,1371 @@ func redeployApp(appStore *apps.Store, deploymentStore *deployments.Store, clone
 	}
 }
 
-func deleteApp(store *apps.Store) http.HandlerFunc {
+// promoteApp handles POST /api/v1/apps/{id}/promote
+// Deploys the image another environment is running to production without rebuilding it, so
+// production runs exactly what was tested there. The production deployment records the
+// deployment it was promoted from.
+func promoteApp(database *db.DB, appStore *apps.Store, deploymentStore *deployments.Store, envStore *environments.Store, maxActiveDeployments int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(chi.URLParam(r, "id"))
 		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid app ID")
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
 			return
 		}
 
-		if err := store.Delete(id); err != nil {
-			respondError(w, http.StatusInternalServerError, err.Error())
-			return
+		// Optional body: {"from": "staging"} promotes the environment's running deployment
+		// (staging by default), {"deployment_id": 42} a specific deployment of the app
+		var req struct {
+			From         string `json:"from"`
+			DeploymentID int    `json:"deployment_id"`
 		}
-
-		w.WriteHeader(http.StatusNoContent)
-	}
-}
-
-func listDeployments(store *deployments.Store) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		appID, err := strconv.Atoi(chi.URLParam(r, "id"))
-		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid app ID")
+		if err := decodeJSON(w, r, &req); err != nil && err != errEmptyBody {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
 			return
 		}
+		if req.From == "" {
+			req.From = "staging"
+		}
 
-		deployments, err := store.ListByAppID(appID)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, err.Error())
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
 			return
 		}
 
-		respondJSON(w, http.StatusOK, deployments)
-	}
-}
-
-func getDeployment(store *deployments.Store) http.HandlerFunc {
+		var source *deployments.Deployment
+		if req.DeploymentID != 0 {
+			source, err = deploymentStore.GetByID(r.Context(), req.DeploymentID)
+			if err != nil || source.AppID != id {
+				respondError(w, http.StatusNotFound, codeNotFound, "Deployment not found")
+				return
+			}
+			// Only an image that passed its health check and served traffic is promoted; a failed,
+			// cancelled or unfinished deployment's image may be broken or missing
+			if source.Status != deployments.StatusRunning && source.Status != deployments.StatusStopped {
+				respondError(w, http.StatusConflict, codeNothingToPromote, fmt.Sprintf("Deployment is %s; only running or stopped deployments can be promoted", source.Status))
+				return
+			}
+		} else {
+			if _, err := envStore.Get(r.Context(), id, req.From); err != nil {
+				if err == sql.ErrNoRows {
+					respondError(w, http.StatusNotFound, codeNotFound, "Environment not found")
+					return
+				}
+				respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+			running, err := deploymentStore.GetRunningByEnvironment(r.Context(), id, req.From)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+			if len(running) == 0 {
+				respondError(w, http.StatusConflict, codeNothingToPromote, fmt.Sprintf("The %s environment has no running deployment to promote", req.From))
+				return
+			}
+			source = running[0]
+		}
+		if source.Environment == environments.Production {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Deployment is already in production")
+			return
+		}
+		// Deployments from before ports were recorded can't be run without building again
+		if !source.ImageName.Valid || !source.Port.Valid {
+			respondError(w, http.StatusConflict, codeNothingToPromote, "Deployment has no image that can be promoted; redeploy the environment first")
+			return
+		}
+
+		// A promotion replaces a queued production deployment, like a redeploy does,
+		// and waits for one that is building
+		if !checkNotBuilding(w, r, deploymentStore, id, environments.Production) {
+			return
+		}
+		pending, err := deploymentStore.HasPending(r.Context(), id, environments.Production)
+		if err != nil {
+			log.Printf("Warning: failed to check for pending deployments: %v", err)
+		}
+		if !pending && !checkDeploymentLimit(w, r, deploymentStore, maxActiveDeployments) {
+			return
+		}
+		deployment, err := replacePending(r.Context(), database, appStore, deploymentStore, id, environments.Production, func(store *deployments.Store) (*deployments.Deployment, error) {
+			return store.CreatePromotion(r.Context(), source, environments.Production)
+		})
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to create deployment: %v", err))
+			return
+		}
+		if err := appStore.UpdateStatus(r.Context(), id, "Pending"); err != nil {
+			log.Printf("Warning: failed to update app status to Pending: %v", err)
+		}
+
+		respondJSON(w, http.StatusCreated, map[string]interface{}{
+			"message":    fmt.Sprintf("Promotion of deployment %d initiated", source.ID),
+			"app":        app,
+			"deployment": deployment,
+		})
+	}
+}
+
+// restartApp handles POST /api/v1/apps/{id}/restart
+// Restarts the container of the app's active deployment without rebuilding the image,
+// then re-runs the HTTP health check to confirm the app came back.
+func restartApp(appStore *apps.Store, deploymentStore *deployments.Store, runner *dockerrun.Runner, healthOptions healthcheck.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		running, err := deploymentStore.GetRunningByEnvironment(r.Context(), id, environments.Production)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		if len(running) == 0 || !running[0].ContainerID.Valid {
+			respondError(w, http.StatusConflict, codeAppNotRunning, "App has no running deployment to restart")
+			return
+		}
+		deployment := running[0]
+
+		restartCtx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		if err := runner.Restart(restartCtx, deployment.ContainerID.String); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to restart container: %v", err))
+			return
+		}
+		log.Printf("Restarted container %s for app %d", deployment.ContainerID.String, id)
+
+		if err := healthcheck.Verify(r.Context(), app.URL, app.HealthCheckPath, app.HealthCheckStatus, healthOptions); err != nil {
+			appStore.UpdateStatus(r.Context(), id, "Failed")
+			respondError(w, http.StatusBadGateway, codeHealthCheckFailed, fmt.Sprintf("Container restarted but failed health check: %v", err))
+			return
+		}
+		if err := appStore.UpdateStatus(r.Context(), id, "Healthy"); err != nil {
+			log.Printf("Warning: failed to update app status to Healthy: %v", err)
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"message":    "App restarted",
+			"deployment": deployment,
+		})
+	}
+}
+
+// stopApp handles POST /api/v1/apps/{id}/stop
+// Stops the app's running container without removing it or its image, so it can be started again,
+// and routes its hostnames to the maintenance page if one is configured.
+// Returns 409 if the app is already stopped or has nothing running.
+func stopApp(appStore *apps.Store, deploymentStore *deployments.Store, domainStore *domains.Store, runner *dockerrun.Runner, maintenanceRouter *maintenance.Router, baseDomain string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+		if app.DesiredState == apps.DesiredStateStopped {
+			respondError(w, http.StatusConflict, codeAppStopped, "App is already stopped")
+			return
+		}
+
+		running, err := deploymentStore.GetRunningByAppID(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		if len(running) == 0 || !running[0].ContainerID.Valid {
+			respondError(w, http.StatusConflict, codeAppNotRunning, "App has no running deployment to stop")
+			return
+		}
+
+		// Record the intent first so the worker keeps the app down even if stopping fails midway
+		if err := appStore.UpdateDesiredState(r.Context(), id, apps.DesiredStateStopped); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		stopCtx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		// Normally one container, but a deploy may be mid-swap
+		for _, deployment := range running {
+			if !deployment.ContainerID.Valid {
+				continue
+			}
+			if err := runner.Stop(stopCtx, deployment.ContainerID.String); err != nil {
+				respondError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to stop container: %v", err))
+				return
+			}
+			log.Printf("Stopped container %s for app %d", deployment.ContainerID.String, id)
+		}
+
+		if err := appStore.UpdateStatus(r.Context(), id, "Stopped"); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		// The worker's maintenance sync would write the route too, but only at its next check
+		if maintenanceRouter.Enabled() {
+			name, hosts := maintenance.Route(r.Context(), domainStore, baseDomain, app.EffectiveSlug(), id)
+			if err := maintenanceRouter.Pause(name, hosts); err != nil {
+				log.Printf("Warning: app %d: %v", id, err)
+			}
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"message":    "App stopped",
+			"deployment": running[0],
+		})
+	}
+}
+
+// startApp handles POST /api/v1/apps/{id}/start
+// Starts the stopped container of the app's latest running deployment again, without rebuilding,
+// and health-checks it. Its maintenance route, if any, is removed. Returns 409 if the app isn't stopped.
+func startApp(appStore *apps.Store, deploymentStore *deployments.Store, runner *dockerrun.Runner, maintenanceRouter *maintenance.Router, healthOptions healthcheck.Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+		if app.DesiredState != apps.DesiredStateStopped {
+			respondError(w, http.StatusConflict, codeAppAlreadyRunning, "App is not stopped")
+			return
+		}
+
+		running, err := deploymentStore.GetRunningByEnvironment(r.Context(), id, environments.Production)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		if len(running) == 0 || !running[0].ContainerID.Valid {
+			respondError(w, http.StatusConflict, codeAppNotRunning, "App has no deployment to start; redeploy it instead")
+			return
+		}
+		deployment := running[0]
+
+		startCtx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		if err := runner.Start(startCtx, deployment.ContainerID.String); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, fmt.Sprintf("Failed to start container: %v", err))
+			return
+		}
+		log.Printf("Started container %s for app %d", deployment.ContainerID.String, id)
+		if maintenanceRouter.Enabled() {
+			name := environments.Subdomain(app.EffectiveSlug(), environments.Production)
+			if err := maintenanceRouter.Resume(name); err != nil {
+				log.Printf("Warning: app %d: %v", id, err)
+			}
+		}
+		// Stopping the app stopped its other environments too; they come back without a health check
+		if all, err := deploymentStore.GetRunningByAppID(r.Context(), id); err != nil {
+			log.Printf("Warning: failed to list deployments of other environments: %v", err)
+		} else {
+			for _, d := range all {
+				if d.Environment == environments.Production || !d.ContainerID.Valid {
+					continue
+				}
+				if err := runner.Start(startCtx, d.ContainerID.String); err != nil {
+					log.Printf("Warning: failed to start container %s of environment %s: %v", d.ContainerID.String, d.Environment, err)
+				}
+			}
+		}
+		if err := appStore.UpdateDesiredState(r.Context(), id, apps.DesiredStateRunning); err != nil {
+			log.Printf("Warning: failed to update app desired state: %v", err)
+		}
+
+		if err := healthcheck.Verify(r.Context(), app.URL, app.HealthCheckPath, app.HealthCheckStatus, healthOptions); err != nil {
+			appStore.UpdateStatus(r.Context(), id, "Failed")
+			respondError(w, http.StatusBadGateway, codeHealthCheckFailed, fmt.Sprintf("Container started but failed health check: %v", err))
+			return
+		}
+		if err := appStore.UpdateStatus(r.Context(), id, "Healthy"); err != nil {
+			log.Printf("Warning: failed to update app status to Healthy: %v", err)
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"message":    "App started",
+			"deployment": deployment,
+		})
+	}
+}
+
+// validateHealthCheck checks user-supplied health check settings and returns
+// an error message, or "" if they are valid. Empty values mean "use the default".
+func validateHealthCheck(path string, status int) string {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return "health_check_path must start with /"
+	}
+	if status != 0 && (status < 100 || status > 599) {
+		return "health_check_status must be a valid HTTP status code"
+	}
+	return ""
+}
+
+// updateHealthCheck handles PUT /api/v1/apps/{id}/health-check
+// Sets the path and expected status code probed after each deploy.
+func updateHealthCheck(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			Path   string `json:"health_check_path"`
+			Status int    `json:"health_check_status"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if msg := validateHealthCheck(req.Path, req.Status); msg != "" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, msg)
+			return
+		}
+		if req.Path == "" {
+			req.Path = "/"
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.UpdateHealthCheck(r.Context(), id, req.Path, req.Status); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		app.HealthCheckPath = req.Path
+		app.HealthCheckStatus = req.Status
+
+		respondJSON(w, http.StatusOK, app)
+	}
+}
+
+// updateRollout handles PUT /api/v1/apps/{id}/rollout
+// Sets how traffic moves to the app's next deployments: "immediate" or "gradual".
+func updateRollout(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			Strategy string `json:"rollout_strategy"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if !apps.IsValidRolloutStrategy(req.Strategy) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("rollout_strategy must be %q or %q", apps.RolloutImmediate, apps.RolloutGradual))
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.UpdateRolloutStrategy(r.Context(), id, req.Strategy); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		app.RolloutStrategy = req.Strategy
+
+		respondJSON(w, http.StatusOK, app)
+	}
+}
+
+// updateCloneOptions handles PUT /api/v1/apps/{id}/clone-options
+// Sets whether the app's next deployments clone the repository's submodules and download its
+// Git LFS files: {"submodules": true, "lfs": false}. Both are off by default since they slow
+// down every clone.
+func updateCloneOptions(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			Submodules bool `json:"submodules"`
+			LFS        bool `json:"lfs"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.UpdateCloneOptions(r.Context(), id, req.Submodules, req.LFS); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		app.Submodules = req.Submodules
+		app.LFS = req.LFS
+
+		respondJSON(w, http.StatusOK, app)
+	}
+}
+
+// updateLogRetention handles PUT /api/v1/apps/{id}/log-retention
+// Sets how many runtime log lines the worker keeps per deployment of the app, up to the
+// platform's RUNTIME_LOG_LINES; 0 keeps the platform's number.
+func updateLogRetention(appStore *apps.Store, platformLines int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			Lines int `json:"lines"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if platformLines == 0 {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Runtime logs are not kept on this platform")
+			return
+		}
+		if err := runtimelogs.ValidateRetention(req.Lines, platformLines); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.UpdateLogRetention(r.Context(), id, req.Lines); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		app.LogRetentionLines = req.Lines
+
+		respondJSON(w, http.StatusOK, app)
+	}
+}
+
+// updateVolume handles PUT /api/v1/apps/{id}/volume
+// Mounts a persistent volume at mount_path in the app's containers from the next deployment on,
+// one volume per environment, kept across deployments. size_mb is capped at the platform's
+// VOLUME_MAX_SIZE_MB (0 when volumes are disabled) and defaults to it. Volumes can't be resized,
+// so once set the size can't change. An empty mount_path stops mounting the volume but keeps
+// its data, and its size, until the app or environment is deleted.
+func updateVolume(appStore *apps.Store, maxSizeMB int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			MountPath string `json:"mount_path"`
+			SizeMB    int    `json:"size_mb"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		mountPath, err := apps.CleanVolumePath(req.MountPath)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if mountPath != "" && maxSizeMB == 0 {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Persistent volumes are not available on this platform")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		// The app's volumes keep the size they were created with, also while detached
+		sizeMB := app.VolumeSizeMB
+		if sizeMB == 0 {
+			if mountPath != "" {
+				sizeMB = req.SizeMB
+				if sizeMB == 0 {
+					sizeMB = maxSizeMB
+				}
+				if sizeMB < 0 || sizeMB > maxSizeMB {
+					respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("size_mb must be between 1 and %d", maxSizeMB))
+					return
+				}
+			}
+		} else if req.SizeMB != 0 && req.SizeMB != sizeMB {
+			respondError(w, http.StatusConflict, codeInvalidRequest, fmt.Sprintf("The app's volumes are %d MB and can't be resized", sizeMB))
+			return
+		}
+
+		if err := appStore.UpdateVolume(r.Context(), id, mountPath, sizeMB); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		app.VolumePath = mountPath
+		app.VolumeSizeMB = sizeMB
+
+		respondJSON(w, http.StatusOK, app)
+	}
+}
+
+// updateNotify handles PUT /api/v1/apps/{id}/notify
+// Sets the webhook URL that is POSTed to when a deployment becomes running or failed.
+// Every call generates a new signing secret, returned only in this response; an empty URL disables notifications.
+func updateNotify(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			NotifyURL string `json:"notify_url"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		req.NotifyURL = strings.TrimSpace(req.NotifyURL)
+		if req.NotifyURL != "" {
+			u, err := url.Parse(req.NotifyURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, "notify_url must be an http or https URL")
+				return
+			}
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		secret := ""
+		if req.NotifyURL != "" {
+			if secret, err = notify.NewSecret(); err != nil {
+				respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+		}
+		if err := appStore.UpdateNotify(r.Context(), id, req.NotifyURL, secret); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"notify_url":    req.NotifyURL,
+			"notify_secret": secret,
+		})
+	}
+}
+
+// buildArgKeyPattern matches valid Dockerfile ARG names
+var buildArgKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// listBuildArgs handles GET /api/v1/apps/{id}/build-args
+func listBuildArgs(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		args, err := appStore.GetBuildArgs(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"app_id":     id,
+			"build_args": args,
+		})
+	}
+}
+
+// setBuildArg handles POST /api/v1/apps/{id}/build-args
+// Creates or replaces a build arg. Takes effect on the next deployment.
+func setBuildArg(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if !buildArgKeyPattern.MatchString(req.Key) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "key must start with a letter or underscore and contain only letters, digits and underscores")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.SetBuildArg(r.Context(), id, req.Key, req.Value); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusCreated, map[string]string{
+			"key":   req.Key,
+			"value": req.Value,
+		})
+	}
+}
+
+// deleteBuildArg handles DELETE /api/v1/apps/{id}/build-args/{key}
+func deleteBuildArg(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.DeleteBuildArg(r.Context(), id, chi.URLParam(r, "key")); err != nil {
+			if err == sql.ErrNoRows {
+				respondError(w, http.StatusNotFound, codeNotFound, "Build arg not found")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listBuildSecrets handles GET /api/v1/apps/{id}/build-secrets
+// Only the secret IDs are returned; values are write-only.
+func listBuildSecrets(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		keys, err := appStore.ListBuildSecrets(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"app_id":        id,
+			"build_secrets": keys,
+		})
+	}
+}
+
+// setBuildSecret handles POST /api/v1/apps/{id}/build-secrets
+// Creates or replaces a build secret. Takes effect on the next deployment.
+func setBuildSecret(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+		if !appStore.BuildSecretsEnabled() {
+			respondError(w, http.StatusServiceUnavailable, codeSecretsNotConfigured, "Build secrets are not enabled on this server")
+			return
+		}
+
+		var req struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if !buildArgKeyPattern.MatchString(req.Key) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "key must start with a letter or underscore and contain only letters, digits and underscores")
+			return
+		}
+		if req.Value == "" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "value is required")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.SetBuildSecret(r.Context(), id, req.Key, req.Value); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		// The value is never echoed back
+		respondJSON(w, http.StatusCreated, map[string]string{
+			"key": req.Key,
+		})
+	}
+}
+
+// deleteBuildSecret handles DELETE /api/v1/apps/{id}/build-secrets/{key}
+func deleteBuildSecret(appStore *apps.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := appStore.DeleteBuildSecret(r.Context(), id, chi.URLParam(r, "key")); err != nil {
+			if err == sql.ErrNoRows {
+				respondError(w, http.StatusNotFound, codeNotFound, "Build secret not found")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listSecrets handles GET /api/v1/apps/{id}/secrets
+// Only the secret names are returned; values are write-only.
+func listSecrets(appStore *apps.Store, secretStore *secrets.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		list, err := secretStore.List(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"app_id":  id,
+			"secrets": list,
+		})
+	}
+}
+
+// setSecret handles POST /api/v1/apps/{id}/secrets
+// Creates or replaces a secret, set in the containers of all the app's environments from the
+// next deployment on. It overrides an environment variable with the same name.
+func setSecret(appStore *apps.Store, secretStore *secrets.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+		if !secretStore.Enabled() {
+			respondError(w, http.StatusServiceUnavailable, codeSecretsNotConfigured, "App secrets are not enabled on this server")
+			return
+		}
+
+		var req struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if !buildArgKeyPattern.MatchString(req.Key) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "key must start with a letter or underscore and contain only letters, digits and underscores")
+			return
+		}
+		if req.Value == "" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "value is required")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := secretStore.Set(r.Context(), id, req.Key, req.Value); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, "Failed to store secret")
+			return
+		}
+
+		// The value is never echoed back
+		respondJSON(w, http.StatusCreated, map[string]string{
+			"key": req.Key,
+		})
+	}
+}
+
+// deleteSecret handles DELETE /api/v1/apps/{id}/secrets/{key}
+// The secret is unset in the app's containers from the next deployment on.
+func deleteSecret(appStore *apps.Store, secretStore *secrets.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := secretStore.Delete(r.Context(), id, chi.URLParam(r, "key")); err != nil {
+			if err == sql.ErrNoRows {
+				respondError(w, http.StatusNotFound, codeNotFound, "Secret not found")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// environmentResponse adds where an environment is served to its settings
+func environmentResponse(env *environments.Environment, app *apps.App, baseDomain string) map[string]interface{} {
+	return map[string]interface{}{
+		"environment": env,
+		"url":         fmt.Sprintf("https://%s.%s", environments.Subdomain(app.EffectiveSlug(), env.Name), baseDomain),
+	}
+}
+
+// listEnvironments handles GET /api/v1/apps/{id}/environments
+func listEnvironments(appStore *apps.Store, envStore *environments.Store, baseDomain string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		list, err := envStore.List(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		result := make([]map[string]interface{}, len(list))
+		for i, env := range list {
+			result[i] = environmentResponse(env, app, baseDomain)
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"app_id":       id,
+			"environments": result,
+		})
+	}
+}
+
+// putEnvironment handles PUT /api/v1/apps/{id}/environments/{name}
+// Creates the environment or replaces its branch and env vars. Takes effect on its next deployment.
+func putEnvironment(appStore *apps.Store, envStore *environments.Store, baseDomain string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+		name := chi.URLParam(r, "name")
+		if err := environments.ValidateName(name); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		var req struct {
+			Branch  string            `json:"branch"`
+			EnvVars map[string]string `json:"env_vars"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil && err != errEmptyBody {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if err := environments.ValidateEnvVars(req.EnvVars); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+		if err := environments.ValidateSubdomain(app.EffectiveSlug(), name); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+
+		env, err := envStore.Put(r.Context(), id, name, strings.TrimSpace(req.Branch), req.EnvVars)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, environmentResponse(env, app, baseDomain))
+	}
+}
+
+// deleteEnvironment handles DELETE /api/v1/apps/{id}/environments/{name}
+// Removes the environment's containers and queued deployments along with it.
+// Production can't be deleted; delete the app instead.
+func deleteEnvironment(database *db.DB, appStore *apps.Store, deploymentStore *deployments.Store, envStore *environments.Store, runner *dockerrun.Runner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+		name := chi.URLParam(r, "name")
+		if name == environments.Production {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "The production environment can't be deleted")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		// Delete the environment and cancel its queued deployments atomically, so the worker
+		// can't pick one up for an environment that no longer exists
+		err = database.WithTx(r.Context(), func(tx *sql.Tx) error {
+			if err := envStore.WithTx(tx).Delete(r.Context(), id, name); err != nil {
+				return err
+			}
+			if _, err := deploymentStore.WithTx(tx).CancelPending(r.Context(), id, name); err != nil {
+				return fmt.Errorf("failed to cancel pending deployments: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			if err == sql.ErrNoRows {
+				respondError(w, http.StatusNotFound, codeNotFound, "Environment not found")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		running, err := deploymentStore.GetRunningByEnvironment(r.Context(), id, name)
+		if err != nil {
+			log.Printf("Warning: failed to list running deployments of environment %s: %v", name, err)
+		}
+		for _, d := range running {
+			if d.ContainerID.Valid {
+				if err := runner.Remove(r.Context(), d.ContainerID.String); err != nil {
+					log.Printf("Warning: failed to remove container %s of environment %s: %v", d.ContainerID.String, name, err)
+					continue
+				}
+			}
+			if _, err := deploymentStore.Transition(r.Context(), d.ID, deployments.StatusRunning, deployments.StatusStopped); err != nil {
+				log.Printf("Warning: failed to mark deployment %d stopped: %v", d.ID, err)
+			}
+		}
+		if _, err := runner.RemoveVolumes(r.Context(), id, name); err != nil {
+			log.Printf("Warning: failed to remove the volume of environment %s: %v", name, err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// domainInstructions describes the DNS records that prove ownership of a custom domain
+func domainInstructions(d *domains.Domain, app *apps.App, baseDomain string) map[string]interface{} {
+	return map[string]interface{}{
+		"domain":   d,
+		"verified": d.Verified(),
+		"txt_record": map[string]string{
+			"name":  domains.ChallengePrefix + d.Domain,
+			"value": d.VerificationToken,
+		},
+		"cname_target": fmt.Sprintf("%s.%s", app.EffectiveSlug(), baseDomain),
+	}
+}
+
+// listDomains handles GET /api/v1/apps/{id}/domains
+func listDomains(appStore *apps.Store, domainStore *domains.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		list, err := domainStore.ListByAppID(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, list)
+	}
+}
+
+// addDomain handles POST /api/v1/apps/{id}/domains
+// Attaches an unverified domain and returns the DNS records the user must create to verify it.
+func addDomain(appStore *apps.Store, domainStore *domains.Store, baseDomain string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		var req struct {
+			Domain string `json:"domain"`
+		}
+		if err := decodeJSON(w, r, &req); err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		domain, err := domains.Normalize(req.Domain)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		// Hostnames under the base domain are ours to hand out
+		if domain == baseDomain || strings.HasSuffix(domain, "."+baseDomain) {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Domains under %s cannot be added as custom domains", baseDomain))
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		d, err := domainStore.Create(r.Context(), id, domain)
+		if err == domains.ErrDuplicate {
+			respondError(w, http.StatusConflict, codeDomainInUse, fmt.Sprintf("Domain %s is already in use", domain))
+			return
+		}
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusCreated, domainInstructions(d, app, baseDomain))
+	}
+}
+
+// verifyDomain handles POST /api/v1/apps/{id}/domains/{domainID}/verify
+// Checks DNS for the TXT or CNAME record and marks the domain verified.
+// The domain is routed from the app's next deployment on.
+func verifyDomain(appStore *apps.Store, domainStore *domains.Store, baseDomain string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+		domainID, err := strconv.Atoi(chi.URLParam(r, "domainID"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid domain ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		d, err := domainStore.GetByID(r.Context(), id, domainID)
+		if err != nil {
+			respondError(w, http.StatusNotFound, codeNotFound, "Domain not found")
+			return
+		}
+
+		if !d.Verified() {
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			defer cancel()
+			if err := domains.Verify(ctx, d, fmt.Sprintf("%s.%s", app.EffectiveSlug(), baseDomain)); err != nil {
+				respondErrorDetails(w, http.StatusUnprocessableEntity, codeDomainNotVerified,
+					"DNS records for this domain were not found. DNS changes can take a while to propagate; try again later.",
+					domainInstructions(d, app, baseDomain))
+				return
+			}
+			if err := domainStore.MarkVerified(r.Context(), d.ID); err != nil {
+				respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+			if d, err = domainStore.GetByID(r.Context(), id, domainID); err != nil {
+				respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"domain":  d,
+			"message": "Domain verified. It will be routed to the app from the next deployment.",
+		})
+	}
+}
+
+// deleteDomain handles DELETE /api/v1/apps/{id}/domains/{domainID}
+// The domain stops being routed once the app is next deployed.
+func deleteDomain(appStore *apps.Store, domainStore *domains.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+		domainID, err := strconv.Atoi(chi.URLParam(r, "domainID"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid domain ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		if err := domainStore.Delete(r.Context(), id, domainID); err != nil {
+			if err == sql.ErrNoRows {
+				respondError(w, http.StatusNotFound, codeNotFound, "Domain not found")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteApp handles DELETE /api/v1/apps/{id}
+// Removes the app's containers, then the app. The containers of its running deployments are
+// removed first; any other container labelled with the app (from failed or stopped deployments,
+// or ones the database lost track of) is found by label and removed too.
+func deleteApp(store *apps.Store, deploymentStore *deployments.Store, runner *dockerrun.Runner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := store.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		removed := make(map[string]bool)
+		running, err := deploymentStore.GetRunningByAppID(r.Context(), id)
+		if err != nil {
+			log.Printf("Warning: failed to list running deployments of app %d: %v", id, err)
+		}
+		for _, d := range running {
+			if !d.ContainerID.Valid {
+				continue
+			}
+			if err := runner.Remove(r.Context(), d.ContainerID.String); err != nil {
+				log.Printf("Warning: failed to remove container %s of app %d: %v", d.ContainerID.String, id, err)
+				continue
+			}
+			removed[d.ContainerID.String] = true
+		}
+		managed, err := runner.ListManaged(r.Context(), id)
+		if err != nil {
+			log.Printf("Warning: failed to list containers of app %d by label: %v", id, err)
+		}
+		for _, c := range managed {
+			if removed[c.ID] {
+				continue
+			}
+			if err := runner.Remove(r.Context(), c.ID); err != nil {
+				log.Printf("Warning: failed to remove container %s of app %d: %v", c.Name, id, err)
+				continue
+			}
+			log.Printf("Removed container %s of deleted app %d", c.Name, id)
+		}
+		// The app's data goes with it; volumes are only removable once their containers are gone
+		if n, err := runner.RemoveVolumes(r.Context(), id, ""); err != nil {
+			log.Printf("Warning: failed to remove volumes of app %d: %v", id, err)
+		} else if n > 0 {
+			log.Printf("Removed %d volume(s) of deleted app %d", n, id)
+		}
+
+		if err := store.Delete(r.Context(), id); err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func listDeployments(store *deployments.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		deployments, err := store.ListByAppID(r.Context(), appID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, deployments)
+	}
+}
+
+// getLatestDeployment handles GET /api/v1/apps/{id}/deployments/latest
+// Returns the app's most recent deployment, with the URL of the environment it was deployed to.
+func getLatestDeployment(appStore *apps.Store, deploymentStore *deployments.Store, baseDomain string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		deployment, err := deploymentStore.GetLatestByAppID(r.Context(), id)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				respondError(w, http.StatusNotFound, codeNotFound, "App has no deployments")
+				return
+			}
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"deployment": deployment,
+			"url":        fmt.Sprintf("https://%s.%s", environments.Subdomain(app.EffectiveSlug(), deployment.Environment), baseDomain),
+		})
+	}
+}
+
+func getDeployment(store *deployments.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(chi.URLParam(r, "id"))
 		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid deployment ID")
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid deployment ID")
 			return
 		}
 
-		deployment, err := store.GetByID(id)
+		deployment, err := store.GetByID(r.Context(), id)
 		if err != nil {
-			respondError(w, http.StatusNotFound, "Deployment not found")
+			respondError(w, http.StatusNotFound, codeNotFound, "Deployment not found")
 			return
 		}
 
@@ -452,17 +2404,127 @@ func getDeployment(store *deployments.Store) http.HandlerFunc {
 	}
 }
 
-func getDeploymentLogs(store *deployments.Store) http.HandlerFunc {
+const (
+	// waitDefaultTimeout is how long waitDeployment blocks when no timeout is given
+	waitDefaultTimeout = 30 * time.Second
+	// waitMaxTimeout caps the timeout a client may ask waitDeployment for
+	waitMaxTimeout = 5 * time.Minute
+	// waitPollInterval is how often waitDeployment re-reads the deployment
+	waitPollInterval = time.Second
+)
+
+// waitDeployment handles GET /api/v1/deployments/{id}/wait?timeout=60
+// Blocks until the deployment is no longer pending or building, or until timeout seconds pass,
+// then returns the deployment. The "done" field tells the two apart, so a client can call again
+// while it is false. Returns early if the client goes away.
+func waitDeployment(appStore *apps.Store, store *deployments.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid deployment ID")
+			return
+		}
+
+		timeout := waitDefaultTimeout
+		if raw := r.URL.Query().Get("timeout"); raw != "" {
+			seconds, err := strconv.Atoi(raw)
+			if err != nil || seconds < 0 {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, "timeout must be a non-negative number of seconds")
+				return
+			}
+			timeout = time.Duration(seconds) * time.Second
+			if timeout > waitMaxTimeout {
+				timeout = waitMaxTimeout
+			}
+		}
+
+		deployment, err := store.GetByID(r.Context(), id)
+		if err != nil || !ownsDeployment(r, appStore, deployment) {
+			respondError(w, http.StatusNotFound, codeNotFound, "Deployment not found")
+			return
+		}
+
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+		ticker := time.NewTicker(waitPollInterval)
+		defer ticker.Stop()
+
+		for !deployment.Status.IsFinal() {
+			select {
+			case <-r.Context().Done():
+				// The client gave up; nobody is left to answer
+				return
+			case <-deadline.C:
+				respondJSON(w, http.StatusOK, map[string]interface{}{
+					"done":       false,
+					"deployment": deployment,
+				})
+				return
+			case <-ticker.C:
+				current, err := store.GetByID(r.Context(), id)
+				if err != nil {
+					if r.Context().Err() != nil {
+						return
+					}
+					respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+					return
+				}
+				deployment = current
+			}
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"done":       true,
+			"deployment": deployment,
+		})
+	}
+}
+
+// getDeploymentEvents handles GET /api/v1/deployments/{id}/events
+// Returns the steps the deployment has gone through so far, oldest first, so a client can
+// show progress and see where a deploy stalled.
+// Response format:
+//
+//	{"deployment_id": 42, "status": "building", "events": [{"event": "cloned", "message": "3f1c...", "created_at": "..."}, ...]}
+func getDeploymentEvents(appStore *apps.Store, store *deployments.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid deployment ID")
+			return
+		}
+
+		deployment, err := store.GetByID(r.Context(), id)
+		if err != nil || !ownsDeployment(r, appStore, deployment) {
+			respondError(w, http.StatusNotFound, codeNotFound, "Deployment not found")
+			return
+		}
+
+		events, err := store.ListEvents(r.Context(), id)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"deployment_id": deployment.ID,
+			"status":        deployment.Status,
+			"events":        events,
+		})
+	}
+}
+
+func getDeploymentLogs(store *deployments.Store, runtimeLogStore *runtimelogs.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id, err := strconv.Atoi(chi.URLParam(r, "id"))
 		if err != nil {
-			respondError(w, http.StatusBadRequest, "Invalid deployment ID")
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid deployment ID")
 			return
 		}
 
-		deployment, err := store.GetByID(id)
+		deployment, err := store.GetByID(r.Context(), id)
 		if err != nil {
-			respondError(w, http.StatusNotFound, "Deployment not found")
+			respondError(w, http.StatusNotFound, codeNotFound, "Deployment not found")
 			return
 		}
 
@@ -472,6 +2534,13 @@ func getDeploymentLogs(store *deployments.Store) http.HandlerFunc {
 			"status":        deployment.Status,
 		}
 
+		// The failing build step and its error, so users don't have to search the log
+		if deployment.FailureSummary.Valid && deployment.FailureSummary.String != "" {
+			response["failure_summary"] = deployment.FailureSummary.String
+		} else {
+			response["failure_summary"] = nil
+		}
+
 		// Add build log if available
 		if deployment.BuildLog.Valid && deployment.BuildLog.String != "" {
 			response["build_log"] = deployment.BuildLog.String
@@ -486,20 +2555,546 @@ func getDeploymentLogs(store *deployments.Store) http.HandlerFunc {
 			response["error_message"] = nil
 		}
 
+		// Runtime log history kept by the worker (RUNTIME_LOG_LINES), which outlives the container's own logs
+		runtimeLines, err := runtimeLogStore.List(r.Context(), deployment.ID, 0)
+		if err != nil {
+			log.Printf("Warning: failed to read stored runtime logs of deployment %d: %v", deployment.ID, err)
+		}
+		if len(runtimeLines) > 0 {
+			response["runtime_log"] = runtimelogs.Text(runtimeLines)
+		} else {
+			response["runtime_log"] = nil
+		}
+
+		// Add container exit status if the container died after starting
+		if deployment.ExitCode.Valid {
+			response["exit_code"] = deployment.ExitCode.Int64
+			response["oom_killed"] = deployment.OOMKilled.Valid && deployment.OOMKilled.Bool
+		} else {
+			response["exit_code"] = nil
+			response["oom_killed"] = nil
+		}
+
 		respondJSON(w, http.StatusOK, response)
 	}
 }
 
+// maxMetricsPoints is the number of points a metrics series is downsampled to
+const maxMetricsPoints = 60
+
+// getAppMetrics handles GET /api/v1/apps/{id}/metrics?window=1h
+// Returns the app's memory/CPU/disk usage over the window, downsampled for charting.
+func getAppMetrics(appStore *apps.Store, metricsStore *metrics.Store, retention time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		window := time.Hour
+		if raw := r.URL.Query().Get("window"); raw != "" {
+			window, err = time.ParseDuration(raw)
+			if err != nil || window <= 0 {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, "window must be a positive duration such as 15m, 1h or 24h")
+				return
+			}
+		}
+		// Nothing older than the retention period is stored
+		if window > retention {
+			window = retention
+		}
+
+		if _, err := appStore.GetByID(r.Context(), id); err != nil {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		bucket := window / maxMetricsPoints
+		points, err := metricsStore.Series(r.Context(), id, time.Now().Add(-window), bucket)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"app_id":         id,
+			"window":         window.String(),
+			"bucket_seconds": int(bucket.Seconds()),
+			"points":         points,
+		})
+	}
+}
+
+// Result limits of the runtime log search
+const (
+	defaultLogSearchLimit = 100
+	maxLogSearchLimit     = 1000
+)
+
+// searchDeploymentLogs handles GET /api/v1/deployments/{id}/logs/search?q=&regex=&stream=&since=&until=&limit=
+// Searches the runtime log history the worker stored for the deployment (RUNTIME_LOG_LINES) for
+// lines containing q, or matching it as a regular expression with regex=true, optionally only
+// from one stream and within a time range. since and until are RFC 3339 times or durations
+// before now (e.g. 15m). Returns matching lines with their line numbers, oldest first.
+func searchDeploymentLogs(appStore *apps.Store, store *deployments.Store, runtimeLogStore *runtimelogs.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid deployment ID")
+			return
+		}
+
+		params := r.URL.Query()
+		query := runtimelogs.Query{Stream: params.Get("stream"), Limit: defaultLogSearchLimit}
+		if text := params.Get("q"); text != "" {
+			if params.Get("regex") != "true" {
+				text = regexp.QuoteMeta(text)
+			}
+			query.Pattern, err = regexp.Compile(text)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Invalid regular expression: %v", err))
+				return
+			}
+		}
+		if query.Stream != "" && query.Stream != logs.StreamStdout && query.Stream != logs.StreamStderr {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "stream must be stdout or stderr")
+			return
+		}
+		for name, bound := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+			raw := params.Get(name)
+			if raw == "" {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, raw); err == nil {
+				*bound = t
+			} else if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+				*bound = time.Now().Add(-d)
+			} else {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, name+" must be an RFC 3339 time or a duration such as 15m or 24h")
+				return
+			}
+		}
+		if raw := params.Get("limit"); raw != "" {
+			query.Limit, err = strconv.Atoi(raw)
+			if err != nil || query.Limit < 1 || query.Limit > maxLogSearchLimit {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxLogSearchLimit))
+				return
+			}
+		}
+
+		deployment, err := store.GetByID(r.Context(), id)
+		if err != nil || !ownsDeployment(r, appStore, deployment) {
+			respondError(w, http.StatusNotFound, codeNotFound, "Deployment not found")
+			return
+		}
+
+		matches, truncated, err := runtimeLogStore.Search(r.Context(), deployment.ID, query)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"deployment_id": deployment.ID,
+			"matches":       matches,
+			"truncated":     truncated,
+		})
+	}
+}
+
+// downloadDeploymentLogs handles GET /api/v1/deployments/{id}/logs/download?type=build|runtime
+// Sends the log as a plain-text attachment instead of embedding it in JSON.
+// Build logs come from the archive directory when available (full log), otherwise from
+// the database (possibly truncated); runtime logs come from the worker's stored history when it
+// keeps one (RUNTIME_LOG_LINES), otherwise they are read from the container.
+func downloadDeploymentLogs(appStore *apps.Store, store *deployments.Store, runtimeLogStore *runtimelogs.Store, runner *dockerrun.Runner, archiveDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid deployment ID")
+			return
+		}
+
+		logType := r.URL.Query().Get("type")
+		if logType == "" {
+			logType = "build"
+		}
+		if logType != "build" && logType != "runtime" {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "type must be build or runtime")
+			return
+		}
+
+		deployment, err := store.GetByID(r.Context(), id)
+		if err != nil || !ownsDeployment(r, appStore, deployment) {
+			respondError(w, http.StatusNotFound, codeNotFound, "Deployment not found")
+			return
+		}
+
+		filename := fmt.Sprintf("deployment-%d-%s.log", deployment.ID, logType)
+		// startDownload sends the headers; the log is then copied to the response as it is read
+		startDownload := func() {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+			w.WriteHeader(http.StatusOK)
+		}
+
+		switch logType {
+		case "build":
+			if archiveDir != "" {
+				if f, err := os.Open(logs.ArchivePath(archiveDir, deployment.ID, "build")); err == nil {
+					defer f.Close()
+					startDownload()
+					io.Copy(w, f)
+					return
+				}
+			}
+			if !deployment.BuildLog.Valid || deployment.BuildLog.String == "" {
+				respondError(w, http.StatusNotFound, codeNotFound, "No build log for this deployment")
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(deployment.BuildLog.String)))
+			startDownload()
+			io.Copy(w, strings.NewReader(deployment.BuildLog.String))
+		case "runtime":
+			out := bufio.NewWriter(w)
+			started := false
+			// Stored lines are written as they are read; the headers go out with the first one
+			count, err := runtimeLogStore.Each(r.Context(), deployment.ID, func(l runtimelogs.Line) error {
+				if !started {
+					started = true
+					startDownload()
+				}
+				_, err := out.WriteString(l.String() + "\n")
+				return err
+			})
+			if count > 0 {
+				if err != nil {
+					log.Printf("Warning: runtime log download of deployment %d ended early: %v", deployment.ID, err)
+				}
+				out.Flush()
+				return
+			}
+			if err != nil {
+				log.Printf("Warning: failed to read stored runtime logs of deployment %d: %v", deployment.ID, err)
+			}
+			if !deployment.ContainerID.Valid || deployment.ContainerID.String == "" {
+				respondError(w, http.StatusNotFound, codeNotFound, "No container for this deployment")
+				return
+			}
+			reader, tty, err := runner.Logs(r.Context(), deployment.ContainerID.String, 0)
+			if err != nil {
+				respondError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("Runtime logs unavailable: %v", err))
+				return
+			}
+			defer reader.Close()
+
+			startDownload()
+			// Lines are written in the format of logs.ParseRuntimeLog as the container log is read
+			err = logs.ScanRuntimeLog(reader, tty, func(stream, line string) {
+				if stream == logs.StreamStderr {
+					out.WriteString("[stderr] ")
+				}
+				out.WriteString(line + "\n")
+			})
+			if err != nil {
+				log.Printf("Warning: runtime log download of deployment %d ended early: %v", deployment.ID, err)
+			}
+			out.Flush()
+		}
+	}
+}
+
+// maxIdempotencyKeyLength matches the idempotency_keys.key column
+const maxIdempotencyKeyLength = 255
+
+// idempotencyMiddleware makes a handler safe to retry for clients that send an Idempotency-Key header.
+// The first request with a key runs normally and its response is stored; later requests with the
+// same key (per user) get that response replayed, marked with an Idempotent-Replayed header.
+// A retry that arrives while the first request is still running gets 409.
+// Server errors (5xx) are not stored, so the request can be retried for real.
+func idempotencyMiddleware(store *idempotency.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				respondError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+				return
+			}
+
+			scope, _ := getUserID(r)
+			reserved, stored, err := store.Reserve(r.Context(), scope, key)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+				return
+			}
+			if !reserved {
+				if stored == nil {
+					respondError(w, http.StatusConflict, codeRequestInProgress, "A request with this Idempotency-Key is still being processed")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				io.WriteString(w, stored.Body)
+				return
+			}
+
+			// Don't leave the key stuck "in progress" if the handler panics
+			defer func() {
+				if p := recover(); p != nil {
+					store.Release(context.WithoutCancel(r.Context()), scope, key)
+					panic(p)
+				}
+			}()
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			// Record the outcome even if the client has already gone away
+			ctx := context.WithoutCancel(r.Context())
+
+			// Server errors and rate limits are worth retrying with the same key
+			if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+				if err := store.Release(ctx, scope, key); err != nil {
+					log.Printf("Warning: failed to release idempotency key: %v", err)
+				}
+				return
+			}
+			if err := store.Complete(ctx, scope, key, idempotency.Response{StatusCode: rec.status, Body: rec.body.String()}); err != nil {
+				log.Printf("Warning: failed to store idempotent response: %v", err)
+			}
+		})
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of its status and body
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// corsMiddleware sets CORS headers for requests from allowed origins.
+// The request's Origin is echoed back only if it is in allowedOrigins, and credentials
+// are allowed for those origins. A "*" entry allows any origin without credentials.
+func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
+	allowAny := false
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			allowAny = true
+			continue
+		}
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			// Responses differ per origin, so caches must key on it
+			w.Header().Add("Vary", "Origin")
+
+			if origin != "" {
+				switch {
+				case allowed[origin]:
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				case allowAny:
+					w.Header().Set("Access-Control-Allow-Origin", "*")
+				}
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Idempotency-Key")
+				w.Header().Set("Access-Control-Max-Age", "3600")
+			}
+
+			// Handle preflight OPTIONS request
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func respondJSON(w http.ResponseWriter, status int, payload interface{}) {
-	// Ensure CORS headers are set (in case middleware didn't run)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(payload)
 }
 
-func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, map[string]string{"error": message})
+// checkNotBuilding refuses a new deployment of an app's environment while the worker is building
+// one, since both would race to replace the environment's containers; a queued deployment is
+// fine, as it is superseded instead. It writes a 409 response naming the building deployment
+// and returns false if one is building.
+func checkNotBuilding(w http.ResponseWriter, r *http.Request, store *deployments.Store, appID int, environment string) bool {
+	building, err := store.GetBuilding(r.Context(), appID, environment)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		// Don't block deploys on a failed check
+		log.Printf("Warning: failed to check for building deployments of app %d: %v", appID, err)
+		return true
+	}
+	respondErrorDetails(w, http.StatusConflict, codeDeploymentInProgress,
+		fmt.Sprintf("Deployment %d of this environment is building; deploy again once it finishes", building.ID),
+		map[string]interface{}{"deployment_id": building.ID})
+	return false
+}
+
+// replacePending queues the deployment create inserts in place of the pending deployments of
+// the app's environment. The app's row stays locked until both are done, so concurrent redeploys
+// and promotions queue one after the other, each replacing the one before, instead of both
+// passing the checks and adding a build each.
+func replacePending(ctx context.Context, database *db.DB, appStore *apps.Store, deploymentStore *deployments.Store, appID int, environment string, create func(*deployments.Store) (*deployments.Deployment, error)) (*deployments.Deployment, error) {
+	var deployment *deployments.Deployment
+	var superseded int64
+	err := database.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := appStore.WithTx(tx).Lock(ctx, appID); err != nil {
+			return err
+		}
+		txDeployments := deploymentStore.WithTx(tx)
+		var err error
+		if superseded, err = txDeployments.CancelPending(ctx, appID, environment); err != nil {
+			return err
+		}
+		deployment, err = create(txDeployments)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if superseded > 0 {
+		log.Printf("Superseded %d pending deployment(s) of app %d", superseded, appID)
+	}
+	return deployment, nil
+}
+
+// checkDeploymentLimit enforces the per-user cap on pending and building deployments.
+// It writes a 429 response and returns false if the authenticated user is at the cap.
+// Requests without a user, and a limit of 0, are not limited.
+func checkDeploymentLimit(w http.ResponseWriter, r *http.Request, store *deployments.Store, limit int) bool {
+	userID, ok := getUserID(r)
+	if !ok || userID == "" || limit <= 0 {
+		return true
+	}
+	active, err := store.CountActiveByUser(r.Context(), userID)
+	if err != nil {
+		// Don't block deploys on a failed count
+		log.Printf("Warning: failed to count active deployments of user %s: %v", userID, err)
+		return true
+	}
+	if active >= limit {
+		respondErrorDetails(w, http.StatusTooManyRequests, codeTooManyDeployments,
+			fmt.Sprintf("You already have %d deployments queued or building; wait for one to finish", active),
+			map[string]interface{}{"limit": limit, "active": active})
+		return false
+	}
+	return true
+}
+
+// rateLimitMiddleware allows each user at most limit requests per window to the wrapped handler,
+// answering 429 with a Retry-After header beyond that. Requests without a user are limited
+// per client IP instead. Each client has a token bucket holding up to limit requests that
+// refills evenly over window, so a burst of limit requests is allowed after a quiet period,
+// and a steady limit per window after that. A limit of 0 disables the middleware. Buckets are
+// kept in memory, so they are per API process and reset on restart.
+func rateLimitMiddleware(limit int, window time.Duration) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	type bucket struct {
+		tokens float64
+		last   time.Time
+	}
+	var (
+		mu        sync.Mutex
+		buckets   = make(map[string]*bucket)
+		lastSweep time.Time
+	)
+	// Tokens added per second
+	rate := float64(limit) / window.Seconds()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := getUserID(r)
+			if !ok {
+				key = r.RemoteAddr
+				if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+					key = host
+				}
+				key = "ip:" + key
+			}
+
+			now := time.Now()
+			mu.Lock()
+			// Drop buckets that have refilled, so the map doesn't grow with every client ever seen
+			if now.Sub(lastSweep) >= window {
+				for k, b := range buckets {
+					if now.Sub(b.last) >= window {
+						delete(buckets, k)
+					}
+				}
+				lastSweep = now
+			}
+			b, exists := buckets[key]
+			if !exists {
+				b = &bucket{tokens: float64(limit), last: now}
+				buckets[key] = b
+			}
+			b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.last).Seconds()*rate)
+			b.last = now
+			allowed := b.tokens >= 1
+			var retryAfter time.Duration
+			if allowed {
+				b.tokens--
+			} else {
+				retryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+			}
+			mu.Unlock()
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				respondError(w, http.StatusTooManyRequests, codeRateLimited,
+					fmt.Sprintf("Too many requests; at most %d per %s are allowed", limit, window))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// methodRateLimit applies reads to GET, HEAD and OPTIONS requests and writes to all others,
+// each with its own buckets.
+func methodRateLimit(reads, writes func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		read, write := reads(next), writes(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				read.ServeHTTP(w, r)
+			default:
+				write.ServeHTTP(w, r)
+			}
+		})
+	}
 }
 
 // getUserID extracts user_id from request context.
@@ -516,6 +3111,22 @@ func getUserID(r *http.Request) (string, bool) {
 	return "", false
 }
 
+// ownsApp reports whether the authenticated user may act on app.
+// Requests without a user in context (no auth middleware) and apps without an owner are allowed.
+func ownsApp(r *http.Request, app *apps.App) bool {
+	userID, ok := getUserID(r)
+	if !ok || app.UserID == "" {
+		return true
+	}
+	return app.UserID == userID
+}
+
+// ownsDeployment reports whether the authenticated user may see deployment, which is up to its app
+func ownsDeployment(r *http.Request, appStore *apps.Store, deployment *deployments.Deployment) bool {
+	app, err := appStore.GetByID(r.Context(), deployment.AppID)
+	return err == nil && ownsApp(r, app)
+}
+
 // listAppsByUser handles GET /api/apps
 // Lists all apps owned by the authenticated user.
 // Response format:
@@ -538,7 +3149,7 @@ func listAppsByUser(store *apps.Store) http.HandlerFunc {
 		// Extract user_id from request context
 		userID, ok := getUserID(r)
 		if !ok {
-			respondError(w, http.StatusUnauthorized, "user_id not found in request context")
+			respondError(w, http.StatusUnauthorized, codeUnauthorized, "user_id not found in request context")
 			return
 		}
 
@@ -546,7 +3157,7 @@ func listAppsByUser(store *apps.Store) http.HandlerFunc {
 		apps, err := store.ListAppsByUserID(r.Context(), userID)
 		if err != nil {
 			// On DB error, return 500 with JSON error message
-			respondError(w, http.StatusInternalServerError, err.Error())
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
 			return
 		}
 
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+)
+
+// pausedRetryAfter is the Retry-After, in seconds, of the maintenance page
+const pausedRetryAfter = "300"
+
+// pausedPage is the maintenance page; %s is the app's hostname
+const pausedPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>App paused</title>
+<style>
+body { font-family: system-ui, sans-serif; color: #333; background: #fafafa; display: flex; align-items: center; justify-content: center; min-height: 100vh; margin: 0; }
+main { text-align: center; padding: 2rem; }
+h1 { font-size: 1.5rem; margin-bottom: 0.5rem; }
+p { color: #666; }
+</style>
+</head>
+<body>
+<main>
+<h1>This app is paused</h1>
+<p>%s isn't running right now. Please check back later.</p>
+</main>
+</body>
+</html>
+`
+
+// pausedApp handles GET /paused
+// Traefik serves this page on the hostnames of apps that aren't running (see MAINTENANCE_PAGE_URL),
+// with the app's hostname in X-Forwarded-Host.
+func pausedApp(w http.ResponseWriter, r *http.Request) {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = "This app"
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", pausedRetryAfter)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, pausedPage, html.EscapeString(host))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxRequestBodyBytes caps the size of JSON request bodies
+const maxRequestBodyBytes = 1 << 20
+
+// errEmptyBody is returned by decodeJSON when the request has no body
+var errEmptyBody = errors.New("request body must not be empty")
+
+// decodeJSON decodes a single JSON object from the request body into dst.
+// The body is capped at maxRequestBodyBytes and unknown fields are rejected,
+// so typos in field names fail loudly instead of being ignored.
+// The returned error's message is suitable for a 400 response.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(dst); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, io.EOF):
+			return errEmptyBody
+		case errors.As(err, &maxBytesErr):
+			return fmt.Errorf("request body must not be larger than %d bytes", maxBytesErr.Limit)
+		case errors.As(err, &syntaxErr):
+			return fmt.Errorf("request body contains malformed JSON at position %d", syntaxErr.Offset)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("request body contains malformed JSON")
+		case errors.As(err, &typeErr):
+			if typeErr.Field != "" {
+				return fmt.Errorf("field %q must be of type %s", typeErr.Field, typeErr.Type)
+			}
+			return errors.New("request body must be a JSON object")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			// encoding/json has no typed error for unknown fields
+			return fmt.Errorf("request body contains unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		default:
+			return fmt.Errorf("invalid request body: %v", err)
+		}
+	}
+
+	if dec.More() {
+		return errors.New("request body must contain a single JSON object")
+	}
+	return nil
+}
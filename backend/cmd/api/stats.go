@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"mvp-be/internal/apps"
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/environments"
+)
+
+// statsEvent is the data of a "stats" server-sent event
+type statsEvent struct {
+	Time             time.Time `json:"time"`
+	MemoryBytes      uint64    `json:"memory_bytes"`
+	MemoryLimitBytes uint64    `json:"memory_limit_bytes"`
+	CPUPercent       float64   `json:"cpu_percent"`
+}
+
+// streamAppStats handles GET /api/v1/apps/{id}/stats/stream
+// Streams the live memory and CPU usage of the app's running container as server-sent events,
+// one "stats" event about every second, until the client disconnects. An "end" event follows
+// if the container stops. Optional query parameter: environment (default production).
+func streamAppStats(appStore *apps.Store, deploymentStore *deployments.Store, runner *dockerrun.Runner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid app ID")
+			return
+		}
+
+		app, err := appStore.GetByID(r.Context(), id)
+		if err != nil || !ownsApp(r, app) {
+			respondError(w, http.StatusNotFound, codeNotFound, "App not found")
+			return
+		}
+
+		env := r.URL.Query().Get("environment")
+		if env == "" {
+			env = environments.Production
+		}
+		running, err := deploymentStore.GetRunningByEnvironment(r.Context(), id, env)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		if len(running) == 0 || !running[0].ContainerID.Valid {
+			respondError(w, http.StatusConflict, codeAppNotRunning, "App has no running deployment")
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			respondError(w, http.StatusInternalServerError, codeInternal, "Streaming is not supported")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		// Keep proxies from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// The request context ends when the client goes away, which closes the Docker stream
+		err = runner.StreamUsage(r.Context(), running[0].ContainerID.String, func(usage dockerrun.ContainerUsage) error {
+			data, err := json.Marshal(statsEvent{
+				Time:             time.Now().UTC(),
+				MemoryBytes:      usage.MemoryBytes,
+				MemoryLimitBytes: usage.MemoryLimitBytes,
+				CPUPercent:       usage.CPUPercent,
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		})
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Warning: stats stream of app %d ended: %v", id, err)
+		}
+		fmt.Fprint(w, "event: end\ndata: {}\n\n")
+		flusher.Flush()
+	}
+}
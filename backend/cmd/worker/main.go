@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"mvp-be/internal/apps"
 	"mvp-be/internal/config"
@@ -16,10 +17,23 @@ import (
 	"mvp-be/internal/deployments"
 	"mvp-be/internal/dockerbuild"
 	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/domains"
 	"mvp-be/internal/engine"
+	"mvp-be/internal/environments"
 	"mvp-be/internal/gitrepo"
+	"mvp-be/internal/healthcheck"
+	"mvp-be/internal/imagepolicy"
+	"mvp-be/internal/maintenance"
+	"mvp-be/internal/metrics"
+	"mvp-be/internal/registry"
+	"mvp-be/internal/rollout"
+	"mvp-be/internal/runtimelogs"
+	"mvp-be/internal/secrets"
 )
 
+// dockerPingTimeout bounds the startup check that the Docker daemon is reachable
+const dockerPingTimeout = 10 * time.Second
+
 // main is the entry point for the deployment worker.
 // It initializes all dependencies and starts the deployment processing loop.
 //
@@ -27,20 +41,30 @@ import (
 //   1. Load configuration from environment variables
 //   2. Connect to PostgreSQL database
 //   3. Run database migrations
-//   4. Initialize data stores (apps, deployments)
+//   4. Initialize data stores (apps, deployments, domains)
 //   5. Initialize Git cloner (with work directory)
 //   6. Initialize Docker builder (connects to Docker daemon)
-//   7. Initialize Docker runner (connects to Docker daemon)
-//   8. Create deployment engine with all dependencies
-//   9. Setup graceful shutdown signal handling
-//   10. Start the deployment processing loop
+//   7. Initialize Docker runner (connects to Docker daemon) and check the daemon and network
+//   8. Setup graceful shutdown signal handling
+//   9. Create deployment engine with all dependencies, woken by notifications of queued deployments
+//   10. Start the usage sampler and the repository cleanup
+//   11. Stop containers of apps their owners stopped that Docker restarted, and remove rollout
+//       routes left behind by interrupted rollouts
+//   12. Start the reconciler that catches containers that died or were removed, and the
+//       liveness checks that restart apps which stopped answering
+//   13. Start the deployment processing loop
 func main() {
 	// Load configuration from environment variables
 	cfg := config.Load()
+	cfg.MustValidate()
 
 	// Initialize database connection
 	// This connects to PostgreSQL using the connection string from config
-	database, err := db.New(cfg.DatabaseURL)
+	database, err := db.New(cfg.DatabaseURL, db.Options{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+	})
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -55,8 +79,24 @@ func main() {
 
 	// Initialize data stores
 	// These provide database operations for apps and deployments
-	appStore := apps.NewStore(database.DB)
+	// App secrets are decrypted here to be set in containers, and build secrets to be mounted
+	// into builds; the key is validated at startup
+	secretsCipher, err := secrets.NewCipher(cfg.SecretsKey)
+	if err != nil {
+		log.Fatalf("Invalid SECRETS_KEY: %v", err)
+	}
+	appStore := apps.NewStore(database.DB, secretsCipher)
 	deploymentStore := deployments.NewStore(database.DB)
+	domainStore := domains.NewStore(database.DB)
+	envStore := environments.NewStore(database.DB)
+	secretStore := secrets.NewStore(database.DB, secretsCipher)
+
+	// Build secrets set before they were encrypted are encrypted once a key is configured
+	if n, err := appStore.EncryptBuildSecrets(context.Background()); err != nil {
+		log.Printf("Warning: failed to encrypt stored build secrets: %v", err)
+	} else if n > 0 {
+		log.Printf("Encrypted the build secrets of %d apps", n)
+	}
 
 	// Initialize Git cloner
 	// This will clone repositories to a temporary directory
@@ -66,7 +106,7 @@ func main() {
 	if err := os.MkdirAll(workDir, 0755); err != nil {
 		log.Fatalf("Failed to create work directory: %v", err)
 	}
-	cloner := gitrepo.NewCloner(workDir)
+	cloner := gitrepo.NewCloner(workDir, cfg.CloneTimeout, cfg.CloneMaxSizeMB<<20)
 
 	// Initialize Docker builder
 	// This connects to the Docker daemon to build images
@@ -74,24 +114,44 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create Docker builder: %v", err)
 	}
+	if cfg.UseBuildKit {
+		if err := builder.EnableBuildKit(context.Background()); err != nil {
+			log.Printf("Warning: USE_BUILDKIT is set but BuildKit can't be used, falling back to the legacy builder: %v", err)
+		} else {
+			log.Printf("Building images with BuildKit")
+		}
+	}
+
+	// Optional registry for multi-host setups; images stay local without one
+	imageRegistry := registry.Config{
+		URL:      cfg.RegistryURL,
+		Username: cfg.RegistryUsername,
+		Password: cfg.RegistryPassword,
+	}
 
 	// Initialize Docker runner
 	// This connects to the Docker daemon to run containers
-	runner, err := dockerrun.NewRunner(cfg.DockerHost)
+	runner, err := dockerrun.NewRunner(cfg.DockerHost, dockerrun.Options{CertResolver: cfg.CertResolver, Network: cfg.DockerNetwork, Registry: imageRegistry, VolumeDriver: cfg.VolumeDriver})
 	if err != nil {
 		log.Fatalf("Failed to create Docker runner: %v", err)
 	}
 
-	// Initialize deployment engine
-	// This orchestrates the entire deployment pipeline
-	deploymentEngine := engine.NewEngine(
-		deploymentStore, // Store for deployment database operations
-		appStore,        // Store for app database operations
-		cloner,          // Git repository cloner
-		builder,         // Docker image builder
-		runner,          // Docker container runner
-		cfg.BaseDomain,  // Base domain for subdomain routing
-	)
+	// Fail fast with a clear message instead of failing the first deploy cryptically
+	pingCtx, cancelPing := context.WithTimeout(context.Background(), dockerPingTimeout)
+	if err := runner.Ping(pingCtx); err != nil {
+		log.Fatalf("Docker daemon at %s is not reachable: %v. Check DOCKER_HOST and that the daemon is running.", cfg.DockerHost, err)
+	}
+	if err := runner.CheckNetwork(pingCtx); err != nil {
+		log.Fatalf("%v. Set DOCKER_NETWORK to the network Traefik is attached to.", err)
+	}
+	cancelPing()
+
+	// Create the log archive directory if full build logs should be kept on disk
+	if cfg.LogArchiveDir != "" {
+		if err := os.MkdirAll(cfg.LogArchiveDir, 0755); err != nil {
+			log.Fatalf("Failed to create log archive directory: %v", err)
+		}
+	}
 
 	// Setup graceful shutdown
 	// Create a cancellable context that can be used to stop the deployment loop
@@ -114,9 +174,207 @@ func main() {
 		cancel()
 	}()
 
+	// Initialize deployment engine
+	// This orchestrates the entire deployment pipeline
+	deploymentEngine := engine.NewEngine(
+		database,        // Database connection for multi-step updates in transactions
+		deploymentStore, // Store for deployment database operations
+		appStore,        // Store for app database operations
+		domainStore,     // Store for custom domains routed to apps
+		envStore,        // Store for the environments apps are deployed to
+		secretStore,     // Store for app secrets set in containers
+		cloner,          // Git repository cloner
+		builder,         // Docker image builder
+		runner,          // Docker container runner
+		cfg.BaseDomain,  // Base domain for subdomain routing
+		engine.Options{
+			HealthCheck: healthcheck.Options{
+				Retries:      cfg.HealthCheckRetries,
+				InitialDelay: cfg.HealthCheckInitialDelay,
+				Interval:     cfg.HealthCheckInterval,
+			},
+			PollInterval:    cfg.PollInterval,
+			PollMaxInterval: cfg.PollMaxInterval,
+			// Pick up new deployments as soon as they are queued; polling catches any missed
+			Wakeup: db.Listen(ctx, cfg.DatabaseURL, deployments.QueuedChannel),
+
+			MaxRetries:    cfg.DeployMaxRetries,
+			LogMaxBytes:   cfg.LogMaxBytes,
+			LogArchiveDir: cfg.LogArchiveDir,
+
+			ReconcileRedeploy: cfg.ReconcileRedeploy,
+			CrashLoopRestarts: cfg.CrashLoopRestarts,
+			CrashLoopWindow:   cfg.CrashLoopWindow,
+			LivenessFailures:  cfg.LivenessFailures,
+			Retention: deployments.Retention{
+				KeepLast: cfg.DeploymentKeepLast,
+				MaxAge:   cfg.DeploymentMaxAge,
+			},
+			Registry: imageRegistry,
+
+			Rollout:        rollout.NewRouter(cfg.TraefikDynamicDir, cfg.CertResolver),
+			CanaryPercent:  cfg.RolloutCanaryPercent,
+			CanaryDuration: cfg.RolloutCanaryDuration,
+
+			ImagePolicy: imagepolicy.Policy{
+				Allow:       cfg.BaseImageAllow,
+				Deny:        cfg.BaseImageDeny,
+				ScanCommand: cfg.BaseImageScanCommand,
+			},
+
+			Maintenance: maintenance.NewRouter(cfg.TraefikDynamicDir, cfg.CertResolver, cfg.MaintenancePageURL),
+		},
+	)
+
+	// Start the usage sampler in the background
+	// It records memory/CPU/disk of running containers for the metrics endpoint
+	sampler := metrics.NewSampler(
+		metrics.NewStore(database.DB),
+		deploymentStore,
+		runner,
+		cfg.MetricsInterval,
+		cfg.MetricsRetention,
+	)
+	go sampler.Run(ctx)
+
+	// Keep runtime logs beyond Docker's own rotation, if enabled
+	if cfg.RuntimeLogLines > 0 {
+		shipper := runtimelogs.NewShipper(
+			runtimelogs.NewStore(database.DB),
+			deploymentStore,
+			appStore,
+			runner,
+			cfg.ReconcileInterval,
+			cfg.RuntimeLogLines,
+		)
+		go shipper.Run(ctx)
+	}
+
+	// Docker restarts containers after a daemon or host restart, including those of apps
+	// their owners stopped; put those back down before processing anything
+	if stopped, err := deploymentEngine.ReconcileStopped(ctx); err != nil {
+		log.Printf("Warning: failed to reconcile stopped apps: %v", err)
+	} else if stopped > 0 {
+		log.Printf("Stopped %d containers of apps their owners stopped", stopped)
+	}
+
+	// Show the maintenance page on the hostnames of apps that aren't running
+	if paused, err := deploymentEngine.SyncMaintenance(ctx); err != nil {
+		log.Printf("Warning: failed to write maintenance routes: %v", err)
+	} else if paused > 0 {
+		log.Printf("Showing the maintenance page for %d apps that aren't running", paused)
+	}
+
+	// A worker that stopped in the middle of a rollout left its route pinning the app's hostnames
+	if cleared, err := deploymentEngine.ClearStaleRollouts(ctx); err != nil {
+		log.Printf("Warning: failed to clear stale rollout routes: %v", err)
+	} else if cleared > 0 {
+		log.Printf("Removed %d rollout routes left behind by interrupted rollouts", cleared)
+	}
+
+	// Periodically delete repository clones left behind by finished or old deployments
+	go runRepoCleanup(ctx, deploymentEngine, cloner, cfg.RepoCleanupInterval, cfg.RepoMaxAge)
+
+	// Periodically check that running deployments' containers are really up
+	go runReconcile(ctx, deploymentEngine, cfg.ReconcileInterval)
+
+	// Periodically check that running apps still answer their health check
+	if cfg.LivenessFailures > 0 {
+		go runLiveness(ctx, deploymentEngine, cfg.LivenessInterval)
+	}
+
 	// Start the deployment processing loop
 	// This will run until the context is cancelled (e.g., on SIGTERM)
 	// The loop continuously polls for pending deployments and processes them
 	deploymentEngine.RunLoop(ctx)
 }
 
+// runRepoCleanup removes repository clones of finished deployments, and any clone older than
+// maxAge, every interval until ctx is cancelled. Old deployments outside the retention are
+// purged on the same schedule.
+func runRepoCleanup(ctx context.Context, deploymentEngine *engine.Engine, cloner *gitrepo.Cloner, interval, maxAge time.Duration) {
+	log.Printf("Repository cleanup started (interval %s, max age %s)", interval, maxAge)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if swept, err := deploymentEngine.SweepRepos(ctx); err != nil {
+				log.Printf("Warning: repository sweep: %v", err)
+			} else if swept > 0 {
+				log.Printf("Removed %d repository clones of finished deployments", swept)
+			}
+
+			if purged, err := deploymentEngine.PurgeDeployments(ctx); err != nil {
+				log.Printf("Warning: deployment purge: %v", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d deployments outside the retention", purged)
+			}
+
+			removed, reclaimed, err := cloner.RemoveStale(maxAge)
+			if err != nil {
+				log.Printf("Warning: repository cleanup: %v", err)
+			}
+			if removed > 0 {
+				log.Printf("Removed %d stale repository clones, reclaimed %.1f MB", removed, float64(reclaimed)/(1<<20))
+			}
+		}
+	}
+}
+
+// runReconcile repairs drift between running deployments and their containers every interval,
+// then updates the maintenance routes to match and removes rollout routes left behind, until
+// ctx is cancelled.
+func runReconcile(ctx context.Context, deploymentEngine *engine.Engine, interval time.Duration) {
+	log.Printf("Reconciler started (interval %s)", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			drifted, err := deploymentEngine.Reconcile(ctx)
+			if err != nil {
+				log.Printf("Warning: reconcile: %v", err)
+			} else if drifted > 0 {
+				log.Printf("Reconciled %d deployments whose containers were no longer running", drifted)
+			}
+			if _, err := deploymentEngine.SyncMaintenance(ctx); err != nil {
+				log.Printf("Warning: maintenance routes: %v", err)
+			}
+			if _, err := deploymentEngine.ClearStaleRollouts(ctx); err != nil {
+				log.Printf("Warning: rollout routes: %v", err)
+			}
+		}
+	}
+}
+
+// runLiveness probes running apps every interval, restarting those that stopped answering,
+// until ctx is cancelled.
+func runLiveness(ctx context.Context, deploymentEngine *engine.Engine, interval time.Duration) {
+	log.Printf("Liveness checks started (interval %s)", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			restarted, err := deploymentEngine.CheckLiveness(ctx)
+			if err != nil {
+				log.Printf("Warning: liveness check: %v", err)
+			} else if restarted > 0 {
+				log.Printf("Restarted %d containers that failed their liveness checks", restarted)
+			}
+		}
+	}
+}
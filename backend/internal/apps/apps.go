@@ -3,8 +3,19 @@ package apps
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"path"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
+
+	"mvp-be/internal/db"
+	"mvp-be/internal/secrets"
 )
 
 type App struct {
@@ -18,44 +29,217 @@ type App struct {
 	Branch    string    `json:"branch"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+
+	// HealthCheckPath is the path probed after a deploy to confirm the app is up
+	HealthCheckPath string `json:"health_check_path,omitempty"`
+	// HealthCheckStatus is the HTTP status the probe must return; 0 accepts any response
+	HealthCheckStatus int `json:"health_check_status,omitempty"`
+
+	// BuildType is how the image is built: BuildTypeDockerfile or BuildTypeBuildpack
+	BuildType string `json:"build_type,omitempty"`
+	// ContextDir is the directory, relative to the repository root, the image is built from; empty for the root
+	ContextDir string `json:"context_dir"`
+	// DockerfilePath is the Dockerfile to build, relative to ContextDir
+	DockerfilePath string `json:"dockerfile_path,omitempty"`
+
+	// RolloutStrategy is how traffic moves to a new deployment: RolloutImmediate or RolloutGradual
+	RolloutStrategy string `json:"rollout_strategy,omitempty"`
+
+	// DesiredState is whether the owner wants the app up: DesiredStateRunning or DesiredStateStopped
+	DesiredState string `json:"desired_state,omitempty"`
+
+	// NotifyURL receives a signed webhook when a deployment becomes running or failed; empty disables it
+	NotifyURL string `json:"notify_url,omitempty"`
+	// NotifySecret is the HMAC key the webhooks are signed with
+	NotifySecret string `json:"-"`
+
+	// LogRetentionLines is how many runtime log lines are kept per deployment; 0 uses the platform's limit
+	LogRetentionLines int `json:"log_retention_lines"`
+
+	// Submodules clones the repository's submodules along with it
+	Submodules bool `json:"submodules"`
+	// LFS downloads the repository's Git LFS files when cloning it
+	LFS bool `json:"lfs"`
+
+	// VolumePath is where the app's persistent volume is mounted in its containers; empty for none
+	VolumePath string `json:"volume_path,omitempty"`
+	// VolumeSizeMB is the size limit of the volume, in megabytes
+	VolumeSizeMB int `json:"volume_size_mb,omitempty"`
+
+	// Commit of the most recent running deployment, populated by the list queries only
+	CommitSHA     string `json:"commit_sha,omitempty"`
+	CommitMessage string `json:"commit_message,omitempty"`
+}
+
+// Build types
+const (
+	// BuildTypeDockerfile builds the image from the Dockerfile at the repository root
+	BuildTypeDockerfile = "dockerfile"
+	// BuildTypeBuildpack builds the image with Nixpacks from the detected language, no Dockerfile needed
+	BuildTypeBuildpack = "buildpack"
+)
+
+// IsValidBuildType reports whether t is a supported build type
+func IsValidBuildType(t string) bool {
+	return t == BuildTypeDockerfile || t == BuildTypeBuildpack
+}
+
+// Rollout strategies
+const (
+	// RolloutImmediate sends traffic to a new deployment as soon as it passes its health check
+	RolloutImmediate = "immediate"
+	// RolloutGradual first sends a small share of traffic to a new deployment, and the rest only
+	// after it passes a second health check
+	RolloutGradual = "gradual"
+)
+
+// IsValidRolloutStrategy reports whether s is a supported rollout strategy
+func IsValidRolloutStrategy(s string) bool {
+	return s == RolloutImmediate || s == RolloutGradual
+}
+
+// DefaultDockerfilePath is the Dockerfile built when an app doesn't name another one
+const DefaultDockerfilePath = "Dockerfile"
+
+// CleanRepoPath normalizes a path inside the repository (a context directory or Dockerfile path)
+// and rejects absolute paths and paths that leave the repository. "" and "." both mean the root and
+// are returned as "".
+func CleanRepoPath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(p, "/") || strings.Contains(p, "\\") {
+		return "", errors.New("must be a relative path inside the repository")
+	}
+	cleaned := path.Clean(p)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.New("must not leave the repository")
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
 }
 
+// CleanVolumePath normalizes the path a persistent volume is mounted at in the container.
+// It must be absolute and can't be the root; "" means no volume.
+func CleanVolumePath(p string) (string, error) {
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", errors.New("mount_path must be an absolute path")
+	}
+	cleaned := path.Clean(p)
+	if cleaned == "/" {
+		return "", errors.New("mount_path can't be the root directory")
+	}
+	return cleaned, nil
+}
+
+// Dockerfile returns the app's Dockerfile path relative to its context directory,
+// falling back to DefaultDockerfilePath
+func (a *App) Dockerfile() string {
+	if a.DockerfilePath == "" {
+		return DefaultDockerfilePath
+	}
+	return a.DockerfilePath
+}
+
+// Desired states
+const (
+	// DesiredStateRunning means the app should be serving traffic
+	DesiredStateRunning = "running"
+	// DesiredStateStopped means the owner stopped the app and its containers must stay down
+	DesiredStateStopped = "stopped"
+)
+
+// runningCommitJoin attaches the commit of each app's newest running deployment
+const runningCommitJoin = `
+       LEFT JOIN LATERAL (
+           SELECT commit_sha, commit_message FROM deployments
+           WHERE deployments.app_id = apps.id AND deployments.status = 'running'
+           ORDER BY created_at DESC LIMIT 1
+       ) d ON true`
+
 type Store struct {
-	db *sql.DB
+	db     db.Querier
+	cipher *secrets.Cipher
 }
 
-func NewStore(db *sql.DB) *Store {
-	return &Store{db: db}
+// NewStore creates a Store that encrypts build secrets with cipher. With a nil cipher build
+// secrets can be listed and deleted, but not set or read.
+func NewStore(db *sql.DB, cipher *secrets.Cipher) *Store {
+	return &Store{db: db, cipher: cipher}
 }
 
-func (s *Store) Create(name, repoURL, branch string) (*App, error) {
+// WithTx returns a Store whose queries run inside tx.
+func (s *Store) WithTx(tx *sql.Tx) *Store {
+	return &Store{db: tx, cipher: s.cipher}
+}
+
+// maxSlugAttempts bounds how many numeric suffixes Create tries before giving up
+const maxSlugAttempts = 100
+
+// Create inserts a new app owned by userID (empty for no owner) with a DNS-safe slug derived from its name.
+// Slugs name hostnames shared by all users, so if any other app already has that slug,
+// a numeric suffix is added ("my-app-2", "my-app-3", ...).
+// Returns ErrDuplicate if the name itself is already taken.
+func (s *Store) Create(ctx context.Context, userID, name, repoURL, branch string) (*App, error) {
 	log.Printf("Creating app with branch: '%s'", branch)
+	base := Slugify(name)
 	var app App
-	err := s.db.QueryRow(
-		"INSERT INTO apps (name, repo_url, branch) VALUES ($1, $2, $3) RETURNING id, name, repo_url, branch, COALESCE(url, '') as url, COALESCE(status, '') as status, created_at, updated_at",
-		name, repoURL, branch,
-	).Scan(&app.ID, &app.Name, &app.RepoURL, &app.Branch, &app.URL, &app.Status, &app.CreatedAt, &app.UpdatedAt)
-	if err != nil {
+	for attempt := 1; ; attempt++ {
+		// A slug clash skips the insert instead of raising an error,
+		// which would abort the surrounding transaction if there is one
+		slug := slugWithSuffix(base, attempt)
+		err := s.db.QueryRowContext(ctx,
+			"INSERT INTO apps (user_id, name, slug, repo_url, branch) VALUES (NULLIF($1, ''), $2, $3, $4, $5) ON CONFLICT (slug) DO NOTHING RETURNING id, COALESCE(user_id, ''), name, slug, repo_url, branch, COALESCE(url, '') as url, COALESCE(status, '') as status, created_at, updated_at",
+			userID, name, slug, repoURL, branch,
+		).Scan(&app.ID, &app.UserID, &app.Name, &app.Slug, &app.RepoURL, &app.Branch, &app.URL, &app.Status, &app.CreatedAt, &app.UpdatedAt)
+		if err == nil {
+			break
+		}
+		if err == sql.ErrNoRows {
+			if attempt >= maxSlugAttempts {
+				return nil, ErrDuplicate
+			}
+			continue
+		}
+
+		// The only other unique constraint is the app name
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, ErrDuplicate
+		}
 		return nil, err
 	}
 	log.Printf("App created with ID: %s, branch saved as: '%s'", app.ID, app.Branch)
 	return &app, nil
 }
 
-func (s *Store) GetByID(id int) (*App, error) {
+func (s *Store) GetByID(ctx context.Context, id int) (*App, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
 	var app App
-	err := s.db.QueryRow(
-		"SELECT id, name, COALESCE(slug, '') as slug, COALESCE(status, '') as status, COALESCE(url, '') as url, repo_url, COALESCE(branch, '') as branch, created_at, updated_at FROM apps WHERE id = $1",
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id, COALESCE(user_id, '') as user_id, name, COALESCE(slug, '') as slug, COALESCE(status, '') as status, COALESCE(url, '') as url, repo_url, COALESCE(branch, '') as branch, health_check_path, COALESCE(health_check_status, 0), build_type, context_dir, dockerfile_path, rollout_strategy, desired_state, COALESCE(notify_url, ''), COALESCE(notify_secret, ''), log_retention_lines, volume_path, volume_size_mb, clone_submodules, clone_lfs, created_at, updated_at FROM apps WHERE id = $1",
 		id,
-	).Scan(&app.ID, &app.Name, &app.Slug, &app.Status, &app.URL, &app.RepoURL, &app.Branch, &app.CreatedAt, &app.UpdatedAt)
+	).Scan(&app.ID, &app.UserID, &app.Name, &app.Slug, &app.Status, &app.URL, &app.RepoURL, &app.Branch, &app.HealthCheckPath, &app.HealthCheckStatus, &app.BuildType, &app.ContextDir, &app.DockerfilePath, &app.RolloutStrategy, &app.DesiredState, &app.NotifyURL, &app.NotifySecret, &app.LogRetentionLines, &app.VolumePath, &app.VolumeSizeMB, &app.Submodules, &app.LFS, &app.CreatedAt, &app.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 	return &app, nil
 }
 
-func (s *Store) List() ([]*App, error) {
-	rows, err := s.db.Query("SELECT id, name, COALESCE(slug, '') as slug, repo_url, COALESCE(branch, '') as branch, COALESCE(url, '') as url, COALESCE(status, '') as status, created_at, updated_at FROM apps ORDER BY created_at DESC")
+func (s *Store) List(ctx context.Context) ([]*App, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT apps.id, name, COALESCE(slug, '') as slug, repo_url, COALESCE(branch, '') as branch, COALESCE(url, '') as url, COALESCE(apps.status, '') as status, apps.created_at, apps.updated_at, COALESCE(d.commit_sha, ''), COALESCE(d.commit_message, '') FROM apps"+runningCommitJoin+" ORDER BY apps.created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +248,7 @@ func (s *Store) List() ([]*App, error) {
 	var apps []*App
 	for rows.Next() {
 		var app App
-		if err := rows.Scan(&app.ID, &app.Name, &app.Slug, &app.RepoURL, &app.Branch, &app.URL, &app.Status, &app.CreatedAt, &app.UpdatedAt); err != nil {
+		if err := rows.Scan(&app.ID, &app.Name, &app.Slug, &app.RepoURL, &app.Branch, &app.URL, &app.Status, &app.CreatedAt, &app.UpdatedAt, &app.CommitSHA, &app.CommitMessage); err != nil {
 			return nil, err
 		}
 		apps = append(apps, &app)
@@ -72,23 +256,30 @@ func (s *Store) List() ([]*App, error) {
 	return apps, rows.Err()
 }
 
-func (s *Store) Delete(id int) error {
-	_, err := s.db.Exec("DELETE FROM apps WHERE id = $1", id)
+func (s *Store) Delete(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM apps WHERE id = $1", id)
 	return err
 }
 
 // UpdateStatus updates the status of an app
-func (s *Store) UpdateStatus(id int, status string) error {
-	_, err := s.db.Exec(
+func (s *Store) UpdateStatus(ctx context.Context, id int, status string) error {
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE apps SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
 		status, id,
 	)
 	return err
 }
 
+// Lock locks the app's row until the transaction the store is bound to (see WithTx) ends,
+// so concurrent changes to the app's deployments run one after the other
+func (s *Store) Lock(ctx context.Context, id int) error {
+	var locked int
+	return s.db.QueryRowContext(ctx, "SELECT id FROM apps WHERE id = $1 FOR UPDATE", id).Scan(&locked)
+}
+
 // UpdateURL updates the URL of an app
-func (s *Store) UpdateURL(id int, url string) error {
-	_, err := s.db.Exec(
+func (s *Store) UpdateURL(ctx context.Context, id int, url string) error {
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE apps SET url = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
 		url, id,
 	)
@@ -96,28 +287,339 @@ func (s *Store) UpdateURL(id int, url string) error {
 }
 
 // UpdateStatusAndURL updates both status and URL of an app
-func (s *Store) UpdateStatusAndURL(id int, status, url string) error {
-	_, err := s.db.Exec(
+func (s *Store) UpdateStatusAndURL(ctx context.Context, id int, status, url string) error {
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE apps SET status = $1, url = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
 		status, url, id,
 	)
 	return err
 }
 
+// UpdateHealthCheck sets the path and expected status code used to health-check an app.
+// An expectedStatus of 0 accepts any HTTP response.
+func (s *Store) UpdateHealthCheck(ctx context.Context, id int, path string, expectedStatus int) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET health_check_path = $1, health_check_status = NULLIF($2, 0), updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		path, expectedStatus, id,
+	)
+	return err
+}
+
+// UpdateBuildType sets how an app's image is built (see BuildTypeDockerfile, BuildTypeBuildpack).
+func (s *Store) UpdateBuildType(ctx context.Context, id int, buildType string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET build_type = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		buildType, id,
+	)
+	return err
+}
+
+// UpdateBuildContext sets the directory an app is built from and the Dockerfile within it.
+// Both must already be cleaned with CleanRepoPath.
+func (s *Store) UpdateBuildContext(ctx context.Context, id int, contextDir, dockerfilePath string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET context_dir = $1, dockerfile_path = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		contextDir, dockerfilePath, id,
+	)
+	return err
+}
+
+// UpdateSource sets the repository and branch an app is deployed from.
+func (s *Store) UpdateSource(ctx context.Context, id int, repoURL, branch string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET repo_url = $1, branch = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		repoURL, branch, id,
+	)
+	return err
+}
+
+// UpdateRolloutStrategy sets how traffic moves to an app's new deployments (see RolloutImmediate, RolloutGradual).
+func (s *Store) UpdateRolloutStrategy(ctx context.Context, id int, strategy string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET rollout_strategy = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		strategy, id,
+	)
+	return err
+}
+
+// UpdateLogRetention sets how many runtime log lines are kept per deployment of an app;
+// 0 uses the platform's limit.
+func (s *Store) UpdateLogRetention(ctx context.Context, id int, lines int) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET log_retention_lines = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		lines, id,
+	)
+	return err
+}
+
+// UpdateCloneOptions sets whether an app's repository is cloned with its submodules and its
+// Git LFS files.
+func (s *Store) UpdateCloneOptions(ctx context.Context, id int, submodules, lfs bool) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET clone_submodules = $1, clone_lfs = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		submodules, lfs, id,
+	)
+	return err
+}
+
+// UpdateVolume sets where an app's persistent volume is mounted and its size limit in megabytes;
+// an empty path detaches the volume from new containers.
+func (s *Store) UpdateVolume(ctx context.Context, id int, path string, sizeMB int) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET volume_path = $1, volume_size_mb = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		path, sizeMB, id,
+	)
+	return err
+}
+
+// UpdateDesiredState records whether the owner wants the app running or stopped
+// (see DesiredStateRunning, DesiredStateStopped).
+func (s *Store) UpdateDesiredState(ctx context.Context, id int, state string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET desired_state = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		state, id,
+	)
+	return err
+}
+
+// UpdateNotify sets the webhook URL notified about deployment status changes and its signing secret.
+// An empty url disables notifications.
+func (s *Store) UpdateNotify(ctx context.Context, id int, url, secret string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET notify_url = NULLIF($1, ''), notify_secret = NULLIF($2, ''), updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		url, secret, id,
+	)
+	return err
+}
+
+// ListIDsByDesiredState returns the IDs of all apps with the given desired state.
+func (s *Store) ListIDsByDesiredState(ctx context.Context, state string) ([]int, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM apps WHERE desired_state = $1 ORDER BY id", state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetBuildArgs returns the Docker build arguments configured for an app.
+// Returns an empty map if none are set.
+func (s *Store) GetBuildArgs(ctx context.Context, id int) (map[string]string, error) {
+	var raw []byte
+	if err := s.db.QueryRowContext(ctx, "SELECT build_args FROM apps WHERE id = $1", id).Scan(&raw); err != nil {
+		return nil, err
+	}
+	args := map[string]string{}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// SetBuildArg creates or replaces a single build argument on an app
+func (s *Store) SetBuildArg(ctx context.Context, id int, key, value string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET build_args = build_args || jsonb_build_object($1::text, $2::text), updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		key, value, id,
+	)
+	return err
+}
+
+// DeleteBuildArg removes a build argument from an app.
+// Returns sql.ErrNoRows if the app has no argument with that key.
+func (s *Store) DeleteBuildArg(ctx context.Context, id int, key string) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET build_args = build_args - $1::text, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND build_args ? $1::text",
+		key, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// BuildSecretsEnabled reports whether build secrets can be set and read.
+func (s *Store) BuildSecretsEnabled() bool {
+	return s.cipher != nil
+}
+
+// buildSecretAdditional is the data a build secret's ciphertext is bound to: its app and key.
+// The prefix keeps it from being swapped with the app's runtime secret of the same name.
+func buildSecretAdditional(id int, key string) string {
+	return fmt.Sprintf("build/%d/%s", id, key)
+}
+
+// GetBuildSecrets returns the build secrets configured for an app with their decrypted values,
+// keyed by secret ID. Returns an empty map if none are set.
+func (s *Store) GetBuildSecrets(ctx context.Context, id int) (map[string]string, error) {
+	var raw []byte
+	var encrypted bool
+	if err := s.db.QueryRowContext(ctx,
+		"SELECT build_secrets, build_secrets_encrypted FROM apps WHERE id = $1", id,
+	).Scan(&raw, &encrypted); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		// Stored before build secrets were encrypted, and not yet migrated (see EncryptBuildSecrets)
+		return values, nil
+	}
+	for key, value := range values {
+		decrypted, err := s.cipher.Decrypt(value, buildSecretAdditional(id, key))
+		if err != nil {
+			return nil, fmt.Errorf("build secret %s: %w", key, err)
+		}
+		values[key] = decrypted
+	}
+	return values, nil
+}
+
+// ListBuildSecrets returns the IDs of an app's build secrets, sorted, without their values.
+func (s *Store) ListBuildSecrets(ctx context.Context, id int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	var raw []byte
+	if err := s.db.QueryRowContext(ctx, "SELECT build_secrets FROM apps WHERE id = $1", id).Scan(&raw); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// SetBuildSecret creates or replaces a single build secret on an app, encrypted.
+// Returns secrets.ErrNoKey if the Store has no cipher.
+func (s *Store) SetBuildSecret(ctx context.Context, id int, key, value string) error {
+	encrypted, err := s.cipher.Encrypt(value, buildSecretAdditional(id, key))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE apps SET build_secrets = build_secrets || jsonb_build_object($1::text, $2::text), updated_at = CURRENT_TIMESTAMP WHERE id = $3 AND build_secrets_encrypted",
+		key, encrypted, id,
+	)
+	return err
+}
+
+// EncryptBuildSecrets encrypts the build secrets stored in plaintext before they were
+// encrypted. It runs at startup, is a no-op once every app's secrets are encrypted, and
+// may run in the API and the worker at the same time.
+//
+// Returns:
+//   - int: The number of apps whose build secrets were encrypted
+//   - error: secrets.ErrNoKey if there are plaintext secrets but the Store has no cipher
+func (s *Store) EncryptBuildSecrets(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, build_secrets FROM apps WHERE NOT build_secrets_encrypted")
+	if err != nil {
+		return 0, err
+	}
+	plaintext := map[int]map[string]string{}
+	for rows.Next() {
+		var id int
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values := map[string]string{}
+		if err := json.Unmarshal(raw, &values); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plaintext[id] = values
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(plaintext) > 0 && s.cipher == nil {
+		return 0, secrets.ErrNoKey
+	}
+
+	encrypted := 0
+	for id, values := range plaintext {
+		for key, value := range values {
+			if values[key], err = s.cipher.Encrypt(value, buildSecretAdditional(id, key)); err != nil {
+				return encrypted, err
+			}
+		}
+		raw, err := json.Marshal(values)
+		if err != nil {
+			return encrypted, err
+		}
+		// Another process may have encrypted them first
+		result, err := s.db.ExecContext(ctx,
+			"UPDATE apps SET build_secrets = $1, build_secrets_encrypted = TRUE WHERE id = $2 AND NOT build_secrets_encrypted",
+			raw, id,
+		)
+		if err != nil {
+			return encrypted, err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			encrypted++
+		}
+	}
+	return encrypted, nil
+}
+
+// DeleteBuildSecret removes a build secret from an app.
+// Returns sql.ErrNoRows if the app has no secret with that key.
+func (s *Store) DeleteBuildSecret(ctx context.Context, id int, key string) error {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE apps SET build_secrets = build_secrets - $1::text, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND build_secrets ? $1::text",
+		key, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 // ListAppsByUserID queries all apps owned by the given user_id, ordered by created_at DESC.
 // Returns an empty slice if no apps are found.
 // SQL Query:
 //
-//	SELECT id, user_id, name, slug, status, url, repo_url, branch, created_at, updated_at
+//	SELECT id, user_id, name, slug, status, url, repo_url, branch, created_at, updated_at, commit_sha, commit_message
 //	FROM apps
+//	LEFT JOIN LATERAL (newest running deployment) d ON true
 //	WHERE user_id = $1
 //	ORDER BY created_at DESC
 func (s *Store) ListAppsByUserID(ctx context.Context, userID string) ([]App, error) {
 	query := `
-       SELECT id, user_id, name, COALESCE(slug, '') as slug, COALESCE(status, '') as status, COALESCE(url, '') as url, repo_url, COALESCE(branch, '') as branch, created_at, updated_at
-       FROM apps
+       SELECT apps.id, user_id, name, COALESCE(slug, '') as slug, COALESCE(apps.status, '') as status, COALESCE(url, '') as url, repo_url, COALESCE(branch, '') as branch, apps.created_at, apps.updated_at,
+              COALESCE(d.commit_sha, ''), COALESCE(d.commit_message, '')
+       FROM apps` + runningCommitJoin + `
        WHERE user_id = $1
-       ORDER BY created_at DESC
+       ORDER BY apps.created_at DESC
    `
 
 	rows, err := s.db.QueryContext(ctx, query, userID)
@@ -140,6 +642,8 @@ func (s *Store) ListAppsByUserID(ctx context.Context, userID string) ([]App, err
 			&app.Branch,
 			&app.CreatedAt,
 			&app.UpdatedAt,
+			&app.CommitSHA,
+			&app.CommitMessage,
 		); err != nil {
 			return nil, err
 		}
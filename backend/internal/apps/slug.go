@@ -0,0 +1,74 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxNameLength is the longest allowed app name. Slugs are used as DNS labels,
+// which are limited to 63 characters.
+const maxNameLength = 63
+
+// namePattern allows letters, digits, spaces, hyphens and underscores,
+// starting with a letter or digit
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 _-]*$`)
+
+// nonSlugChars matches runs of characters that are not allowed in a slug
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// ErrDuplicate is returned when an app with the same name already exists
+var ErrDuplicate = errors.New("an app with this name already exists")
+
+// ValidateName checks that an app name uses allowed characters and length
+// and that it produces a non-empty slug.
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("name is required")
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxNameLength)
+	}
+	if !namePattern.MatchString(name) {
+		return errors.New("name may only contain letters, digits, spaces, hyphens and underscores, and must start with a letter or digit")
+	}
+	if Slugify(name) == "" {
+		return errors.New("name must contain at least one letter or digit")
+	}
+	return nil
+}
+
+// Slugify converts an app name into a DNS-safe slug: lowercase letters, digits
+// and single hyphens, with no leading or trailing hyphen, at most 63 characters.
+// For example "My App_2" becomes "my-app-2".
+func Slugify(name string) string {
+	slug := nonSlugChars.ReplaceAllString(strings.ToLower(name), "-")
+	slug = strings.Trim(slug, "-")
+	if len(slug) > maxNameLength {
+		slug = strings.TrimRight(slug[:maxNameLength], "-")
+	}
+	return slug
+}
+
+// slugWithSuffix returns base for the first attempt and base-N for attempt N,
+// shortening base so the result still fits in a DNS label.
+func slugWithSuffix(base string, attempt int) string {
+	if attempt <= 1 {
+		return base
+	}
+	suffix := fmt.Sprintf("-%d", attempt)
+	if len(base)+len(suffix) > maxNameLength {
+		base = strings.TrimRight(base[:maxNameLength-len(suffix)], "-")
+	}
+	return base + suffix
+}
+
+// EffectiveSlug returns the app's stored slug, deriving one from the name for
+// apps created before slugs were stored.
+func (a *App) EffectiveSlug() string {
+	if a.Slug != "" {
+		return a.Slug
+	}
+	return Slugify(a.Name)
+}
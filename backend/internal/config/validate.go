@@ -0,0 +1,207 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"mvp-be/internal/dockerhost"
+	"mvp-be/internal/imagepolicy"
+	"mvp-be/internal/secrets"
+)
+
+// IsProduction reports whether the configuration is for a production deployment
+func (c *Config) IsProduction() bool {
+	return c.Env == EnvProduction
+}
+
+// MustValidate logs the warnings of Validate and exits if the configuration can't be used.
+// The API and the worker call it at startup.
+func (c *Config) MustValidate() {
+	warnings, err := c.Validate()
+	for _, w := range warnings {
+		log.Printf("Warning: %s", w)
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration (ENV=%s):\n%v", c.Env, err)
+	}
+}
+
+// VolumesEnabled reports whether apps may have persistent volumes: VolumeMaxSizeMB is set and
+// VolumeDriver can cap a volume's size, which the built-in "local" driver can't.
+func (c *Config) VolumesEnabled() bool {
+	return c.VolumeMaxSizeMB > 0 && c.VolumeDriver != "" && c.VolumeDriver != "local"
+}
+
+// TrustedProxyPrefixes parses TrustedProxies. A single IP is a prefix of its full length.
+func (c *Config) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(c.TrustedProxies))
+	for _, proxy := range c.TrustedProxies {
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Validate checks the configuration for values the API and worker can't run with.
+// Outright invalid values (an unknown ENV, a variable that doesn't parse, such as a duration
+// without a unit, a non-positive interval) are always errors.
+// Insecure or development defaults (the default database password, an empty or localhost
+// base domain, CORS open to every origin) are errors in production and warnings otherwise,
+// so a misconfigured production deployment fails at startup instead of running insecurely.
+//
+// Returns:
+//   - []string: Problems worth logging that don't stop startup
+//   - error: All problems that must stop startup, joined; nil if there are none
+func (c *Config) Validate() (warnings []string, err error) {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	// insecure is an error in production and a warning everywhere else
+	insecure := func(format string, args ...interface{}) {
+		if c.IsProduction() {
+			invalid(format, args...)
+		} else {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+	}
+
+	// A typo would silently turn off every production check
+	if c.Env != EnvDevelopment && c.Env != EnvProduction {
+		invalid("ENV must be %q or %q, got %q", EnvDevelopment, EnvProduction, c.Env)
+	}
+	errs = append(errs, c.parseErrors...)
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		invalid("PORT must be a port number between 1 and 65535, got %q", c.Port)
+	}
+
+	if u, err := url.Parse(c.DatabaseURL); err != nil || u.Host == "" {
+		invalid("DATABASE_URL is not a valid connection URL")
+	} else if c.DatabaseURL == defaultDatabaseURL {
+		insecure("DATABASE_URL is the built-in development default, with a publicly known password")
+	}
+
+	if err := dockerhost.Validate(c.DockerHost); err != nil {
+		invalid("DOCKER_HOST: %v", err)
+	} else if dockerhost.IsUnencryptedTCP(c.DockerHost) {
+		// Not fatal: a TCP socket on a private network is a deliberate, if risky, setup
+		warnings = append(warnings, fmt.Sprintf("DOCKER_HOST %s is an unencrypted, unauthenticated TCP socket: "+
+			"anyone who can reach it can run containers as root on that host. Prefer %s", c.DockerHost, dockerhost.Default))
+	}
+
+	switch c.BaseDomain {
+	case "":
+		insecure("BASE_DOMAIN is empty; apps would get no reachable URL")
+	case "localhost":
+		insecure("BASE_DOMAIN is localhost; apps are only reachable from this machine")
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			insecure("ALLOWED_ORIGINS allows every origin; set it to the frontend's origin")
+			break
+		}
+	}
+
+	if c.VolumeMaxSizeMB > 0 && !c.VolumesEnabled() {
+		warnings = append(warnings, fmt.Sprintf("VOLUME_DRIVER %q can't limit volume sizes; persistent volumes are disabled", c.VolumeDriver))
+	}
+
+	if c.ExecEnabled {
+		// Nothing in the API authenticates requests: handlers only read a user that an upstream
+		// layer may put in the request context, and a shell must never be open to anonymous callers
+		invalid("EXEC_ENABLED needs user authentication, which the API doesn't have; shell access can't be enabled")
+		explicit := false
+		for _, origin := range c.AllowedOrigins {
+			if origin != "*" {
+				explicit = true
+			}
+		}
+		// The shell's origin check ignores "*", so no browser could use it anyway
+		if !explicit {
+			invalid("EXEC_ENABLED needs ALLOWED_ORIGINS to list the frontend's origins; \"*\" is not accepted for shell access")
+		}
+	}
+
+	if _, err := c.TrustedProxyPrefixes(); err != nil {
+		invalid("TRUSTED_PROXIES: %v", err)
+	}
+
+	// Tickers panic on non-positive intervals
+	for name, d := range map[string]time.Duration{
+		"METRICS_INTERVAL":      c.MetricsInterval,
+		"REPO_CLEANUP_INTERVAL": c.RepoCleanupInterval,
+		"RECONCILE_INTERVAL":    c.ReconcileInterval,
+		"LIVENESS_INTERVAL":     c.LivenessInterval,
+		"CLONE_TIMEOUT":         c.CloneTimeout,
+		"POLL_INTERVAL":         c.PollInterval,
+	} {
+		if d <= 0 {
+			invalid("%s must be positive, got %s", name, d)
+		}
+	}
+	if c.PollMaxInterval < c.PollInterval {
+		invalid("POLL_MAX_INTERVAL must be at least POLL_INTERVAL (%s), got %s", c.PollInterval, c.PollMaxInterval)
+	}
+
+	for name, n := range map[string]int{
+		"HEALTHCHECK_RETRIES":             c.HealthCheckRetries,
+		"DEPLOY_MAX_RETRIES":              c.DeployMaxRetries,
+		"LOG_MAX_BYTES":                   c.LogMaxBytes,
+		"MAX_ACTIVE_DEPLOYMENTS_PER_USER": c.MaxActiveDeploymentsPerUser,
+		"RATE_LIMIT_READ":                 c.RateLimitRead,
+		"RATE_LIMIT_WRITE":                c.RateLimitWrite,
+		"RATE_LIMIT_DEPLOY":               c.RateLimitDeploy,
+		"VOLUME_MAX_SIZE_MB":              c.VolumeMaxSizeMB,
+		"DEPLOYMENT_KEEP_LAST":            c.DeploymentKeepLast,
+		"CRASH_LOOP_RESTARTS":             c.CrashLoopRestarts,
+		"RUNTIME_LOG_LINES":               c.RuntimeLogLines,
+		"LIVENESS_FAILURES":               c.LivenessFailures,
+	} {
+		if n < 0 {
+			invalid("%s must not be negative, got %d", name, n)
+		}
+	}
+	if c.DBMaxOpenConns < 1 {
+		invalid("DB_MAX_OPEN_CONNS must be at least 1, got %d", c.DBMaxOpenConns)
+	}
+
+	imagePolicy := imagepolicy.Policy{Allow: c.BaseImageAllow, Deny: c.BaseImageDeny}
+	if err := imagePolicy.Validate(); err != nil {
+		invalid("BASE_IMAGE_ALLOW/BASE_IMAGE_DENY: %v", err)
+	}
+
+	// A canary share of 0 or 100 would not be gradual at all
+	if c.RolloutCanaryPercent < 1 || c.RolloutCanaryPercent > 99 {
+		invalid("ROLLOUT_CANARY_PERCENT must be between 1 and 99, got %d", c.RolloutCanaryPercent)
+	}
+
+	if c.MaintenancePageURL != "" {
+		if u, err := url.Parse(c.MaintenancePageURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("MAINTENANCE_PAGE_URL must be an http(s) URL, got %q", c.MaintenancePageURL)
+		} else if c.TraefikDynamicDir == "" {
+			warnings = append(warnings, "MAINTENANCE_PAGE_URL is set but TRAEFIK_DYNAMIC_DIR is not; stopped apps won't show the page")
+		}
+	}
+
+	if c.SecretsKey != "" {
+		if _, err := secrets.NewCipher(c.SecretsKey); err != nil {
+			invalid("SECRETS_KEY: %v", err)
+		}
+	}
+
+	return warnings, errors.Join(errs...)
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// listenMinReconnect and listenMaxReconnect bound the wait between attempts to re-establish
+// a lost listening connection
+const (
+	listenMinReconnect = time.Second
+	listenMaxReconnect = time.Minute
+)
+
+// listenPingInterval is how often an idle listening connection is checked, so a dead one is
+// noticed and re-established
+const listenPingInterval = 90 * time.Second
+
+// Listen subscribes to a Postgres notification channel on a dedicated connection and returns
+// a channel that receives a value whenever a notification arrives, until ctx is cancelled.
+// Notifications that arrive while the previous one is unread are merged into it. The connection
+// is re-established after it is lost, and the returned channel also receives a value then,
+// since notifications sent in the meantime are gone.
+//
+// Parameters:
+//   - ctx: Stops listening and closes the connection when cancelled
+//   - databaseURL: PostgreSQL connection string, as for New
+//   - channel: The notification channel to LISTEN on
+//
+// Returns:
+//   - <-chan struct{}: Receives a value per notification (or reconnect)
+func Listen(ctx context.Context, databaseURL, channel string) <-chan struct{} {
+	wake := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	listener := pq.NewListener(databaseURL, listenMinReconnect, listenMaxReconnect, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Printf("Warning: lost the connection listening on %s: %v", channel, err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("Warning: failed to connect to listen on %s: %v", channel, err)
+		case pq.ListenerEventReconnected:
+			log.Printf("Listening on %s again", channel)
+		}
+	})
+
+	go func() {
+		defer listener.Close()
+
+		// Listen blocks until connected, which may be a while if the database is down
+		listening := make(chan error, 1)
+		go func() { listening <- listener.Listen(channel) }()
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-listening:
+			if err != nil {
+				log.Printf("Warning: failed to listen on %s: %v", channel, err)
+				return
+			}
+		}
+		log.Printf("Listening on %s", channel)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.NotificationChannel():
+				// A nil notification means the connection was re-established
+				signal()
+			case <-time.After(listenPingInterval):
+				go listener.Ping()
+			}
+		}
+	}()
+	return wake
+}
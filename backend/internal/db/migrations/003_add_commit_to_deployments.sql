@@ -0,0 +1,4 @@
+-- Track the requested commit and the resolved commit SHA for each deployment
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS commit VARCHAR(64),
+ADD COLUMN IF NOT EXISTS commit_sha VARCHAR(64);
@@ -0,0 +1,3 @@
+-- Store the subject line of the deployed commit
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS commit_message TEXT;
@@ -0,0 +1,13 @@
+-- Periodic resource usage samples for running containers
+CREATE TABLE IF NOT EXISTS usage_samples (
+    id BIGSERIAL PRIMARY KEY,
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    deployment_id INTEGER NOT NULL REFERENCES deployments(id) ON DELETE CASCADE,
+    memory_bytes BIGINT NOT NULL,
+    cpu_percent DOUBLE PRECISION NOT NULL,
+    disk_bytes BIGINT NOT NULL,
+    sampled_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_samples_app_id_sampled_at ON usage_samples(app_id, sampled_at);
+CREATE INDEX IF NOT EXISTS idx_usage_samples_sampled_at ON usage_samples(sampled_at);
@@ -0,0 +1,4 @@
+-- Record how a deployment's container exited when it dies after startup
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS exit_code INTEGER,
+ADD COLUMN IF NOT EXISTS oom_killed BOOLEAN;
@@ -0,0 +1,5 @@
+-- Per-app health check configuration
+-- health_check_status NULL means any HTTP response is accepted
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS health_check_path VARCHAR(255) NOT NULL DEFAULT '/',
+ADD COLUMN IF NOT EXISTS health_check_status INTEGER;
@@ -0,0 +1,4 @@
+-- Retry tracking for deployments that fail with transient errors
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS retry_count INTEGER NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP;
@@ -0,0 +1,3 @@
+-- Docker build arguments (ARG values) passed to every image build of an app
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS build_args JSONB NOT NULL DEFAULT '{}'::jsonb;
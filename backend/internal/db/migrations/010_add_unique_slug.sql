@@ -0,0 +1,19 @@
+-- Slugs name the hostnames, Traefik routers and containers of apps, which every user shares,
+-- so they must be unique across the platform, not just per user.
+
+-- Apps from before slugs were stored are served at a slug derived from their name (see
+-- App.EffectiveSlug), which the index wouldn't cover, so store it first
+UPDATE apps SET slug = COALESCE(NULLIF(RTRIM(LEFT(TRIM(BOTH '-' FROM regexp_replace(lower(name), '[^a-z0-9]+', '-', 'g')), 63), '-'), ''), 'app')
+WHERE slug IS NULL OR slug = '';
+
+-- Apps that share an older app's slug get {slug}-{id} instead and move to that hostname
+-- with their next deployment
+UPDATE apps SET slug = RTRIM(LEFT(slug, 62 - LENGTH(id::text)), '-') || '-' || id
+WHERE id IN (
+    SELECT id FROM (
+        SELECT id, ROW_NUMBER() OVER (PARTITION BY slug ORDER BY created_at, id) AS n
+        FROM apps
+    ) ranked WHERE n > 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_apps_slug ON apps (slug);
@@ -0,0 +1,3 @@
+-- How an app's image is built: from its Dockerfile, or by Nixpacks from the detected language
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS build_type VARCHAR(20) NOT NULL DEFAULT 'dockerfile';
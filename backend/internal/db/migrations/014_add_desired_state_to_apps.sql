@@ -0,0 +1,4 @@
+-- Whether the owner wants the app up ('running') or deliberately stopped ('stopped').
+-- The worker uses it to keep stopped apps down after Docker restarts their containers.
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS desired_state VARCHAR(20) NOT NULL DEFAULT 'running';
@@ -0,0 +1,5 @@
+-- Webhook notified when a deployment of the app becomes running or failed,
+-- and the secret its payloads are signed with
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS notify_url TEXT,
+ADD COLUMN IF NOT EXISTS notify_secret TEXT;
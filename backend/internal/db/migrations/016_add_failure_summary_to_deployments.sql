@@ -0,0 +1,3 @@
+-- One-line reason a build failed, including the Dockerfile step, extracted from the build log
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS failure_summary TEXT;
@@ -0,0 +1,6 @@
+-- Where in the repository an app is built from, so several apps can be deployed from one monorepo.
+-- context_dir is relative to the repository root ('' = root);
+-- dockerfile_path is relative to context_dir.
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS context_dir TEXT NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS dockerfile_path TEXT NOT NULL DEFAULT 'Dockerfile';
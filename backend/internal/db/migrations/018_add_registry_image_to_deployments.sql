@@ -0,0 +1,4 @@
+-- Registry reference a deployment's image was pushed as (NULL when no registry is configured),
+-- so a host that didn't build the image can pull it
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS registry_image TEXT;
@@ -0,0 +1,3 @@
+-- How traffic moves to a new deployment: all at once, or a small share first
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS rollout_strategy VARCHAR(20) NOT NULL DEFAULT 'immediate';
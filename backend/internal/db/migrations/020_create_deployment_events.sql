@@ -0,0 +1,10 @@
+-- Steps a deployment went through, for a progress timeline
+CREATE TABLE IF NOT EXISTS deployment_events (
+    id BIGSERIAL PRIMARY KEY,
+    deployment_id INTEGER NOT NULL REFERENCES deployments(id) ON DELETE CASCADE,
+    event VARCHAR(50) NOT NULL,
+    message TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_deployment_events_deployment_id ON deployment_events(deployment_id, created_at);
@@ -0,0 +1,3 @@
+-- Whether a deployment was asked to build without reusing cached layers
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS no_cache BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,3 @@
+-- Secrets mounted into an app's image builds (RUN --mount=type=secret), kept out of the image's layers
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS build_secrets JSONB NOT NULL DEFAULT '{}'::jsonb;
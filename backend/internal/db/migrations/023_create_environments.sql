@@ -0,0 +1,19 @@
+-- Named targets an app is deployed to besides production (e.g. staging), each with its own
+-- branch, runtime environment variables and subdomain. Production needs no row; one only
+-- stores its environment variables.
+CREATE TABLE IF NOT EXISTS environments (
+    id SERIAL PRIMARY KEY,
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    name VARCHAR(20) NOT NULL,
+    branch VARCHAR(255) NOT NULL DEFAULT '',
+    env_vars JSONB NOT NULL DEFAULT '{}'::jsonb,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (app_id, name)
+);
+
+-- Existing deployments all went to production
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS environment VARCHAR(20) NOT NULL DEFAULT 'production';
+
+CREATE INDEX IF NOT EXISTS idx_deployments_app_id_environment ON deployments(app_id, environment);
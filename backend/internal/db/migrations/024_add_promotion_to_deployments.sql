@@ -0,0 +1,6 @@
+-- A promoted deployment runs the image of another environment's deployment instead of building one;
+-- promoted_from records which. port is the port the deployment's app listens on, so a promotion
+-- can run the image without its source.
+ALTER TABLE deployments
+ADD COLUMN IF NOT EXISTS promoted_from INTEGER REFERENCES deployments(id) ON DELETE SET NULL,
+ADD COLUMN IF NOT EXISTS port INTEGER;
@@ -0,0 +1,14 @@
+-- Runtime log lines shipped from running containers, kept as a ring buffer per deployment
+-- so history survives Docker's log rotation and container restarts
+CREATE TABLE IF NOT EXISTS runtime_logs (
+    deployment_id INTEGER NOT NULL REFERENCES deployments(id) ON DELETE CASCADE,
+    line_number BIGINT NOT NULL,
+    stream VARCHAR(6) NOT NULL,
+    logged_at TIMESTAMP NOT NULL,
+    message TEXT NOT NULL,
+    PRIMARY KEY (deployment_id, line_number)
+);
+
+-- How many runtime log lines to keep per deployment; 0 uses the platform's RUNTIME_LOG_LINES
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS log_retention_lines INTEGER NOT NULL DEFAULT 0;
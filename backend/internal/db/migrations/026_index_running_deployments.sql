@@ -0,0 +1,7 @@
+-- Serve the running-deployments-of-an-app queries, newest first, from an index. id breaks ties
+-- between deployments created in the same instant, so the newest is always the same one.
+CREATE INDEX IF NOT EXISTS idx_deployments_app_id_status_created_at
+ON deployments(app_id, status, created_at DESC, id DESC);
+
+CREATE INDEX IF NOT EXISTS idx_deployments_app_id_environment_status_created_at
+ON deployments(app_id, environment, status, created_at DESC, id DESC);
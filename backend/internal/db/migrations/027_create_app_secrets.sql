@@ -0,0 +1,11 @@
+-- Runtime secrets of an app, set in the containers of all its environments like environment
+-- variables. Values are encrypted by the application (AES-256-GCM with SECRETS_KEY) and are
+-- never returned by the API.
+CREATE TABLE IF NOT EXISTS app_secrets (
+    app_id INTEGER NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    key VARCHAR(255) NOT NULL,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (app_id, key)
+);
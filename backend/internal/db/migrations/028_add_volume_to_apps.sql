@@ -0,0 +1,5 @@
+-- Persistent storage of an app: a Docker volume per environment, mounted at volume_path in every
+-- container of that environment and kept across deployments. An empty volume_path means none.
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS volume_path TEXT NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS volume_size_mb INTEGER NOT NULL DEFAULT 0;
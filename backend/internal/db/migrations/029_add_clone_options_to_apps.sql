@@ -0,0 +1,5 @@
+-- Opt-in clone steps most repositories don't need: recursing into submodules, and downloading
+-- Git LFS files in place of their pointers.
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS clone_submodules BOOLEAN NOT NULL DEFAULT FALSE,
+ADD COLUMN IF NOT EXISTS clone_lfs BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,4 @@
+-- Serve an app's newest deployment (GetLatestByAppID) and its deployment history, newest first,
+-- from an index instead of sorting all of the app's deployments.
+CREATE INDEX IF NOT EXISTS idx_deployments_app_id_created_at
+ON deployments(app_id, created_at DESC, id DESC);
@@ -0,0 +1,9 @@
+-- Build secrets are now stored encrypted with SECRETS_KEY. Existing values are plaintext until
+-- the API or worker next starts with a key and encrypts them (see apps.Store.EncryptBuildSecrets).
+-- Apps without build secrets have nothing to encrypt, and new apps start out encrypted.
+ALTER TABLE apps
+ADD COLUMN IF NOT EXISTS build_secrets_encrypted BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE apps SET build_secrets_encrypted = TRUE WHERE build_secrets = '{}'::jsonb;
+
+ALTER TABLE apps ALTER COLUMN build_secrets_encrypted SET DEFAULT TRUE;
@@ -4,8 +4,15 @@
 package deployments
 
 import (
+	"context"
 	"database/sql"
+	"log"
+	"strconv"
 	"time"
+
+	"github.com/lib/pq"
+
+	"mvp-be/internal/db"
 )
 
 // Status represents the current state of a deployment.
@@ -28,8 +35,17 @@ const (
 
 	// StatusStopped indicates the deployment was manually stopped
 	StatusStopped Status = "stopped"
+
+	// StatusCancelled indicates the deployment was superseded by a newer one before it started
+	StatusCancelled Status = "cancelled"
 )
 
+// IsFinal reports whether a deployment in this status has finished processing,
+// i.e. it is no longer pending or building.
+func (s Status) IsFinal() bool {
+	return s != StatusPending && s != StatusBuilding
+}
+
 // Deployment represents a single deployment instance of an app.
 // It tracks the entire deployment lifecycle from creation to completion.
 type Deployment struct {
@@ -39,14 +55,21 @@ type Deployment struct {
 	// AppID is the foreign key reference to the app being deployed
 	AppID int `json:"app_id"`
 
+	// Environment is the app's environment the deployment targets (e.g. "production", "staging")
+	Environment string `json:"environment"`
+
 	// Status is the current state of the deployment (pending, building, running, failed, stopped)
 	Status Status `json:"status"`
 
 	// ImageName is the Docker image name that was built for this deployment
-	// Format: mvp-{app-name}:{deployment-id}
+	// Format: mvp-{app-slug}-app{app-id}:{deployment-id}
 	// Empty until the Docker build completes successfully
 	ImageName sql.NullString `json:"image_name,omitempty"`
 
+	// RegistryImage is the registry reference ImageName was pushed as
+	// Empty unless a registry is configured
+	RegistryImage sql.NullString `json:"registry_image,omitempty"`
+
 	// ContainerID is the Docker container ID of the running container
 	// Empty until the container is successfully started
 	ContainerID sql.NullString `json:"container_id,omitempty"`
@@ -64,6 +87,40 @@ type Deployment struct {
 	// Empty if deployment is successful or still in progress
 	ErrorMessage sql.NullString `json:"error_message,omitempty"`
 
+	// Commit is the commit SHA the user asked to deploy
+	// Empty when the deployment tracks the latest commit on the app's branch
+	Commit sql.NullString `json:"commit,omitempty"`
+
+	// CommitSHA is the full commit SHA that was actually checked out and built
+	// Empty until the repository has been cloned
+	CommitSHA sql.NullString `json:"commit_sha,omitempty"`
+
+	// CommitMessage is the subject line of the commit that was built
+	CommitMessage sql.NullString `json:"commit_message,omitempty"`
+
+	// ExitCode is the exit code of the container if it stopped right after starting
+	ExitCode sql.NullInt64 `json:"exit_code,omitempty"`
+
+	// OOMKilled is true if the container was killed for exceeding its memory limit
+	OOMKilled sql.NullBool `json:"oom_killed,omitempty"`
+
+	// FailureSummary is a one-line reason the build failed, naming the failing step when known
+	FailureSummary sql.NullString `json:"failure_summary,omitempty"`
+
+	// NoCache is true if the image was built without reusing cached layers
+	NoCache bool `json:"no_cache"`
+
+	// PromotedFrom is the deployment, of another environment, whose image this one runs
+	// Empty for deployments that built their own image
+	PromotedFrom sql.NullInt64 `json:"promoted_from,omitempty"`
+
+	// Port is the port the app listens on inside the container
+	// Empty until the image is built
+	Port sql.NullInt64 `json:"port,omitempty"`
+
+	// RetryCount is how many times the deployment was requeued after a transient failure
+	RetryCount int `json:"retry_count"`
+
 	// CreatedAt is the timestamp when the deployment was created
 	CreatedAt time.Time `json:"created_at"`
 
@@ -71,11 +128,30 @@ type Deployment struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// deploymentColumns is the column list selected by every deployment query.
+// It must stay in the same order as the fields scanned in scanDeployment.
+const deploymentColumns = "id, app_id, environment, status, image_name, registry_image, container_id, subdomain, build_log, error_message, commit, commit_sha, commit_message, exit_code, oom_killed, failure_summary, no_cache, promoted_from, port, retry_count, created_at, updated_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanDeployment scans a single row selected with deploymentColumns into a Deployment.
+func scanDeployment(row rowScanner) (*Deployment, error) {
+	var d Deployment
+	err := row.Scan(&d.ID, &d.AppID, &d.Environment, &d.Status, &d.ImageName, &d.RegistryImage, &d.ContainerID, &d.Subdomain, &d.BuildLog, &d.ErrorMessage, &d.Commit, &d.CommitSHA, &d.CommitMessage, &d.ExitCode, &d.OOMKilled, &d.FailureSummary, &d.NoCache, &d.PromotedFrom, &d.Port, &d.RetryCount, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
 // Store provides database operations for the Deployment model.
 // It encapsulates all SQL queries related to deployments.
 type Store struct {
-	// db is the database connection used for all queries
-	db *sql.DB
+	// db is the database connection (or transaction) used for all queries
+	db db.Querier
 }
 
 // NewStore creates a new Store instance with the provided database connection.
@@ -89,59 +165,235 @@ func NewStore(db *sql.DB) *Store {
 	return &Store{db: db}
 }
 
+// WithTx returns a Store whose queries run inside tx.
+func (s *Store) WithTx(tx *sql.Tx) *Store {
+	return &Store{db: tx}
+}
+
+// QueuedChannel is the Postgres notification channel a notification is sent on whenever a
+// deployment is queued, so workers can pick it up without waiting for their next poll
+const QueuedChannel = "deployment_queued"
+
 // Create inserts a new deployment for the given app with status "pending".
 // This is typically called when a new app is created or a redeployment is triggered.
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - appID: The ID of the app to deploy
+//   - environment: The app's environment to deploy to (e.g. "production")
+//   - commit: Optional commit SHA to pin the deployment to; empty deploys the branch HEAD
+//   - noCache: Build the image from scratch instead of reusing cached layers
 //
 // Returns:
 //   - *Deployment: The newly created deployment with ID and timestamps populated, or nil on error
 //   - error: Database error if insertion fails
-func (s *Store) Create(appID int) (*Deployment, error) {
-	var d Deployment
+func (s *Store) Create(ctx context.Context, appID int, environment, commit string, noCache bool) (*Deployment, error) {
 	// Create deployment with initial status of "pending"
 	// Use RETURNING clause to get all fields in one query
-	err := s.db.QueryRow(
-		"INSERT INTO deployments (app_id, status) VALUES ($1, $2) RETURNING id, app_id, status, image_name, container_id, subdomain, build_log, error_message, created_at, updated_at",
-		appID, StatusPending,
-	).Scan(&d.ID, &d.AppID, &d.Status, &d.ImageName, &d.ContainerID, &d.Subdomain, &d.BuildLog, &d.ErrorMessage, &d.CreatedAt, &d.UpdatedAt)
+	// An empty commit is stored as NULL, meaning "latest commit on the branch"
+	row := s.db.QueryRowContext(ctx,
+		"INSERT INTO deployments (app_id, environment, status, commit, no_cache) VALUES ($1, $2, $3, NULLIF($4, ''), $5) RETURNING "+deploymentColumns,
+		appID, environment, StatusPending, commit, noCache,
+	)
+	deployment, err := scanDeployment(row)
 	if err != nil {
 		return nil, err
 	}
-	return &d, nil
+	s.notifyQueued(ctx, deployment.ID)
+	return deployment, nil
+}
+
+// CreatePromotion inserts a pending deployment that runs source's image in another environment
+// instead of building one. The commit and image are copied from source, so the new deployment
+// runs byte-for-byte the same artifact, and source is recorded as its PromotedFrom.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - source: The built deployment to promote; it must have an image and a port
+//   - environment: The app's environment to run the image in (e.g. "production")
+//
+// Returns:
+//   - *Deployment: The newly created deployment, or nil on error
+//   - error: Database error if insertion fails
+func (s *Store) CreatePromotion(ctx context.Context, source *Deployment, environment string) (*Deployment, error) {
+	row := s.db.QueryRowContext(ctx,
+		`INSERT INTO deployments (app_id, environment, status, promoted_from, image_name, registry_image, port, commit, commit_sha, commit_message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING `+deploymentColumns,
+		source.AppID, environment, StatusPending, source.ID, source.ImageName, source.RegistryImage, source.Port, source.CommitSHA, source.CommitSHA, source.CommitMessage,
+	)
+	deployment, err := scanDeployment(row)
+	if err != nil {
+		return nil, err
+	}
+	s.notifyQueued(ctx, deployment.ID)
+	return deployment, nil
+}
+
+// notifyQueued wakes the workers listening on QueuedChannel. Inside a transaction the
+// notification is only delivered once it commits. A failed notification only delays the
+// deployment until the workers' next poll, so it is logged rather than returned.
+func (s *Store) notifyQueued(ctx context.Context, deploymentID int) {
+	if _, err := s.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", QueuedChannel, strconv.Itoa(deploymentID)); err != nil {
+		log.Printf("Warning: failed to notify workers of deployment %d: %v", deploymentID, err)
+	}
+}
+
+// HasPending reports whether an app's environment has a deployment queued that has not started building yet.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The ID of the app to check
+//   - environment: The app's environment to check
+//
+// Returns:
+//   - bool: true if at least one pending deployment exists
+//   - error: Database error if query fails
+func (s *Store) HasPending(ctx context.Context, appID int, environment string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM deployments WHERE app_id = $1 AND environment = $2 AND status = $3)",
+		appID, environment, StatusPending,
+	).Scan(&exists)
+	return exists, err
+}
+
+// HasActive checks whether any environment of an app has a deployment that is pending or building.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The ID of the app to check
+//
+// Returns:
+//   - bool: true if a deployment is queued or in progress
+//   - error: Database error if query fails
+func (s *Store) HasActive(ctx context.Context, appID int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM deployments WHERE app_id = $1 AND status IN ($2, $3))",
+		appID, StatusPending, StatusBuilding,
+	).Scan(&exists)
+	return exists, err
+}
+
+// CountActiveByUser counts the deployments of a user's apps that are pending or building.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - userID: The owner of the apps
+//
+// Returns:
+//   - int: Number of queued or in-progress deployments
+//   - error: Database error if query fails
+func (s *Store) CountActiveByUser(ctx context.Context, userID string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM deployments JOIN apps ON apps.id = deployments.app_id WHERE apps.user_id = $1 AND deployments.status IN ($2, $3)",
+		userID, StatusPending, StatusBuilding,
+	).Scan(&count)
+	return count, err
+}
+
+// CancelPending marks all pending deployments of an app's environment as cancelled so a newer one
+// replaces them. Deployments the worker has already picked up (building) are not affected.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The ID of the app whose queued deployments to cancel
+//   - environment: The app's environment whose queued deployments to cancel
+//
+// Returns:
+//   - int64: Number of deployments cancelled
+//   - error: Database error if update fails
+func (s *Store) CancelPending(ctx context.Context, appID int, environment string) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET status = $1, error_message = 'Superseded by a newer deployment', updated_at = CURRENT_TIMESTAMP WHERE app_id = $2 AND environment = $3 AND status = $4",
+		StatusCancelled, appID, environment, StatusPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 // GetByID retrieves a deployment by its unique ID.
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - id: The unique identifier of the deployment to retrieve
 //
 // Returns:
 //   - *Deployment: The deployment if found, or nil on error
 //   - error: sql.ErrNoRows if deployment not found, or other database error
-func (s *Store) GetByID(id int) (*Deployment, error) {
-	var d Deployment
-	err := s.db.QueryRow(
-		"SELECT id, app_id, status, image_name, container_id, subdomain, build_log, error_message, created_at, updated_at FROM deployments WHERE id = $1",
+func (s *Store) GetByID(ctx context.Context, id int) (*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE id = $1",
 		id,
-	).Scan(&d.ID, &d.AppID, &d.Status, &d.ImageName, &d.ContainerID, &d.Subdomain, &d.BuildLog, &d.ErrorMessage, &d.CreatedAt, &d.UpdatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return &d, nil
+	)
+	return scanDeployment(row)
+}
+
+// GetLatestByAppID retrieves the most recently created deployment of an app, in any
+// environment and status.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The ID of the app
+//
+// Returns:
+//   - *Deployment: The newest deployment, or nil on error
+//   - error: sql.ErrNoRows if the app has no deployments, or other database error
+func (s *Store) GetLatestByAppID(ctx context.Context, appID int) (*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE app_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1",
+		appID,
+	)
+	return scanDeployment(row)
+}
+
+// GetBuilding retrieves the deployment of an app's environment the worker is building, if any.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The ID of the app
+//   - environment: The app's environment
+//
+// Returns:
+//   - *Deployment: The building deployment (the newest, should there be several), or nil on error
+//   - error: sql.ErrNoRows if nothing is building, or other database error
+func (s *Store) GetBuilding(ctx context.Context, appID int, environment string) (*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE app_id = $1 AND environment = $2 AND status = $3 ORDER BY created_at DESC LIMIT 1",
+		appID, environment, StatusBuilding,
+	)
+	return scanDeployment(row)
 }
 
 // GetPending retrieves all deployments with status "pending", ordered by creation time (oldest first).
 // This is used by the deployment worker to find work items to process.
+// Deployments scheduled for a later retry are skipped until their next attempt time.
 //
 // Returns:
 //   - []*Deployment: A slice of all pending deployments, or nil on error
 //   - error: Database error if query fails
-func (s *Store) GetPending() ([]*Deployment, error) {
+func (s *Store) GetPending(ctx context.Context) ([]*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
 	// Order by created_at ASC so oldest pending deployments are processed first (FIFO)
-	rows, err := s.db.Query(
-		"SELECT id, app_id, status, image_name, container_id, subdomain, build_log, error_message, created_at, updated_at FROM deployments WHERE status = $1 ORDER BY created_at ASC",
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE status = $1 AND (next_attempt_at IS NULL OR next_attempt_at <= CURRENT_TIMESTAMP) ORDER BY created_at ASC",
 		StatusPending,
 	)
 	if err != nil {
@@ -151,113 +403,493 @@ func (s *Store) GetPending() ([]*Deployment, error) {
 
 	var deployments []*Deployment
 	for rows.Next() {
-		var d Deployment
-		if err := rows.Scan(&d.ID, &d.AppID, &d.Status, &d.ImageName, &d.ContainerID, &d.Subdomain, &d.BuildLog, &d.ErrorMessage, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, rows.Err()
+}
+
+// ListRunning retrieves all deployments with status "running" that have a container.
+// This is used by background jobs that need to inspect live containers.
+//
+// Returns:
+//   - []*Deployment: A slice of running deployments, or nil on error
+//   - error: Database error if query fails
+func (s *Store) ListRunning(ctx context.Context) ([]*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE status = $1 AND container_id IS NOT NULL ORDER BY created_at ASC",
+		StatusRunning,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deployments []*Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, rows.Err()
+}
+
+// ListBuilding retrieves all deployments with status "building", oldest first.
+//
+// Returns:
+//   - []*Deployment: The building deployments (empty if none)
+//   - error: Database error if query fails
+func (s *Store) ListBuilding(ctx context.Context) ([]*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE status = $1 ORDER BY created_at ASC",
+		StatusBuilding,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deployments []*Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, rows.Err()
+}
+
+// GetRunningByAppID retrieves the running deployments of an app in all its environments, newest first.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The ID of the app whose running deployments to retrieve
+//
+// Returns:
+//   - []*Deployment: Running deployments ordered by created_at DESC, then id DESC (empty if none)
+//   - error: Database error if query fails
+func (s *Store) GetRunningByAppID(ctx context.Context, appID int) ([]*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE app_id = $1 AND status = $2 ORDER BY created_at DESC, id DESC",
+		appID, StatusRunning,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deployments []*Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, rows.Err()
+}
+
+// GetRunningByEnvironment retrieves the running deployments of one of an app's environments, newest first.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The ID of the app whose running deployments to retrieve
+//   - environment: The app's environment (e.g. "production")
+//
+// Returns:
+//   - []*Deployment: Running deployments ordered by created_at DESC, then id DESC (empty if none)
+//   - error: Database error if query fails
+func (s *Store) GetRunningByEnvironment(ctx context.Context, appID int, environment string) ([]*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE app_id = $1 AND environment = $2 AND status = $3 ORDER BY created_at DESC, id DESC",
+		appID, environment, StatusRunning,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deployments []*Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
 			return nil, err
 		}
-		deployments = append(deployments, &d)
+		deployments = append(deployments, d)
 	}
 	return deployments, rows.Err()
 }
 
+// FilterFinished returns the subset of ids whose deployments are finished (running, failed,
+// stopped or cancelled), i.e. no longer need their source checkout. IDs with no deployment
+// row (e.g. the app was deleted) are returned as well.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - ids: Deployment IDs to check
+//
+// Returns:
+//   - []int: The IDs whose deployments are finished or missing
+//   - error: Database error if query fails
+func (s *Store) FilterFinished(ctx context.Context, ids []int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT t.id FROM unnest($1::int[]) AS t(id) WHERE NOT EXISTS (SELECT 1 FROM deployments d WHERE d.id = t.id AND d.status IN ($2, $3))",
+		pq.Array(ids), StatusPending, StatusBuilding,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var finished []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		finished = append(finished, id)
+	}
+	return finished, rows.Err()
+}
+
 // UpdateStatus updates the status of a deployment and refreshes the updated_at timestamp.
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - id: The deployment ID to update
-//   - status: The new status value (pending, building, running, failed, stopped)
+//   - status: The new status value (pending, building, running, failed, stopped, cancelled)
 //
 // Returns:
 //   - error: Database error if update fails
-func (s *Store) UpdateStatus(id int, status Status) error {
-	_, err := s.db.Exec(
+func (s *Store) UpdateStatus(ctx context.Context, id int, status Status) error {
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE deployments SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
 		status, id,
 	)
 	return err
 }
 
+// Transition moves a deployment from one status to another, only if it is still in the first.
+// A deployment another process has moved on in the meantime (e.g. a worker already building it,
+// or the reconciler failing it) is left alone, so concurrent updates can't undo each other.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to update
+//   - from: The status the deployment is expected to have
+//   - to: The new status
+//
+// Returns:
+//   - bool: Whether the deployment was in from and is now in to
+//   - error: Database error if update fails
+func (s *Store) Transition(ctx context.Context, id int, from, to Status) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2 AND status = $3",
+		to, id, from,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
 // UpdateImage updates the Docker image name for a deployment.
 // Called after a successful Docker build.
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - id: The deployment ID to update
-//   - imageName: The Docker image name that was built (e.g., "mvp-myapp:123")
+//   - imageName: The Docker image name that was built (e.g., "mvp-myapp-app7:123")
 //
 // Returns:
 //   - error: Database error if update fails
-func (s *Store) UpdateImage(id int, imageName string) error {
-	_, err := s.db.Exec(
+func (s *Store) UpdateImage(ctx context.Context, id int, imageName string) error {
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE deployments SET image_name = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
 		imageName, id,
 	)
 	return err
 }
 
+// UpdatePort records the port a deployment's app listens on.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to update
+//   - port: The port inside the container
+//
+// Returns:
+//   - error: Database error if update fails
+func (s *Store) UpdatePort(ctx context.Context, id int, port int) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET port = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		port, id,
+	)
+	return err
+}
+
+// UpdateRegistryImage records the registry reference a deployment's image was pushed as.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to update
+//   - ref: The registry reference (e.g., "registry.example.com/mvp-myapp-app7:123")
+//
+// Returns:
+//   - error: Database error if update fails
+func (s *Store) UpdateRegistryImage(ctx context.Context, id int, ref string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET registry_image = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		ref, id,
+	)
+	return err
+}
+
 // UpdateContainer updates the container ID and subdomain for a deployment.
 // Called after a container is successfully started.
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - id: The deployment ID to update
 //   - containerID: The Docker container ID
 //   - subdomain: The subdomain assigned to this deployment
 //
 // Returns:
 //   - error: Database error if update fails
-func (s *Store) UpdateContainer(id int, containerID, subdomain string) error {
-	_, err := s.db.Exec(
+func (s *Store) UpdateContainer(ctx context.Context, id int, containerID, subdomain string) error {
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE deployments SET container_id = $1, subdomain = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
 		containerID, subdomain, id,
 	)
 	return err
 }
 
+// UpdateCommit records the commit that was checked out and built for a deployment.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to update
+//   - sha: The full commit SHA of the checked-out HEAD
+//   - message: The subject line of that commit
+//
+// Returns:
+//   - error: Database error if update fails
+func (s *Store) UpdateCommit(ctx context.Context, id int, sha, message string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET commit_sha = $1, commit_message = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		sha, message, id,
+	)
+	return err
+}
+
+// UpdateExitStatus records how a deployment's container exited.
+// Called when a container dies shortly after being started.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to update
+//   - exitCode: The container's exit code
+//   - oomKilled: Whether the kernel killed the container for exceeding its memory limit
+//
+// Returns:
+//   - error: Database error if update fails
+func (s *Store) UpdateExitStatus(ctx context.Context, id int, exitCode int, oomKilled bool) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET exit_code = $1, oom_killed = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		exitCode, oomKilled, id,
+	)
+	return err
+}
+
 // UpdateBuildLog updates the build log for a deployment.
 // The build log contains the Docker build output.
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - id: The deployment ID to update
 //   - log: The build log content (typically Docker build output)
 //
 // Returns:
 //   - error: Database error if update fails
-func (s *Store) UpdateBuildLog(id int, log string) error {
-	_, err := s.db.Exec(
+func (s *Store) UpdateBuildLog(ctx context.Context, id int, log string) error {
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE deployments SET build_log = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
 		log, id,
 	)
 	return err
 }
 
+// UpdateFailureSummary stores the one-line reason a deployment's build failed.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to update
+//   - summary: The failure summary extracted from the build log
+//
+// Returns:
+//   - error: Database error if update fails
+func (s *Store) UpdateFailureSummary(ctx context.Context, id int, summary string) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET failure_summary = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2",
+		summary, id,
+	)
+	return err
+}
+
 // UpdateError updates the error message and sets status to "failed" for a deployment.
 // This is called when a deployment encounters an error during processing.
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - id: The deployment ID to update
 //   - errorMsg: The error message describing what went wrong
 //
 // Returns:
 //   - error: Database error if update fails
-func (s *Store) UpdateError(id int, errorMsg string) error {
+func (s *Store) UpdateError(ctx context.Context, id int, errorMsg string) error {
 	// Automatically set status to "failed" when recording an error
-	_, err := s.db.Exec(
+	_, err := s.db.ExecContext(ctx,
 		"UPDATE deployments SET error_message = $1, status = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
 		errorMsg, StatusFailed, id,
 	)
 	return err
 }
 
+// ScheduleRetry puts a deployment back in the queue after a transient failure.
+// The retry count is incremented and the deployment is not picked up again until after delay.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to requeue
+//   - errorMsg: The transient error, kept so users can see why the deploy is retrying
+//   - delay: How long to wait before the next attempt
+//
+// Returns:
+//   - error: Database error if update fails
+func (s *Store) ScheduleRetry(ctx context.Context, id int, errorMsg string, delay time.Duration) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET status = $1, error_message = $2, retry_count = retry_count + 1, next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second', updated_at = CURRENT_TIMESTAMP WHERE id = $4",
+		StatusPending, errorMsg, delay.Seconds(), id,
+	)
+	return err
+}
+
+// Requeue puts a deployment back in the queue after a platform outage, without counting it as a retry.
+// The deployment is not picked up again until after delay.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - id: The deployment ID to requeue
+//   - errorMsg: Why the deployment is waiting, shown to users meanwhile
+//   - delay: How long to wait before the next attempt
+//
+// Returns:
+//   - error: Database error if update fails
+func (s *Store) Requeue(ctx context.Context, id int, errorMsg string, delay time.Duration) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE deployments SET status = $1, error_message = $2, next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second', updated_at = CURRENT_TIMESTAMP WHERE id = $4",
+		StatusPending, errorMsg, delay.Seconds(), id,
+	)
+	return err
+}
+
+// Retention decides which finished deployments of an app are kept.
+// A deployment is kept if it is among the app's KeepLast newest, or younger than MaxAge.
+// Pending, building and running deployments are always kept.
+type Retention struct {
+	// KeepLast is how many of each app's newest deployments are kept regardless of age; 0 keeps none by count
+	KeepLast int
+	// MaxAge is how long deployments are kept regardless of count; 0 keeps none by age
+	MaxAge time.Duration
+}
+
+// Enabled reports whether the retention limits anything; with both limits 0 nothing is purged.
+func (r Retention) Enabled() bool {
+	return r.KeepLast > 0 || r.MaxAge > 0
+}
+
+// Purge deletes the failed, stopped and cancelled deployments that fall outside the retention,
+// along with their logs and usage samples.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - retention: Which deployments to keep
+//
+// Returns:
+//   - []int: IDs of the deleted deployments (empty if retention is disabled)
+//   - error: Database error if the delete fails
+func (s *Store) Purge(ctx context.Context, retention Retention) ([]int, error) {
+	if !retention.Enabled() {
+		return nil, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		DELETE FROM deployments WHERE id IN (
+			SELECT id FROM (
+				SELECT id, status, created_at,
+				       ROW_NUMBER() OVER (PARTITION BY app_id ORDER BY created_at DESC, id DESC) AS rank
+				FROM deployments
+			) ranked
+			WHERE status IN ($1, $2, $3)
+			  AND ($4::int = 0 OR rank > $4::int)
+			  AND ($5::float8 = 0 OR created_at < CURRENT_TIMESTAMP - $5::float8 * INTERVAL '1 second')
+		) RETURNING id`,
+		StatusFailed, StatusStopped, StatusCancelled, retention.KeepLast, retention.MaxAge.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 // ListByAppID retrieves all deployments for a specific app, ordered by creation time (newest first).
 //
 // Parameters:
+//   - ctx: Context for cancellation and deadlines
 //   - appID: The ID of the app whose deployments to retrieve
 //
 // Returns:
 //   - []*Deployment: A slice of all deployments for the app, or nil on error
 //   - error: Database error if query fails
-func (s *Store) ListByAppID(appID int) ([]*Deployment, error) {
+func (s *Store) ListByAppID(ctx context.Context, appID int) ([]*Deployment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
 	// Order by created_at DESC so most recent deployments appear first
-	rows, err := s.db.Query(
-		"SELECT id, app_id, status, image_name, container_id, subdomain, build_log, error_message, created_at, updated_at FROM deployments WHERE app_id = $1 ORDER BY created_at DESC",
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+deploymentColumns+" FROM deployments WHERE app_id = $1 ORDER BY created_at DESC",
 		appID,
 	)
 	if err != nil {
@@ -267,11 +899,11 @@ func (s *Store) ListByAppID(appID int) ([]*Deployment, error) {
 
 	var deployments []*Deployment
 	for rows.Next() {
-		var d Deployment
-		if err := rows.Scan(&d.ID, &d.AppID, &d.Status, &d.ImageName, &d.ContainerID, &d.Subdomain, &d.BuildLog, &d.ErrorMessage, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		d, err := scanDeployment(rows)
+		if err != nil {
 			return nil, err
 		}
-		deployments = append(deployments, &d)
+		deployments = append(deployments, d)
 	}
 	return deployments, rows.Err()
 }
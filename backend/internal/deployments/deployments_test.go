@@ -0,0 +1,84 @@
+package deployments
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"mvp-be/internal/db"
+)
+
+// testDB connects to the Postgres database in TEST_DATABASE_URL and migrates it, or skips
+// the test if none is configured. Tests create their own rows and delete them afterwards.
+func testDB(t *testing.T) *db.DB {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	database, err := db.New(url, db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func TestGetRunningByAppIDNewestFirst(t *testing.T) {
+	database := testDB(t)
+	ctx := context.Background()
+
+	name := fmt.Sprintf("running-order-%d", time.Now().UnixNano())
+	var appID int
+	err := database.QueryRowContext(ctx,
+		"INSERT INTO apps (name, slug, repo_url, branch) VALUES ($1, $1, 'https://example.com/repo.git', 'main') RETURNING id",
+		name,
+	).Scan(&appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		database.Exec("DELETE FROM deployments WHERE app_id = $1", appID)
+		database.Exec("DELETE FROM apps WHERE id = $1", appID)
+	})
+
+	// Inserted out of order, so the result can't follow insertion order by accident
+	now := time.Now().UTC().Truncate(time.Second)
+	insert := func(status Status, createdAt time.Time) int {
+		t.Helper()
+		var id int
+		err := database.QueryRowContext(ctx,
+			"INSERT INTO deployments (app_id, environment, status, created_at) VALUES ($1, 'production', $2, $3) RETURNING id",
+			appID, status, createdAt,
+		).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	middle := insert(StatusRunning, now.Add(-time.Minute))
+	newest := insert(StatusRunning, now)
+	oldest := insert(StatusRunning, now.Add(-time.Hour))
+	insert(StatusStopped, now.Add(time.Minute))
+	// Same created_at as newest, inserted later: the higher id comes first
+	tied := insert(StatusRunning, now)
+
+	running, err := NewStore(database.DB).GetRunningByAppID(ctx, appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{tied, newest, middle, oldest}
+	if len(running) != len(want) {
+		t.Fatalf("GetRunningByAppID() returned %d deployments, want %d", len(running), len(want))
+	}
+	for i, d := range running {
+		if d.ID != want[i] {
+			t.Errorf("deployment %d = %d, want %d", i, d.ID, want[i])
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package deployments
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"mvp-be/internal/db"
+)
+
+// EventType names a step of the deployment pipeline
+type EventType string
+
+// Deployment events, in the order a successful deployment records them
+const (
+	EventCloned            EventType = "cloned"
+	EventDockerfileChecked EventType = "dockerfile-checked"
+	EventBuilding          EventType = "building"
+	EventBuilt             EventType = "built"
+	// EventPromoted replaces the clone and build steps of a deployment that runs another
+	// environment's image; its message names the source deployment
+	EventPromoted          EventType = "promoted"
+	EventContainerStarted  EventType = "container-started"
+	EventHealthCheckPassed EventType = "health-check-passed"
+	EventRunning           EventType = "running"
+
+	// EventRetrying ends an attempt that failed transiently; the timeline continues with the next attempt
+	EventRetrying EventType = "retrying"
+	// EventFailed ends the timeline of a deployment that failed for good
+	EventFailed EventType = "failed"
+	// EventCrashLooping is recorded when a running deployment is stopped for restarting too often;
+	// its message holds the container's last log lines
+	EventCrashLooping EventType = "crash-looping"
+	// EventLivenessFailed is recorded when a running deployment's container is restarted for
+	// failing its health check repeatedly; its message holds the last probe error
+	EventLivenessFailed EventType = "liveness-failed"
+)
+
+// Event is one step in a deployment's timeline
+type Event struct {
+	ID           int64     `json:"id"`
+	DeploymentID int       `json:"deployment_id"`
+	Event        EventType `json:"event"`
+	// Message adds detail, such as the commit cloned or the error that failed the step
+	Message   string    `json:"message,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddEvent appends an event to a deployment's timeline.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - deploymentID: The deployment the event belongs to
+//   - event: The step that was reached
+//   - message: Optional detail; empty for none
+//
+// Returns:
+//   - error: Database error if the insert fails
+func (s *Store) AddEvent(ctx context.Context, deploymentID int, event EventType, message string) error {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO deployment_events (deployment_id, event, message) VALUES ($1, $2, NULLIF($3, ''))",
+		deploymentID, event, message,
+	)
+	return err
+}
+
+// ListEvents returns a deployment's timeline, oldest event first.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - deploymentID: The deployment whose events to list
+//
+// Returns:
+//   - []*Event: The events, empty if none were recorded
+//   - error: Database error if the query fails
+func (s *Store) ListEvents(ctx context.Context, deploymentID int) ([]*Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, deployment_id, event, message, created_at FROM deployment_events WHERE deployment_id = $1 ORDER BY created_at ASC, id ASC",
+		deploymentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		var e Event
+		var message sql.NullString
+		if err := rows.Scan(&e.ID, &e.DeploymentID, &e.Event, &message, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Message = message.String
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,103 @@
+package dockerbuild
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dockerBinary is the Docker CLI, whose buildx plugin drives BuildKit builds
+const dockerBinary = "docker"
+
+// EnableBuildKit makes Build use BuildKit, through the Docker CLI's buildx plugin, instead of
+// the legacy build API. BuildKit caches better, runs independent stages in parallel and
+// supports secret mounts. The API's own BuildKit mode needs a client session the Docker SDK
+// doesn't provide, so the CLI is used the same way Nixpacks is.
+// If buildx can't be found the Builder is left unchanged, so callers can fall back to the
+// legacy builder.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//
+// Returns:
+//   - error: Error if the Docker CLI or its buildx plugin isn't available on the worker host
+func (b *Builder) EnableBuildKit(ctx context.Context) error {
+	if _, err := exec.LookPath(dockerBinary); err != nil {
+		return fmt.Errorf("BuildKit builds need the %s CLI on the worker host: %w", dockerBinary, err)
+	}
+	cmd := exec.CommandContext(ctx, dockerBinary, "buildx", "version")
+	cmd.Env = b.cliEnv()
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("docker buildx is not available: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	b.buildKit = true
+	return nil
+}
+
+// BuildKitEnabled reports whether Build uses BuildKit.
+func (b *Builder) BuildKitEnabled() bool {
+	return b.buildKit
+}
+
+// secretEnvPrefix namespaces the environment variables secrets are handed to buildx in,
+// so a secret ID like PATH can't clobber the CLI's own environment
+const secretEnvPrefix = "STACKYN_BUILD_SECRET_"
+
+// buildWithBuildKit runs `docker buildx build` and returns its plain progress output.
+// Unlike the legacy API, BuildKit reports progress as text rather than JSON; logs.ParseBuildLog
+// understands both. The image is loaded into the daemon, where Run expects it.
+//
+// Each secret is passed with --secret id=KEY,env=..., reading the value from the CLI's
+// environment so it never appears on a command line. A Dockerfile reads it with
+// RUN --mount=type=secret,id=KEY, which mounts it at /run/secrets/KEY for that step only;
+// it isn't written to any layer or to the image's history.
+func (b *Builder) buildWithBuildKit(ctx context.Context, contextPath, dockerfile, imageName string, buildArgs, secrets map[string]string, noCache bool) (string, io.ReadCloser, error) {
+	args := []string{"buildx", "build", "--progress=plain", "--load",
+		"--tag", imageName,
+		"--file", filepath.Join(contextPath, dockerfile),
+	}
+	if noCache {
+		args = append(args, "--no-cache")
+	}
+	keys := make([]string, 0, len(buildArgs))
+	for key := range buildArgs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--build-arg", key+"="+buildArgs[key])
+	}
+	env := b.cliEnv()
+	keys = keys[:0]
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--secret", "id="+key+",env="+secretEnvPrefix+key)
+		env = append(env, secretEnvPrefix+key+"="+secrets[key])
+	}
+	args = append(args, contextPath)
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, dockerBinary, args...)
+	cmd.Env = env
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return "", io.NopCloser(&output), fmt.Errorf("buildkit build failed: %w", err)
+	}
+	return imageName, io.NopCloser(&output), nil
+}
+
+// cliEnv is the environment of Docker CLI commands, pointed at the Builder's daemon
+func (b *Builder) cliEnv() []string {
+	return append(os.Environ(), "DOCKER_HOST="+b.dockerHost, "DOCKER_BUILDKIT=1")
+}
@@ -4,12 +4,17 @@ package dockerbuild
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+
+	"mvp-be/internal/dockerhost"
+	"mvp-be/internal/registry"
 )
 
 // Builder handles building Docker images using the Docker API.
@@ -17,6 +22,12 @@ import (
 type Builder struct {
 	// client is the Docker API client used to communicate with the Docker daemon
 	client *client.Client
+
+	// dockerHost is passed to CLI build tools so they use the same daemon
+	dockerHost string
+
+	// buildKit is true if Build uses BuildKit instead of the legacy build API (see EnableBuildKit)
+	buildKit bool
 }
 
 // NewBuilder creates a new Builder instance connected to the Docker daemon.
@@ -28,6 +39,10 @@ type Builder struct {
 //   - *Builder: A new Builder instance ready to build images, or nil on error
 //   - error: Error if Docker client creation fails (connection issue, invalid host, etc.)
 func NewBuilder(dockerHost string) (*Builder, error) {
+	if err := dockerhost.Validate(dockerHost); err != nil {
+		return nil, err
+	}
+
 	// Create Docker client with host configuration and API version negotiation
 	cli, err := client.NewClientWithOpts(
 		client.WithHost(dockerHost),
@@ -37,33 +52,54 @@ func NewBuilder(dockerHost string) (*Builder, error) {
 		return nil, fmt.Errorf("failed to create docker client: %w", err)
 	}
 
-	return &Builder{client: cli}, nil
+	return &Builder{client: cli, dockerHost: dockerHost}, nil
 }
 
-// Build builds a Docker image from a repository path.
-// It creates a tar archive of the repository and sends it to Docker for building.
-// The build process looks for a Dockerfile in the root of the repository.
+// Build builds a Docker image from a directory of a cloned repository.
+// It creates a tar archive of the directory and sends it to Docker as the build context,
+// or, once EnableBuildKit succeeded, builds it with BuildKit.
 //
 // Parameters:
 //   - ctx: Context for cancellation and timeout control
-//   - repoPath: The local filesystem path to the cloned repository
-//   - imageName: The name to tag the built image (e.g., "mvp-myapp:123")
+//   - contextPath: The local directory to build from (the repository root or a subdirectory)
+//   - dockerfile: The Dockerfile to use, relative to contextPath
+//   - imageName: The name to tag the built image (e.g., "mvp-myapp-app7:123", see ImageName)
+//   - buildArgs: Values for ARG instructions in the Dockerfile (may be nil)
+//   - secrets: Values for RUN --mount=type=secret, keyed by secret ID (may be nil; needs BuildKit)
+//   - noCache: Run every step again instead of reusing layers cached by earlier builds
 //
 // Returns:
 //   - string: The image name that was built (same as input imageName)
-//   - io.ReadCloser: A stream containing the Docker build output/logs (must be closed by caller)
+//   - io.ReadCloser: A stream containing the Docker build output/logs (must be closed by caller).
+//     With BuildKit it is returned on failure too, so the caller can show why the build failed.
 //   - error: Error if tar creation fails, Docker build fails, or image cannot be created
-func (b *Builder) Build(ctx context.Context, repoPath string, imageName string) (string, io.ReadCloser, error) {
+func (b *Builder) Build(ctx context.Context, contextPath, dockerfile string, imageName string, buildArgs, secrets map[string]string, noCache bool) (string, io.ReadCloser, error) {
+	if b.buildKit {
+		return b.buildWithBuildKit(ctx, contextPath, dockerfile, imageName, buildArgs, secrets, noCache)
+	}
+	// The legacy builder has no secret mounts, and passing secrets as build args would store them in the image
+	if len(secrets) > 0 {
+		return "", nil, errors.New("build secrets need BuildKit, which is not enabled on the worker (USE_BUILDKIT=true)")
+	}
+
+	// Docker expects pointers so that an ARG can be set to an empty value
+	args := make(map[string]*string, len(buildArgs))
+	for key, value := range buildArgs {
+		args[key] = &value
+	}
+
 	// Configure Docker build options
 	buildOptions := types.ImageBuildOptions{
 		Tags:       []string{imageName}, // Tag the image with the provided name
-		Dockerfile: "Dockerfile",         // Look for Dockerfile in the root of the build context
+		Dockerfile: dockerfile,           // Path of the Dockerfile inside the build context
 		Remove:    true,                 // Remove intermediate containers after build
+		BuildArgs:  args,                // Values for ARG instructions
+		NoCache:    noCache,             // Layers of earlier builds are reused unless asked not to
 	}
 
 	// Create a tar archive of the repository to send as build context
 	// Docker requires the build context to be a tar stream
-	buildContext, err := createTarContext(repoPath)
+	buildContext, err := createTarContext(contextPath)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to create build context: %w", err)
 	}
@@ -82,6 +118,70 @@ func (b *Builder) Build(ctx context.Context, repoPath string, imageName string)
 	return imageName, buildResponse.Body, nil
 }
 
+// ImageName returns the tag of a deployment's image: mvp-{slug}-app{appID}:{deploymentID}.
+// Slugs of different apps can collide; the app ID keeps their images apart.
+func ImageName(slug string, appID, deploymentID int) string {
+	return fmt.Sprintf("mvp-%s-app%d:%d", slug, appID, deploymentID)
+}
+
+// RemoveStaleImage makes sure no image is tagged imageName before it is built.
+// A leftover tag, e.g. from an earlier attempt of the same deployment, would otherwise be
+// run if the new build didn't replace it.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - imageName: The tag about to be built
+//
+// Returns:
+//   - bool: True if a stale image was found and untagged
+//   - error: Error if the image can't be inspected or removed
+func (b *Builder) RemoveStaleImage(ctx context.Context, imageName string) (bool, error) {
+	if _, err := b.client.ImageInspect(ctx, imageName); err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+	// Force untags it even if a stopped container of the failed attempt still uses it
+	if _, err := b.client.ImageRemove(ctx, imageName, image.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+		return false, fmt.Errorf("failed to remove stale image %s: %w", imageName, err)
+	}
+	return true, nil
+}
+
+// Push tags a built image with its registry reference and pushes it, so workers on
+// other hosts can pull it.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - imageName: The local image to push (as returned by Build)
+//   - reg: The registry to push to; must be enabled
+//
+// Returns:
+//   - string: The registry reference the image was pushed as
+//   - error: Error if tagging fails or the registry rejects the push
+func (b *Builder) Push(ctx context.Context, imageName string, reg registry.Config) (string, error) {
+	ref := reg.Reference(imageName)
+	if err := b.client.ImageTag(ctx, imageName, ref); err != nil {
+		return "", fmt.Errorf("failed to tag image: %w", err)
+	}
+
+	auth, err := reg.Auth()
+	if err != nil {
+		return "", err
+	}
+	stream, err := b.client.ImagePush(ctx, ref, image.PushOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", fmt.Errorf("failed to push image: %w", err)
+	}
+	defer stream.Close()
+	// The push only happens while the progress stream is read
+	if err := registry.CheckStream(stream); err != nil {
+		return "", fmt.Errorf("failed to push image: %w", err)
+	}
+	return ref, nil
+}
+
 // createTarContext creates a tar.gz archive of the given directory path.
 // This is used to send the repository to Docker as a build context.
 // The tar command is executed and its stdout is returned as a ReadCloser.
@@ -0,0 +1,60 @@
+package dockerbuild
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+)
+
+// nixpacksBinary is the Nixpacks CLI, which must be installed on the worker host
+const nixpacksBinary = "nixpacks"
+
+// BuildWithNixpacks builds an image without a Dockerfile by running Nixpacks,
+// which detects the app's language and generates the build plan itself.
+// The build runs against the same Docker daemon as Build.
+//
+// Parameters:
+//   - ctx: Context for cancellation and timeout control
+//   - repoPath: The local filesystem path to the cloned repository
+//   - imageName: The name to tag the built image (e.g., "mvp-myapp:123")
+//   - buildArgs: Passed to Nixpacks as build-time environment variables (may be nil)
+//   - noCache: Build without reusing layers cached by earlier builds
+//
+// Returns:
+//   - string: The image name that was built (same as input imageName)
+//   - io.ReadCloser: The Nixpacks output, including the detected providers and build plan.
+//     It is returned on failure too, so the caller can show why detection or the build failed.
+//   - error: Error if Nixpacks is not installed or the build fails
+func (b *Builder) BuildWithNixpacks(ctx context.Context, repoPath string, imageName string, buildArgs map[string]string, noCache bool) (string, io.ReadCloser, error) {
+	if _, err := exec.LookPath(nixpacksBinary); err != nil {
+		return "", nil, fmt.Errorf("buildpack builds need the %s CLI on the worker host: %w", nixpacksBinary, err)
+	}
+
+	args := []string{"build", repoPath, "--name", imageName}
+	if noCache {
+		args = append(args, "--no-cache")
+	}
+	keys := make([]string, 0, len(buildArgs))
+	for key := range buildArgs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "--env", key+"="+buildArgs[key])
+	}
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, nixpacksBinary, args...)
+	cmd.Env = append(os.Environ(), "DOCKER_HOST="+b.dockerHost)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return "", io.NopCloser(&output), fmt.Errorf("nixpacks build failed: %w", err)
+	}
+	return imageName, io.NopCloser(&output), nil
+}
@@ -0,0 +1,43 @@
+// Package dockerhost validates Docker daemon addresses (DOCKER_HOST).
+package dockerhost
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Default is the local daemon's Unix socket
+const Default = "unix:///var/run/docker.sock"
+
+// schemes are the address schemes the Docker client can connect with
+var schemes = []string{"unix", "tcp", "npipe"}
+
+// Validate checks that host is an address the Docker client can connect to,
+// e.g. "unix:///var/run/docker.sock" or "tcp://10.0.0.5:2376".
+func Validate(host string) error {
+	u, err := url.Parse(host)
+	if err != nil {
+		return fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme != scheme {
+			continue
+		}
+		if scheme == "tcp" && u.Host == "" {
+			return fmt.Errorf("invalid docker host %q: missing host and port", host)
+		}
+		if scheme != "tcp" && u.Path == "" {
+			return fmt.Errorf("invalid docker host %q: missing socket path", host)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid docker host %q: scheme must be one of %s", host, strings.Join(schemes, ", "))
+}
+
+// IsUnencryptedTCP reports whether host is a TCP address. The clients here don't set up TLS,
+// so such a daemon is reached without encryption or authentication, and anyone who can reach
+// the port can run containers as root on its host.
+func IsUnencryptedTCP(host string) bool {
+	return strings.HasPrefix(host, "tcp://")
+}
@@ -0,0 +1,77 @@
+package dockerrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// Deadlines for single Docker API requests. Without them a wedged daemon would hang the
+// caller (and with it the worker's loop) for as long as the caller's own context allows.
+const (
+	// callTimeout bounds quick requests: inspect, create, start, remove, stats
+	callTimeout = 30 * time.Second
+	// stopTimeout leaves room for the container's stop grace period (10s by default) on stop and restart
+	stopTimeout = 2 * time.Minute
+	// pullTimeout bounds pulling an image from the registry, including reading the progress stream
+	pullTimeout = 10 * time.Minute
+)
+
+// Retries of idempotent requests that hit a transient connection error
+const (
+	callAttempts   = 3
+	callRetryDelay = 500 * time.Millisecond
+)
+
+// call runs a Docker request with its own deadline of timeout, derived from ctx.
+// A request cut off by that deadline, rather than by ctx, says so in its error.
+func (r *Runner) call(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(callCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("docker did not respond within %s: %w", timeout, err)
+	}
+	return err
+}
+
+// retry runs an idempotent Docker request like call, with callTimeout, trying it again
+// up to callAttempts times in total when it fails with a transient connection error.
+// Only requests that are safe to repeat (inspect, list, stats) may use it.
+func (r *Runner) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := r.call(ctx, callTimeout, fn)
+		if err == nil || attempt == callAttempts || !isTransient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(callRetryDelay * time.Duration(attempt)):
+		}
+	}
+}
+
+// isTransient reports whether err is a network hiccup worth retrying, as opposed to an
+// answer from the daemon (not found, conflict, ...) or a deadline running out
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if client.IsErrConnectionFailed(err) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -2,19 +2,89 @@ package dockerrun
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+
+	"mvp-be/internal/dockerhost"
+	"mvp-be/internal/registry"
 )
 
+// startupGracePeriod is how long Run waits after starting a container
+// before checking that it did not exit immediately.
+const startupGracePeriod = 3 * time.Second
+
+// ContainerExitError is returned by Run when a container stops right after starting.
+// It carries the structured exit status so callers can tell a crash from an OOM kill.
+type ContainerExitError struct {
+	ExitCode  int
+	OOMKilled bool
+	// Reason is Docker's own error string for the container, if any
+	Reason string
+}
+
+func (e *ContainerExitError) Error() string {
+	if e.OOMKilled {
+		return fmt.Sprintf("container was killed after running out of memory (exit code %d)", e.ExitCode)
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("container exited with code %d: %s", e.ExitCode, e.Reason)
+	}
+	return fmt.Sprintf("container exited with code %d", e.ExitCode)
+}
+
 type Runner struct {
 	client *client.Client
+	opts   Options
 }
 
-func NewRunner(dockerHost string) (*Runner, error) {
+// Options configures how Run labels and attaches containers.
+type Options struct {
+	// CertResolver is the Traefik certificate resolver used for the containers' routers
+	CertResolver string
+
+	// Network is the Docker network containers join; Traefik must be attached to it too
+	Network string
+
+	// Registry is where images built on another host are pulled from; zero to run local images only
+	Registry registry.Config
+
+	// VolumeDriver is the Docker volume driver persistent volumes are created with; "" for "local"
+	VolumeDriver string
+}
+
+// Labels Run sets on every container, so the platform's containers can be found by what they
+// belong to (see ListManaged) even when the database's container IDs are missing or stale
+const (
+	LabelAppID        = "stackyn.app_id"
+	LabelDeploymentID = "stackyn.deployment_id"
+	LabelEnvironment  = "stackyn.environment"
+)
+
+// Owner is the deployment a container is run for
+type Owner struct {
+	AppID        int
+	DeploymentID int
+	Environment  string
+}
+
+func NewRunner(dockerHost string, opts Options) (*Runner, error) {
+	if err := dockerhost.Validate(dockerHost); err != nil {
+		return nil, err
+	}
+
 	cli, err := client.NewClientWithOpts(
 		client.WithHost(dockerHost),
 		client.WithAPIVersionNegotiation(),
@@ -23,32 +93,116 @@ func NewRunner(dockerHost string) (*Runner, error) {
 		return nil, fmt.Errorf("failed to create docker client: %w", err)
 	}
 
-	return &Runner{client: cli}, nil
+	return &Runner{client: cli, opts: opts}, nil
+}
+
+// Ping checks that the Docker daemon is reachable.
+func (r *Runner) Ping(ctx context.Context) error {
+	return r.retry(ctx, func(ctx context.Context) error {
+		_, err := r.client.Ping(ctx)
+		return err
+	})
 }
 
-func (r *Runner) Run(ctx context.Context, imageName, subdomain, baseDomain string) (string, error) {
-	// Build FQDN and determine router/service names
-	fqdn := fmt.Sprintf("%s.%s", subdomain, baseDomain)
-	routerName := subdomain
-	serviceName := subdomain
-	containerName := subdomain
-	internalPort := 8080 // Default port, can be made configurable if needed
+// CheckNetwork verifies that the configured network exists.
+// It is not created automatically: Traefik has to be attached to it for routing to work,
+// so a missing network almost always means a misconfigured name.
+func (r *Runner) CheckNetwork(ctx context.Context) error {
+	err := r.retry(ctx, func(ctx context.Context) error {
+		_, err := r.client.NetworkInspect(ctx, r.opts.Network, network.InspectOptions{})
+		return err
+	})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return fmt.Errorf("docker network %q does not exist", r.opts.Network)
+		}
+		return fmt.Errorf("failed to inspect docker network %q: %w", r.opts.Network, err)
+	}
+	return nil
+}
+
+// Run starts a container for a deployment and registers it with Traefik under two hostnames:
+// the stable subdomain, shared by every deployment of the app's environment, and a per-deployment
+// hostname named after the container, used to health-check the new container on its own.
+//
+// Every deployment of an app registers the same router and service for the stable hostname
+// with identical labels, so while an old and a new container overlap Traefik merges them into
+// one load-balanced service instead of reporting a conflict. Removing the old container then
+// completes the swap without downtime.
+//
+// Verified custom domains are routed to the same stable service through one extra router,
+// each getting its own certificate from the cert resolver.
+//
+// The container is also labelled with its owner (see ListManaged).
+//
+// With a volume, the persistent volume of the owner's environment (see VolumeName) is created
+// if needed and mounted. The old and new container of a swap mount it at the same time, and
+// removing a container never removes it (see RemoveVolumes).
+//
+// Parameters:
+//   - owner: The app, deployment and environment the container is run for
+//   - imageName: The image to run; a reference into the configured registry is pulled first if it isn't local
+//   - containerName: Unique container name for this deployment (also its own hostname)
+//   - subdomain: The stable subdomain of the app's environment
+//   - baseDomain: The base domain both hostnames live under
+//   - customDomains: Additional verified hostnames routed to the app (may be empty)
+//   - port: The port the app listens on inside the container; also passed to it as PORT
+//   - env: Environment variables set in the container (may be nil); PORT can't be overridden
+//   - vol: The persistent volume to mount, or nil for none
+func (r *Runner) Run(ctx context.Context, owner Owner, imageName, containerName, subdomain, baseDomain string, customDomains []string, port int, env map[string]string, vol *Volume) (string, error) {
+	internalPort := port
 
 	// Create Traefik labels with HTTPS/TLS support
 	labels := map[string]string{
-		"traefik.enable":                                                     "true",
-		"traefik.docker.network":                                             "stackyn-network",
-		"traefik.http.routers." + routerName + ".rule":                       fmt.Sprintf("Host(`%s`)", fqdn),
-		"traefik.http.routers." + routerName + ".entrypoints":                "websecure",
-		"traefik.http.routers." + routerName + ".tls":                        "true",
-		"traefik.http.routers." + routerName + ".tls.certresolver":           "le",
-		"traefik.http.services." + serviceName + ".loadbalancer.server.port": strconv.Itoa(internalPort),
+		"traefik.enable":         "true",
+		"traefik.docker.network": r.opts.Network,
+		LabelAppID:               strconv.Itoa(owner.AppID),
+		LabelDeploymentID:        strconv.Itoa(owner.DeploymentID),
+		LabelEnvironment:         owner.Environment,
+	}
+	// With two routers on one container, each must name its service explicitly
+	for _, name := range []string{subdomain, containerName} {
+		fqdn := fmt.Sprintf("%s.%s", name, baseDomain)
+		labels["traefik.http.routers."+name+".rule"] = fmt.Sprintf("Host(`%s`)", fqdn)
+		labels["traefik.http.routers."+name+".entrypoints"] = "websecure"
+		labels["traefik.http.routers."+name+".tls"] = "true"
+		labels["traefik.http.routers."+name+".tls.certresolver"] = r.opts.CertResolver
+		labels["traefik.http.routers."+name+".service"] = name
+		labels["traefik.http.services."+name+".loadbalancer.server.port"] = strconv.Itoa(internalPort)
+	}
+	if len(customDomains) > 0 {
+		// The underscore can't appear in a slug, so this never clashes with another app's router
+		routerName := subdomain + "_domains"
+		rules := make([]string, len(customDomains))
+		for i, domain := range customDomains {
+			rules[i] = fmt.Sprintf("Host(`%s`)", domain)
+		}
+		labels["traefik.http.routers."+routerName+".rule"] = strings.Join(rules, " || ")
+		labels["traefik.http.routers."+routerName+".entrypoints"] = "websecure"
+		labels["traefik.http.routers."+routerName+".tls"] = "true"
+		labels["traefik.http.routers."+routerName+".tls.certresolver"] = r.opts.CertResolver
+		labels["traefik.http.routers."+routerName+".service"] = subdomain
 	}
 
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		if key != "PORT" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	containerEnv := make([]string, 0, len(keys)+1)
+	for _, key := range keys {
+		containerEnv = append(containerEnv, key+"="+env[key])
+	}
+	// Apps that read PORT listen where Traefik expects them to
+	containerEnv = append(containerEnv, fmt.Sprintf("PORT=%d", internalPort))
+
 	// Create container config
 	containerConfig := &container.Config{
 		Image:  imageName,
 		Labels: labels,
+		Env:    containerEnv,
 	}
 
 	// Create host config
@@ -59,31 +213,414 @@ func (r *Runner) Run(ctx context.Context, imageName, subdomain, baseDomain strin
 		},
 	}
 
-	// Create network config to connect to stackyn-network
+	// Create network config to connect to the network Traefik routes over
 	networkConfig := &network.NetworkingConfig{
 		EndpointsConfig: map[string]*network.EndpointSettings{
-			"stackyn-network": {},
+			r.opts.Network: {},
 		},
 	}
 
+	if err := r.ensureImage(ctx, imageName); err != nil {
+		return "", err
+	}
+	if vol != nil {
+		name, err := r.ensureVolume(ctx, owner, *vol)
+		if err != nil {
+			return "", err
+		}
+		hostConfig.Mounts = []mount.Mount{volumeMount(name, *vol)}
+	}
+
 	// Create container
-	resp, err := r.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, containerName)
+	var resp container.CreateResponse
+	err := r.call(ctx, callTimeout, func(ctx context.Context) error {
+		var err error
+		resp, err = r.client.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, containerName)
+		return err
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed to create container: %w", err)
 	}
 
 	// Start container
-	if err := r.client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+	if err := r.Start(ctx, resp.ID); err != nil {
 		return "", fmt.Errorf("failed to start container: %w", err)
 	}
 
+	// Give the process a moment, then make sure it is still up
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-time.After(startupGracePeriod):
+	}
+
+	info, err := r.inspect(ctx, resp.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container: %w", err)
+	}
+	// A crashing container under the restart policy shows up as restarting rather than exited
+	if !info.State.Running || info.State.Restarting {
+		exitErr := &ContainerExitError{
+			ExitCode:  info.State.ExitCode,
+			OOMKilled: info.State.OOMKilled,
+			Reason:    info.State.Error,
+		}
+		// Remove the crashed container so the restart policy doesn't keep reviving it
+		if err := r.Remove(ctx, resp.ID); err != nil {
+			log.Printf("Warning: failed to remove crashed container %s: %v", resp.ID, err)
+		}
+		return "", exitErr
+	}
+
 	return resp.ID, nil
 }
 
+// ensureImage pulls imageName from the configured registry if the daemon doesn't have it.
+// Images that aren't registry references were built on this host and are never pulled.
+func (r *Runner) ensureImage(ctx context.Context, imageName string) error {
+	if !r.opts.Registry.IsReference(imageName) {
+		return nil
+	}
+	err := r.retry(ctx, func(ctx context.Context) error {
+		_, err := r.client.ImageInspect(ctx, imageName)
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect image: %w", err)
+	}
+
+	auth, err := r.opts.Registry.Auth()
+	if err != nil {
+		return err
+	}
+	log.Printf("Pulling image %s", imageName)
+	// The pull happens while the progress stream is read, so the deadline covers both
+	err = r.call(ctx, pullTimeout, func(ctx context.Context) error {
+		stream, err := r.client.ImagePull(ctx, imageName, image.PullOptions{RegistryAuth: auth})
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		return registry.CheckStream(stream)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pull image: %w", err)
+	}
+	return nil
+}
+
+// Start starts an existing, stopped container with its original image and configuration.
+func (r *Runner) Start(ctx context.Context, containerID string) error {
+	return r.call(ctx, callTimeout, func(ctx context.Context) error {
+		return r.client.ContainerStart(ctx, containerID, container.StartOptions{})
+	})
+}
+
+// inspect inspects a container, retrying transient connection errors
+func (r *Runner) inspect(ctx context.Context, containerID string) (container.InspectResponse, error) {
+	var info container.InspectResponse
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		info, err = r.client.ContainerInspect(ctx, containerID)
+		return err
+	})
+	return info, err
+}
+
+// ContainerStatus is the observed state of a container.
+type ContainerStatus struct {
+	// Exists is false if the container was removed; the other fields are then zero
+	Exists bool
+	// Name is the container's name, which is also its own hostname and Traefik service
+	Name       string
+	Running    bool
+	Restarting bool
+	ExitCode   int
+	OOMKilled  bool
+	// RestartCount is how many times Docker's restart policy has restarted the container
+	RestartCount int
+}
+
+// Status inspects a container. A container that no longer exists is reported
+// with Exists false rather than as an error.
+func (r *Runner) Status(ctx context.Context, containerID string) (*ContainerStatus, error) {
+	info, err := r.inspect(ctx, containerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return &ContainerStatus{}, nil
+		}
+		return nil, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	return &ContainerStatus{
+		Exists:       true,
+		Name:         strings.TrimPrefix(info.Name, "/"),
+		Running:      info.State.Running,
+		Restarting:   info.State.Restarting,
+		ExitCode:     info.State.ExitCode,
+		OOMKilled:    info.State.OOMKilled,
+		RestartCount: info.RestartCount,
+	}, nil
+}
+
+// Address returns a container's IP address on the configured network, which other
+// containers on that network (and usually the host) can reach it on directly.
+func (r *Runner) Address(ctx context.Context, containerID string) (string, error) {
+	info, err := r.inspect(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if info.NetworkSettings == nil || info.NetworkSettings.Networks[r.opts.Network] == nil || info.NetworkSettings.Networks[r.opts.Network].IPAddress == "" {
+		return "", fmt.Errorf("container has no address on network %q", r.opts.Network)
+	}
+	return info.NetworkSettings.Networks[r.opts.Network].IPAddress, nil
+}
+
+// IsRunning reports whether a container exists and is running.
+// A container that no longer exists is reported as not running, without an error.
+func (r *Runner) IsRunning(ctx context.Context, containerID string) (bool, error) {
+	status, err := r.Status(ctx, containerID)
+	if err != nil {
+		return false, err
+	}
+	return status.Running, nil
+}
+
+// ManagedContainer is a container Run created, as found by its labels
+type ManagedContainer struct {
+	ID    string
+	Name  string
+	Owner Owner
+	// State is Docker's state of the container: "running", "exited", "restarting", ...
+	State string
+}
+
+// Running reports whether the container is up
+func (c ManagedContainer) Running() bool {
+	return c.State == container.StateRunning
+}
+
+// ListManaged lists the containers Run created, running or not, by their labels.
+// An appID of 0 lists those of every app. Containers created before the labels were
+// introduced aren't included.
+func (r *Runner) ListManaged(ctx context.Context, appID int) ([]ManagedContainer, error) {
+	label := LabelAppID
+	if appID != 0 {
+		label = fmt.Sprintf("%s=%d", LabelAppID, appID)
+	}
+	var summaries []container.Summary
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		summaries, err = r.client.ContainerList(ctx, container.ListOptions{
+			All:     true,
+			Filters: filters.NewArgs(filters.Arg("label", label)),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	managed := make([]ManagedContainer, 0, len(summaries))
+	for _, c := range summaries {
+		appID, err := strconv.Atoi(c.Labels[LabelAppID])
+		if err != nil {
+			continue
+		}
+		deploymentID, _ := strconv.Atoi(c.Labels[LabelDeploymentID])
+		name := ""
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		managed = append(managed, ManagedContainer{
+			ID:   c.ID,
+			Name: name,
+			Owner: Owner{
+				AppID:        appID,
+				DeploymentID: deploymentID,
+				Environment:  c.Labels[LabelEnvironment],
+			},
+			State: c.State,
+		})
+	}
+	return managed, nil
+}
+
 func (r *Runner) Stop(ctx context.Context, containerID string) error {
-	return r.client.ContainerStop(ctx, containerID, container.StopOptions{})
+	return r.call(ctx, stopTimeout, func(ctx context.Context) error {
+		return r.client.ContainerStop(ctx, containerID, container.StopOptions{})
+	})
 }
 
 func (r *Runner) Remove(ctx context.Context, containerID string) error {
-	return r.client.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
+	return r.call(ctx, stopTimeout, func(ctx context.Context) error {
+		return r.client.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
+	})
+}
+
+// Restart restarts a container in place, reusing its existing image and configuration.
+func (r *Runner) Restart(ctx context.Context, containerID string) error {
+	return r.call(ctx, stopTimeout, func(ctx context.Context) error {
+		return r.client.ContainerRestart(ctx, containerID, container.StopOptions{})
+	})
+}
+
+// Logs returns the stdout/stderr log stream of a container.
+// tail limits the output to the last N lines; 0 returns the full log.
+// tty reports whether the container runs with a TTY: its stream is then raw text,
+// otherwise it is multiplexed with an 8-byte header per frame (see logs.ParseRuntimeLog).
+// The caller must close the returned reader. The stream is bounded by ctx only, since
+// reading a long log can legitimately take a while.
+func (r *Runner) Logs(ctx context.Context, containerID string, tail int) (reader io.ReadCloser, tty bool, err error) {
+	info, err := r.inspect(ctx, containerID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	tty = info.Config != nil && info.Config.Tty
+
+	tailOpt := "all"
+	if tail > 0 {
+		tailOpt = strconv.Itoa(tail)
+	}
+	reader, err = r.client.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Tail:       tailOpt,
+	})
+	return reader, tty, err
+}
+
+// FollowLogs streams a container's stdout/stderr log from since onwards (from the start if since
+// is zero), with each line prefixed by its timestamp, and keeps the stream open for new lines
+// until the container stops or ctx is cancelled. tty is as for Logs.
+// The caller must close the returned reader.
+func (r *Runner) FollowLogs(ctx context.Context, containerID string, since time.Time) (reader io.ReadCloser, tty bool, err error) {
+	info, err := r.inspect(ctx, containerID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	tty = info.Config != nil && info.Config.Tty
+
+	opts := container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Follow:     true,
+	}
+	if !since.IsZero() {
+		opts.Since = fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())
+	}
+	reader, err = r.client.ContainerLogs(ctx, containerID, opts)
+	return reader, tty, err
+}
+
+// ContainerUsage is a point-in-time resource usage snapshot of a container
+type ContainerUsage struct {
+	MemoryBytes      uint64  `json:"memory_bytes"`
+	MemoryLimitBytes uint64  `json:"memory_limit_bytes"`
+	CPUPercent       float64 `json:"cpu_percent"`
+	DiskBytes        int64   `json:"disk_bytes"`
+}
+
+// Usage returns the current memory, CPU and writable-layer disk usage of a container.
+// CPU usage is computed over the daemon's sampling interval, so this call takes about a second.
+func (r *Runner) Usage(ctx context.Context, containerID string) (*ContainerUsage, error) {
+	var stats container.StatsResponse
+	err := r.retry(ctx, func(ctx context.Context) error {
+		resp, err := r.client.ContainerStats(ctx, containerID, false)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return json.NewDecoder(resp.Body).Decode(&stats)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container stats: %w", err)
+	}
+	usage := usageFromStats(&stats)
+
+	var info container.InspectResponse
+	err = r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		info, _, err = r.client.ContainerInspectWithRaw(ctx, containerID, true)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	if info.SizeRw != nil {
+		usage.DiskBytes = *info.SizeRw
+	}
+
+	return &usage, nil
+}
+
+// StreamUsage calls fn with the memory and CPU usage of a container about once a second, as
+// the daemon samples it, until ctx is cancelled, fn returns an error or the container stops.
+// DiskBytes is not measured. The stats stream is closed when StreamUsage returns.
+//
+// Returns:
+//   - error: nil once the container stops, ctx's error once it is cancelled, otherwise the
+//     error that ended the stream
+func (r *Runner) StreamUsage(ctx context.Context, containerID string, fn func(ContainerUsage) error) error {
+	resp, err := r.client.ContainerStats(ctx, containerID, true)
+	if err != nil {
+		return fmt.Errorf("failed to get container stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var stats container.StatsResponse
+		if err := decoder.Decode(&stats); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read container stats: %w", err)
+		}
+		// The daemon sends samples without a read time once the container has stopped
+		if stats.Read.IsZero() {
+			return nil
+		}
+		if err := fn(usageFromStats(&stats)); err != nil {
+			return err
+		}
+	}
+}
+
+// usageFromStats converts raw Docker stats into a ContainerUsage,
+// using the same memory and CPU formulas as `docker stats`.
+func usageFromStats(stats *container.StatsResponse) ContainerUsage {
+	usage := ContainerUsage{
+		MemoryBytes:      stats.MemoryStats.Usage,
+		MemoryLimitBytes: stats.MemoryStats.Limit,
+	}
+
+	// Page cache is reclaimable, so exclude it like the Docker CLI does
+	// (inactive_file on cgroup v2, cache on cgroup v1)
+	cache := stats.MemoryStats.Stats["inactive_file"]
+	if cache == 0 {
+		cache = stats.MemoryStats.Stats["cache"]
+	}
+	if cache < usage.MemoryBytes {
+		usage.MemoryBytes -= cache
+	}
+
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(stats.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		usage.CPUPercent = cpuDelta / systemDelta * onlineCPUs * 100
+	}
+
+	return usage
 }
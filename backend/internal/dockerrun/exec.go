@@ -0,0 +1,74 @@
+package dockerrun
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// ExecSession is an interactive command running in a container with a terminal. Reading
+// returns the terminal's output, writing types into it.
+type ExecSession struct {
+	// ID identifies the session to ResizeExec
+	ID   string
+	resp types.HijackedResponse
+}
+
+func (s *ExecSession) Read(p []byte) (int, error) {
+	return s.resp.Reader.Read(p)
+}
+
+func (s *ExecSession) Write(p []byte) (int, error) {
+	return s.resp.Conn.Write(p)
+}
+
+// Close disconnects from the command, which sees its input end.
+func (s *ExecSession) Close() error {
+	s.resp.Close()
+	return nil
+}
+
+// Exec starts cmd in a running container, attached to a new terminal of rows by cols
+// characters (0 for Docker's default size). The caller must close the session.
+func (r *Runner) Exec(ctx context.Context, containerID string, cmd []string, rows, cols uint) (*ExecSession, error) {
+	var consoleSize *[2]uint
+	if rows > 0 && cols > 0 {
+		consoleSize = &[2]uint{rows, cols}
+	}
+
+	var created container.ExecCreateResponse
+	err := r.call(ctx, callTimeout, func(ctx context.Context) error {
+		var err error
+		created, err = r.client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+			Tty:          true,
+			ConsoleSize:  consoleSize,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			Cmd:          cmd,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	// The attached connection outlives this call, so it isn't bound by a call deadline
+	resp, err := r.client.ContainerExecAttach(ctx, created.ID, container.ExecAttachOptions{
+		Tty:         true,
+		ConsoleSize: consoleSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to exec: %w", err)
+	}
+	return &ExecSession{ID: created.ID, resp: resp}, nil
+}
+
+// ResizeExec resizes the terminal of an exec session to rows by cols characters.
+func (r *Runner) ResizeExec(ctx context.Context, execID string, rows, cols uint) error {
+	return r.call(ctx, callTimeout, func(ctx context.Context) error {
+		return r.client.ContainerExecResize(ctx, execID, container.ResizeOptions{Height: rows, Width: cols})
+	})
+}
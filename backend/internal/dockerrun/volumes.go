@@ -0,0 +1,123 @@
+package dockerrun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+)
+
+// defaultVolumeDriver is Docker's built-in volume driver, which stores volumes on the host's
+// disk and has no size option
+const defaultVolumeDriver = "local"
+
+// ErrVolumeSizeUnlimited is returned when a volume would be created with the "local" driver,
+// which can't cap its size. Volumes created before this was refused are still mounted.
+var ErrVolumeSizeUnlimited = errors.New(`persistent volumes are disabled: the "local" volume driver can't limit their size; set VOLUME_DRIVER to a driver that can`)
+
+// Volume is the persistent volume of an app's environment. Every deployment of the environment
+// mounts the same volume, so its data outlives the containers.
+type Volume struct {
+	// MountPath is the absolute path the volume is mounted at in the container
+	MountPath string
+	// SizeMB is the volume's size limit in megabytes, passed to the driver as its "size" option
+	SizeMB int
+}
+
+// VolumeName returns the name of the volume of an app's environment
+func VolumeName(appID int, environment string) string {
+	return fmt.Sprintf("stackyn-app-%d-%s", appID, environment)
+}
+
+// ensureVolume creates the volume of owner's environment if it doesn't exist yet and returns
+// its name. An existing volume is used as is, including its size. With the "local" driver only
+// existing volumes are used, and ErrVolumeSizeUnlimited is returned instead of creating one.
+func (r *Runner) ensureVolume(ctx context.Context, owner Owner, v Volume) (string, error) {
+	name := VolumeName(owner.AppID, owner.Environment)
+	driver := r.opts.VolumeDriver
+	if driver == "" {
+		driver = defaultVolumeDriver
+	}
+	if driver == defaultVolumeDriver {
+		err := r.call(ctx, callTimeout, func(ctx context.Context) error {
+			_, err := r.client.VolumeInspect(ctx, name)
+			return err
+		})
+		if client.IsErrNotFound(err) {
+			return "", ErrVolumeSizeUnlimited
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect volume %s: %w", name, err)
+		}
+		return name, nil
+	}
+	opts := volume.CreateOptions{
+		Name:   name,
+		Driver: driver,
+		Labels: map[string]string{
+			LabelAppID:       strconv.Itoa(owner.AppID),
+			LabelEnvironment: owner.Environment,
+		},
+	}
+	if v.SizeMB > 0 {
+		opts.DriverOpts = map[string]string{"size": fmt.Sprintf("%dM", v.SizeMB)}
+	}
+	// Creating a volume that already exists with the same driver returns the existing one
+	err := r.call(ctx, callTimeout, func(ctx context.Context) error {
+		_, err := r.client.VolumeCreate(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// volumeMount mounts the named volume at v.MountPath
+func volumeMount(name string, v Volume) mount.Mount {
+	return mount.Mount{
+		Type:   mount.TypeVolume,
+		Source: name,
+		Target: v.MountPath,
+	}
+}
+
+// RemoveVolumes deletes the persistent volumes of an app, and with them its data. An empty
+// environment removes the volumes of all its environments. Volumes still mounted by a
+// container can't be removed, so the app's containers must be removed first.
+//
+// Returns:
+//   - int: Number of volumes removed
+//   - error: Error if the volumes could not be listed or one could not be removed
+func (r *Runner) RemoveVolumes(ctx context.Context, appID int, environment string) (int, error) {
+	args := filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%d", LabelAppID, appID)))
+	if environment != "" {
+		args.Add("label", fmt.Sprintf("%s=%s", LabelEnvironment, environment))
+	}
+	var list volume.ListResponse
+	err := r.retry(ctx, func(ctx context.Context) error {
+		var err error
+		list, err = r.client.VolumeList(ctx, volume.ListOptions{Filters: args})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	removed := 0
+	for _, v := range list.Volumes {
+		err := r.call(ctx, callTimeout, func(ctx context.Context) error {
+			return r.client.VolumeRemove(ctx, v.Name, false)
+		})
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove volume %s: %w", v.Name, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,203 @@
+// Package domains manages custom domains attached to apps.
+// A domain is only routed to its app once ownership has been proven through DNS,
+// either with a TXT record holding the domain's verification token or a CNAME
+// pointing at the app's own subdomain.
+package domains
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ChallengePrefix is prepended to a domain to form the name of its verification TXT record
+const ChallengePrefix = "_stackyn-challenge."
+
+// hostnamePattern matches a lowercase fully-qualified hostname with at least two labels
+var hostnamePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
+
+// ErrDuplicate is returned when the domain is already attached to an app
+var ErrDuplicate = errors.New("domain is already in use")
+
+// ErrNotVerified is returned by Verify when DNS does not (yet) prove ownership
+var ErrNotVerified = errors.New("domain ownership could not be verified")
+
+type Domain struct {
+	ID                int          `json:"id"`
+	AppID             int          `json:"app_id"`
+	Domain            string       `json:"domain"`
+	VerificationToken string       `json:"verification_token"`
+	VerifiedAt        sql.NullTime `json:"verified_at"`
+	CreatedAt         time.Time    `json:"created_at"`
+}
+
+// Verified reports whether the domain has passed DNS verification
+func (d *Domain) Verified() bool {
+	return d.VerifiedAt.Valid
+}
+
+// Normalize lowercases a domain and strips a trailing dot, then checks that it is a valid hostname.
+func Normalize(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if len(domain) > 253 || !hostnamePattern.MatchString(domain) {
+		return "", fmt.Errorf("%q is not a valid domain name", domain)
+	}
+	return domain, nil
+}
+
+// Store provides database operations for custom domains.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a new Store instance with the provided database connection.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+const domainColumns = "id, app_id, domain, verification_token, verified_at, created_at"
+
+// Create attaches an unverified domain to an app with a fresh verification token.
+// Returns ErrDuplicate if the domain is already attached to any app.
+func (s *Store) Create(ctx context.Context, appID int, domain string) (*Domain, error) {
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var d Domain
+	err = s.db.QueryRowContext(ctx,
+		"INSERT INTO custom_domains (app_id, domain, verification_token) VALUES ($1, $2, $3) RETURNING "+domainColumns,
+		appID, domain, token,
+	).Scan(&d.ID, &d.AppID, &d.Domain, &d.VerificationToken, &d.VerifiedAt, &d.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, ErrDuplicate
+		}
+		return nil, err
+	}
+	return &d, nil
+}
+
+// GetByID returns a domain of the given app, or sql.ErrNoRows if it doesn't exist.
+func (s *Store) GetByID(ctx context.Context, appID, id int) (*Domain, error) {
+	var d Domain
+	err := s.db.QueryRowContext(ctx,
+		"SELECT "+domainColumns+" FROM custom_domains WHERE id = $1 AND app_id = $2",
+		id, appID,
+	).Scan(&d.ID, &d.AppID, &d.Domain, &d.VerificationToken, &d.VerifiedAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ListByAppID returns all domains of an app, verified or not, ordered by creation time.
+func (s *Store) ListByAppID(ctx context.Context, appID int) ([]*Domain, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+domainColumns+" FROM custom_domains WHERE app_id = $1 ORDER BY created_at ASC",
+		appID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []*Domain{}
+	for rows.Next() {
+		var d Domain
+		if err := rows.Scan(&d.ID, &d.AppID, &d.Domain, &d.VerificationToken, &d.VerifiedAt, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		domains = append(domains, &d)
+	}
+	return domains, rows.Err()
+}
+
+// ListVerified returns the hostnames of an app's verified domains, the ones that should be routed.
+func (s *Store) ListVerified(ctx context.Context, appID int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT domain FROM custom_domains WHERE app_id = $1 AND verified_at IS NOT NULL ORDER BY domain ASC",
+		appID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hosts []string
+	for rows.Next() {
+		var host string
+		if err := rows.Scan(&host); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
+}
+
+// MarkVerified records that a domain passed DNS verification.
+func (s *Store) MarkVerified(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE custom_domains SET verified_at = CURRENT_TIMESTAMP WHERE id = $1",
+		id,
+	)
+	return err
+}
+
+// Delete detaches a domain from its app. Returns sql.ErrNoRows if it doesn't exist.
+func (s *Store) Delete(ctx context.Context, appID, id int) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM custom_domains WHERE id = $1 AND app_id = $2", id, appID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Verify checks DNS for proof that the domain points at target (the app's own hostname).
+// Either a TXT record at ChallengePrefix+domain containing the verification token,
+// or a CNAME from the domain to target, is accepted.
+// Returns ErrNotVerified if neither is found.
+func Verify(ctx context.Context, d *Domain, target string) error {
+	records, err := net.DefaultResolver.LookupTXT(ctx, ChallengePrefix+d.Domain)
+	if err == nil {
+		for _, record := range records {
+			if strings.TrimSpace(record) == d.VerificationToken {
+				return nil
+			}
+		}
+	}
+
+	cname, err := net.DefaultResolver.LookupCNAME(ctx, d.Domain)
+	if err == nil && strings.EqualFold(strings.TrimSuffix(cname, "."), target) {
+		return nil
+	}
+
+	return ErrNotVerified
+}
+
+// newToken returns a random hex verification token
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate verification token: %w", err)
+	}
+	return "stackyn-verify=" + hex.EncodeToString(b), nil
+}
@@ -2,73 +2,342 @@ package engine
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/docker/docker/client"
+
 	"mvp-be/internal/apps"
+	"mvp-be/internal/db"
 	"mvp-be/internal/deployments"
 	"mvp-be/internal/dockerbuild"
 	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/domains"
+	"mvp-be/internal/environments"
 	"mvp-be/internal/gitrepo"
+	"mvp-be/internal/healthcheck"
+	"mvp-be/internal/imagepolicy"
 	"mvp-be/internal/logs"
+	"mvp-be/internal/maintenance"
+	"mvp-be/internal/registry"
+	"mvp-be/internal/rollout"
+	"mvp-be/internal/secrets"
 )
 
 type Engine struct {
+	database        *db.DB
 	deploymentStore *deployments.Store
 	appStore        *apps.Store
+	domainStore     *domains.Store
+	envStore        *environments.Store
+	secretStore     *secrets.Store
 	cloner          *gitrepo.Cloner
 	builder         *dockerbuild.Builder
 	runner          *dockerrun.Runner
 	baseDomain      string
+	opts            Options
+
+	// restartMu guards restartHistory, the restart counts Reconcile observed per container
+	restartMu      sync.Mutex
+	restartHistory map[string][]restartSample
+
+	// livenessMu guards liveness, the probe failures and restarts CheckLiveness observed per container
+	livenessMu sync.Mutex
+	liveness   map[string]*livenessState
+}
+
+// Options holds the engine's tunable behaviour.
+type Options struct {
+	// HealthCheck is the retry policy for the post-deploy health check
+	HealthCheck healthcheck.Options
+
+	// MaxRetries is how many times a transient failure is retried before the deployment fails
+	MaxRetries int
+
+	// LogMaxBytes caps the size of the build log stored in the database (0 = no cap)
+	LogMaxBytes int
+
+	// LogArchiveDir, if non-empty, receives the full untruncated build log of each deployment
+	LogArchiveDir string
+
+	// ReconcileRedeploy makes Reconcile queue a new deployment for apps whose container stopped
+	ReconcileRedeploy bool
+
+	// CrashLoopRestarts is how many restarts within CrashLoopWindow make Reconcile stop a
+	// container as crash-looping (0 disables the check)
+	CrashLoopRestarts int
+
+	// CrashLoopWindow is the period CrashLoopRestarts is counted over
+	CrashLoopWindow time.Duration
+
+	// LivenessFailures is how many health check probes in a row a running container must fail
+	// for CheckLiveness to restart it (0 disables liveness checks)
+	LivenessFailures int
+
+	// Retention decides which finished deployments PurgeDeployments deletes
+	Retention deployments.Retention
+
+	// Registry, if enabled, receives every built image and is where containers' images are pulled from
+	Registry registry.Config
+
+	// Rollout writes the traffic splits of gradual rollouts; gradual apps roll out immediately if it is disabled
+	Rollout *rollout.Router
+
+	// CanaryPercent is the share of traffic a gradual rollout sends to the new deployment first
+	CanaryPercent int
+
+	// CanaryDuration is how long the new deployment serves CanaryPercent before its second health check
+	CanaryDuration time.Duration
+
+	// ImagePolicy restricts and scans the base images of Dockerfile builds
+	ImagePolicy imagepolicy.Policy
+
+	// PollInterval is how long RunLoop waits after finding pending deployments; the wait doubles
+	// with each poll that finds none, up to PollMaxInterval
+	PollInterval time.Duration
+
+	// PollMaxInterval caps the wait between polls while the queue is empty
+	PollMaxInterval time.Duration
+
+	// Wakeup, if set, ends RunLoop's wait between polls early, e.g. when a deployment is queued
+	Wakeup <-chan struct{}
+
+	// Maintenance routes the hostnames of apps that aren't running to the maintenance page;
+	// SyncMaintenance does nothing if it is disabled
+	Maintenance *maintenance.Router
 }
 
 func NewEngine(
+	database *db.DB,
 	deploymentStore *deployments.Store,
 	appStore *apps.Store,
+	domainStore *domains.Store,
+	envStore *environments.Store,
+	secretStore *secrets.Store,
 	cloner *gitrepo.Cloner,
 	builder *dockerbuild.Builder,
 	runner *dockerrun.Runner,
 	baseDomain string,
+	opts Options,
 ) *Engine {
 	return &Engine{
+		database:        database,
 		deploymentStore: deploymentStore,
 		appStore:        appStore,
+		domainStore:     domainStore,
+		envStore:        envStore,
+		secretStore:     secretStore,
 		cloner:          cloner,
 		builder:         builder,
 		runner:          runner,
 		baseDomain:      baseDomain,
+		opts:            opts,
+		restartHistory:  make(map[string][]restartSample),
+		liveness:        make(map[string]*livenessState),
 	}
 }
 
 func (e *Engine) ProcessDeployment(ctx context.Context, deploymentID int) error {
 	// Get deployment
-	deployment, err := e.deploymentStore.GetByID(deploymentID)
+	deployment, err := e.deploymentStore.GetByID(ctx, deploymentID)
 	if err != nil {
 		return fmt.Errorf("failed to get deployment: %w", err)
 	}
 
+	// It may have been cancelled by a newer deployment since it was fetched
+	if deployment.Status != deployments.StatusPending {
+		log.Printf("Skipping deployment %d: status is %s", deploymentID, deployment.Status)
+		return nil
+	}
+
 	// Get app
-	app, err := e.appStore.GetByID(deployment.AppID)
+	app, err := e.appStore.GetByID(ctx, deployment.AppID)
 	if err != nil {
 		return fmt.Errorf("failed to get app: %w", err)
 	}
 
-	log.Printf("Processing deployment %d for app %s", deploymentID, app.Name)
+	log.Printf("Processing deployment %d for app %s (%s)", deploymentID, app.Name, deployment.Environment)
 
-	// Step 1: Clone repository
-	if err := e.deploymentStore.UpdateStatus(deploymentID, deployments.StatusBuilding); err != nil {
+	// Mark the deployment as being worked on, unless it was cancelled or picked up since it was read
+	claimed, err := e.deploymentStore.Transition(ctx, deploymentID, deployments.StatusPending, deployments.StatusBuilding)
+	if err != nil {
 		return fmt.Errorf("failed to update status: %w", err)
 	}
+	if !claimed {
+		log.Printf("Skipping deployment %d: no longer pending", deploymentID)
+		return nil
+	}
 	
 	// Update app status to "Building"
-	if err := e.appStore.UpdateStatus(deployment.AppID, "Building"); err != nil {
-		log.Printf("Warning: failed to update app status to Building: %v", err)
+	if tracksApp(deployment) {
+		if err := e.appStore.UpdateStatus(ctx, deployment.AppID, "Building"); err != nil {
+			log.Printf("Warning: failed to update app status to Building: %v", err)
+		}
+	}
+
+	env, err := e.envStore.Get(ctx, deployment.AppID, deployment.Environment)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			e.fail(ctx, deployment, fmt.Sprintf("Environment %q no longer exists", deployment.Environment), false)
+		} else {
+			// A database error, which the retry will likely get past
+			e.fail(ctx, deployment, fmt.Sprintf("Failed to load environment %q: %v", deployment.Environment, err), true)
+		}
+		return fmt.Errorf("failed to get environment: %w", err)
+	}
+
+	// Steps 1 and 2: Clone and build the image, unless a promotion brings one
+	var runImage string
+	var port int
+	if deployment.PromotedFrom.Valid {
+		// A promotion runs the image another environment built and tested, without rebuilding it
+		runImage, port, err = e.promotedImage(ctx, deployment)
+	} else {
+		runImage, port, err = e.build(ctx, deployment, app, env)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Step 3: Run container with Traefik labels
+	// The subdomain stays the same across deployments of an environment; the container name is unique per deployment
+	subdomain := environments.Subdomain(app.EffectiveSlug(), env.Name)
+	containerName := environments.DeploymentName(subdomain, deploymentID)
+	// Only verified custom domains are routed, to production; removed ones drop off with this deploy
+	var customDomains []string
+	if env.Name == environments.Production {
+		customDomains, err = e.domainStore.ListVerified(ctx, deployment.AppID)
+		if err != nil {
+			log.Printf("Warning: failed to load custom domains: %v", err)
+		}
+	}
+	// A gradual rollout keeps the traffic on the running deployment until the new one proves itself
+	gradual := e.beginRollout(ctx, app, deployment, subdomain, customDomains)
+	defer e.endRollout(gradual)
+	containerEnv, err := e.containerEnv(ctx, deployment.AppID, env)
+	if err != nil {
+		e.fail(ctx, deployment, fmt.Sprintf("Failed to load app secrets: %v", err), false)
+		return fmt.Errorf("failed to load app secrets: %w", err)
+	}
+	containerID, err := e.runner.Run(ctx, dockerrun.Owner{AppID: deployment.AppID, DeploymentID: deploymentID, Environment: deployment.Environment}, runImage, containerName, subdomain, e.baseDomain, customDomains, port, containerEnv, appVolume(app))
+	if err != nil {
+		if isDaemonDown(err) {
+			e.requeueUnavailable(ctx, deployment, err)
+			return fmt.Errorf("container run failed: %w", err)
+		}
+		errorMsg := fmt.Sprintf("Container run failed: %v", err)
+		var exitErr *dockerrun.ContainerExitError
+		if errors.As(err, &exitErr) {
+			if err := e.deploymentStore.UpdateExitStatus(ctx, deploymentID, exitErr.ExitCode, exitErr.OOMKilled); err != nil {
+				log.Printf("Warning: failed to record container exit status: %v", err)
+			}
+			errorMsg = containerExitMessage(exitErr)
+		}
+		e.fail(ctx, deployment, errorMsg, isDockerUnavailable(err))
+		return fmt.Errorf("container run failed: %w", err)
 	}
 
-	// Use branch from app, default to "main" only if empty
-	branch := app.Branch
+	// Update container info
+	if err := e.deploymentStore.UpdateContainer(ctx, deploymentID, containerID, subdomain); err != nil {
+		return fmt.Errorf("failed to update container info: %w", err)
+	}
+	e.recordEvent(ctx, deploymentID, deployments.EventContainerStarted, containerName)
+
+	// Step 4: Wait for the container itself to answer on the Docker network, so it is ready
+	// before we rely on Traefik, then verify it answers on its health check path through Traefik.
+	// Probe its own hostname, since the stable one may still be served by the previous deployment
+	// The direct probe gets a share of the retries' time on top of it; the external check always
+	// gets all of it, since a worker outside Docker can't reach the container network at all
+	externalCheck := e.opts.HealthCheck
+	if e.waitReady(ctx, containerID, port, app) {
+		// The container already had its initial delay
+		externalCheck.InitialDelay = 0
+	}
+	checkCtx, cancelCheck := context.WithTimeout(ctx, externalCheck.Budget())
+	defer cancelCheck()
+	appURL := fmt.Sprintf("https://%s.%s", subdomain, e.baseDomain)
+	deploymentURL := fmt.Sprintf("https://%s.%s", containerName, e.baseDomain)
+	if err := healthcheck.Verify(checkCtx, deploymentURL, app.HealthCheckPath, app.HealthCheckStatus, externalCheck); err != nil {
+		e.fail(ctx, deployment, fmt.Sprintf("Health check failed on %s: %v", app.HealthCheckPath, err), false)
+		// Don't leave an unhealthy container routed
+		if err := e.runner.Remove(ctx, containerID); err != nil {
+			log.Printf("Warning: failed to remove unhealthy container %s: %v", containerID, err)
+		}
+		return fmt.Errorf("health check failed: %w", err)
+	}
+	log.Printf("Readiness: confirmed externally at %s", deploymentURL)
+	e.recordEvent(ctx, deploymentID, deployments.EventHealthCheckPassed, deploymentURL+app.HealthCheckPath)
+
+	if gradual != nil {
+		if err := e.promote(ctx, gradual, containerID, containerName, deploymentURL, app); err != nil {
+			e.fail(ctx, deployment, fmt.Sprintf("Gradual rollout failed: %v", err), false)
+			if err := e.runner.Remove(ctx, containerID); err != nil {
+				log.Printf("Warning: failed to remove unhealthy container %s: %v", containerID, err)
+			}
+			return fmt.Errorf("gradual rollout failed: %w", err)
+		}
+	}
+
+	// Step 5: Mark as running and the app as "Healthy" with its URL, together,
+	// so the app can't show a URL for a deployment that isn't recorded as running.
+	// A successful deploy brings a stopped app back up, so it is wanted running again.
+	// The app's status and URL are its production environment's.
+	err = e.database.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := e.deploymentStore.WithTx(tx).UpdateStatus(ctx, deploymentID, deployments.StatusRunning); err != nil {
+			return fmt.Errorf("failed to update status: %w", err)
+		}
+		if !tracksApp(deployment) {
+			return nil
+		}
+		if err := e.appStore.WithTx(tx).UpdateStatusAndURL(ctx, deployment.AppID, "Healthy", appURL); err != nil {
+			return fmt.Errorf("failed to update app status and URL: %w", err)
+		}
+		if err := e.appStore.WithTx(tx).UpdateDesiredState(ctx, deployment.AppID, apps.DesiredStateRunning); err != nil {
+			return fmt.Errorf("failed to update app desired state: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e.recordEvent(ctx, deploymentID, deployments.EventRunning, appURL)
+	e.notifyStatus(ctx, deploymentID, deployments.StatusRunning, appURL, "")
+
+	// Step 6: Take the previous deployments out of rotation now that the new one is serving
+	e.retirePrevious(ctx, deployment)
+
+	// The image is built and the source isn't needed at runtime
+	if err := e.cloner.Remove(deploymentID); err != nil {
+		log.Printf("Warning: failed to remove repository clone of deployment %d: %v", deploymentID, err)
+	}
+
+	log.Printf("Deployment %d completed successfully. Container: %s, Subdomain: %s.%s",
+		deploymentID, containerID, subdomain, e.baseDomain)
+
+	return nil
+}
+
+// build clones the deployment's commit and builds its image (steps 1 and 2 of ProcessDeployment),
+// pushing it to the registry if one is configured. It returns the image to run and the port the
+// app listens on; on error the deployment has already been failed or requeued.
+func (e *Engine) build(ctx context.Context, deployment *deployments.Deployment, app *apps.App, env *environments.Environment) (string, int, error) {
+	deploymentID := deployment.ID
+
+	// Step 1: Clone repository
+	// Use branch from the environment or app, default to "main" only if empty
+	branch := env.BranchOr(app.Branch)
 	log.Printf("App branch from database: '%s'", branch)
 	if branch == "" {
 		log.Printf("Branch is empty, defaulting to 'main'")
@@ -77,83 +346,438 @@ func (e *Engine) ProcessDeployment(ctx context.Context, deploymentID int) error
 		log.Printf("Using branch: '%s'", branch)
 	}
 
-	repoPath, err := e.cloner.Clone(app.RepoURL, deploymentID, branch)
+	if deployment.Commit.Valid {
+		log.Printf("Pinning deployment to commit: '%s'", deployment.Commit.String)
+	}
+
+	if app.Submodules || app.LFS {
+		log.Printf("Cloning with submodules: %t, LFS files: %t", app.Submodules, app.LFS)
+	}
+	repoPath, err := e.cloner.Clone(ctx, app.RepoURL, deploymentID, branch, deployment.Commit.String, gitrepo.CloneOptions{Submodules: app.Submodules, LFS: app.LFS})
 	if err != nil {
-		e.deploymentStore.UpdateError(deploymentID, fmt.Sprintf("Git clone failed: %v", err))
-		// Update app status to "Failed"
-		e.appStore.UpdateStatus(deployment.AppID, "Failed")
-		return fmt.Errorf("git clone failed: %w", err)
+		e.fail(ctx, deployment, fmt.Sprintf("Git clone failed: %v", err), gitrepo.IsTransient(err))
+		return "", 0, fmt.Errorf("git clone failed: %w", err)
 	}
 
-	// Check if Dockerfile exists before attempting to build
-	if err := gitrepo.CheckDockerfile(repoPath); err != nil {
-		errorMsg := "Dockerfile is not available in the repository root directory. Please ensure your repository contains a Dockerfile."
-		e.deploymentStore.UpdateError(deploymentID, errorMsg)
-		// Update app status to "Failed"
-		e.appStore.UpdateStatus(deployment.AppID, "Failed")
-		return fmt.Errorf("dockerfile check failed: %w", err)
+	if !app.LFS && gitrepo.UsesLFS(repoPath) {
+		log.Printf("Warning: the repository uses Git LFS but the app doesn't download LFS files; building with their pointers")
 	}
 
-	// Step 2: Build Docker image
-	imageName := fmt.Sprintf("mvp-%s:%d", strings.ToLower(app.Name), deploymentID)
-	builtImage, buildLogReader, err := e.builder.Build(ctx, repoPath, imageName)
+	// Record exactly which commit is being built
+	sha, message, err := gitrepo.HeadCommit(ctx, repoPath)
 	if err != nil {
-		e.deploymentStore.UpdateError(deploymentID, fmt.Sprintf("Docker build failed: %v", err))
-		// Update app status to "Failed"
-		e.appStore.UpdateStatus(deployment.AppID, "Failed")
-		return fmt.Errorf("docker build failed: %w", err)
+		log.Printf("Warning: failed to read commit info: %v", err)
+	} else if err := e.deploymentStore.UpdateCommit(ctx, deploymentID, sha, message); err != nil {
+		log.Printf("Warning: failed to update commit info: %v", err)
 	}
+	e.recordEvent(ctx, deploymentID, deployments.EventCloned, sha)
 
-	// Parse and store build log
-	buildLog, err := logs.ParseBuildLog(buildLogReader)
+	// The app may live in a subdirectory of a monorepo
+	contextPath := filepath.Join(repoPath, app.ContextDir)
+	// Nothing may be read or archived through a symlink that leads out of the checkout
+	if err := gitrepo.CheckBuildPaths(repoPath, app.ContextDir, app.Dockerfile()); err != nil {
+		e.fail(ctx, deployment, fmt.Sprintf("Invalid build path: %v", err), false)
+		return "", 0, fmt.Errorf("build path check failed: %w", err)
+	}
+
+	// Check if Dockerfile exists before attempting to build; buildpack apps don't need one
+	if app.BuildType != apps.BuildTypeBuildpack {
+		if err := gitrepo.CheckDockerfile(contextPath, app.Dockerfile()); err != nil {
+			errorMsg := fmt.Sprintf("Dockerfile is not available in the repository (%v). Please ensure your repository contains %s, or set the app's build_type to \"buildpack\".", err, path.Join(app.ContextDir, app.Dockerfile()))
+			e.fail(ctx, deployment, errorMsg, false)
+			return "", 0, fmt.Errorf("dockerfile check failed: %w", err)
+		}
+		e.recordEvent(ctx, deploymentID, deployments.EventDockerfileChecked, path.Join(app.ContextDir, app.Dockerfile()))
+	}
+
+	// Step 2: Build Docker image
+	imageName := dockerbuild.ImageName(app.EffectiveSlug(), deployment.AppID, deploymentID)
+	// Never build on top of, or fall back to, an image left behind with the same tag
+	if removed, err := e.builder.RemoveStaleImage(ctx, imageName); err != nil {
+		if isDaemonDown(err) {
+			e.requeueUnavailable(ctx, deployment, err)
+			return "", 0, fmt.Errorf("stale image check failed: %w", err)
+		}
+		e.fail(ctx, deployment, fmt.Sprintf("Failed to remove stale image: %v", err), isDockerUnavailable(err))
+		return "", 0, fmt.Errorf("stale image check failed: %w", err)
+	} else if removed {
+		log.Printf("Removed stale image %s before building", imageName)
+	}
+	buildArgs, err := e.appStore.GetBuildArgs(ctx, deployment.AppID)
 	if err != nil {
-		log.Printf("Warning: failed to parse build log: %v", err)
+		log.Printf("Warning: failed to load build args: %v", err)
+	}
+	if len(buildArgs) > 0 {
+		keys := make([]string, 0, len(buildArgs))
+		for key := range buildArgs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		log.Printf("Using build args: %s", strings.Join(keys, ", "))
+	}
+	// Operators may restrict which base images are built on. Nixpacks picks its own, which
+	// can't be checked, so buildpack builds are refused while a policy is configured.
+	if app.BuildType == apps.BuildTypeBuildpack && e.opts.ImagePolicy.Enabled() {
+		msg := "Buildpack builds choose their own base images and can't be checked against the base image policy; add a Dockerfile to the repository and use the dockerfile build type"
+		e.fail(ctx, deployment, msg, false)
+		return "", 0, errors.New(msg)
+	}
+	if e.opts.ImagePolicy.Enabled() {
+		if err := e.checkBaseImages(ctx, filepath.Join(contextPath, app.Dockerfile()), buildArgs); err != nil {
+			e.fail(ctx, deployment, fmt.Sprintf("Base image check failed: %v", err), false)
+			return "", 0, fmt.Errorf("base image check failed: %w", err)
+		}
+	}
+	buildSecrets, err := e.appStore.GetBuildSecrets(ctx, deployment.AppID)
+	if err != nil {
+		// Building without them would produce an image missing what they provide
+		e.fail(ctx, deployment, fmt.Sprintf("Failed to load build secrets: %v", err), false)
+		return "", 0, fmt.Errorf("failed to load build secrets: %w", err)
+	}
+	// Build output can echo ARG values, so mask the secret-looking ones, and every build secret
+	secrets := logs.SecretValues(buildArgs)
+	if len(buildSecrets) > 0 {
+		keys := make([]string, 0, len(buildSecrets))
+		for key, value := range buildSecrets {
+			keys = append(keys, key)
+			secrets = append(secrets, value)
+		}
+		sort.Strings(keys)
+		log.Printf("Using build secrets: %s", strings.Join(keys, ", "))
+	}
+	buildEvent := imageName
+	if deployment.NoCache {
+		log.Printf("Building without the layer cache (no_cache requested)")
+		buildEvent += " (no cache)"
+	}
+	e.recordEvent(ctx, deploymentID, deployments.EventBuilding, buildEvent)
+	var builtImage string
+	var buildLogReader io.ReadCloser
+	if app.BuildType == apps.BuildTypeBuildpack {
+		log.Printf("Building with Nixpacks (no Dockerfile)")
+		if len(buildSecrets) > 0 {
+			// Nixpacks can only pass them as build environment, which ends up in the image
+			log.Printf("Warning: build secrets are not passed to Nixpacks builds")
+		}
+		builtImage, buildLogReader, err = e.builder.BuildWithNixpacks(ctx, contextPath, imageName, buildArgs, deployment.NoCache)
 	} else {
-		if err := e.deploymentStore.UpdateBuildLog(deploymentID, buildLog); err != nil {
-			log.Printf("Warning: failed to update build log: %v", err)
+		builtImage, buildLogReader, err = e.builder.Build(ctx, contextPath, app.Dockerfile(), imageName, buildArgs, buildSecrets, deployment.NoCache)
+	}
+	if err != nil {
+		// Keep whatever output the build produced so the user can see why it failed
+		errorMsg := fmt.Sprintf("Docker build failed: %v", err)
+		if buildLogReader != nil {
+			// CLI builds (BuildKit, Nixpacks) only say the command failed; their output says why
+			if summary := e.storeBuildLog(ctx, deploymentID, buildLogReader, secrets); summary != "" {
+				errorMsg = "Docker build failed: " + summary
+			}
+		}
+		if isDaemonDown(err) {
+			e.requeueUnavailable(ctx, deployment, err)
+			return "", 0, fmt.Errorf("docker build failed: %w", err)
 		}
+		e.fail(ctx, deployment, errorMsg, isDockerUnavailable(err))
+		return "", 0, fmt.Errorf("docker build failed: %w", err)
+	}
+
+	// Reading the stream is what waits for the build; the daemon reports build errors inside it
+	if summary := e.storeBuildLog(ctx, deploymentID, buildLogReader, secrets); summary != "" {
+		e.fail(ctx, deployment, "Docker build failed: "+summary, false)
+		return "", 0, fmt.Errorf("docker build failed: %s", summary)
 	}
 
 	// Update image name
-	if err := e.deploymentStore.UpdateImage(deploymentID, builtImage); err != nil {
-		return fmt.Errorf("failed to update image name: %w", err)
+	if err := e.deploymentStore.UpdateImage(ctx, deploymentID, builtImage); err != nil {
+		return "", 0, fmt.Errorf("failed to update image name: %w", err)
 	}
+	e.recordEvent(ctx, deploymentID, deployments.EventBuilt, builtImage)
 
-	// Step 3: Run container with Traefik labels
-	subdomain := fmt.Sprintf("%s-%d", strings.ToLower(app.Name), deploymentID)
-	containerID, err := e.runner.Run(ctx, builtImage, subdomain, e.baseDomain)
+	// With a registry, the container runs from the pushed image so any host can start it
+	runImage := builtImage
+	if e.opts.Registry.Enabled() {
+		ref, err := e.builder.Push(ctx, builtImage, e.opts.Registry)
+		if err != nil {
+			if isDaemonDown(err) {
+				e.requeueUnavailable(ctx, deployment, err)
+				return "", 0, fmt.Errorf("image push failed: %w", err)
+			}
+			// Registries are remote services; an outage is worth retrying
+			e.fail(ctx, deployment, fmt.Sprintf("Failed to push image to registry: %v", err), true)
+			return "", 0, fmt.Errorf("image push failed: %w", err)
+		}
+		log.Printf("Pushed image %s", ref)
+		if err := e.deploymentStore.UpdateRegistryImage(ctx, deploymentID, ref); err != nil {
+			return "", 0, fmt.Errorf("failed to update registry image: %w", err)
+		}
+		runImage = ref
+	}
+
+	port := e.appPort(contextPath, app.Dockerfile())
+	if err := e.deploymentStore.UpdatePort(ctx, deploymentID, port); err != nil {
+		log.Printf("Warning: failed to record port of deployment %d: %v", deploymentID, err)
+	}
+	return runImage, port, nil
+}
+
+// promotedImage returns the image and port of a promoted deployment, copied from its source
+// deployment when the promotion was created. Nothing is cloned or built.
+func (e *Engine) promotedImage(ctx context.Context, deployment *deployments.Deployment) (string, int, error) {
+	if !deployment.ImageName.Valid || !deployment.Port.Valid {
+		e.fail(ctx, deployment, "Promoted deployment has no image to run", false)
+		return "", 0, errors.New("promoted deployment has no image")
+	}
+	runImage := deployment.ImageName.String
+	if deployment.RegistryImage.Valid {
+		runImage = deployment.RegistryImage.String
+	}
+	log.Printf("Promoting image %s of deployment %d", runImage, deployment.PromotedFrom.Int64)
+	e.recordEvent(ctx, deployment.ID, deployments.EventPromoted, fmt.Sprintf("deployment %d (%s)", deployment.PromotedFrom.Int64, runImage))
+	return runImage, int(deployment.Port.Int64), nil
+}
+
+// checkBaseImages checks the Dockerfile's base images against the image policy and runs its
+// scan on them.
+func (e *Engine) checkBaseImages(ctx context.Context, dockerfile string, buildArgs map[string]string) error {
+	images, err := gitrepo.BaseImages(dockerfile, buildArgs)
 	if err != nil {
-		e.deploymentStore.UpdateError(deploymentID, fmt.Sprintf("Container run failed: %v", err))
-		// Update app status to "Failed"
-		e.appStore.UpdateStatus(deployment.AppID, "Failed")
-		return fmt.Errorf("container run failed: %w", err)
+		return fmt.Errorf("failed to read the Dockerfile: %w", err)
 	}
+	if err := e.opts.ImagePolicy.Check(images); err != nil {
+		return err
+	}
+	if err := e.opts.ImagePolicy.Scan(ctx, images); err != nil {
+		return err
+	}
+	log.Printf("Base images allowed by policy: %s", strings.Join(images, ", "))
+	return nil
+}
 
-	// Update container info
-	if err := e.deploymentStore.UpdateContainer(deploymentID, containerID, subdomain); err != nil {
-		return fmt.Errorf("failed to update container info: %w", err)
+// tracksApp reports whether a deployment's progress is reflected in its app's status and URL,
+// which belong to the production environment
+func tracksApp(d *deployments.Deployment) bool {
+	return d.Environment == environments.Production
+}
+
+// recordEvent adds a step to the deployment's timeline. The timeline is informational,
+// so a failure to record it doesn't stop the deployment.
+func (e *Engine) recordEvent(ctx context.Context, deploymentID int, event deployments.EventType, message string) {
+	if err := e.deploymentStore.AddEvent(ctx, deploymentID, event, message); err != nil {
+		log.Printf("Warning: failed to record %s event of deployment %d: %v", event, deploymentID, err)
 	}
+}
 
-	// Step 4: Mark as running
-	if err := e.deploymentStore.UpdateStatus(deploymentID, deployments.StatusRunning); err != nil {
-		return fmt.Errorf("failed to update status: %w", err)
+// internalCheckShare is the part of the health-check retries' time (see healthcheck.Options.Budget)
+// that waitReady may take before the external check starts
+const internalCheckShare = 2
+
+// waitReady probes the container directly on its network address until it answers its health check,
+// for at most 1/internalCheckShare of the time the health-check retries take. The worker isn't
+// always able to reach the container network, so a failure here is only logged; the check
+// through Traefik that follows decides whether the deployment is healthy. It reports whether the
+// container answered.
+func (e *Engine) waitReady(ctx context.Context, containerID string, port int, app *apps.App) bool {
+	address, err := e.runner.Address(ctx, containerID)
+	if err != nil {
+		log.Printf("Readiness: no internal address (%v); relying on the external check", err)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.opts.HealthCheck.Budget()/internalCheckShare)
+	defer cancel()
+	internalURL := fmt.Sprintf("http://%s:%d", address, port)
+	if err := healthcheck.Verify(ctx, internalURL, app.HealthCheckPath, app.HealthCheckStatus, e.opts.HealthCheck); err != nil {
+		log.Printf("Readiness: not confirmed internally at %s (%v); relying on the external check", internalURL, err)
+		return false
 	}
+	log.Printf("Readiness: confirmed internally at %s", internalURL)
+	return true
+}
 
-	// Update app status to "Healthy" and set URL
-	appURL := fmt.Sprintf("https://%s.%s", subdomain, e.baseDomain)
-	if err := e.appStore.UpdateStatusAndURL(deployment.AppID, "Healthy", appURL); err != nil {
-		log.Printf("Warning: failed to update app status and URL: %v", err)
+// appPort decides which port the app listens on: the Dockerfile's EXPOSE if it has one,
+// otherwise the usual port of the language or framework detected in the build context
+func (e *Engine) appPort(contextPath, dockerfile string) int {
+	if port := gitrepo.ExposedPort(filepath.Join(contextPath, dockerfile)); port != 0 {
+		log.Printf("Using port %d from Dockerfile EXPOSE", port)
+		return port
 	}
+	info := gitrepo.DetectApp(contextPath)
+	log.Printf("Detected language '%s', framework '%s'; using port %d", info.Language, info.Framework, info.Port)
+	return info.Port
+}
 
-	log.Printf("Deployment %d completed successfully. Container: %s, Subdomain: %s.%s",
-		deploymentID, containerID, subdomain, e.baseDomain)
+// retirePrevious removes the containers of the running deployments of current's app and
+// environment other than current itself, and marks those deployments stopped.
+func (e *Engine) retirePrevious(ctx context.Context, current *deployments.Deployment) {
+	appID := current.AppID
+	running, err := e.deploymentStore.GetRunningByEnvironment(ctx, appID, current.Environment)
+	if err != nil {
+		log.Printf("Warning: failed to list previous deployments of app %d: %v", appID, err)
+		return
+	}
+	for _, d := range running {
+		if d.ID == current.ID {
+			continue
+		}
+		// Claim the deployment first, so one that moved on since it was listed keeps its container
+		stopped, err := e.deploymentStore.Transition(ctx, d.ID, deployments.StatusRunning, deployments.StatusStopped)
+		if err != nil {
+			log.Printf("Warning: failed to mark previous deployment %d stopped: %v", d.ID, err)
+			continue
+		}
+		if !stopped {
+			log.Printf("Previous deployment %d of app %d is no longer running; leaving it alone", d.ID, appID)
+			continue
+		}
+		if d.ContainerID.Valid {
+			// A container that is already gone has nothing left to retire
+			if err := e.runner.Remove(ctx, d.ContainerID.String); err != nil && !client.IsErrNotFound(err) {
+				log.Printf("Warning: failed to remove container of previous deployment %d: %v", d.ID, err)
+				continue
+			}
+		}
+		log.Printf("Retired previous deployment %d of app %d", d.ID, appID)
+	}
+}
 
-	return nil
+// storeBuildLog parses a build log stream, masks the given secret values, archives the full
+// log if configured and stores the (possibly truncated) log on the deployment.
+// If the log reports that the build failed, the failure summary is stored too and returned;
+// it is empty for a successful build.
+func (e *Engine) storeBuildLog(ctx context.Context, deploymentID int, buildLogReader io.ReadCloser, secrets []string) string {
+	// When archiving, read the whole log so the archive is complete, and cap only the DB copy
+	parseLimit := e.opts.LogMaxBytes
+	if e.opts.LogArchiveDir != "" {
+		parseLimit = 0
+	}
+	parsed, err := logs.ParseBuildLog(buildLogReader, parseLimit)
+	if err != nil {
+		log.Printf("Warning: failed to parse build log: %v", err)
+		return ""
+	}
+	if cache := parsed.CacheSummary(); cache != "" {
+		log.Printf("Build cache: %s", cache)
+	}
+
+	buildLog := logs.Redact(parsed.Text, secrets)
+	if e.opts.LogArchiveDir != "" {
+		path := logs.ArchivePath(e.opts.LogArchiveDir, deploymentID, "build")
+		if err := os.WriteFile(path, []byte(buildLog), 0644); err != nil {
+			log.Printf("Warning: failed to archive build log: %v", err)
+		}
+		buildLog = logs.Truncate(buildLog, e.opts.LogMaxBytes)
+	}
+	if err := e.deploymentStore.UpdateBuildLog(ctx, deploymentID, buildLog); err != nil {
+		log.Printf("Warning: failed to update build log: %v", err)
+	}
+
+	summary := logs.Redact(parsed.FailureSummary(), secrets)
+	if summary != "" {
+		if err := e.deploymentStore.UpdateFailureSummary(ctx, deploymentID, summary); err != nil {
+			log.Printf("Warning: failed to update failure summary: %v", err)
+		}
+	}
+	return summary
 }
 
+// SweepRepos removes the clone directories of deployments that are no longer pending or building,
+// catching checkouts left behind by failed or interrupted deploys.
+// Returns the number of directories removed.
+func (e *Engine) SweepRepos(ctx context.Context) (int, error) {
+	ids, err := e.cloner.DeploymentIDs()
+	if err != nil {
+		return 0, err
+	}
+	finished, err := e.deploymentStore.FilterFinished(ctx, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check deployment statuses: %w", err)
+	}
+
+	removed := 0
+	for _, id := range finished {
+		if err := e.cloner.Remove(id); err != nil {
+			log.Printf("Warning: failed to remove repository clone of deployment %d: %v", id, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// PurgeDeployments deletes finished deployments outside the retention, together with their
+// archived log files.
+//
+// Returns:
+//   - int: Number of deployments deleted
+//   - error: Error if the purge query fails
+func (e *Engine) PurgeDeployments(ctx context.Context) (int, error) {
+	ids, err := e.deploymentStore.Purge(ctx, e.opts.Retention)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deployments: %w", err)
+	}
+	if e.opts.LogArchiveDir != "" {
+		for _, id := range ids {
+			for _, logType := range []string{"build", "runtime"} {
+				path := logs.ArchivePath(e.opts.LogArchiveDir, id, logType)
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					log.Printf("Warning: failed to remove archived log %s: %v", path, err)
+				}
+			}
+		}
+	}
+	return len(ids), nil
+}
+
+// appVolume returns the persistent volume an app's containers mount, or nil if it has none
+func appVolume(app *apps.App) *dockerrun.Volume {
+	if app.VolumePath == "" {
+		return nil
+	}
+	return &dockerrun.Volume{MountPath: app.VolumePath, SizeMB: app.VolumeSizeMB}
+}
+
+// containerEnv returns the environment variables of an environment's containers: its own
+// variables, with the app's secrets on top. Only the secrets' names are logged.
+func (e *Engine) containerEnv(ctx context.Context, appID int, env *environments.Environment) (map[string]string, error) {
+	appSecrets, err := e.secretStore.Values(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	if len(appSecrets) == 0 {
+		return env.EnvVars, nil
+	}
+	vars := make(map[string]string, len(env.EnvVars)+len(appSecrets))
+	for key, value := range env.EnvVars {
+		vars[key] = value
+	}
+	keys := make([]string, 0, len(appSecrets))
+	for key, value := range appSecrets {
+		keys = append(keys, key)
+		vars[key] = value
+	}
+	sort.Strings(keys)
+	log.Printf("Using app secrets: %s", strings.Join(keys, ", "))
+	return vars, nil
+}
+
+// containerExitMessage turns a container exit into an actionable message for the user.
+func containerExitMessage(exitErr *dockerrun.ContainerExitError) string {
+	switch {
+	case exitErr.OOMKilled:
+		return "Your app was killed because it ran out of memory. Increase your plan's memory or reduce the app's memory usage, then redeploy."
+	case exitErr.Reason != "":
+		// Docker reports an error when the container could not run at all (bad entrypoint, missing binary, etc.)
+		return fmt.Sprintf("Container failed to start (exit code %d): %s. Check your Dockerfile's CMD/ENTRYPOINT.", exitErr.ExitCode, exitErr.Reason)
+	default:
+		return fmt.Sprintf("Your app crashed shortly after starting (exit code %d). Check the runtime logs for details.", exitErr.ExitCode)
+	}
+}
+
+// RunLoop processes pending deployments until ctx is cancelled. It polls again soon after
+// finding work and backs off while the queue is empty or can't be read (see nextPollDelay),
+// but polls right away when Options.Wakeup fires.
 func (e *Engine) RunLoop(ctx context.Context) {
 	log.Println("Deployment engine started")
 
+	delay := e.opts.PollInterval
 	for {
 		select {
 		case <-ctx.Done():
@@ -161,10 +785,9 @@ func (e *Engine) RunLoop(ctx context.Context) {
 			return
 		default:
 			// Get pending deployments
-			pending, err := e.deploymentStore.GetPending()
+			pending, err := e.deploymentStore.GetPending(ctx)
 			if err != nil {
 				log.Printf("Error fetching pending deployments: %v", err)
-				continue
 			}
 
 			// Process each pending deployment
@@ -174,14 +797,38 @@ func (e *Engine) RunLoop(ctx context.Context) {
 				}
 			}
 
-			// Simple polling - in production, use a better mechanism
-			// Sleep for a short duration before checking again
+			delay = nextPollDelay(delay, e.opts.PollInterval, e.opts.PollMaxInterval, len(pending) > 0)
 			select {
 			case <-ctx.Done():
+				log.Println("Deployment engine stopped")
 				return
-			case <-time.After(2 * time.Second):
-				// Poll every 2 seconds
+			case <-time.After(jitter(delay)):
+			case <-e.opts.Wakeup:
+				delay = e.opts.PollInterval
 			}
 		}
 	}
 }
+
+// nextPollDelay returns the wait before the next poll: base after one that found work, otherwise
+// double the previous wait, capped at limit. A failed poll backs off like an empty one, so an
+// unreachable database isn't hammered.
+func nextPollDelay(previous, base, limit time.Duration, found bool) time.Duration {
+	if found || previous < base {
+		return base
+	}
+	return min(previous*2, limit)
+}
+
+// pollJitter is the largest fraction a poll's wait is shortened or lengthened by
+const pollJitter = 0.2
+
+// jitter spreads d by up to pollJitter either way, so workers started together don't keep
+// polling in lockstep
+func jitter(d time.Duration) time.Duration {
+	spread := time.Duration(float64(d) * pollJitter)
+	if spread <= 0 {
+		return d
+	}
+	return d - spread + rand.N(2*spread)
+}
@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"mvp-be/internal/apps"
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/healthcheck"
+)
+
+// Readiness and liveness are checked differently. Readiness is the health check a new
+// deployment must pass before it takes traffic; if it fails, the new container is removed and
+// the previous deployment keeps serving. Liveness is checked afterwards, for as long as the
+// deployment runs: an app that stops answering its health check is restarted in place, since
+// there is no earlier container to fall back to.
+
+// livenessProbeTimeout bounds a single liveness probe, including the container inspection
+const livenessProbeTimeout = 10 * time.Second
+
+// livenessState is what the liveness checks remember about one container
+type livenessState struct {
+	// failures is the number of probes in a row the container failed
+	failures int
+	// restarts are the times the container was restarted for failing its probes
+	restarts []time.Time
+}
+
+// livenessFailed records a failed probe of a container and returns how many probes in a row it failed
+func (e *Engine) livenessFailed(containerID string) int {
+	e.livenessMu.Lock()
+	defer e.livenessMu.Unlock()
+
+	state := e.liveness[containerID]
+	if state == nil {
+		state = &livenessState{}
+		e.liveness[containerID] = state
+	}
+	state.failures++
+	return state.failures
+}
+
+// livenessPassed records a passed probe of a container and returns how many probes in a row it
+// had failed before
+func (e *Engine) livenessPassed(containerID string) int {
+	e.livenessMu.Lock()
+	defer e.livenessMu.Unlock()
+
+	state := e.liveness[containerID]
+	if state == nil {
+		return 0
+	}
+	failures := state.failures
+	state.failures = 0
+	return failures
+}
+
+// livenessRestarted records a restart of a container and returns how many times it was
+// restarted for failing its probes within CrashLoopWindow, including this one
+func (e *Engine) livenessRestarted(containerID string, now time.Time) int {
+	e.livenessMu.Lock()
+	defer e.livenessMu.Unlock()
+
+	state := e.liveness[containerID]
+	if state == nil {
+		state = &livenessState{}
+		e.liveness[containerID] = state
+	}
+	state.failures = 0
+	restarts := append(state.restarts, now)
+	for len(restarts) > 0 && now.Sub(restarts[0]) >= e.opts.CrashLoopWindow {
+		restarts = restarts[1:]
+	}
+	state.restarts = restarts
+	return len(restarts)
+}
+
+// forgetLiveness drops the liveness state of containers that are no longer probed
+func (e *Engine) forgetLiveness(probed map[string]bool) {
+	e.livenessMu.Lock()
+	defer e.livenessMu.Unlock()
+	for id := range e.liveness {
+		if !probed[id] {
+			delete(e.liveness, id)
+		}
+	}
+}
+
+// livenessFailure is a running deployment that failed Options.LivenessFailures probes in a row
+type livenessFailure struct {
+	deployment *deployments.Deployment
+	status     *dockerrun.ContainerStatus
+	err        error
+}
+
+// CheckLiveness probes the health check path of every running deployment's container once.
+// A container that fails Options.LivenessFailures probes in a row is restarted, and its
+// deployment records a "liveness-failed" event; a production deployment also marks its app
+// "Unhealthy" until the app answers again. Restarts count towards Options.CrashLoopRestarts:
+// a container restarted that often within Options.CrashLoopWindow is stopped as crash-looping.
+// Like the restart policy, which is unless-stopped, the checks leave alone apps their owners
+// stopped, and containers that aren't running or that Docker is already restarting;
+// Reconcile deals with those.
+//
+// Returns:
+//   - int: Number of containers restarted or stopped
+//   - error: Error if the running deployments could not be listed
+func (e *Engine) CheckLiveness(ctx context.Context) (int, error) {
+	if e.opts.LivenessFailures <= 0 {
+		return 0, nil
+	}
+	running, err := e.deploymentStore.ListRunning(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list running deployments: %w", err)
+	}
+
+	// Each app is loaded once for its health check settings
+	appsByID := make(map[int]*apps.App)
+	for _, d := range running {
+		if _, ok := appsByID[d.AppID]; ok {
+			continue
+		}
+		app, err := e.appStore.GetByID(ctx, d.AppID)
+		if err != nil {
+			log.Printf("Warning: failed to load app %d for its liveness check: %v", d.AppID, err)
+		}
+		appsByID[d.AppID] = app
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failures []livenessFailure
+	)
+	probed := make(map[string]bool, len(running))
+	sem := make(chan struct{}, reconcileConcurrency)
+	for _, d := range running {
+		app := appsByID[d.AppID]
+		if app == nil || app.DesiredState == apps.DesiredStateStopped || !d.ContainerID.Valid {
+			continue
+		}
+		probed[d.ContainerID.String] = true
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d *deployments.Deployment, app *apps.App) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			probeCtx, cancel := context.WithTimeout(ctx, livenessProbeTimeout)
+			defer cancel()
+			status, err := e.runner.Status(probeCtx, d.ContainerID.String)
+			if err != nil {
+				log.Printf("Warning: failed to inspect container %s of deployment %d: %v", d.ContainerID.String, d.ID, err)
+				return
+			}
+			if !status.Running || status.Restarting {
+				return
+			}
+
+			// Probe the container's own hostname, its name; the stable one may be shared during a rollout
+			containerURL := fmt.Sprintf("https://%s.%s", status.Name, e.baseDomain)
+			err = healthcheck.Probe(probeCtx, containerURL, app.HealthCheckPath, app.HealthCheckStatus)
+			if err == nil {
+				if failed := e.livenessPassed(d.ContainerID.String); failed > 0 {
+					log.Printf("Liveness: deployment %d of app %d answers again after %d failed probes", d.ID, d.AppID, failed)
+				}
+				if tracksApp(d) && app.Status == "Unhealthy" {
+					if err := e.appStore.UpdateStatus(ctx, d.AppID, "Healthy"); err != nil {
+						log.Printf("Warning: failed to mark app %d healthy: %v", d.AppID, err)
+					}
+				}
+				return
+			}
+			failed := e.livenessFailed(d.ContainerID.String)
+			log.Printf("Liveness: probe %d/%d of deployment %d of app %d failed: %v", failed, e.opts.LivenessFailures, d.ID, d.AppID, err)
+			if failed < e.opts.LivenessFailures {
+				return
+			}
+			mu.Lock()
+			failures = append(failures, livenessFailure{deployment: d, status: status, err: err})
+			mu.Unlock()
+		}(d, app)
+	}
+	wg.Wait()
+	e.forgetLiveness(probed)
+
+	for _, f := range failures {
+		e.restartUnhealthy(ctx, f)
+	}
+	return len(failures), nil
+}
+
+// restartUnhealthy restarts a container that failed its liveness probes, or stops it as
+// crash-looping if it was restarted for that too often already
+func (e *Engine) restartUnhealthy(ctx context.Context, f livenessFailure) {
+	d := f.deployment
+	containerID := d.ContainerID.String
+	app, err := e.appStore.GetByID(ctx, d.AppID)
+	if err != nil {
+		log.Printf("Warning: failed to load app %d: %v", d.AppID, err)
+		return
+	}
+	// The owner may have stopped the app while it was probed
+	if app.DesiredState == apps.DesiredStateStopped {
+		return
+	}
+
+	restarts := e.livenessRestarted(containerID, time.Now())
+	if e.opts.CrashLoopRestarts > 0 && restarts > e.opts.CrashLoopRestarts {
+		e.stopCrashLoop(ctx, d, f.status, fmt.Sprintf("Container failed its health check on %s after %d restarts in %s and was stopped: %v",
+			app.HealthCheckPath, e.opts.CrashLoopRestarts, e.opts.CrashLoopWindow, f.err))
+		return
+	}
+
+	message := fmt.Sprintf("Failed %d health checks in a row on %s (%v); restarting the container", e.opts.LivenessFailures, app.HealthCheckPath, f.err)
+	log.Printf("Liveness: deployment %d of app %d: %s", d.ID, d.AppID, message)
+	e.recordEvent(ctx, d.ID, deployments.EventLivenessFailed, message)
+	if tracksApp(d) {
+		if err := e.appStore.UpdateStatus(ctx, d.AppID, "Unhealthy"); err != nil {
+			log.Printf("Warning: failed to mark app %d unhealthy: %v", d.AppID, err)
+		}
+	}
+	if err := e.runner.Restart(ctx, containerID); err != nil {
+		log.Printf("Warning: failed to restart unhealthy container %s: %v", containerID, err)
+	}
+}
@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"mvp-be/internal/maintenance"
+)
+
+// pausedStatuses are the app statuses whose hostnames show the maintenance page
+var pausedStatuses = map[string]bool{
+	"Stopped":      true,
+	"Failed":       true,
+	"CrashLooping": true,
+}
+
+// SyncMaintenance routes the production hostnames of stopped, failed and crash-looping apps
+// to the maintenance page, and removes the routes of apps that are back up or deleted.
+// The API writes and removes the routes of apps stopped and started through it right away;
+// this is the backstop for everything else, such as failed and crash-looping apps. The routes
+// only answer while no container serves the hostnames, so a route left behind is harmless.
+// It does nothing if Options.Maintenance is disabled.
+//
+// Returns:
+//   - int: Number of apps showing the maintenance page
+//   - error: Error if the apps or existing routes could not be listed
+func (e *Engine) SyncMaintenance(ctx context.Context) (int, error) {
+	if !e.opts.Maintenance.Enabled() {
+		return 0, nil
+	}
+	allApps, err := e.appStore.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list apps: %w", err)
+	}
+	existing, err := e.opts.Maintenance.Paused()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list maintenance routes: %w", err)
+	}
+
+	paused := make(map[string]bool)
+	for _, app := range allApps {
+		if !pausedStatuses[app.Status] {
+			continue
+		}
+		appID, err := strconv.Atoi(app.ID)
+		if err != nil {
+			continue
+		}
+		subdomain, hosts := maintenance.Route(ctx, e.domainStore, e.baseDomain, app.EffectiveSlug(), appID)
+		if err := e.opts.Maintenance.Pause(subdomain, hosts); err != nil {
+			log.Printf("Warning: app %s: %v", app.ID, err)
+			continue
+		}
+		paused[subdomain] = true
+	}
+	for _, name := range existing {
+		if paused[name] {
+			continue
+		}
+		if err := e.opts.Maintenance.Resume(name); err != nil {
+			log.Printf("Warning: %s: %v", name, err)
+		}
+	}
+	return len(paused), nil
+}
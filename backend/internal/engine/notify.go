@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/notify"
+)
+
+// notifyStatus sends the app's webhook, if it has one, about a deployment reaching status.
+// Delivery, including retries, happens in the background so it never delays deployments.
+func (e *Engine) notifyStatus(ctx context.Context, deploymentID int, status deployments.Status, url, errorMsg string) {
+	ctx = context.WithoutCancel(ctx)
+
+	deployment, err := e.deploymentStore.GetByID(ctx, deploymentID)
+	if err != nil {
+		log.Printf("Warning: failed to load deployment %d for notification: %v", deploymentID, err)
+		return
+	}
+	app, err := e.appStore.GetByID(ctx, deployment.AppID)
+	if err != nil {
+		log.Printf("Warning: failed to load app %d for notification: %v", deployment.AppID, err)
+		return
+	}
+	if app.NotifyURL == "" {
+		return
+	}
+
+	event := notify.Event{
+		AppID:        deployment.AppID,
+		DeploymentID: deploymentID,
+		Status:       string(status),
+		URL:          url,
+		CommitSHA:    deployment.CommitSHA.String,
+		Error:        errorMsg,
+		Timestamp:    time.Now().UTC(),
+	}
+	go func() {
+		if err := notify.Send(ctx, app.NotifyURL, app.NotifySecret, event); err != nil {
+			log.Printf("Warning: failed to notify app %d about deployment %d: %v", deployment.AppID, deploymentID, err)
+		}
+	}()
+}
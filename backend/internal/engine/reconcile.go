@@ -0,0 +1,370 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"mvp-be/internal/apps"
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/environments"
+	"mvp-be/internal/logs"
+)
+
+// ReconcileStopped stops the containers of apps their owners stopped.
+// Containers run with the unless-stopped restart policy, so a daemon or host restart
+// brings them back up; this puts them down again.
+//
+// Returns:
+//   - int: Number of containers stopped
+//   - error: Error if the stopped apps could not be listed
+func (e *Engine) ReconcileStopped(ctx context.Context) (int, error) {
+	appIDs, err := e.appStore.ListIDsByDesiredState(ctx, apps.DesiredStateStopped)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list stopped apps: %w", err)
+	}
+
+	stopped := 0
+	for _, appID := range appIDs {
+		running, err := e.deploymentStore.GetRunningByAppID(ctx, appID)
+		if err != nil {
+			log.Printf("Warning: failed to list deployments of stopped app %d: %v", appID, err)
+			continue
+		}
+		for _, d := range running {
+			if !d.ContainerID.Valid {
+				continue
+			}
+			up, err := e.runner.IsRunning(ctx, d.ContainerID.String)
+			if err != nil {
+				log.Printf("Warning: failed to check container %s of app %d: %v", d.ContainerID.String, appID, err)
+				continue
+			}
+			if !up {
+				continue
+			}
+			if err := e.runner.Stop(ctx, d.ContainerID.String); err != nil {
+				log.Printf("Warning: failed to stop container %s of app %d: %v", d.ContainerID.String, appID, err)
+				continue
+			}
+			log.Printf("Stopped container %s of app %d, which its owner stopped", d.ContainerID.String, appID)
+			stopped++
+		}
+		if err := e.appStore.UpdateStatus(ctx, appID, "Stopped"); err != nil {
+			log.Printf("Warning: failed to update status of stopped app %d: %v", appID, err)
+		}
+	}
+	return stopped, nil
+}
+
+// reconcileConcurrency bounds how many containers Reconcile inspects at once
+const reconcileConcurrency = 8
+
+// reconcileInspectTimeout bounds a single container inspection during Reconcile
+const reconcileInspectTimeout = 10 * time.Second
+
+// drift is a running deployment whose container is not actually running
+type drift struct {
+	deployment *deployments.Deployment
+	status     *dockerrun.ContainerStatus
+}
+
+// crashLogLines is how many of a crash-looping container's last log lines are kept
+const crashLogLines = 50
+
+// restartSample is a container's restart count as seen by one Reconcile pass
+type restartSample struct {
+	at    time.Time
+	count int
+}
+
+// restartsInWindow records a container's current restart count and returns how many times it
+// restarted within CrashLoopWindow. The first count seen is only a baseline, so restarts from
+// before the worker started watching the container aren't held against it.
+func (e *Engine) restartsInWindow(containerID string, count int, now time.Time) int {
+	e.restartMu.Lock()
+	defer e.restartMu.Unlock()
+
+	history := append(e.restartHistory[containerID], restartSample{at: now, count: count})
+	// Keep the newest sample older than the window as the baseline to count from
+	for len(history) > 1 && now.Sub(history[1].at) >= e.opts.CrashLoopWindow {
+		history = history[1:]
+	}
+	e.restartHistory[containerID] = history
+	return count - history[0].count
+}
+
+// forgetRestarts drops the restart history of containers that are no longer watched
+func (e *Engine) forgetRestarts(watched map[string]bool) {
+	e.restartMu.Lock()
+	defer e.restartMu.Unlock()
+	for id := range e.restartHistory {
+		if !watched[id] {
+			delete(e.restartHistory, id)
+		}
+	}
+}
+
+// Reconcile repairs drift between the database and Docker. Every deployment recorded as
+// running has its container inspected; if the container was removed or has exited, the
+// deployment is marked failed, and an app left with no running deployment is marked "Failed".
+// With Options.ReconcileRedeploy set, such apps are also queued for a fresh deployment.
+// A container the restart policy restarted Options.CrashLoopRestarts times within
+// Options.CrashLoopWindow is stopped and its app marked "CrashLooping" (see stopCrashLoop).
+// Apps their owners stopped are skipped, since their containers are meant to be down.
+//
+// Returns:
+//   - int: Number of deployments found drifted
+//   - error: Error if the running deployments could not be listed
+func (e *Engine) Reconcile(ctx context.Context) (int, error) {
+	running, err := e.deploymentStore.ListRunning(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list running deployments: %w", err)
+	}
+	stoppedIDs, err := e.appStore.ListIDsByDesiredState(ctx, apps.DesiredStateStopped)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list stopped apps: %w", err)
+	}
+	stoppedApps := make(map[int]bool, len(stoppedIDs))
+	for _, id := range stoppedIDs {
+		stoppedApps[id] = true
+	}
+
+	// Inspect containers in parallel, a few at a time
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		drifted    []drift
+		crashLoops []drift
+	)
+	watched := make(map[string]bool, len(running))
+	sem := make(chan struct{}, reconcileConcurrency)
+	for _, d := range running {
+		if stoppedApps[d.AppID] {
+			continue
+		}
+		watched[d.ContainerID.String] = true
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(d *deployments.Deployment) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			inspectCtx, cancel := context.WithTimeout(ctx, reconcileInspectTimeout)
+			defer cancel()
+			status, err := e.runner.Status(inspectCtx, d.ContainerID.String)
+			if err != nil {
+				// Can't tell; leave it for the next pass rather than guess
+				log.Printf("Warning: failed to inspect container %s of deployment %d: %v", d.ContainerID.String, d.ID, err)
+				return
+			}
+			if status.Exists && e.opts.CrashLoopRestarts > 0 &&
+				e.restartsInWindow(d.ContainerID.String, status.RestartCount, time.Now()) >= e.opts.CrashLoopRestarts {
+				mu.Lock()
+				crashLoops = append(crashLoops, drift{deployment: d, status: status})
+				mu.Unlock()
+				return
+			}
+			if status.Running && !status.Restarting {
+				return
+			}
+			// Below the crash loop threshold, let the restart policy bring it back
+			if status.Restarting && e.opts.CrashLoopRestarts > 0 {
+				return
+			}
+			mu.Lock()
+			drifted = append(drifted, drift{deployment: d, status: status})
+			mu.Unlock()
+		}(d)
+	}
+	wg.Wait()
+	e.forgetRestarts(watched)
+
+	for _, cl := range crashLoops {
+		errorMsg := fmt.Sprintf("Container restarted %d times in %s and was stopped. %s", cl.status.RestartCount, e.opts.CrashLoopWindow,
+			containerExitMessage(&dockerrun.ContainerExitError{ExitCode: cl.status.ExitCode, OOMKilled: cl.status.OOMKilled}))
+		e.stopCrashLoop(ctx, cl.deployment, cl.status, errorMsg)
+	}
+
+	drifted = e.relink(ctx, drifted)
+
+	affected := make(map[appEnvironment]bool)
+	for _, dr := range drifted {
+		d := dr.deployment
+		var errorMsg string
+		if !dr.status.Exists {
+			errorMsg = "Container was removed outside of the platform"
+		} else {
+			if err := e.deploymentStore.UpdateExitStatus(ctx, d.ID, dr.status.ExitCode, dr.status.OOMKilled); err != nil {
+				log.Printf("Warning: failed to record exit status of deployment %d: %v", d.ID, err)
+			}
+			errorMsg = containerExitMessage(&dockerrun.ContainerExitError{ExitCode: dr.status.ExitCode, OOMKilled: dr.status.OOMKilled})
+			if dr.status.Restarting {
+				errorMsg = "Container keeps crashing and restarting. " + errorMsg
+			}
+		}
+		if err := e.deploymentStore.UpdateError(ctx, d.ID, errorMsg); err != nil {
+			log.Printf("Warning: failed to mark drifted deployment %d failed: %v", d.ID, err)
+			continue
+		}
+		log.Printf("Deployment %d of app %d is no longer running: %s", d.ID, d.AppID, errorMsg)
+		e.notifyStatus(ctx, d.ID, deployments.StatusFailed, "", errorMsg)
+		affected[appEnvironment{appID: d.AppID, environment: d.Environment}] = true
+	}
+
+	for ae := range affected {
+		e.reconcileApp(ctx, ae.appID, ae.environment)
+	}
+	return len(drifted) + len(crashLoops), nil
+}
+
+// relink looks up, by their labels, the containers of drifted deployments whose recorded
+// container no longer exists. A deployment whose own container is still there under another
+// ID has that ID recorded instead of being failed; the next pass inspects it. The rest of
+// drifted is returned.
+func (e *Engine) relink(ctx context.Context, drifted []drift) []drift {
+	missing := false
+	for _, dr := range drifted {
+		missing = missing || !dr.status.Exists
+	}
+	if !missing {
+		return drifted
+	}
+	managed, err := e.runner.ListManaged(ctx, 0)
+	if err != nil {
+		log.Printf("Warning: failed to look up containers by label: %v", err)
+		return drifted
+	}
+	byDeployment := make(map[int]dockerrun.ManagedContainer, len(managed))
+	for _, c := range managed {
+		byDeployment[c.Owner.DeploymentID] = c
+	}
+
+	remaining := drifted[:0]
+	for _, dr := range drifted {
+		d := dr.deployment
+		c, ok := byDeployment[d.ID]
+		if dr.status.Exists || !ok {
+			remaining = append(remaining, dr)
+			continue
+		}
+		if err := e.deploymentStore.UpdateContainer(ctx, d.ID, c.ID, d.Subdomain.String); err != nil {
+			log.Printf("Warning: failed to record container %s of deployment %d: %v", c.ID, d.ID, err)
+			remaining = append(remaining, dr)
+			continue
+		}
+		log.Printf("Deployment %d's container %s is gone, but its container %s (%s) was found by label; recorded it instead", d.ID, d.ContainerID.String, c.ID, c.State)
+	}
+	return remaining
+}
+
+// appEnvironment identifies one environment of an app
+type appEnvironment struct {
+	appID       int
+	environment string
+}
+
+// reconcileApp handles an app environment whose deployments drifted. If nothing of it is left
+// running, a production environment marks the app "Failed", and a redeploy of the environment
+// is queued when that is enabled.
+func (e *Engine) reconcileApp(ctx context.Context, appID int, environment string) {
+	remaining, err := e.deploymentStore.GetRunningByEnvironment(ctx, appID, environment)
+	if err != nil {
+		log.Printf("Warning: failed to list running deployments of app %d: %v", appID, err)
+		return
+	}
+	if len(remaining) > 0 {
+		// Another deployment still serves the environment
+		return
+	}
+	production := environment == environments.Production
+
+	if !e.opts.ReconcileRedeploy {
+		if !production {
+			return
+		}
+		if err := e.appStore.UpdateStatus(ctx, appID, "Failed"); err != nil {
+			log.Printf("Warning: failed to mark app %d failed: %v", appID, err)
+		}
+		return
+	}
+
+	pending, err := e.deploymentStore.HasPending(ctx, appID, environment)
+	if err != nil {
+		log.Printf("Warning: failed to check pending deployments of app %d: %v", appID, err)
+		return
+	}
+	if pending {
+		return
+	}
+	err = e.database.WithTx(ctx, func(tx *sql.Tx) error {
+		if _, err := e.deploymentStore.WithTx(tx).Create(ctx, appID, environment, "", false); err != nil {
+			return err
+		}
+		if !production {
+			return nil
+		}
+		return e.appStore.WithTx(tx).UpdateStatus(ctx, appID, "Pending")
+	})
+	if err != nil {
+		log.Printf("Warning: failed to queue redeploy of app %d: %v", appID, err)
+		return
+	}
+	log.Printf("Queued a redeploy of app %d (%s) after its container stopped", appID, environment)
+}
+
+// stopCrashLoop stops a crash-looping container so the restart policy stops reviving it, keeps
+// its last log lines in the deployment's timeline, and marks the deployment failed. The app is
+// marked "CrashLooping" rather than redeployed, since a new deployment of the same code would
+// most likely crash the same way. Only production deployments change the app's status.
+// errorMsg says why the container was stopped.
+func (e *Engine) stopCrashLoop(ctx context.Context, d *deployments.Deployment, status *dockerrun.ContainerStatus, errorMsg string) {
+	containerID := d.ContainerID.String
+
+	// Capture the logs first; they explain the crash
+	crashLog := ""
+	reader, tty, err := e.runner.Logs(ctx, containerID, crashLogLines)
+	if err == nil {
+		if tty {
+			crashLog, err = logs.ParsePlainLog(reader, 0)
+		} else {
+			crashLog, err = logs.ParseRuntimeLog(reader, 0)
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to read logs of crash-looping container %s: %v", containerID, err)
+	}
+
+	if err := e.runner.Stop(ctx, containerID); err != nil {
+		log.Printf("Warning: failed to stop crash-looping container %s: %v", containerID, err)
+	}
+	if err := e.deploymentStore.UpdateExitStatus(ctx, d.ID, status.ExitCode, status.OOMKilled); err != nil {
+		log.Printf("Warning: failed to record exit status of deployment %d: %v", d.ID, err)
+	}
+	if err := e.deploymentStore.UpdateError(ctx, d.ID, errorMsg); err != nil {
+		log.Printf("Warning: failed to mark crash-looping deployment %d failed: %v", d.ID, err)
+		return
+	}
+	e.recordEvent(ctx, d.ID, deployments.EventCrashLooping, crashLog)
+	log.Printf("Deployment %d of app %d is crash-looping: %s", d.ID, d.AppID, errorMsg)
+	e.notifyStatus(ctx, d.ID, deployments.StatusFailed, "", errorMsg)
+
+	if d.Environment != environments.Production {
+		return
+	}
+	remaining, err := e.deploymentStore.GetRunningByEnvironment(ctx, d.AppID, d.Environment)
+	if err != nil {
+		log.Printf("Warning: failed to list running deployments of app %d: %v", d.AppID, err)
+		return
+	}
+	if len(remaining) > 0 {
+		return
+	}
+	if err := e.appStore.UpdateStatus(ctx, d.AppID, "CrashLooping"); err != nil {
+		log.Printf("Warning: failed to mark app %d crash-looping: %v", d.AppID, err)
+	}
+}
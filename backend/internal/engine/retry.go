@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"mvp-be/internal/deployments"
+)
+
+// retryBaseDelay is the wait before the first retry; it doubles for each further retry.
+const retryBaseDelay = 30 * time.Second
+
+// fail records a deployment failure.
+// Transient failures (network errors while cloning, Docker daemon unreachable) are requeued
+// with exponential backoff until maxRetries is reached; anything else fails immediately.
+func (e *Engine) fail(ctx context.Context, deployment *deployments.Deployment, errorMsg string, transient bool) {
+	// The failure must be recorded even if the deploy was aborted by shutdown
+	ctx = context.WithoutCancel(ctx)
+
+	if transient && deployment.RetryCount < e.opts.MaxRetries {
+		delay := retryBaseDelay << deployment.RetryCount
+		retryMsg := fmt.Sprintf("%s (retry %d/%d in %s)", errorMsg, deployment.RetryCount+1, e.opts.MaxRetries, delay)
+		err := e.database.WithTx(ctx, func(tx *sql.Tx) error {
+			if err := e.deploymentStore.WithTx(tx).ScheduleRetry(ctx, deployment.ID, retryMsg, delay); err != nil {
+				return err
+			}
+			if !tracksApp(deployment) {
+				return nil
+			}
+			return e.appStore.WithTx(tx).UpdateStatus(ctx, deployment.AppID, "Pending")
+		})
+		if err != nil {
+			log.Printf("Warning: failed to schedule retry for deployment %d: %v", deployment.ID, err)
+		} else {
+			log.Printf("Deployment %d hit a transient error, retrying in %s: %s", deployment.ID, delay, errorMsg)
+			e.recordEvent(ctx, deployment.ID, deployments.EventRetrying, retryMsg)
+			return
+		}
+	}
+
+	// Record the error and mark the app "Failed" together
+	err := e.database.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := e.deploymentStore.WithTx(tx).UpdateError(ctx, deployment.ID, errorMsg); err != nil {
+			return err
+		}
+		if !tracksApp(deployment) {
+			return nil
+		}
+		return e.appStore.WithTx(tx).UpdateStatus(ctx, deployment.AppID, "Failed")
+	})
+	if err != nil {
+		log.Printf("Warning: failed to record failure of deployment %d: %v", deployment.ID, err)
+		return
+	}
+	e.recordEvent(ctx, deployment.ID, deployments.EventFailed, errorMsg)
+	e.notifyStatus(ctx, deployment.ID, deployments.StatusFailed, "", errorMsg)
+}
+
+// unavailableRetryDelay is how long a deployment waits before retrying when the Docker daemon is down
+const unavailableRetryDelay = 30 * time.Second
+
+// requeueUnavailable puts a deployment back in the queue because the Docker daemon could not be reached.
+// That is an outage of the platform rather than a problem with the app, so it does not use up the
+// deployment's retries; it is tried again every unavailableRetryDelay until the daemon is back.
+func (e *Engine) requeueUnavailable(ctx context.Context, deployment *deployments.Deployment, cause error) {
+	ctx = context.WithoutCancel(ctx)
+
+	errorMsg := fmt.Sprintf("Platform temporarily unavailable, will retry in %s", unavailableRetryDelay)
+	err := e.database.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := e.deploymentStore.WithTx(tx).Requeue(ctx, deployment.ID, errorMsg, unavailableRetryDelay); err != nil {
+			return err
+		}
+		if !tracksApp(deployment) {
+			return nil
+		}
+		return e.appStore.WithTx(tx).UpdateStatus(ctx, deployment.AppID, "Pending")
+	})
+	if err != nil {
+		log.Printf("Warning: failed to requeue deployment %d: %v", deployment.ID, err)
+		return
+	}
+	log.Printf("Docker daemon unreachable, requeued deployment %d: %v", deployment.ID, cause)
+	e.recordEvent(ctx, deployment.ID, deployments.EventRetrying, errorMsg)
+}
+
+// isDaemonDown reports whether err means the Docker daemon refused or dropped the connection
+func isDaemonDown(err error) bool {
+	return client.IsErrConnectionFailed(err)
+}
+
+// isDockerUnavailable reports whether err means the Docker daemon could not be reached,
+// as opposed to a problem with the build or container itself.
+func isDockerUnavailable(err error) bool {
+	return client.IsErrConnectionFailed(err) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"mvp-be/internal/apps"
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/environments"
+	"mvp-be/internal/healthcheck"
+	"mvp-be/internal/rollout"
+)
+
+// gradualRollout is a rollout that moves an app's traffic to a new deployment in two steps
+type gradualRollout struct {
+	subdomain string
+	hosts     []string
+	previous  []rollout.Backend
+}
+
+// beginRollout starts a gradual rollout for apps that use one, pinning the hostnames of the
+// deployment's environment to its currently running containers so the new container gets no
+// traffic when it starts.
+// It returns nil, and the deployment proceeds immediately, if the app uses the immediate
+// strategy, nothing is running yet, or rollout routes aren't configured.
+func (e *Engine) beginRollout(ctx context.Context, app *apps.App, deployment *deployments.Deployment, subdomain string, customDomains []string) *gradualRollout {
+	if app.RolloutStrategy != apps.RolloutGradual {
+		return nil
+	}
+	if !e.opts.Rollout.Enabled() {
+		log.Printf("Gradual rollout isn't available (TRAEFIK_DYNAMIC_DIR not set); rolling out immediately")
+		return nil
+	}
+
+	running, err := e.deploymentStore.GetRunningByEnvironment(ctx, deployment.AppID, deployment.Environment)
+	if err != nil {
+		log.Printf("Warning: failed to list running deployments, rolling out immediately: %v", err)
+		return nil
+	}
+	var previous []rollout.Backend
+	for _, d := range running {
+		if d.ID == deployment.ID || !d.ContainerID.Valid {
+			continue
+		}
+		// A route to a service that no longer exists would break the app's hostname
+		status, err := e.runner.Status(ctx, d.ContainerID.String)
+		if err != nil || !status.Running {
+			continue
+		}
+		// Each container's own service is named after it
+		previous = append(previous, rollout.Backend{Service: status.Name})
+	}
+	if len(previous) == 0 {
+		return nil
+	}
+
+	r := &gradualRollout{
+		subdomain: subdomain,
+		hosts:     append([]string{fmt.Sprintf("%s.%s", subdomain, e.baseDomain)}, customDomains...),
+		previous:  previous,
+	}
+	if err := e.opts.Rollout.Route(subdomain, r.hosts, r.split("", 0)); err != nil {
+		log.Printf("Warning: %v; rolling out immediately", err)
+		return nil
+	}
+	log.Printf("Gradual rollout: pinned %s to the running deployment", subdomain)
+	return r
+}
+
+// split returns the backends with canaryPercent of the traffic on canary and the rest
+// shared by the previous containers; an empty canary keeps all traffic on the previous ones.
+func (r *gradualRollout) split(canary string, canaryPercent int) []rollout.Backend {
+	backends := make([]rollout.Backend, 0, len(r.previous)+1)
+	for _, b := range r.previous {
+		backends = append(backends, rollout.Backend{Service: b.Service, Weight: 100 - canaryPercent})
+	}
+	if canary != "" {
+		backends = append(backends, rollout.Backend{Service: canary, Weight: canaryPercent})
+	}
+	return backends
+}
+
+// promote sends a share of the traffic to the new container, waits, and checks its health
+// again before sending it all the traffic. An error means the new container failed the
+// second check; the traffic is back on the previous deployment by then.
+func (e *Engine) promote(ctx context.Context, r *gradualRollout, containerID, containerName, deploymentURL string, app *apps.App) error {
+	percent := e.opts.CanaryPercent
+	if err := e.opts.Rollout.Route(r.subdomain, r.hosts, r.split(containerName, percent)); err != nil {
+		// Without a canary step the rollout is simply immediate
+		log.Printf("Warning: %v; shifting all traffic at once", err)
+		return nil
+	}
+	log.Printf("Gradual rollout: %d%% of traffic on %s for %s", percent, containerName, e.opts.CanaryDuration)
+
+	select {
+	case <-ctx.Done():
+		e.restorePrevious(r)
+		return ctx.Err()
+	case <-time.After(e.opts.CanaryDuration):
+	}
+
+	// Second health gate: still up, and still answering its health check under real traffic
+	if up, err := e.runner.IsRunning(ctx, containerID); err != nil || !up {
+		e.restorePrevious(r)
+		return fmt.Errorf("container stopped while receiving %d%% of traffic", percent)
+	}
+	if err := healthcheck.Verify(ctx, deploymentURL, app.HealthCheckPath, app.HealthCheckStatus, e.opts.HealthCheck); err != nil {
+		e.restorePrevious(r)
+		return fmt.Errorf("health check failed while receiving %d%% of traffic: %w", percent, err)
+	}
+
+	// Keep the old containers out of rotation until they are retired
+	if err := e.opts.Rollout.Route(r.subdomain, r.hosts, []rollout.Backend{{Service: containerName, Weight: 100}}); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	log.Printf("Gradual rollout: all traffic on %s", containerName)
+	return nil
+}
+
+// restorePrevious sends all traffic back to the previous deployment after a failed canary
+func (e *Engine) restorePrevious(r *gradualRollout) {
+	if err := e.opts.Rollout.Route(r.subdomain, r.hosts, r.split("", 0)); err != nil {
+		log.Printf("Warning: failed to restore traffic to the previous deployment: %v", err)
+	}
+}
+
+// endRollout hands the app's hostnames back to the container labels
+func (e *Engine) endRollout(r *gradualRollout) {
+	if r == nil {
+		return
+	}
+	if err := e.opts.Rollout.Clear(r.subdomain); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// rolloutStepGrace is added to the longest wait of a rollout step to allow for the rest of the
+// step, such as pulling the new image and starting its container
+const rolloutStepGrace = 10 * time.Minute
+
+// ClearStaleRollouts removes the rollout routes a worker left behind when it stopped in the
+// middle of a rollout, which would otherwise keep pinning the app's hostnames to containers
+// that were retired since. A route is left behind if no deployment of its app and environment
+// is building, or if it wasn't rewritten for longer than a rollout step takes, as happens when
+// the worker crashed and its deployment was never finished.
+// It does nothing if rollout routes aren't configured.
+//
+// Returns:
+//   - int: Number of routes removed
+//   - error: Error if the routes or building deployments could not be listed
+func (e *Engine) ClearStaleRollouts(ctx context.Context) (int, error) {
+	if !e.opts.Rollout.Enabled() {
+		return 0, nil
+	}
+	routes, err := e.opts.Rollout.Routes()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list rollout routes: %w", err)
+	}
+	if len(routes) == 0 {
+		return 0, nil
+	}
+	building, err := e.deploymentStore.ListBuilding(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list building deployments: %w", err)
+	}
+
+	inProgress := make(map[string]bool, len(building))
+	for _, d := range building {
+		app, err := e.appStore.GetByID(ctx, d.AppID)
+		if err != nil {
+			// Keep the routes of apps that can't be looked up now; the next pass decides
+			log.Printf("Warning: failed to get app %d of building deployment %d: %v", d.AppID, d.ID, err)
+			return 0, nil
+		}
+		inProgress[environments.Subdomain(app.EffectiveSlug(), d.Environment)] = true
+	}
+
+	maxStep := e.opts.CanaryDuration + e.opts.HealthCheck.Budget() + rolloutStepGrace
+	cleared := 0
+	for name, written := range routes {
+		if inProgress[name] && time.Since(written) < maxStep {
+			continue
+		}
+		if err := e.opts.Rollout.Clear(name); err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		log.Printf("Removed the rollout route of %s, left behind by an interrupted rollout", name)
+		cleared++
+	}
+	return cleared, nil
+}
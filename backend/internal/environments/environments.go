@@ -0,0 +1,230 @@
+// Package environments manages the targets an app is deployed to.
+// Every app has a production environment, served at the app's own subdomain; other
+// environments (e.g. staging) run their own deployments side by side, each from its own
+// branch, with its own runtime environment variables and subdomain.
+package environments
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mvp-be/internal/db"
+)
+
+// Production is the environment every app has. It needs no row: one only stores its
+// environment variables and, optionally, a branch other than the app's.
+const Production = "production"
+
+// maxNameLength keeps environment subdomains short enough to be DNS labels
+const maxNameLength = 20
+
+// namePattern allows lowercase letters, digits and single hyphens, starting with a letter
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+// envVarKeyPattern matches valid environment variable names
+var envVarKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type Environment struct {
+	ID    int    `json:"id,omitempty"`
+	AppID int    `json:"app_id"`
+	Name  string `json:"name"`
+
+	// Branch is deployed to the environment; empty deploys the app's branch
+	Branch string `json:"branch"`
+
+	// EnvVars are set in the environment's containers
+	EnvVars map[string]string `json:"env_vars"`
+
+	CreatedAt time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// BranchOr returns the environment's branch, or appBranch if it doesn't set one
+func (e *Environment) BranchOr(appBranch string) string {
+	if e.Branch != "" {
+		return e.Branch
+	}
+	return appBranch
+}
+
+// ValidateName checks that name can be used as an environment name and in a subdomain.
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("environment name is required")
+	}
+	if len(name) > maxNameLength || !namePattern.MatchString(name) {
+		return errors.New("environment name must be at most 20 lowercase letters, digits and single hyphens, starting with a letter")
+	}
+	return nil
+}
+
+// ValidateSubdomain checks that the subdomain of an environment of the app with the given slug
+// fits in a DNS label as it is. Subdomain has to shorten the slug otherwise, and a shortened
+// slug can be the start of another app's slug, giving both apps the same subdomain.
+func ValidateSubdomain(slug, environment string) error {
+	if environment == Production || environment == "" {
+		return nil
+	}
+	if limit := 63 - len(slug) - len("--"); len(environment) > limit {
+		return fmt.Errorf("environment name must be at most %d characters for this app, whose slug is %d characters long", limit, len(slug))
+	}
+	return nil
+}
+
+// ValidateEnvVars checks that every key is a valid environment variable name.
+func ValidateEnvVars(vars map[string]string) error {
+	for key := range vars {
+		if !envVarKeyPattern.MatchString(key) {
+			return errors.New("env var names must start with a letter or underscore and contain only letters, digits and underscores")
+		}
+	}
+	return nil
+}
+
+// Subdomain returns the subdomain an environment of the app with the given slug is served at:
+// the slug itself for production, and {slug}--{environment} otherwise. Slugs never contain
+// two hyphens in a row, so an environment can't take another app's subdomain.
+func Subdomain(slug, environment string) string {
+	if environment == Production || environment == "" {
+		return slug
+	}
+	suffix := "--" + environment
+	// Keep within the 63 characters of a DNS label; new environments are checked to fit
+	// without this (see ValidateSubdomain)
+	if len(slug)+len(suffix) > 63 {
+		slug = strings.TrimRight(slug[:63-len(suffix)], "-")
+	}
+	return slug + suffix
+}
+
+// DeploymentName returns the name of a deployment's container, which is also its own hostname
+// and Traefik router: {subdomain}--{deploymentID}. Environment names start with a letter and
+// slugs never contain two hyphens in a row, so it can't be another app's or environment's
+// subdomain, as {slug}-{deploymentID} could be ("my-app" deployment 2 and app "my-app-2").
+func DeploymentName(subdomain string, deploymentID int) string {
+	return subdomain + "--" + strconv.Itoa(deploymentID)
+}
+
+// Store provides database operations for environments.
+type Store struct {
+	db db.Querier
+}
+
+// NewStore creates a new Store instance with the provided database connection.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// WithTx returns a Store whose queries run inside tx.
+func (s *Store) WithTx(tx *sql.Tx) *Store {
+	return &Store{db: tx}
+}
+
+const environmentColumns = "id, app_id, name, branch, env_vars, created_at, updated_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEnvironment(row rowScanner) (*Environment, error) {
+	var e Environment
+	var envVars []byte
+	if err := row.Scan(&e.ID, &e.AppID, &e.Name, &e.Branch, &envVars, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return nil, err
+	}
+	e.EnvVars = map[string]string{}
+	if err := json.Unmarshal(envVars, &e.EnvVars); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Get returns an environment of an app. Production is returned even without a row, with
+// no environment variables; other environments return sql.ErrNoRows if they don't exist.
+func (s *Store) Get(ctx context.Context, appID int, name string) (*Environment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	e, err := scanEnvironment(s.db.QueryRowContext(ctx,
+		"SELECT "+environmentColumns+" FROM environments WHERE app_id = $1 AND name = $2",
+		appID, name,
+	))
+	if errors.Is(err, sql.ErrNoRows) && name == Production {
+		return &Environment{AppID: appID, Name: Production, EnvVars: map[string]string{}}, nil
+	}
+	return e, err
+}
+
+// List returns the environments of an app, production first and the others by name.
+func (s *Store) List(ctx context.Context, appID int) ([]*Environment, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT "+environmentColumns+" FROM environments WHERE app_id = $1 ORDER BY name <> $2, name ASC",
+		appID, Production,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	environments := []*Environment{}
+	for rows.Next() {
+		e, err := scanEnvironment(rows)
+		if err != nil {
+			return nil, err
+		}
+		environments = append(environments, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(environments) == 0 || environments[0].Name != Production {
+		production := &Environment{AppID: appID, Name: Production, EnvVars: map[string]string{}}
+		environments = append([]*Environment{production}, environments...)
+	}
+	return environments, nil
+}
+
+// Put creates an environment or replaces its branch and environment variables.
+// Changes take effect on the environment's next deployment.
+func (s *Store) Put(ctx context.Context, appID int, name, branch string, envVars map[string]string) (*Environment, error) {
+	if envVars == nil {
+		envVars = map[string]string{}
+	}
+	raw, err := json.Marshal(envVars)
+	if err != nil {
+		return nil, err
+	}
+	return scanEnvironment(s.db.QueryRowContext(ctx,
+		`INSERT INTO environments (app_id, name, branch, env_vars) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (app_id, name) DO UPDATE SET branch = EXCLUDED.branch, env_vars = EXCLUDED.env_vars, updated_at = CURRENT_TIMESTAMP
+		RETURNING `+environmentColumns,
+		appID, name, branch, raw,
+	))
+}
+
+// Delete removes an environment. Returns sql.ErrNoRows if it doesn't exist.
+func (s *Store) Delete(ctx context.Context, appID int, name string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM environments WHERE app_id = $1 AND name = $2", appID, name)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package gitrepo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// repoDirPrefix is the name prefix of per-deployment clone directories in the work directory
+const repoDirPrefix = "deployment-"
+
+// RepoDir returns the clone directory of a deployment
+func (c *Cloner) RepoDir(deploymentID int) string {
+	return filepath.Join(c.WorkDir, fmt.Sprintf("%s%d", repoDirPrefix, deploymentID))
+}
+
+// Remove deletes a deployment's clone directory, if it exists
+func (c *Cloner) Remove(deploymentID int) error {
+	return os.RemoveAll(c.RepoDir(deploymentID))
+}
+
+// DeploymentIDs returns the IDs of deployments that have a clone directory in the work directory
+func (c *Cloner) DeploymentIDs() ([]int, error) {
+	entries, err := os.ReadDir(c.WorkDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read work directory: %w", err)
+	}
+
+	var ids []int
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), repoDirPrefix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), repoDirPrefix))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// RemoveStale deletes deployment clone directories last modified more than maxAge ago.
+// Directories that fail to be removed are skipped and reported in the returned error.
+//
+// Returns:
+//   - int: Number of directories removed
+//   - int64: Bytes reclaimed
+//   - error: The last removal error, if any
+func (c *Cloner) RemoveStale(maxAge time.Duration) (int, int64, error) {
+	entries, err := os.ReadDir(c.WorkDir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read work directory: %w", err)
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var removed int
+	var reclaimed int64
+	var lastErr error
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), repoDirPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(c.WorkDir, entry.Name())
+		size, _ := dirSize(path)
+		if err := os.RemoveAll(path); err != nil {
+			lastErr = fmt.Errorf("failed to remove %s: %w", path, err)
+			continue
+		}
+		removed++
+		reclaimed += size
+	}
+	return removed, reclaimed, lastErr
+}
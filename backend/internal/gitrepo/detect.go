@@ -0,0 +1,272 @@
+package gitrepo
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the port assumed when nothing in the repository suggests another one
+const DefaultPort = 8080
+
+// AppInfo describes what DetectApp found out about a repository
+type AppInfo struct {
+	// Language is the detected ecosystem ("node", "python", "go", "ruby", ...), empty if unknown
+	Language string
+	// Framework is the detected framework ("django", "rails", "next", ...), empty if unknown or none
+	Framework string
+	// Port is the port the app most likely listens on
+	Port int
+}
+
+// detector recognises one ecosystem from marker files in the repository root
+type detector struct {
+	language string
+	markers  []string
+	detect   func(repoPath string) (framework string, port int)
+}
+
+// detectors are checked in order; the first whose marker file exists wins
+var detectors = []detector{
+	{language: "node", markers: []string{"package.json"}, detect: detectNode},
+	{language: "python", markers: []string{"manage.py", "requirements.txt", "pyproject.toml", "Pipfile"}, detect: detectPython},
+	{language: "ruby", markers: []string{"Gemfile"}, detect: detectRuby},
+	{language: "go", markers: []string{"go.mod"}, detect: func(string) (string, int) { return "", 8080 }},
+	{language: "php", markers: []string{"composer.json"}, detect: func(string) (string, int) { return "", 8000 }},
+	{language: "java", markers: []string{"pom.xml", "build.gradle", "build.gradle.kts"}, detect: func(string) (string, int) { return "", 8080 }},
+	{language: "rust", markers: []string{"Cargo.toml"}, detect: func(string) (string, int) { return "", 8080 }},
+}
+
+// DetectApp inspects the files in the repository root to guess the app's language,
+// framework and the port it listens on. Unknown repositories get DefaultPort.
+func DetectApp(repoPath string) AppInfo {
+	for _, d := range detectors {
+		for _, marker := range d.markers {
+			if !fileExists(filepath.Join(repoPath, marker)) {
+				continue
+			}
+			framework, port := d.detect(repoPath)
+			if port == 0 {
+				port = DefaultPort
+			}
+			return AppInfo{Language: d.language, Framework: framework, Port: port}
+		}
+	}
+	return AppInfo{Port: DefaultPort}
+}
+
+// nodeFrameworkPorts maps well-known Node dependencies to the port their dev/start servers use
+var nodeFrameworkPorts = []struct {
+	dependency string
+	port       int
+}{
+	{"next", 3000},
+	{"nuxt", 3000},
+	{"@remix-run/serve", 3000},
+	{"@nestjs/core", 3000},
+	{"express", 3000},
+	{"fastify", 3000},
+	{"koa", 3000},
+}
+
+// detectNode reads package.json for a port in the start script, then falls back to the framework default
+func detectNode(repoPath string) (string, int) {
+	raw, err := os.ReadFile(filepath.Join(repoPath, "package.json"))
+	if err != nil {
+		return "", 0
+	}
+	var pkg struct {
+		Scripts      map[string]string `json:"scripts"`
+		Dependencies map[string]string `json:"dependencies"`
+	}
+	if err := json.Unmarshal(raw, &pkg); err != nil {
+		return "", 0
+	}
+
+	framework, port := "", 0
+	for _, fp := range nodeFrameworkPorts {
+		if _, ok := pkg.Dependencies[fp.dependency]; ok {
+			framework, port = fp.dependency, fp.port
+			break
+		}
+	}
+	// An explicit port in the start script beats the framework default
+	if p := portFromCommand(pkg.Scripts["start"]); p != 0 {
+		port = p
+	}
+	return framework, port
+}
+
+// detectPython tells Django apart from other Python apps
+func detectPython(repoPath string) (string, int) {
+	if fileExists(filepath.Join(repoPath, "manage.py")) || fileContains(filepath.Join(repoPath, "requirements.txt"), "django") {
+		return "django", 8000
+	}
+	if fileContains(filepath.Join(repoPath, "requirements.txt"), "flask") {
+		return "flask", 5000
+	}
+	return "", 8000
+}
+
+// detectRuby tells Rails apart from other Ruby apps
+func detectRuby(repoPath string) (string, int) {
+	if fileContains(filepath.Join(repoPath, "Gemfile"), "rails") {
+		return "rails", 3000
+	}
+	return "", 4567
+}
+
+// portFromCommand extracts a port from common forms in a shell command:
+// "PORT=4000 node ...", "--port 4000", "--port=4000", "-p 4000"
+func portFromCommand(cmd string) int {
+	fields := strings.Fields(cmd)
+	for i, field := range fields {
+		var value string
+		switch {
+		case strings.HasPrefix(field, "PORT="):
+			value = strings.TrimPrefix(field, "PORT=")
+		case strings.HasPrefix(field, "--port="):
+			value = strings.TrimPrefix(field, "--port=")
+		case (field == "--port" || field == "-p") && i+1 < len(fields):
+			value = fields[i+1]
+		default:
+			continue
+		}
+		if port := parsePort(value); port != 0 {
+			return port
+		}
+	}
+	return 0
+}
+
+// ExposedPort returns the port declared with EXPOSE in the final stage of the given Dockerfile,
+// or 0 if the file doesn't exist or exposes nothing usable.
+// Ports given through build arguments or environment variables can't be resolved and are skipped.
+func ExposedPort(dockerfile string) int {
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	port := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// Only the final stage runs, so a new stage forgets what earlier ones exposed
+		if strings.EqualFold(fields[0], "FROM") {
+			port = 0
+			continue
+		}
+		if !strings.EqualFold(fields[0], "EXPOSE") {
+			continue
+		}
+		for _, spec := range fields[1:] {
+			// EXPOSE 8000/tcp
+			if p := parsePort(strings.TrimSuffix(spec, "/tcp")); p != 0 {
+				port = p
+				break
+			}
+		}
+	}
+	return port
+}
+
+// parsePort returns value as a port number, or 0 if it isn't a valid one
+func parsePort(value string) int {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0
+	}
+	return port
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// fileContains reports whether the file at path mentions substr, ignoring case
+func fileContains(path, substr string) bool {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(raw)), substr)
+}
+
+// workerCommands are start commands of common background job runners
+var workerCommands = []string{"celery", "sidekiq", "rq worker", "resque", "delayed_job", "worker.py", "worker.js"}
+
+// WorkerHints returns the reasons to believe the app in contextPath is a background worker
+// rather than a web server, or nil if nothing suggests so. Workers never answer HTTP,
+// so they fail the platform's health check even when they run fine.
+// dockerfile is the Dockerfile path relative to contextPath; an empty one skips the Dockerfile checks.
+func WorkerHints(contextPath, dockerfile string) []string {
+	var hints []string
+
+	// A Procfile with processes but no "web" process runs nothing that serves HTTP
+	if raw, err := os.ReadFile(filepath.Join(contextPath, "Procfile")); err == nil {
+		hasWeb, processes := false, 0
+		for _, line := range strings.Split(string(raw), "\n") {
+			name, _, ok := strings.Cut(strings.TrimSpace(line), ":")
+			if !ok || strings.HasPrefix(name, "#") {
+				continue
+			}
+			processes++
+			if strings.TrimSpace(name) == "web" {
+				hasWeb = true
+			}
+		}
+		if processes > 0 && !hasWeb {
+			hints = append(hints, "Procfile defines no web process")
+		}
+	}
+
+	if dockerfile == "" {
+		return hints
+	}
+	path := filepath.Join(contextPath, dockerfile)
+	if cmd := startCommand(path); cmd != "" {
+		lower := strings.ToLower(cmd)
+		for _, worker := range workerCommands {
+			if strings.Contains(lower, worker) {
+				hints = append(hints, "Dockerfile start command runs "+worker)
+				break
+			}
+		}
+	}
+	if fileExists(path) && ExposedPort(path) == 0 && DetectApp(contextPath).Framework == "" {
+		hints = append(hints, "Dockerfile exposes no port and no web framework was detected")
+	}
+	return hints
+}
+
+// startCommand returns the last CMD or ENTRYPOINT instruction's arguments in the Dockerfile,
+// or "" if there is none
+func startCommand(dockerfile string) string {
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	cmd := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if strings.EqualFold(fields[0], "CMD") || strings.EqualFold(fields[0], "ENTRYPOINT") {
+			cmd = strings.Join(fields[1:], " ")
+		}
+	}
+	return cmd
+}
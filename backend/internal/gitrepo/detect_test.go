@@ -0,0 +1,137 @@
+package gitrepo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRepo creates a repository directory holding files, keyed by path
+func writeRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDetectApp(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  AppInfo
+	}{
+		{
+			name:  "unknown",
+			files: map[string]string{"README.md": "hello"},
+			want:  AppInfo{Port: DefaultPort},
+		},
+		{
+			name:  "node without framework",
+			files: map[string]string{"package.json": `{"scripts": {"start": "node index.js"}}`},
+			want:  AppInfo{Language: "node", Port: DefaultPort},
+		},
+		{
+			name:  "node framework",
+			files: map[string]string{"package.json": `{"dependencies": {"next": "14.0.0"}}`},
+			want:  AppInfo{Language: "node", Framework: "next", Port: 3000},
+		},
+		{
+			name: "node start script port beats framework",
+			files: map[string]string{"package.json": `{
+				"scripts": {"start": "PORT=4000 node server.js"},
+				"dependencies": {"express": "4.18.0"}
+			}`},
+			want: AppInfo{Language: "node", Framework: "express", Port: 4000},
+		},
+		{
+			name:  "django by manage.py",
+			files: map[string]string{"manage.py": "", "requirements.txt": "gunicorn\n"},
+			want:  AppInfo{Language: "python", Framework: "django", Port: 8000},
+		},
+		{
+			name:  "django by requirements",
+			files: map[string]string{"requirements.txt": "Django==5.0\n"},
+			want:  AppInfo{Language: "python", Framework: "django", Port: 8000},
+		},
+		{
+			name:  "flask",
+			files: map[string]string{"requirements.txt": "Flask==3.0\n"},
+			want:  AppInfo{Language: "python", Framework: "flask", Port: 5000},
+		},
+		{
+			name:  "python without framework",
+			files: map[string]string{"pyproject.toml": "[project]\n"},
+			want:  AppInfo{Language: "python", Port: 8000},
+		},
+		{
+			name:  "rails",
+			files: map[string]string{"Gemfile": "gem 'rails', '~> 7.1'\n"},
+			want:  AppInfo{Language: "ruby", Framework: "rails", Port: 3000},
+		},
+		{
+			name:  "ruby without rails",
+			files: map[string]string{"Gemfile": "gem 'sinatra'\n"},
+			want:  AppInfo{Language: "ruby", Port: 4567},
+		},
+		{
+			name:  "go",
+			files: map[string]string{"go.mod": "module example.com/app\n"},
+			want:  AppInfo{Language: "go", Port: 8080},
+		},
+		{
+			name:  "php",
+			files: map[string]string{"composer.json": "{}"},
+			want:  AppInfo{Language: "php", Port: 8000},
+		},
+		{
+			name:  "java",
+			files: map[string]string{"build.gradle.kts": ""},
+			want:  AppInfo{Language: "java", Port: 8080},
+		},
+		{
+			name:  "rust",
+			files: map[string]string{"Cargo.toml": "[package]\n"},
+			want:  AppInfo{Language: "rust", Port: 8080},
+		},
+		{
+			name:  "node wins over other markers",
+			files: map[string]string{"package.json": "{}", "requirements.txt": "django\n"},
+			want:  AppInfo{Language: "node", Port: DefaultPort},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectApp(writeRepo(t, tt.files)); got != tt.want {
+				t.Errorf("DetectApp() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortFromCommand(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want int
+	}{
+		{"node index.js", 0},
+		{"PORT=4000 node index.js", 4000},
+		{"next start --port 3001", 3001},
+		{"next start --port=3002", 3002},
+		{"next start -p 3003", 3003},
+		{"next start -p", 0},
+		{"serve --port abc", 0},
+	}
+	for _, tt := range tests {
+		if got := portFromCommand(tt.cmd); got != tt.want {
+			t.Errorf("portFromCommand(%q) = %d, want %d", tt.cmd, got, tt.want)
+		}
+	}
+}
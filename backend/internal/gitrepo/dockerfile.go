@@ -0,0 +1,347 @@
+package gitrepo
+
+import (
+	"bufio"
+	"encoding/csv"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// This is a small Dockerfile parser for finding the images a build pulls. BuildKit's own parser
+// (github.com/moby/buildkit/frontend/dockerfile/parser) isn't a dependency of this module, so it
+// follows the same rules for the parts that matter here: parser directives, the escape character,
+// line continuations, comments inside them and heredocs, whose bodies aren't instructions.
+
+// instruction is one Dockerfile instruction with its line continuations joined
+type instruction struct {
+	// cmd is the keyword, lowercased ("from", "copy", "run", ...)
+	cmd string
+	// args are the whitespace-separated words after the keyword
+	args []string
+}
+
+// directivePattern matches a parser directive such as "# syntax=docker/dockerfile:1"
+var directivePattern = regexp.MustCompile(`^#\s*([a-zA-Z][a-zA-Z0-9]*)\s*=\s*(.+?)\s*$`)
+
+// heredocPattern matches a word of an instruction that starts a heredoc: "<<EOF", "<<-EOF",
+// "<<'EOF'" or, with a file descriptor, "3<<EOF"
+var heredocPattern = regexp.MustCompile(`^\d*<<(-?)([^<]+)$`)
+
+// parseDockerfile reads the instructions of the Dockerfile at path and its syntax directive
+func parseDockerfile(path string) (instructions []instruction, syntax string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+
+	// Directives are only recognised in the comments that open the file
+	escape := byte('\\')
+directives:
+	for _, line := range lines {
+		match := directivePattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			break
+		}
+		switch strings.ToLower(match[1]) {
+		case "syntax":
+			syntax = match[2]
+		case "escape":
+			if match[2] == "`" {
+				escape = '`'
+			}
+		case "check":
+		default:
+			// An unknown directive is a comment, which ends the directives
+			break directives
+		}
+	}
+
+	var current strings.Builder
+	continued := false
+	finish := func() []heredoc {
+		fields := strings.Fields(current.String())
+		current.Reset()
+		continued = false
+		if len(fields) == 0 {
+			return nil
+		}
+		in := instruction{cmd: strings.ToLower(fields[0]), args: fields[1:]}
+		instructions = append(instructions, in)
+		return heredocs(in.cmd, in.args)
+	}
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		// Comments are dropped, also inside a continued instruction, as are empty lines there
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		line := strings.TrimRightFunc(lines[i], func(r rune) bool { return r == ' ' || r == '\t' })
+		if line[len(line)-1] == escape {
+			current.WriteString(line[:len(line)-1])
+			continued = true
+			continue
+		}
+		current.WriteString(line)
+		// Skip the bodies of the instruction's heredocs
+		for _, doc := range finish() {
+			for i++; i < len(lines) && !doc.ends(lines[i]); i++ {
+			}
+		}
+	}
+	if continued {
+		finish()
+	}
+	return instructions, syntax, nil
+}
+
+// heredoc is a heredoc an instruction opens
+type heredoc struct {
+	// word ends the heredoc, on a line of its own
+	word string
+	// stripTabs is set for "<<-", which allows tabs before word
+	stripTabs bool
+}
+
+// ends reports whether line terminates h
+func (h heredoc) ends(line string) bool {
+	if h.stripTabs {
+		line = strings.TrimLeft(line, "\t")
+	}
+	return line == h.word
+}
+
+// heredocs returns the heredocs an instruction opens, in order.
+// Only RUN, COPY and ADD take heredocs, and not in their JSON form.
+func heredocs(cmd string, words []string) []heredoc {
+	if cmd != "run" && cmd != "copy" && cmd != "add" {
+		return nil
+	}
+	if len(words) > 0 && strings.HasPrefix(words[0], "[") {
+		return nil
+	}
+	var docs []heredoc
+	for _, word := range words {
+		match := heredocPattern.FindStringSubmatch(word)
+		if match == nil {
+			continue
+		}
+		name := match[2]
+		if len(name) >= 2 && (name[0] == '"' || name[0] == '\'') && name[len(name)-1] == name[0] {
+			name = name[1 : len(name)-1]
+		}
+		docs = append(docs, heredoc{word: name, stripTabs: match[1] == "-"})
+	}
+	return docs
+}
+
+// flags splits an instruction's leading "--name=value" flags from the words after them
+func flags(args []string) (map[string][]string, []string) {
+	values := map[string][]string{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		name, value, _ := strings.Cut(strings.TrimPrefix(args[0], "--"), "=")
+		values[strings.ToLower(name)] = append(values[strings.ToLower(name)], strings.Trim(value, `"'`))
+		args = args[1:]
+	}
+	return values, args
+}
+
+// mountFrom returns the from= option of a RUN --mount value, empty if it has none
+func mountFrom(mount string) string {
+	fields, err := csv.NewReader(strings.NewReader(mount)).Read()
+	if err != nil {
+		return ""
+	}
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		if strings.EqualFold(strings.TrimSpace(key), "from") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// expand replaces $VAR, ${VAR} and the ${VAR:-default}, ${VAR-default}, ${VAR:+alt} and
+// ${VAR+alt} forms with the variables in vars, as the Dockerfile frontend does
+func expand(s string, vars map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		for _, op := range []string{":-", ":+", "-", "+"} {
+			name, word, ok := strings.Cut(name, op)
+			if !ok {
+				continue
+			}
+			value, set := vars[name]
+			switch op {
+			case ":-":
+				if value == "" {
+					return word
+				}
+			case "-":
+				if !set {
+					return word
+				}
+			case ":+":
+				if value != "" {
+					return word
+				}
+				return ""
+			case "+":
+				if set {
+					return word
+				}
+				return ""
+			}
+			return value
+		}
+		return vars[name]
+	})
+}
+
+// declareArgs adds the variables an ARG instruction declares to vars. A build arg overrides
+// the default; an ARG without either takes its value from inherited, when that has it.
+func declareArgs(args []string, vars, inherited, buildArgs map[string]string) {
+	for _, arg := range args {
+		name, value, hasValue := strings.Cut(arg, "=")
+		if override, ok := buildArgs[name]; ok {
+			vars[name] = override
+		} else if hasValue {
+			vars[name] = expand(strings.Trim(value, `"'`), vars)
+		} else if value, ok := inherited[name]; ok {
+			vars[name] = value
+		}
+	}
+}
+
+// platformArgs are the build args BuildKit defines for every build, which FROM lines may use.
+// Builds run for the worker's own platform.
+func platformArgs() map[string]string {
+	platform := "linux/" + runtime.GOARCH
+	return map[string]string{
+		"BUILDPLATFORM":  platform,
+		"BUILDOS":        "linux",
+		"BUILDARCH":      runtime.GOARCH,
+		"TARGETPLATFORM": platform,
+		"TARGETOS":       "linux",
+		"TARGETARCH":     runtime.GOARCH,
+	}
+}
+
+// BaseImages returns the images a build of the given Dockerfile pulls, in order and without
+// duplicates: the frontend named by its syntax directive (or the BUILDKIT_SYNTAX build arg), the
+// images its FROM lines build on, and the images COPY --from and RUN --mount=from= read files
+// from. Build stages, referenced by name or index, and "scratch" aren't images and are left out.
+// Variables are resolved the way the build would resolve them: FROM lines from the ARGs declared
+// before the first FROM, the other instructions from the ARGs and ENVs of their stage, with
+// buildArgs taking precedence over ARG defaults.
+func BaseImages(dockerfile string, buildArgs map[string]string) ([]string, error) {
+	instructions, syntax, err := parseDockerfile(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+
+	// COPY --from and RUN --mount can reference stages declared after them, FROM lines only
+	// earlier ones: "FROM node AS node" builds on the image
+	var stages []string
+	for _, in := range instructions {
+		if in.cmd != "from" {
+			continue
+		}
+		name := ""
+		if _, rest := flags(in.args); len(rest) >= 3 && strings.EqualFold(rest[1], "AS") {
+			name = strings.ToLower(rest[2])
+		}
+		stages = append(stages, name)
+	}
+	// isStage reports whether ref names one of the first count stages, by name or index
+	isStage := func(ref string, count int) bool {
+		if index, err := strconv.Atoi(ref); err == nil {
+			return index >= 0 && index < count
+		}
+		for _, name := range stages[:count] {
+			if name != "" && name == strings.ToLower(ref) {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := map[string]bool{}
+	var images []string
+	add := func(ref string) {
+		if ref == "" || strings.EqualFold(ref, "scratch") || seen[ref] {
+			return
+		}
+		seen[ref] = true
+		images = append(images, ref)
+	}
+	if override, ok := buildArgs["BUILDKIT_SYNTAX"]; ok {
+		syntax = override
+	}
+	add(syntax)
+
+	globals := platformArgs()
+	var stageVars map[string]string
+	stage := 0
+	for _, in := range instructions {
+		switch in.cmd {
+		case "arg":
+			if stageVars == nil {
+				// Only ARGs before the first FROM can be used in FROM lines
+				declareArgs(in.args, globals, nil, buildArgs)
+			} else {
+				declareArgs(in.args, stageVars, globals, buildArgs)
+			}
+		case "env":
+			if stageVars == nil {
+				continue
+			}
+			// ENV KEY=value KEY2=value2, or the legacy ENV KEY value
+			if len(in.args) >= 2 && !strings.Contains(in.args[0], "=") {
+				stageVars[in.args[0]] = expand(strings.Join(in.args[1:], " "), stageVars)
+				continue
+			}
+			for _, arg := range in.args {
+				if name, value, ok := strings.Cut(arg, "="); ok {
+					stageVars[name] = expand(strings.Trim(value, `"'`), stageVars)
+				}
+			}
+		case "from":
+			stageVars = map[string]string{}
+			// FROM --platform=linux/amd64 image AS name
+			if _, rest := flags(in.args); len(rest) > 0 {
+				if image := expand(rest[0], globals); !isStage(image, stage) {
+					add(image)
+				}
+			}
+			stage++
+		case "copy":
+			opts, _ := flags(in.args)
+			for _, from := range opts["from"] {
+				if image := expand(from, stageVars); !isStage(image, len(stages)) {
+					add(image)
+				}
+			}
+		case "run":
+			opts, _ := flags(in.args)
+			for _, mount := range opts["mount"] {
+				if image := expand(mountFrom(mount), stageVars); !isStage(image, len(stages)) {
+					add(image)
+				}
+			}
+		}
+	}
+	return images, nil
+}
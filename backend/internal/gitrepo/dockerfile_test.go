@@ -0,0 +1,146 @@
+package gitrepo
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBaseImages(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		buildArgs  map[string]string
+		want       []string
+	}{
+		{
+			name:       "single stage",
+			dockerfile: "FROM node:20\nRUN npm ci\n",
+			want:       []string{"node:20"},
+		},
+		{
+			name:       "lowercase keywords and platform flag",
+			dockerfile: "from --platform=linux/amd64 python:3.12 as build\n",
+			want:       []string{"python:3.12"},
+		},
+		{
+			name:       "stages and scratch are left out",
+			dockerfile: "FROM golang:1.25 AS build\nFROM build AS test\nFROM scratch\nCOPY --from=build /app /app\nCOPY --from=0 /bin /bin\n",
+			want:       []string{"golang:1.25"},
+		},
+		{
+			name:       "stage referenced before it is declared",
+			dockerfile: "FROM alpine\nCOPY --from=assets /dist /dist\nFROM node:20 AS assets\n",
+			want:       []string{"alpine", "node:20"},
+		},
+		{
+			name:       "FROM only references earlier stages",
+			dockerfile: "FROM node AS node\nFROM tools AS build\nFROM build\nCOPY --from=node / /\n",
+			want:       []string{"node", "tools"},
+		},
+		{
+			name:       "line continuation",
+			dockerfile: "FROM \\\n  node:20 \\\n  AS build\n",
+			want:       []string{"node:20"},
+		},
+		{
+			name:       "continuation splitting the image name",
+			dockerfile: "FROM ev\\\nil:latest\n",
+			want:       []string{"evil:latest"},
+		},
+		{
+			name:       "comments and empty lines inside a continuation",
+			dockerfile: "FROM alpine\nRUN echo one \\\n# FROM commented:out\n\n  && echo two\n",
+			want:       []string{"alpine"},
+		},
+		{
+			name:       "escape directive",
+			dockerfile: "# escape=`\nFROM mcr.microsoft.com/windows/servercore `\n  AS base\nCOPY `\n  --from=other:1 C:\\src C:\\dst\n",
+			want:       []string{"mcr.microsoft.com/windows/servercore", "other:1"},
+		},
+		{
+			name:       "syntax directive",
+			dockerfile: "# syntax=docker/dockerfile:1.7\n# escape=\\\nFROM alpine\n",
+			want:       []string{"docker/dockerfile:1.7", "alpine"},
+		},
+		{
+			name:       "syntax comment after an instruction isn't a directive",
+			dockerfile: "FROM alpine\n# syntax=evil/frontend\n",
+			want:       []string{"alpine"},
+		},
+		{
+			name:       "syntax comment after a plain comment isn't a directive",
+			dockerfile: "# build the app\n# syntax=evil/frontend\nFROM alpine\n",
+			want:       []string{"alpine"},
+		},
+		{
+			name:       "BUILDKIT_SYNTAX overrides the directive",
+			dockerfile: "# syntax=docker/dockerfile:1\nFROM alpine\n",
+			buildArgs:  map[string]string{"BUILDKIT_SYNTAX": "evil/frontend"},
+			want:       []string{"evil/frontend", "alpine"},
+		},
+		{
+			name:       "COPY --from an image",
+			dockerfile: "FROM alpine\nCOPY --link --from=nginx:1.27 /etc/nginx /etc/nginx\n",
+			want:       []string{"alpine", "nginx:1.27"},
+		},
+		{
+			name:       "RUN --mount from an image",
+			dockerfile: "FROM alpine\nRUN --mount=type=cache,target=/root/.cache \\\n    --mount=type=bind,from=tools:2,source=/bin/tool,target=/usr/bin/tool tool\n",
+			want:       []string{"alpine", "tools:2"},
+		},
+		{
+			name:       "RUN --mount from a stage",
+			dockerfile: "FROM golang AS deps\nFROM alpine\nRUN --mount=from=deps,target=/deps ls /deps\n",
+			want:       []string{"golang", "alpine"},
+		},
+		{
+			name:       "heredoc bodies aren't instructions",
+			dockerfile: "FROM alpine\nRUN <<EOF\nFROM inside:heredoc\nCOPY --from=also:inside / /\nEOF\nCOPY <<-'CONF' /etc/app.conf\n\tFROM config:text\n\tCONF\nFROM after:heredoc\n",
+			want:       []string{"alpine", "after:heredoc"},
+		},
+		{
+			name:       "global ARGs with build args taking precedence",
+			dockerfile: "ARG NODE=18\nARG REGISTRY\nFROM ${REGISTRY:-docker.io}/library/node:$NODE\n",
+			buildArgs:  map[string]string{"NODE": "20"},
+			want:       []string{"docker.io/library/node:20"},
+		},
+		{
+			name:       "ARGs after the first FROM don't apply to FROM lines",
+			dockerfile: "FROM alpine\nARG BASE=evil\nFROM ${BASE:-debian}\n",
+			want:       []string{"alpine", "debian"},
+		},
+		{
+			name:       "platform args",
+			dockerfile: "FROM --platform=$BUILDPLATFORM golang AS build\nFROM tool-${TARGETOS}\n",
+			want:       []string{"golang", "tool-linux"},
+		},
+		{
+			name:       "stage ARGs and ENVs in COPY --from",
+			dockerfile: "ARG TOOLS=tools:1\nFROM alpine\nARG TOOLS\nENV PROXY=proxy:2\nCOPY --from=$TOOLS /a /a\nCOPY --from=${PROXY} /b /b\n",
+			want:       []string{"alpine", "tools:1", "proxy:2"},
+		},
+		{
+			name:       "global ARG not redeclared in the stage",
+			dockerfile: "ARG TOOLS=tools:1\nFROM alpine\nCOPY --from=${TOOLS:-fallback:3} /a /a\n",
+			want:       []string{"alpine", "fallback:3"},
+		},
+		{
+			name:       "duplicates",
+			dockerfile: "FROM alpine AS a\nFROM alpine AS b\nCOPY --from=alpine / /\n",
+			want:       []string{"alpine"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeRepo(t, map[string]string{"Dockerfile": tt.dockerfile})
+			got, err := BaseImages(filepath.Join(dir, "Dockerfile"), tt.buildArgs)
+			if err != nil {
+				t.Fatalf("BaseImages() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BaseImages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,46 +1,318 @@
 package gitrepo
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Cloner struct {
 	WorkDir string
+
+	// Timeout bounds how long a single clone may run. Zero disables the timeout.
+	Timeout time.Duration
+
+	// MaxSizeBytes is the largest checkout allowed on disk. Zero disables the check.
+	MaxSizeBytes int64
 }
 
-func NewCloner(workDir string) *Cloner {
-	return &Cloner{WorkDir: workDir}
+func NewCloner(workDir string, timeout time.Duration, maxSizeBytes int64) *Cloner {
+	return &Cloner{WorkDir: workDir, Timeout: timeout, MaxSizeBytes: maxSizeBytes}
+}
+
+// CloneOptions are the opt-in, slower parts of a clone.
+type CloneOptions struct {
+	// Submodules also clones the repository's submodules, recursively and shallowly
+	Submodules bool
+
+	// LFS downloads the Git LFS files of repositories whose .gitattributes use LFS,
+	// replacing their pointer files. It needs git-lfs on the host (see ErrLFSNotInstalled).
+	LFS bool
 }
 
-func (c *Cloner) Clone(repoURL string, deploymentID int, branch string) (string, error) {
-	repoDir := filepath.Join(c.WorkDir, fmt.Sprintf("deployment-%d", deploymentID))
+// Clone shallow-clones branch of repoURL into a per-deployment directory.
+// When commit is non-empty the checkout is moved to that commit after cloning.
+// opts adds submodules and LFS files; both count towards MaxSizeBytes.
+func (c *Cloner) Clone(ctx context.Context, repoURL string, deploymentID int, branch, commit string, opts CloneOptions) (string, error) {
+	repoDir := c.RepoDir(deploymentID)
 
 	// Remove directory if it exists
 	if err := os.RemoveAll(repoDir); err != nil {
 		return "", fmt.Errorf("failed to clean directory: %w", err)
 	}
 
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
 	// Clone repository with specific branch
 	// First clone the repository (shallow clone for the specific branch)
-	cmd := exec.Command("git", "clone", "--branch", branch, "--single-branch", "--depth", "1", repoURL, repoDir)
+	args := []string{"clone", "--branch", branch, "--single-branch", "--depth", "1"}
+	if opts.Submodules {
+		args = append(args, "--recurse-submodules", "--shallow-submodules")
+	}
+	if c.MaxSizeBytes > 0 {
+		// Skip any single blob larger than the whole checkout budget
+		args = append(args, fmt.Sprintf("--filter=blob:limit=%d", c.MaxSizeBytes))
+	}
+	args = append(args, "--", repoURL, repoDir)
+
+	cmd := gitCommand(ctx, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
+		// Don't leave a partial checkout behind
+		os.RemoveAll(repoDir)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("git clone timed out after %s", c.Timeout)
+		}
 		return "", fmt.Errorf("git clone failed: %w, output: %s", err, string(output))
 	}
 
+	if commit != "" {
+		if err := checkoutCommit(ctx, repoDir, commit); err != nil {
+			os.RemoveAll(repoDir)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", fmt.Errorf("git clone timed out after %s", c.Timeout)
+			}
+			return "", err
+		}
+	}
+
+	if opts.Submodules && commit != "" {
+		// The submodules were cloned for the branch's head, not the pinned commit
+		if err := updateSubmodules(ctx, repoDir); err != nil {
+			os.RemoveAll(repoDir)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", fmt.Errorf("git clone timed out after %s", c.Timeout)
+			}
+			return "", err
+		}
+	}
+	if opts.LFS && UsesLFS(repoDir) {
+		if err := pullLFS(ctx, repoDir); err != nil {
+			os.RemoveAll(repoDir)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", fmt.Errorf("git clone timed out after %s", c.Timeout)
+			}
+			return "", err
+		}
+	}
+
+	if c.MaxSizeBytes > 0 {
+		size, err := dirSize(repoDir)
+		if err != nil {
+			os.RemoveAll(repoDir)
+			return "", fmt.Errorf("failed to measure repository size: %w", err)
+		}
+		if size > c.MaxSizeBytes {
+			os.RemoveAll(repoDir)
+			return "", fmt.Errorf("repository is too large: %d MB exceeds the %d MB limit", size>>20, c.MaxSizeBytes>>20)
+		}
+	}
+
 	return repoDir, nil
 }
 
-// CheckDockerfile checks if a Dockerfile exists in the repository directory
-func CheckDockerfile(repoPath string) error {
-	dockerfilePath := filepath.Join(repoPath, "Dockerfile")
+// allowProtocols limits git to https remotes, like ValidateRepoURL. It also covers repositories
+// stored before repo_url was validated and the submodules a repository declares.
+const allowProtocols = "GIT_ALLOW_PROTOCOL=https"
+
+// gitCommand runs git with Git LFS smudging turned off. A host with git-lfs installed would
+// otherwise download LFS files on every checkout; they're only downloaded by pullLFS, when
+// CloneOptions.LFS asks for them.
+func gitCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_LFS_SKIP_SMUDGE=1", allowProtocols)
+	return cmd
+}
+
+// checkoutCommit moves a shallow clone to the given commit.
+// It first tries to fetch just that commit and falls back to unshallowing
+// the branch, which also handles abbreviated SHAs.
+func checkoutCommit(ctx context.Context, repoDir, commit string) error {
+	fetch := gitCommand(ctx, "-C", repoDir, "fetch", "--depth", "1", "origin", commit)
+	if _, err := fetch.CombinedOutput(); err != nil {
+		unshallow := gitCommand(ctx, "-C", repoDir, "fetch", "--unshallow", "origin")
+		if output, err := unshallow.CombinedOutput(); err != nil {
+			return fmt.Errorf("git fetch failed: %w, output: %s", err, string(output))
+		}
+	}
+
+	checkout := gitCommand(ctx, "-C", repoDir, "checkout", "--detach", commit)
+	if output, err := checkout.CombinedOutput(); err != nil {
+		return fmt.Errorf("commit %s not found on branch: %w, output: %s", commit, err, string(output))
+	}
+	return nil
+}
+
+// updateSubmodules checks out the submodule commits the current checkout records
+func updateSubmodules(ctx context.Context, repoDir string) error {
+	update := gitCommand(ctx, "-C", repoDir, "submodule", "update", "--init", "--recursive", "--depth", "1")
+	if output, err := update.CombinedOutput(); err != nil {
+		return fmt.Errorf("git submodule update failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// ErrLFSNotInstalled is returned by Clone when LFS files are asked for but git-lfs is missing
+var ErrLFSNotInstalled = errors.New("the repository uses Git LFS, but git-lfs is not installed on the build host")
+
+// UsesLFS reports whether the checkout's .gitattributes route any files through Git LFS
+func UsesLFS(repoDir string) bool {
+	return fileContains(filepath.Join(repoDir, ".gitattributes"), "filter=lfs")
+}
+
+// pullLFS downloads the LFS files of the checkout in place of their pointer files
+func pullLFS(ctx context.Context, repoDir string) error {
+	if err := exec.CommandContext(ctx, "git", "lfs", "version").Run(); err != nil {
+		return ErrLFSNotInstalled
+	}
+	pull := exec.CommandContext(ctx, "git", "-C", repoDir, "lfs", "pull")
+	if output, err := pull.CombinedOutput(); err != nil {
+		return fmt.Errorf("git lfs pull failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// HeadCommit returns the full SHA and subject line of the commit checked out in repoPath
+func HeadCommit(ctx context.Context, repoPath string) (sha, subject string, err error) {
+	output, err := exec.CommandContext(ctx, "git", "-C", repoPath, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("git rev-parse failed: %w", err)
+	}
+	sha = strings.TrimSpace(string(output))
+
+	output, err = exec.CommandContext(ctx, "git", "-C", repoPath, "log", "-1", "--format=%s").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("git log failed: %w", err)
+	}
+	subject = strings.TrimSpace(string(output))
+
+	return sha, subject, nil
+}
+
+// IsValidCommit reports whether s looks like a (possibly abbreviated) hex commit SHA
+func IsValidCommit(s string) bool {
+	if len(s) < 7 || len(s) > 40 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// dirSize returns the total size in bytes of all regular files under path
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// transientGitMarkers are fragments of git output that indicate a network
+// problem rather than a problem with the repository itself.
+var transientGitMarkers = []string{
+	"Could not resolve host",
+	"Connection timed out",
+	"Connection refused",
+	"Connection reset",
+	"Operation timed out",
+	"early EOF",
+	"the remote end hung up unexpectedly",
+	"RPC failed",
+	"returned error: 502",
+	"returned error: 503",
+	"returned error: 504",
+}
+
+// IsTransient reports whether a Clone error is likely caused by a temporary
+// network or hosting problem and is worth retrying.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, marker := range transientGitMarkers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrOutsideRepo is returned by CheckBuildPaths for a path a symlink leads out of the repository
+var ErrOutsideRepo = errors.New("leads outside the repository through a symlink")
+
+// CheckBuildPaths checks that the build context directory, and the Dockerfile inside it, stay
+// inside the repository once symlinks are followed. Their names are checked when they are set
+// (see apps.CleanRepoPath), but a symlink committed to the repository could still point them at
+// files of the host, which the build, the Dockerfile checks and the port detection would read.
+// A path that doesn't exist passes, since there is nothing to read through it.
+//
+// Parameters:
+//   - repoPath: The root of the checkout
+//   - contextDir: The build context directory, relative to repoPath ("" for the root)
+//   - dockerfilePath: The Dockerfile, relative to the context directory
+func CheckBuildPaths(repoPath, contextDir, dockerfilePath string) error {
+	root, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve repository path: %w", err)
+	}
+	for _, p := range []struct{ name, path string }{
+		{"context_dir", filepath.Join(repoPath, contextDir)},
+		{"dockerfile_path", filepath.Join(repoPath, contextDir, dockerfilePath)},
+	} {
+		resolved, err := filepath.EvalSymlinks(p.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", p.name, err)
+		}
+		rel, err := filepath.Rel(root, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s %w", p.name, ErrOutsideRepo)
+		}
+	}
+	return nil
+}
+
+// CheckDockerfile checks that the build context directory exists and contains the Dockerfile.
+//
+// Parameters:
+//   - contextPath: The directory the image is built from (the repository root or a subdirectory)
+//   - dockerfilePath: The Dockerfile, relative to contextPath
+func CheckDockerfile(contextPath, dockerfilePath string) error {
+	if info, err := os.Stat(contextPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("build context directory not found in repository")
+	}
 
 	// Check if Dockerfile exists
-	if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
-		return fmt.Errorf("dockerfile not found in repository root directory")
+	if _, err := os.Stat(filepath.Join(contextPath, dockerfilePath)); os.IsNotExist(err) {
+		return fmt.Errorf("dockerfile %s not found in build context", dockerfilePath)
 	}
 
 	return nil
@@ -0,0 +1,90 @@
+package gitrepo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckBuildPaths(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "Dockerfile"), []byte("FROM scratch\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo := writeRepo(t, map[string]string{
+		"Dockerfile":              "FROM alpine\n",
+		"services/api/Dockerfile": "FROM alpine\n",
+	})
+	links := map[string]string{
+		"host":                  outside,
+		"host-dockerfile":       filepath.Join(outside, "Dockerfile"),
+		"services/api/Linked":   "../../Dockerfile",
+		"services/api/Escape":   "../../../" + filepath.Base(outside) + "/Dockerfile",
+		"services/current":      "api",
+		"services/api/dangling": filepath.Join(outside, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(repo, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		contextDir string
+		dockerfile string
+		outside    bool
+	}{
+		{"root", "", "Dockerfile", false},
+		{"subdirectory", "services/api", "Dockerfile", false},
+		{"symlinked context inside the repository", "services/current", "Dockerfile", false},
+		{"symlinked Dockerfile inside the repository", "services/api", "Linked", false},
+		{"missing Dockerfile", "", "Missing", false},
+		{"dangling symlink", "services/api", "dangling", false},
+		{"context symlinked out", "host", "Dockerfile", true},
+		{"Dockerfile symlinked out", "", "host-dockerfile", true},
+		{"Dockerfile symlinked out relatively", "services/api", "Escape", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckBuildPaths(repo, tt.contextDir, tt.dockerfile)
+			if tt.outside {
+				if !errors.Is(err, ErrOutsideRepo) {
+					t.Errorf("CheckBuildPaths() = %v, want ErrOutsideRepo", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("CheckBuildPaths() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestValidateRepoURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://github.com/go-chi/chi.git", true},
+		{"https://gitlab.example.com:8443/group/sub/repo", true},
+		{"https://token@github.com/user/private.git", true},
+		{"http://github.com/user/repo.git", false},
+		{"file:///etc", false},
+		{"/var/lib/repos/app.git", false},
+		{"../other-app", false},
+		{"ext::sh -c touch% /tmp/pwned", false},
+		{"--upload-pack=touch /tmp/pwned", false},
+		{"git@github.com:user/repo.git", false},
+		{"ssh://git@github.com/user/repo.git", false},
+		{"https://github.com", false},
+		{"https:///user/repo.git", false},
+		{"https://github.com/user/repo.git\n--upload-pack=x", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateRepoURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("ValidateRepoURL(%q) error = %v, want valid = %v", tt.url, err, tt.valid)
+		}
+	}
+}
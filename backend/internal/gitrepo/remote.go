@@ -0,0 +1,115 @@
+package gitrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// probeTimeout bounds a single query of a remote repository's refs
+const probeTimeout = 30 * time.Second
+
+// ValidateRepoURL checks that repoURL is an https:// URL of a remote repository. Clones run on
+// the platform's hosts, so local paths, file:// URLs and transports such as ext:: must never
+// reach git.
+func ValidateRepoURL(repoURL string) error {
+	if strings.ContainsFunc(repoURL, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		return errors.New("repo_url must not contain spaces or control characters")
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.Opaque != "" {
+		return errors.New("repo_url must be an https:// URL, such as https://github.com/user/repo.git")
+	}
+	if u.Path == "" || u.Path == "/" {
+		return errors.New("repo_url must include the repository path")
+	}
+	return nil
+}
+
+// lsRemote runs `git ls-remote` with flags against repoURL, limited to the refs matching
+// patterns if any, and returns its output. Git never prompts for credentials, so a private
+// repository fails instead of hanging.
+func lsRemote(ctx context.Context, repoURL string, flags []string, patterns ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	args := append([]string{"ls-remote"}, flags...)
+	args = append(append(args, "--", repoURL), patterns...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", allowProtocols)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("git ls-remote timed out after %s", probeTimeout)
+		}
+		return "", fmt.Errorf("git ls-remote failed: %w, output: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// RemoteBranches lists the branches of repoURL, sorted by name.
+func RemoteBranches(ctx context.Context, repoURL string) ([]string, error) {
+	output, err := lsRemote(ctx, repoURL, []string{"--heads"})
+	if err != nil {
+		return nil, err
+	}
+	var branches []string
+	for _, line := range strings.Split(output, "\n") {
+		// Each line is "<sha>\trefs/heads/<branch>"
+		_, ref, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+			branches = append(branches, branch)
+		}
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
+
+// RemoteBranchExists reports whether repoURL has branch, without cloning it.
+//
+// Returns:
+//   - bool: Whether the branch exists
+//   - []string: All branches of the repository, to suggest when it doesn't
+//   - error: Error if the repository could not be queried
+func RemoteBranchExists(ctx context.Context, repoURL, branch string) (bool, []string, error) {
+	branches, err := RemoteBranches(ctx, repoURL)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, b := range branches {
+		if b == branch {
+			return true, branches, nil
+		}
+	}
+	return false, branches, nil
+}
+
+// DefaultBranch returns the branch the HEAD of repoURL points to, such as "main" or "master".
+func DefaultBranch(ctx context.Context, repoURL string) (string, error) {
+	output, err := lsRemote(ctx, repoURL, []string{"--symref"}, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	// The first line is "ref: refs/heads/<branch>\tHEAD"
+	for _, line := range strings.Split(output, "\n") {
+		ref, target, ok := strings.Cut(line, "\t")
+		if !ok || target != "HEAD" {
+			continue
+		}
+		if branch, ok := strings.CutPrefix(ref, "ref: refs/heads/"); ok {
+			return branch, nil
+		}
+	}
+	return "", errors.New("repository has no default branch")
+}
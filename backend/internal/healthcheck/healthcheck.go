@@ -0,0 +1,165 @@
+// Package healthcheck verifies that a deployed app is reachable over HTTP.
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProbeTimeout bounds a single health check request
+const ProbeTimeout = 5 * time.Second
+
+// client is shared by all checks. Certificate errors are ignored because a freshly
+// routed app may still be served Traefik's default certificate while ACME issues
+// the real one; we only care that the app answers.
+var client = &http.Client{
+	Timeout: ProbeTimeout,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+// Options controls how many times and how often Verify probes an app.
+type Options struct {
+	// Retries is the total number of probe attempts
+	Retries int
+	// InitialDelay is how long to wait before the first attempt
+	InitialDelay time.Duration
+	// Interval is the wait before the second attempt; it doubles after each further failure
+	Interval time.Duration
+}
+
+// DefaultOptions are the defaults of HEALTHCHECK_RETRIES, HEALTHCHECK_INITIAL_DELAY and
+// HEALTHCHECK_INTERVAL:
+// 3 attempts, after an initial 5s delay, then with 2s and 4s backoff.
+var DefaultOptions = Options{
+	Retries:      3,
+	InitialDelay: 5 * time.Second,
+	Interval:     2 * time.Second,
+}
+
+// delays returns the wait before each attempt
+func (o Options) delays() []time.Duration {
+	retries := o.Retries
+	if retries < 1 {
+		retries = 1
+	}
+	delays := make([]time.Duration, retries)
+	delays[0] = o.InitialDelay
+	interval := o.Interval
+	for i := 1; i < retries; i++ {
+		delays[i] = interval
+		interval *= 2
+	}
+	return delays
+}
+
+// Budget returns the longest Verify can take with these options: every delay, plus every
+// attempt running into ProbeTimeout.
+func (o Options) Budget() time.Duration {
+	var budget time.Duration
+	for _, delay := range o.delays() {
+		budget += delay + ProbeTimeout
+	}
+	return budget
+}
+
+// Verify waits for the app to respond to an HTTP GET on the given path.
+// When expectedStatus is 0 any HTTP response counts as healthy, which keeps apps
+// without a dedicated health endpoint working; otherwise the status must match.
+// Attempts are spaced according to opts (see DefaultOptions).
+//
+// Parameters:
+//   - ctx: Context for cancellation
+//   - baseURL: The public URL of the app (e.g. https://myapp.example.com)
+//   - path: The path to probe (e.g. "/" or "/healthz")
+//   - expectedStatus: The required HTTP status code, or 0 to accept any response
+//   - opts: Retry count and delays
+//
+// Returns:
+//   - error: nil if the app responded as expected, otherwise the last error encountered,
+//     also if ctx ends before the attempts do
+func Verify(ctx context.Context, baseURL, path string, expectedStatus int, opts Options) error {
+	url := probeURL(baseURL, path)
+
+	delays := opts.delays()
+
+	var lastErr error
+	// stopped reports why ctx ended the attempts early
+	stopped := func(attempts int) error {
+		if lastErr == nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("app did not respond in time after %d attempts: %w", attempts, lastErr)
+	}
+	for attempt, delay := range delays {
+		select {
+		case <-ctx.Done():
+			return stopped(attempt)
+		case <-time.After(delay):
+		}
+
+		status, err := probe(ctx, url, expectedStatus)
+		if err != nil {
+			if ctx.Err() != nil {
+				return stopped(attempt)
+			}
+			lastErr = err
+			log.Printf("Health check attempt %d/%d for %s failed: %v", attempt+1, len(delays), url, err)
+			continue
+		}
+
+		log.Printf("Health check for %s passed with status %d", url, status)
+		return nil
+	}
+
+	return fmt.Errorf("app did not respond after %d attempts: %w", len(delays), lastErr)
+}
+
+// Probe makes a single health check request, without retrying or logging. It is what the
+// liveness checks of running apps use; whether a failure matters is up to the caller.
+//
+// Parameters:
+//   - ctx: Context for cancellation
+//   - baseURL: The public URL of the app (e.g. https://myapp.example.com)
+//   - path: The path to probe (e.g. "/" or "/healthz")
+//   - expectedStatus: The required HTTP status code, or 0 to accept any response
+//
+// Returns:
+//   - error: nil if the app responded as expected
+func Probe(ctx context.Context, baseURL, path string, expectedStatus int) error {
+	_, err := probe(ctx, probeURL(baseURL, path), expectedStatus)
+	return err
+}
+
+// probeURL joins the app's URL and the health check path, which defaults to "/"
+func probeURL(baseURL, path string) string {
+	if path == "" {
+		path = "/"
+	}
+	return strings.TrimSuffix(baseURL, "/") + path
+}
+
+// probe GETs url once and returns the response status
+func probe(ctx context.Context, url string, expectedStatus int) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("invalid health check URL: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if expectedStatus != 0 && resp.StatusCode != expectedStatus {
+		return resp.StatusCode, fmt.Errorf("got status %d, expected %d", resp.StatusCode, expectedStatus)
+	}
+	return resp.StatusCode, nil
+}
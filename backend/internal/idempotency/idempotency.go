@@ -0,0 +1,86 @@
+// Package idempotency stores the responses of requests sent with an Idempotency-Key
+// header so a retried request gets the original response instead of being executed twice.
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// TTL is how long a key is remembered; a retry after that is treated as a new request
+const TTL = 24 * time.Hour
+
+// Response is a stored response to replay
+type Response struct {
+	StatusCode int
+	Body       string
+}
+
+// Store provides database operations for idempotency keys.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a new Store instance with the provided database connection.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Reserve claims a key within a scope (e.g. the user ID) before the request is executed.
+// Expired keys are purged first, so a key can be reused once its TTL has passed.
+//
+// Returns:
+//   - bool: true if the key was claimed and the request should be executed
+//   - *Response: if not claimed, the stored response, or nil if the first request is still in progress
+//   - error: Database error if the query fails
+func (s *Store) Reserve(ctx context.Context, scope, key string) (bool, *Response, error) {
+	if _, err := s.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'",
+		TTL.Seconds(),
+	); err != nil {
+		return false, nil, err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (scope, key) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		scope, key,
+	)
+	if err != nil {
+		return false, nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return false, nil, err
+	} else if n == 1 {
+		return true, nil, nil
+	}
+
+	var status sql.NullInt64
+	var body sql.NullString
+	err = s.db.QueryRowContext(ctx,
+		"SELECT status_code, response_body FROM idempotency_keys WHERE scope = $1 AND key = $2",
+		scope, key,
+	).Scan(&status, &body)
+	if err != nil {
+		return false, nil, err
+	}
+	if !status.Valid {
+		return false, nil, nil
+	}
+	return false, &Response{StatusCode: int(status.Int64), Body: body.String}, nil
+}
+
+// Complete stores the response of a reserved key for replay.
+func (s *Store) Complete(ctx context.Context, scope, key string, resp Response) error {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE idempotency_keys SET status_code = $3, response_body = $4 WHERE scope = $1 AND key = $2",
+		scope, key, resp.StatusCode, resp.Body,
+	)
+	return err
+}
+
+// Release drops a reserved key without storing a response, so the request can be retried.
+func (s *Store) Release(ctx context.Context, scope, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2", scope, key)
+	return err
+}
@@ -0,0 +1,136 @@
+// Package imagepolicy decides which base images apps may be built from, so operators can
+// keep builds off unapproved or known-vulnerable images.
+package imagepolicy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// Policy restricts the base images named in FROM lines.
+// Patterns in Allow and Deny are path.Match globs matched against the image as written and
+// against its full name: "node:*", "python:3.12-slim", "docker.io/library/*" or
+// "registry.example.com/base/*@sha256:*". An image without a tag is the ":latest" one.
+// The zero value allows every image and scans none.
+type Policy struct {
+	// Allow, if non-empty, lists the only base images builds may use
+	Allow []string
+
+	// Deny lists base images builds may not use, even if Allow matches them
+	Deny []string
+
+	// ScanCommand, if set, is run with each base image appended as its last argument before
+	// the build, e.g. "trivy image --exit-code 1 --severity CRITICAL". A non-zero exit
+	// rejects the image.
+	ScanCommand string
+}
+
+// scanTimeout bounds the scan of one base image
+const scanTimeout = 5 * time.Minute
+
+// scanOutputLines is how many of a failed scan's last output lines the error keeps
+const scanOutputLines = 20
+
+// Enabled reports whether the policy restricts or scans anything.
+func (p Policy) Enabled() bool {
+	return len(p.Allow) > 0 || len(p.Deny) > 0 || p.ScanCommand != ""
+}
+
+// Validate checks that every pattern is a valid glob.
+func (p Policy) Validate() error {
+	var errs []error
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid base image pattern %q: %w", pattern, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check returns an error naming the first image the policy doesn't allow.
+func (p Policy) Check(images []string) error {
+	for _, image := range images {
+		if pattern := match(p.Deny, image); pattern != "" {
+			return fmt.Errorf("base image %s is not allowed (denied by %q)", image, pattern)
+		}
+		if len(p.Allow) > 0 && match(p.Allow, image) == "" {
+			return fmt.Errorf("base image %s is not allowed; allowed base images are %s", image, strings.Join(p.Allow, ", "))
+		}
+	}
+	return nil
+}
+
+// Scan runs ScanCommand on each image and returns an error with the scanner's last output
+// lines for the first one it rejects. It does nothing if no ScanCommand is set.
+func (p Policy) Scan(ctx context.Context, images []string) error {
+	args := strings.Fields(p.ScanCommand)
+	if len(args) == 0 {
+		return nil
+	}
+	for _, image := range images {
+		scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
+		var output bytes.Buffer
+		cmd := exec.CommandContext(scanCtx, args[0], append(args[1:], image)...)
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("base image %s failed its scan (%v):\n%s", image, err, lastLines(output.String(), scanOutputLines))
+		}
+	}
+	return nil
+}
+
+// match returns the first pattern image matches, or ""
+func match(patterns []string, image string) string {
+	full := Normalize(image)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, image); ok {
+			return pattern
+		}
+		if ok, _ := path.Match(pattern, full); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// Normalize returns the full name of an image reference the way Docker resolves it,
+// e.g. "node:20" becomes "docker.io/library/node:20" and "nginx" "docker.io/library/nginx:latest".
+func Normalize(image string) string {
+	name, suffix := image, ""
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, suffix = name[:i], name[i:]
+	}
+	// A colon after the last slash starts the tag; one before it is a registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, suffix = name[:i], name[i:]+suffix
+	} else if suffix == "" {
+		suffix = ":latest"
+	}
+
+	first, _, hasSlash := strings.Cut(name, "/")
+	switch {
+	case !hasSlash:
+		name = "docker.io/library/" + name
+	case !strings.ContainsAny(first, ".:") && first != "localhost":
+		name = "docker.io/" + name
+	}
+	return name + suffix
+}
+
+// lastLines returns the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,45 +1,427 @@
 // Package logs provides utilities for parsing and processing deployment logs.
-// Currently focused on parsing Docker build logs from streams.
+// It parses Docker build logs from streams and redacts secret values from them.
 package logs
 
 import (
 	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 
-// ParseBuildLog reads a stream of build logs and converts it to a single string.
-// This is used to capture Docker build output and store it in the database.
+// TruncatedMarker is prepended to logs whose beginning was dropped to stay under the size cap.
+const TruncatedMarker = "[log truncated]"
+
+// tailBuffer keeps the most recent lines whose combined size fits within maxBytes.
+// A maxBytes of 0 keeps everything.
+type tailBuffer struct {
+	maxBytes  int
+	lines     []string
+	start     int
+	size      int
+	truncated bool
+}
+
+// add appends a line, dropping the oldest lines once the buffer is over its cap
+func (b *tailBuffer) add(line string) {
+	if b.maxBytes > 0 && len(line) > b.maxBytes {
+		// Keep only the end of an oversized line
+		line = line[len(line)-b.maxBytes:]
+		b.truncated = true
+	}
+	b.lines = append(b.lines, line)
+	b.size += len(line) + 1
+
+	for b.maxBytes > 0 && b.size > b.maxBytes && b.start < len(b.lines)-1 {
+		b.size -= len(b.lines[b.start]) + 1
+		b.lines[b.start] = ""
+		b.start++
+		b.truncated = true
+	}
+
+	// Compact occasionally so dropped lines can be garbage collected
+	if b.start > 1024 && b.start > len(b.lines)/2 {
+		b.lines = append([]string(nil), b.lines[b.start:]...)
+		b.start = 0
+	}
+}
+
+// String joins the kept lines, prefixed with TruncatedMarker if anything was dropped
+func (b *tailBuffer) String() string {
+	out := strings.Join(b.lines[b.start:], "\n")
+	if b.truncated {
+		return TruncatedMarker + "\n" + out
+	}
+	return out
+}
+
+// BuildLog is the result of parsing a build output stream.
+type BuildLog struct {
+	// Text is the readable log, prefixed with TruncatedMarker if trimmed
+	Text string
+	// Error is the error the build reported, empty if it succeeded
+	Error string
+	// FailedStep is the Dockerfile step that was running when the build failed
+	// (e.g. "Step 4/7 : RUN npm ci", or "[4/7] RUN npm ci" with BuildKit),
+	// empty if unknown or the build succeeded
+	FailedStep string
+	// Steps is the number of build steps seen in the output
+	Steps int
+	// CachedSteps is how many of them reused a layer from an earlier build
+	CachedSteps int
+}
+
+// CacheSummary describes how much of the build came from the layer cache
+// (e.g. "4 of 7 steps cached"), or "" if the output had no recognizable steps.
+func (b *BuildLog) CacheSummary() string {
+	if b.Steps == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d steps cached", b.CachedSteps, b.Steps)
+}
+
+// BuildKit's plain progress output numbers each step ("#7 [2/5] RUN npm ci") and
+// prefixes the step's output, cache hits and errors with its number
+var (
+	buildKitStep   = regexp.MustCompile(`^#(\d+) (\[.*)$`)
+	buildKitCached = regexp.MustCompile(`^#(\d+) CACHED`)
+	buildKitError  = regexp.MustCompile(`^#(\d+) ERROR: (.*)$`)
+)
+
+// scanStep follows the build steps through one line of build output: it counts steps and
+// cache hits and, for BuildKit, records which step failed. The legacy builder prints
+// "Step n/m" followed by " ---> Using cache" for cached steps and reports errors as JSON;
+// BuildKit (USE_BUILDKIT and Nixpacks) prints "#n CACHED" and "#n ERROR: ..." instead,
+// and ends a failed build with "ERROR: failed to solve: ...".
+// steps maps BuildKit step numbers to their names. Errors are only taken from plain
+// (non-JSON) lines: in the legacy stream such text is output of the build's own commands.
+func (b *BuildLog) scanStep(line string, steps map[string]string, plain bool) {
+	switch {
+	case strings.HasPrefix(line, "Step "):
+		b.Steps++
+	case strings.TrimSpace(line) == "---> Using cache":
+		b.CachedSteps++
+	case !plain:
+	case strings.HasPrefix(line, "ERROR: failed to "):
+		// The final summary repeats the step's error; keep the step's own if it was seen
+		if b.Error == "" {
+			b.Error = strings.TrimPrefix(line, "ERROR: ")
+		}
+	default:
+		if m := buildKitStep.FindStringSubmatch(line); m != nil {
+			if _, seen := steps[m[1]]; !seen {
+				steps[m[1]] = m[2]
+				b.Steps++
+			}
+		} else if buildKitCached.MatchString(line) {
+			b.CachedSteps++
+		} else if m := buildKitError.FindStringSubmatch(line); m != nil && b.Error == "" {
+			b.Error = m[2]
+			b.FailedStep = steps[m[1]]
+		}
+	}
+}
+
+// FailureSummary is a one-line description of why the build failed, naming the step if known.
+// Empty if the build succeeded.
+func (b *BuildLog) FailureSummary() string {
+	if b.Error == "" {
+		return ""
+	}
+	if b.FailedStep != "" {
+		return fmt.Sprintf("%s failed: %s", b.FailedStep, b.Error)
+	}
+	return b.Error
+}
+
+// buildMessage is one JSON object of the Docker build stream
+type buildMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	ID          string `json:"id"`
+	Progress    string `json:"progress"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// ParseBuildLog reads a build output stream and converts it to readable text.
+// The Docker daemon sends the build as a stream of JSON objects ({"stream": ...},
+// {"status": ...}, {"errorDetail": ...}); their text is unwrapped, and a reported
+// error is extracted together with the step that was running. Lines that aren't
+// JSON (BuildKit and Nixpacks output) are kept as they are, and BuildKit's errors
+// are extracted from them the same way.
+// Only the last maxBytes of output are kept so verbose builds can't bloat the database.
 // The reader is automatically closed when the function returns.
 //
 // Parameters:
-//   - reader: An io.ReadCloser containing the build log stream (typically from Docker build output)
+//   - reader: An io.ReadCloser containing the build output (typically from Builder.Build)
+//   - maxBytes: Maximum size of the returned text; 0 disables the cap
 //
 // Returns:
-//   - string: All log lines joined with newlines, or empty string on error
+//   - *BuildLog: The readable log and any build error, or nil on error
 //   - error: Error if reading or scanning fails
-func ParseBuildLog(reader io.ReadCloser) (string, error) {
+func ParseBuildLog(reader io.ReadCloser, maxBytes int) (*BuildLog, error) {
 	// Ensure the reader is closed when we're done
 	defer reader.Close()
 
-	// Store all log lines in a slice
-	var logLines []string
-	
+	// Store the most recent log lines
+	logLines := &tailBuffer{maxBytes: maxBytes}
+	result := &BuildLog{}
+	currentStep := ""
+	buildKitSteps := make(map[string]string)
+
 	// Use a scanner to read line by line (more efficient than reading all at once)
 	scanner := bufio.NewScanner(reader)
+	// A single stream message can carry a long line of compiler output
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
 
 	// Read each line from the stream
 	for scanner.Scan() {
 		line := scanner.Text()
-		logLines = append(logLines, line)
+		var msg buildMessage
+		if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &msg) != nil {
+			result.scanStep(line, buildKitSteps, true)
+			logLines.add(line)
+			continue
+		}
+
+		switch {
+		case msg.ErrorDetail != nil || msg.Error != "":
+			result.Error = msg.Error
+			if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+				result.Error = msg.ErrorDetail.Message
+			}
+			result.FailedStep = currentStep
+			logLines.add("ERROR: " + result.Error)
+		case msg.Stream != "":
+			for _, text := range strings.Split(strings.TrimRight(msg.Stream, "\n"), "\n") {
+				if strings.HasPrefix(text, "Step ") {
+					currentStep = strings.TrimSpace(text)
+				}
+				result.scanStep(text, buildKitSteps, false)
+				logLines.add(text)
+			}
+		case msg.Status != "" && msg.Progress == "":
+			// Per-layer pull progress updates would drown out the build itself
+			if msg.ID != "" {
+				logLines.add(msg.ID + ": " + msg.Status)
+			} else {
+				logLines.add(msg.Status)
+			}
+		}
 	}
 
 	// Check for scanning errors (not EOF, which is normal)
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Join the kept lines with newline characters to create the log
+	result.Text = logLines.String()
+	return result, nil
+}
+
+// Truncate keeps the last maxBytes of text, cutting on line boundaries,
+// and prefixes TruncatedMarker if anything was removed. A maxBytes of 0 returns text unchanged.
+func Truncate(text string, maxBytes int) string {
+	if maxBytes <= 0 || len(text) <= maxBytes {
+		return text
+	}
+	logLines := &tailBuffer{maxBytes: maxBytes}
+	for _, line := range strings.Split(text, "\n") {
+		logLines.add(line)
+	}
+	return logLines.String()
+}
+
+// ArchivePath returns where the full log of the given type ("build" or "runtime")
+// for a deployment is stored inside an archive directory.
+func ArchivePath(dir string, deploymentID int, logType string) string {
+	return filepath.Join(dir, fmt.Sprintf("deployment-%d-%s.log", deploymentID, logType))
+}
+
+// Stream identifiers used in the Docker multiplexed log header
+const (
+	streamStdout = 1
+	streamStderr = 2
+)
+
+// ParsePlainLog reads a raw container log stream, as returned for containers started with a TTY,
+// and converts it to a single string. Such streams have no frame headers, and stdout and stderr
+// are merged. Carriage returns from the terminal are dropped.
+// Only the last maxBytes of output are kept.
+// The reader is automatically closed when the function returns.
+//
+// Parameters:
+//   - reader: An io.ReadCloser containing the log stream (typically from Runner.Logs)
+//   - maxBytes: Maximum size of the returned log; 0 disables the cap
+//
+// Returns:
+//   - string: Log lines joined with newlines, prefixed with TruncatedMarker if trimmed, or empty string on error
+//   - error: Error if reading or scanning fails
+func ParsePlainLog(reader io.ReadCloser, maxBytes int) (string, error) {
+	// Ensure the reader is closed when we're done
+	defer reader.Close()
+
+	logLines := &tailBuffer{maxBytes: maxBytes}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		logLines.add(strings.TrimRight(scanner.Text(), "\r"))
+	}
 	if err := scanner.Err(); err != nil {
 		return "", err
 	}
+	return logLines.String(), nil
+}
+
+// ParseRuntimeLog reads a multiplexed Docker container log stream and converts it to a single string.
+// Each frame in the stream starts with an 8-byte header: the stream type (1 = stdout, 2 = stderr),
+// three zero bytes, and a big-endian uint32 payload length.
+// Lines written to stderr are prefixed with "[stderr] " so users can tell the streams apart.
+// Only the last maxBytes of output are kept.
+// The reader is automatically closed when the function returns.
+//
+// Parameters:
+//   - reader: An io.ReadCloser containing the log stream (typically from Runner.Logs)
+//   - maxBytes: Maximum size of the returned log; 0 disables the cap
+//
+// Returns:
+//   - string: Log lines joined with newlines, prefixed with TruncatedMarker if trimmed, or empty string on error
+//   - error: Error if reading fails or a frame is truncated
+func ParseRuntimeLog(reader io.ReadCloser, maxBytes int) (string, error) {
+	// Ensure the reader is closed when we're done
+	defer reader.Close()
+
+	logLines := &tailBuffer{maxBytes: maxBytes}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			// A clean EOF between frames is the normal end of the stream
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return "", err
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return "", err
+		}
+
+		prefix := ""
+		if header[0] == streamStderr {
+			prefix = "[stderr] "
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(payload), "\n"), "\n") {
+			logLines.add(prefix + line)
+		}
+	}
 
-	// Join all lines with newline characters to create the full log
-	return strings.Join(logLines, "\n"), nil
+	return logLines.String(), nil
 }
 
+// Stream names of runtime log lines
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// ScanRuntimeLog reads a container log stream as it arrives, such as a followed one, and calls
+// fn with each line and the stream it was written to. A TTY stream is raw text whose lines are
+// all reported as stdout; any other stream is multiplexed (see ParseRuntimeLog).
+// The reader isn't closed.
+//
+// Returns:
+//   - error: nil once the stream ends cleanly, otherwise the read error
+func ScanRuntimeLog(reader io.Reader, tty bool, fn func(stream, line string)) error {
+	if tty {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			fn(StreamStdout, strings.TrimRight(scanner.Text(), "\r"))
+		}
+		return scanner.Err()
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return err
+		}
+		stream := StreamStdout
+		if header[0] == streamStderr {
+			stream = StreamStderr
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(payload), "\n"), "\n") {
+			fn(stream, line)
+		}
+	}
+}
+
+// SplitTimestamp separates the timestamp Docker prefixes container log lines with from the
+// line itself. ok is false if the line has no timestamp.
+func SplitTimestamp(line string) (at time.Time, message string, ok bool) {
+	stamp, message, found := strings.Cut(line, " ")
+	if !found {
+		stamp, message = line, ""
+	}
+	at, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return time.Time{}, line, false
+	}
+	return at, message, true
+}
+
+// secretKeyMarkers are substrings that make a variable name look like it holds a secret
+var secretKeyMarkers = []string{"SECRET", "TOKEN", "PASSWORD", "PASSWD", "PASS", "KEY", "CREDENTIAL", "AUTH", "PRIVATE"}
+
+// IsSecretKey reports whether a variable name looks like it holds a secret
+// (e.g. NPM_TOKEN, DB_PASSWORD, API_KEY).
+func IsSecretKey(key string) bool {
+	upper := strings.ToUpper(key)
+	for _, marker := range secretKeyMarkers {
+		if strings.Contains(upper, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// SecretValues returns the values of all secret-looking keys in vars, for use with Redact.
+func SecretValues(vars map[string]string) []string {
+	var secrets []string
+	for key, value := range vars {
+		if IsSecretKey(key) {
+			secrets = append(secrets, value)
+		}
+	}
+	return secrets
+}
+
+// Redact replaces every occurrence of each secret in text with "[REDACTED]".
+// Very short values are skipped since masking them would mangle unrelated output.
+func Redact(text string, secrets []string) string {
+	for _, secret := range secrets {
+		if len(secret) < 4 {
+			continue
+		}
+		text = strings.ReplaceAll(text, secret, "[REDACTED]")
+	}
+	return text
+}
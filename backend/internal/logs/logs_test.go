@@ -0,0 +1,128 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// frame encodes payload as one frame of a multiplexed Docker log stream
+func frame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+// multiplexed joins frames into a multiplexed log stream
+func multiplexed(frames ...[]byte) io.ReadCloser {
+	return io.NopCloser(bytes.NewReader(bytes.Join(frames, nil)))
+}
+
+// raw is the log stream of a TTY container: plain text without frame headers
+func raw(text string) io.ReadCloser {
+	return io.NopCloser(strings.NewReader(text))
+}
+
+func TestParseRuntimeLog(t *testing.T) {
+	stream := multiplexed(
+		frame(1, "listening on :8080\n"),
+		frame(2, "warning: no cache\n"),
+		frame(1, "GET /\nGET /health\n"),
+	)
+	got, err := ParseRuntimeLog(stream, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "listening on :8080\n[stderr] warning: no cache\nGET /\nGET /health"
+	if got != want {
+		t.Errorf("ParseRuntimeLog() = %q, want %q", got, want)
+	}
+}
+
+func TestParseRuntimeLogTruncatedFrame(t *testing.T) {
+	full := frame(1, "a line that is cut off\n")
+	stream := io.NopCloser(bytes.NewReader(full[:len(full)-5]))
+	if _, err := ParseRuntimeLog(stream, 0); err == nil {
+		t.Error("ParseRuntimeLog() of a truncated frame returned no error")
+	}
+}
+
+func TestParseRuntimeLogMaxBytes(t *testing.T) {
+	stream := multiplexed(frame(1, "first\n"), frame(1, "second\n"), frame(1, "third\n"))
+	got, err := ParseRuntimeLog(stream, 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := TruncatedMarker + "\nsecond\nthird"
+	if got != want {
+		t.Errorf("ParseRuntimeLog() = %q, want %q", got, want)
+	}
+}
+
+func TestParsePlainLog(t *testing.T) {
+	// A TTY ends lines with CRLF and has no frame headers
+	got, err := ParsePlainLog(raw("listening on :8080\r\nGET /\r\n"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "listening on :8080\nGET /"
+	if got != want {
+		t.Errorf("ParsePlainLog() = %q, want %q", got, want)
+	}
+}
+
+func TestParsePlainLogKeepsBytesAFrameHeaderWouldEat(t *testing.T) {
+	// Read as multiplexed, the first 8 bytes would be taken for a frame header
+	text := "\x01bc\x00\x00\x00\x00\x05hello world"
+	got, err := ParsePlainLog(raw(text), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != text {
+		t.Errorf("ParsePlainLog() = %q, want %q", got, text)
+	}
+}
+
+func TestScanRuntimeLog(t *testing.T) {
+	type line struct{ stream, text string }
+	tests := []struct {
+		name   string
+		stream io.Reader
+		tty    bool
+		want   []line
+	}{
+		{
+			name:   "multiplexed",
+			stream: multiplexed(frame(1, "out 1\nout 2\n"), frame(2, "err\n")),
+			want:   []line{{StreamStdout, "out 1"}, {StreamStdout, "out 2"}, {StreamStderr, "err"}},
+		},
+		{
+			name:   "raw",
+			stream: raw("out 1\r\nout 2\n"),
+			tty:    true,
+			want:   []line{{StreamStdout, "out 1"}, {StreamStdout, "out 2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []line
+			err := ScanRuntimeLog(tt.stream, tt.tty, func(stream, text string) {
+				got = append(got, line{stream, text})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ScanRuntimeLog() read %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("line %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
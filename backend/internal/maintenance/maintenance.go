@@ -0,0 +1,137 @@
+// Package maintenance routes the hostnames of apps that aren't running to a static
+// "app is paused" page.
+//
+// Like gradual rollouts (see package rollout), the routes are files in the directory
+// Traefik's file provider watches. Each is a router for an app's hostnames with the lowest
+// priority, so the label-defined router of any running container takes precedence and the
+// page only answers while the app has no container up. The page itself is served elsewhere,
+// by default by the API; the router rewrites every request path to the page's path.
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mvp-be/internal/domains"
+	"mvp-be/internal/environments"
+)
+
+// routerPriority loses to the label-defined routers, whose priority is the length of their rule
+const routerPriority = 1
+
+// filePrefix starts the names of the files the Router writes
+const filePrefix = "paused-"
+
+// Router writes and removes maintenance routes in Traefik's dynamic configuration directory.
+type Router struct {
+	dir          string
+	certResolver string
+	page         *url.URL
+}
+
+// NewRouter returns a Router writing to dir, the directory Traefik's file provider watches,
+// routes to the page at pageURL. An empty dir or pageURL disables maintenance routes.
+func NewRouter(dir, certResolver, pageURL string) *Router {
+	r := &Router{dir: dir, certResolver: certResolver}
+	if u, err := url.Parse(pageURL); err == nil && u.Host != "" {
+		r.page = u
+	}
+	return r
+}
+
+// Route returns the name of an app's maintenance route and the hosts it covers: the app's
+// production hostname and its verified custom domains. A failure to list the custom domains is
+// logged, and the route covers the production hostname alone.
+func Route(ctx context.Context, domainStore *domains.Store, baseDomain, slug string, appID int) (name string, hosts []string) {
+	name = environments.Subdomain(slug, environments.Production)
+	hosts = []string{fmt.Sprintf("%s.%s", name, baseDomain)}
+	customDomains, err := domainStore.ListVerified(ctx, appID)
+	if err != nil {
+		log.Printf("Warning: failed to list custom domains of app %d: %v", appID, err)
+	}
+	return name, append(hosts, customDomains...)
+}
+
+// Enabled reports whether maintenance routes can be written.
+func (r *Router) Enabled() bool {
+	return r != nil && r.dir != "" && r.page != nil
+}
+
+// Pause sends requests for hosts to the maintenance page whenever no container serves them.
+// Calling it again replaces the hosts of the same app.
+func (r *Router) Pause(name string, hosts []string) error {
+	rules := make([]string, len(hosts))
+	for i, host := range hosts {
+		rules[i] = fmt.Sprintf("Host(`%s`)", host)
+	}
+	pagePath := r.page.Path
+	if pagePath == "" {
+		pagePath = "/"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written while %s is not running; removed when it runs again\n", name)
+	b.WriteString("http:\n")
+	b.WriteString("  routers:\n")
+	fmt.Fprintf(&b, "    %s-paused:\n", name)
+	fmt.Fprintf(&b, "      rule: %q\n", strings.Join(rules, " || "))
+	b.WriteString("      entryPoints:\n        - websecure\n")
+	fmt.Fprintf(&b, "      priority: %d\n", routerPriority)
+	fmt.Fprintf(&b, "      middlewares:\n        - %s-paused\n", name)
+	fmt.Fprintf(&b, "      service: %s-paused\n", name)
+	b.WriteString("      tls:\n")
+	fmt.Fprintf(&b, "        certResolver: %q\n", r.certResolver)
+	b.WriteString("  middlewares:\n")
+	fmt.Fprintf(&b, "    %s-paused:\n", name)
+	fmt.Fprintf(&b, "      replacePath:\n        path: %q\n", pagePath)
+	b.WriteString("  services:\n")
+	fmt.Fprintf(&b, "    %s-paused:\n", name)
+	b.WriteString("      loadBalancer:\n        passHostHeader: false\n        servers:\n")
+	fmt.Fprintf(&b, "          - url: %q\n", r.page.Scheme+"://"+r.page.Host)
+
+	// Rewriting an unchanged route would only make Traefik reload it
+	path := r.path(name)
+	if current, err := os.ReadFile(path); err == nil && string(current) == b.String() {
+		return nil
+	}
+	// Write and rename, so Traefik never loads a half-written file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write maintenance route: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write maintenance route: %w", err)
+	}
+	return nil
+}
+
+// Resume removes an app's maintenance route.
+func (r *Router) Resume(name string) error {
+	if err := os.Remove(r.path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove maintenance route: %w", err)
+	}
+	return nil
+}
+
+// Paused returns the names of the apps that have a maintenance route.
+func (r *Router) Paused() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(r.dir, filePrefix+"*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), filePrefix), ".yml")
+	}
+	return names, nil
+}
+
+func (r *Router) path(name string) string {
+	return filepath.Join(r.dir, filePrefix+name+".yml")
+}
@@ -0,0 +1,163 @@
+// Package metrics records container resource usage over time.
+// A background Sampler periodically snapshots every running container and
+// the Store serves downsampled time series for charting.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/dockerrun"
+)
+
+// Point is a single downsampled value in a usage series
+type Point struct {
+	Timestamp   time.Time `json:"timestamp"`
+	MemoryBytes int64     `json:"memory_bytes"`
+	CPUPercent  float64   `json:"cpu_percent"`
+	DiskBytes   int64     `json:"disk_bytes"`
+}
+
+// Store provides database operations for usage samples.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a new Store instance with the provided database connection.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Record inserts a usage sample for a deployment's container.
+func (s *Store) Record(ctx context.Context, appID, deploymentID int, usage *dockerrun.ContainerUsage) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO usage_samples (app_id, deployment_id, memory_bytes, cpu_percent, disk_bytes) VALUES ($1, $2, $3, $4, $5)",
+		appID, deploymentID, int64(usage.MemoryBytes), usage.CPUPercent, usage.DiskBytes,
+	)
+	return err
+}
+
+// Series returns an app's usage since the given time, averaged into buckets of the given width.
+// Memory and CPU are averaged per bucket; disk uses the bucket maximum.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - appID: The app whose samples to read
+//   - since: Only samples taken at or after this time are included
+//   - bucket: The width of each downsampled point
+//
+// Returns:
+//   - []Point: Points ordered by timestamp (oldest first), empty if there are no samples
+//   - error: Database error if query fails
+func (s *Store) Series(ctx context.Context, appID int, since time.Time, bucket time.Duration) ([]Point, error) {
+	seconds := bucket.Seconds()
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT to_timestamp(floor(extract(epoch FROM sampled_at) / $3) * $3) AT TIME ZONE 'UTC' AS bucket,
+		       AVG(memory_bytes)::BIGINT, AVG(cpu_percent), MAX(disk_bytes)
+		FROM usage_samples
+		WHERE app_id = $1 AND sampled_at >= $2
+		GROUP BY bucket
+		ORDER BY bucket ASC`,
+		appID, since, seconds,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []Point{}
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Timestamp, &p.MemoryBytes, &p.CPUPercent, &p.DiskBytes); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// Cleanup deletes samples older than the retention period and returns how many were removed.
+func (s *Store) Cleanup(ctx context.Context, retention time.Duration) (int64, error) {
+	result, err := s.db.ExecContext(ctx,
+		"DELETE FROM usage_samples WHERE sampled_at < $1",
+		time.Now().Add(-retention),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Sampler periodically records resource usage of every running deployment.
+type Sampler struct {
+	store           *Store
+	deploymentStore *deployments.Store
+	runner          *dockerrun.Runner
+	interval        time.Duration
+	retention       time.Duration
+}
+
+// NewSampler creates a Sampler that records usage every interval and
+// deletes samples older than retention.
+func NewSampler(store *Store, deploymentStore *deployments.Store, runner *dockerrun.Runner, interval, retention time.Duration) *Sampler {
+	return &Sampler{
+		store:           store,
+		deploymentStore: deploymentStore,
+		runner:          runner,
+		interval:        interval,
+		retention:       retention,
+	}
+}
+
+// Run samples on every tick until ctx is cancelled.
+func (s *Sampler) Run(ctx context.Context) {
+	log.Printf("Usage sampler started (interval %s, retention %s)", s.interval, s.retention)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Usage sampler stopped")
+			return
+		case <-ticker.C:
+			s.sample(ctx)
+		}
+	}
+}
+
+// sample records one usage sample per running deployment and prunes expired samples.
+func (s *Sampler) sample(ctx context.Context) {
+	running, err := s.deploymentStore.ListRunning(ctx)
+	if err != nil {
+		log.Printf("Error listing running deployments for sampling: %v", err)
+		return
+	}
+
+	for _, d := range running {
+		sampleCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		usage, err := s.runner.Usage(sampleCtx, d.ContainerID.String)
+		cancel()
+		if err != nil {
+			log.Printf("Warning: failed to sample usage for deployment %d: %v", d.ID, err)
+			continue
+		}
+		if err := s.store.Record(ctx, d.AppID, d.ID, usage); err != nil {
+			log.Printf("Warning: failed to record usage for deployment %d: %v", d.ID, err)
+		}
+	}
+
+	if removed, err := s.store.Cleanup(ctx, s.retention); err != nil {
+		log.Printf("Warning: failed to clean up usage samples: %v", err)
+	} else if removed > 0 {
+		log.Printf("Removed %d expired usage samples", removed)
+	}
+}
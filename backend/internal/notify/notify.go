@@ -0,0 +1,182 @@
+// Package notify delivers signed webhook notifications about deployment status changes.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the request body, keyed with the app's
+// notify secret, as "sha256=<hex>". Receivers recompute it to check the request came from us.
+const SignatureHeader = "X-Stackyn-Signature"
+
+// EventHeader names the kind of event in the body
+const EventHeader = "X-Stackyn-Event"
+
+// EventDeploymentStatus is sent when a deployment becomes running or failed
+const EventDeploymentStatus = "deployment.status"
+
+// maxAttempts is how many times Send tries to deliver a notification
+const maxAttempts = 4
+
+// retryBaseDelay is the wait before the first retry; it doubles for each further retry
+const retryBaseDelay = 2 * time.Second
+
+// client only connects to public addresses and doesn't follow redirects, so a notify URL
+// can't make the platform call its own services, the private network or a cloud metadata
+// endpoint, not even through a hostname that resolves to one or a redirect to one.
+// A redirect counts as a failed delivery.
+var client = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: checkDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// nonPublicPrefixes are ranges beyond the loopback, private and link-local ones that must not
+// be reached: "this network", carrier-grade NAT, IETF protocol assignments, benchmarking,
+// documentation and reserved addresses, and the IPv6 forms that embed IPv4 addresses
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// isPublicAddress reports whether ip is a public unicast address notifications may be sent to
+func isPublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDialAddress refuses connections to non-public addresses. It runs for every address
+// a hostname resolves to, after resolution, so DNS can't point around it.
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddress(ip) {
+		return fmt.Errorf("notifications can't be sent to non-public address %s", ip)
+	}
+	return nil
+}
+
+// Event is the JSON body of a deployment status notification.
+type Event struct {
+	AppID        int       `json:"app_id"`
+	DeploymentID int       `json:"deployment_id"`
+	Status       string    `json:"status"`
+	URL          string    `json:"url,omitempty"`
+	CommitSHA    string    `json:"commit_sha,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// NewSecret returns a random secret for signing an app's notifications
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the value of SignatureHeader for body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send POSTs event to url, signed with secret. Only public addresses are contacted and
+// redirects aren't followed (see client). Network errors and non-2xx responses are retried
+// with exponential backoff (2s, 4s, 8s) before giving up.
+func Send(ctx context.Context, url, secret string, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	signature := Sign(secret, body)
+
+	var lastErr error
+	delay := retryBaseDelay
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		lastErr = post(ctx, url, signature, body)
+		if lastErr == nil {
+			return nil
+		}
+		log.Printf("Notification to %s failed (attempt %d/%d): %v", url, attempt, maxAttempts, lastErr)
+	}
+	return lastErr
+}
+
+// post makes a single delivery attempt
+func post(ctx context.Context, url, signature string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Stackyn-Webhook")
+	req.Header.Set(EventHeader, EventDeploymentStatus)
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package registry holds the settings for pushing built images to a Docker registry,
+// so a container can run on a different host than the one its image was built on.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+// Config is the registry images are pushed to and pulled from.
+// The zero value disables the registry: images stay on the host that built them.
+type Config struct {
+	// URL is the registry host and optional path prefix, e.g. "registry.example.com/stackyn"
+	URL string
+
+	// Username and Password authenticate to the registry; both empty for anonymous access
+	Username string
+	Password string
+}
+
+// Enabled reports whether a registry is configured.
+func (c Config) Enabled() bool {
+	return c.URL != ""
+}
+
+// Reference returns the registry reference of a local image name,
+// e.g. "registry.example.com/stackyn/mvp-myapp-app7:123".
+func (c Config) Reference(imageName string) string {
+	return strings.TrimSuffix(c.URL, "/") + "/" + imageName
+}
+
+// IsReference reports whether image is a reference into this registry.
+func (c Config) IsReference(image string) bool {
+	return c.Enabled() && strings.HasPrefix(image, strings.TrimSuffix(c.URL, "/")+"/")
+}
+
+// Auth returns the encoded credentials the Docker API expects for pushes and pulls,
+// or "" when no credentials are configured.
+func (c Config) Auth() (string, error) {
+	if c.Username == "" && c.Password == "" {
+		return "", nil
+	}
+	auth, err := registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      c.Username,
+		Password:      c.Password,
+		ServerAddress: strings.SplitN(c.URL, "/", 2)[0],
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode registry credentials: %w", err)
+	}
+	return auth, nil
+}
+
+// CheckStream reads a push or pull progress stream to the end and returns the error
+// the daemon reported in it, if any. The API call itself succeeds even when the
+// transfer fails, so the stream must be read to know the outcome.
+func CheckStream(stream io.Reader) error {
+	dec := json.NewDecoder(stream)
+	for {
+		var msg struct {
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read progress stream: %w", err)
+		}
+		if msg.ErrorDetail.Message != "" {
+			return errors.New(msg.ErrorDetail.Message)
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package rollout splits an app's traffic between deployments while a new one is rolled out.
+//
+// Containers register with Traefik through Docker labels, but labels are fixed when a
+// container is created and Traefik's weighted services can't be declared with them. The
+// split is therefore written as a file to the directory Traefik's file provider watches:
+// a router for the app's hostnames, with a higher priority than the label-defined one,
+// pointing at a weighted service over the containers' own (label-defined) services.
+// Removing the file hands the hostnames back to the labels.
+package rollout
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// routerPriority beats the label-defined routers, whose priority is the length of their rule
+const routerPriority = 1000000
+
+// Backend is a container's Traefik service and its share of the traffic
+type Backend struct {
+	// Service is the service the container defines with its labels (named after the container)
+	Service string
+	// Weight is the relative share of requests the service receives
+	Weight int
+}
+
+// Router writes and removes rollout routes in Traefik's dynamic configuration directory.
+type Router struct {
+	dir          string
+	certResolver string
+}
+
+// NewRouter returns a Router writing to dir, the directory Traefik's file provider watches.
+// An empty dir disables gradual rollouts.
+func NewRouter(dir, certResolver string) *Router {
+	return &Router{dir: dir, certResolver: certResolver}
+}
+
+// Enabled reports whether rollout routes can be written.
+func (r *Router) Enabled() bool {
+	return r != nil && r.dir != ""
+}
+
+// Route sends all requests for hosts to backends, split by their weights, taking
+// precedence over the routes the containers' labels define. Calling it again replaces
+// the previous split of the same app.
+func (r *Router) Route(name string, hosts []string, backends []Backend) error {
+	rules := make([]string, len(hosts))
+	for i, host := range hosts {
+		rules[i] = fmt.Sprintf("Host(`%s`)", host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Written by the deployment worker while %s is being rolled out; removed when it ends\n", name)
+	b.WriteString("http:\n")
+	b.WriteString("  routers:\n")
+	fmt.Fprintf(&b, "    %s-rollout:\n", name)
+	fmt.Fprintf(&b, "      rule: %q\n", strings.Join(rules, " || "))
+	b.WriteString("      entryPoints:\n        - websecure\n")
+	fmt.Fprintf(&b, "      priority: %d\n", routerPriority)
+	fmt.Fprintf(&b, "      service: %s-rollout\n", name)
+	b.WriteString("      tls:\n")
+	fmt.Fprintf(&b, "        certResolver: %q\n", r.certResolver)
+	b.WriteString("  services:\n")
+	fmt.Fprintf(&b, "    %s-rollout:\n", name)
+	b.WriteString("      weighted:\n        services:\n")
+	for _, backend := range backends {
+		fmt.Fprintf(&b, "          - name: %s@docker\n            weight: %d\n", backend.Service, backend.Weight)
+	}
+
+	// Write and rename, so Traefik never loads a half-written file
+	path := r.path(name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write rollout route: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write rollout route: %w", err)
+	}
+	return nil
+}
+
+// Clear removes an app's rollout route, handing its hostnames back to the container labels.
+func (r *Router) Clear(name string) error {
+	if err := os.Remove(r.path(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove rollout route: %w", err)
+	}
+	return nil
+}
+
+// Routes returns the names of the apps that have a rollout route, with when each route was
+// last written. A rollout rewrites its route at every step, so one that hasn't been written
+// for longer than a step takes was left behind.
+func (r *Router) Routes() (map[string]time.Time, error) {
+	files, err := filepath.Glob(filepath.Join(r.dir, "rollout-*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	routes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		routes[strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "rollout-"), ".yml")] = info.ModTime()
+	}
+	return routes, nil
+}
+
+func (r *Router) path(name string) string {
+	return filepath.Join(r.dir, "rollout-"+name+".yml")
+}
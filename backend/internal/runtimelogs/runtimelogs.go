@@ -0,0 +1,266 @@
+// Package runtimelogs keeps the runtime logs of running containers in the database.
+// A background Shipper follows every running deployment's container and the Store keeps its
+// most recent lines, so the logs outlive Docker's own log rotation and container restarts.
+package runtimelogs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"mvp-be/internal/logs"
+)
+
+// Line is one stored runtime log line
+type Line struct {
+	// Number counts the deployment's lines from 1; it keeps increasing as old lines are dropped
+	Number   int64     `json:"line"`
+	Stream   string    `json:"stream"`
+	LoggedAt time.Time `json:"logged_at"`
+	Message  string    `json:"message"`
+}
+
+// String formats the line the way container logs are downloaded: a marker for stderr, then the
+// timestamp and the message
+func (l Line) String() string {
+	prefix := ""
+	if l.Stream == logs.StreamStderr {
+		prefix = "[stderr] "
+	}
+	return prefix + l.LoggedAt.UTC().Format(time.RFC3339Nano) + " " + l.Message
+}
+
+// Store provides database operations for runtime log lines.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore creates a new Store instance with the provided database connection.
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Append stores lines at the end of a deployment's log, numbering them after the last stored
+// line, then drops all but the newest keep lines. Only one Shipper may append to a deployment.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - deploymentID: The deployment the lines were logged by
+//   - lines: The lines, oldest first; their Number is ignored
+//   - keep: How many lines the deployment keeps in total
+//
+// Returns:
+//   - error: Database error if the lines could not be stored
+func (s *Store) Append(ctx context.Context, deploymentID int, lines []Line, keep int) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	if err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(MAX(line_number), 0) FROM runtime_logs WHERE deployment_id = $1", deploymentID,
+	).Scan(&last); err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx,
+		"INSERT INTO runtime_logs (deployment_id, line_number, stream, logged_at, message) VALUES ($1, $2, $3, $4, $5)",
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, line := range lines {
+		// Postgres text can't hold NUL bytes
+		message := strings.ReplaceAll(line.Message, "\x00", "")
+		if _, err := stmt.ExecContext(ctx, deploymentID, last+int64(i)+1, line.Stream, line.LoggedAt.UTC(), message); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM runtime_logs WHERE deployment_id = $1 AND line_number <= $2",
+		deploymentID, last+int64(len(lines))-int64(keep),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LastLoggedAt returns when the newest stored line of a deployment was logged, or the zero
+// time if none is stored.
+func (s *Store) LastLoggedAt(ctx context.Context, deploymentID int) (time.Time, error) {
+	var at sql.NullTime
+	err := s.db.QueryRowContext(ctx,
+		"SELECT MAX(logged_at) FROM runtime_logs WHERE deployment_id = $1", deploymentID,
+	).Scan(&at)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return at.Time, nil
+}
+
+// List returns a deployment's stored lines, oldest first.
+//
+// Parameters:
+//   - ctx: Context for cancellation and deadlines
+//   - deploymentID: The deployment whose lines to return
+//   - limit: Return only the newest limit lines; 0 returns them all
+//
+// Returns:
+//   - []Line: The lines (empty if none are stored)
+//   - error: Database error if query fails
+func (s *Store) List(ctx context.Context, deploymentID int, limit int) ([]Line, error) {
+	query := "SELECT line_number, stream, logged_at, message FROM runtime_logs WHERE deployment_id = $1 ORDER BY line_number DESC"
+	args := []interface{}{deploymentID}
+	if limit > 0 {
+		query += " LIMIT $2"
+		args = append(args, limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []Line{}
+	for rows.Next() {
+		var l Line
+		if err := rows.Scan(&l.Number, &l.Stream, &l.LoggedAt, &l.Message); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Newest were read first so the limit keeps them; return them in log order
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, nil
+}
+
+// Each calls fn with each of a deployment's stored lines, oldest first, as they are read from
+// the database, so a log can be written out without holding all of it in memory. It stops at
+// the first error fn returns.
+//
+// Returns:
+//   - int: How many lines were passed to fn
+//   - error: Database error, or the error fn returned
+func (s *Store) Each(ctx context.Context, deploymentID int, fn func(Line) error) (int, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT line_number, stream, logged_at, message FROM runtime_logs WHERE deployment_id = $1 ORDER BY line_number ASC",
+		deploymentID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var l Line
+		if err := rows.Scan(&l.Number, &l.Stream, &l.LoggedAt, &l.Message); err != nil {
+			return count, err
+		}
+		if err := fn(l); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// Query selects stored lines for Search
+type Query struct {
+	// Pattern must match somewhere in the message; nil matches every line
+	Pattern *regexp.Regexp
+	// Stream, if set, is "stdout" or "stderr"
+	Stream string
+	// Since and Until, if set, bound when the lines were logged (inclusive)
+	Since time.Time
+	Until time.Time
+	// Limit is the most lines returned
+	Limit int
+}
+
+// Search returns a deployment's stored lines that match q, oldest first. The scan is bounded by
+// the deployment's retention, since only that many lines are stored.
+//
+// Returns:
+//   - []Line: Up to q.Limit matching lines (empty if none match)
+//   - bool: Whether more lines matched than were returned
+//   - error: Database error if query fails
+func (s *Store) Search(ctx context.Context, deploymentID int, q Query) ([]Line, bool, error) {
+	query := "SELECT line_number, stream, logged_at, message FROM runtime_logs WHERE deployment_id = $1"
+	args := []interface{}{deploymentID}
+	if q.Stream != "" {
+		args = append(args, q.Stream)
+		query += fmt.Sprintf(" AND stream = $%d", len(args))
+	}
+	if !q.Since.IsZero() {
+		args = append(args, q.Since.UTC())
+		query += fmt.Sprintf(" AND logged_at >= $%d", len(args))
+	}
+	if !q.Until.IsZero() {
+		args = append(args, q.Until.UTC())
+		query += fmt.Sprintf(" AND logged_at <= $%d", len(args))
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY line_number ASC", args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	matches := []Line{}
+	for rows.Next() {
+		var l Line
+		if err := rows.Scan(&l.Number, &l.Stream, &l.LoggedAt, &l.Message); err != nil {
+			return nil, false, err
+		}
+		if q.Pattern != nil && !q.Pattern.MatchString(l.Message) {
+			continue
+		}
+		if len(matches) == q.Limit {
+			return matches, true, nil
+		}
+		matches = append(matches, l)
+	}
+	return matches, false, rows.Err()
+}
+
+// Text joins lines into a log in the format of a downloaded container log.
+func Text(lines []Line) string {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// RetentionLines returns how many lines a deployment of an app keeps: the app's own setting,
+// capped at the platform's limit, or the platform's limit if the app has no setting.
+func RetentionLines(appLines, platformLines int) int {
+	if appLines > 0 && appLines < platformLines {
+		return appLines
+	}
+	return platformLines
+}
+
+// ValidateRetention checks an app's retention setting against the platform's limit.
+func ValidateRetention(lines, platformLines int) error {
+	if lines < 0 || lines > platformLines {
+		return fmt.Errorf("lines must be between 0 (the platform default) and %d", platformLines)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package runtimelogs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"mvp-be/internal/apps"
+	"mvp-be/internal/deployments"
+	"mvp-be/internal/dockerrun"
+	"mvp-be/internal/logs"
+)
+
+// flushInterval is how often a follower stores the lines it has read
+const flushInterval = 2 * time.Second
+
+// flushLines makes a follower store its lines early once this many are waiting
+const flushLines = 200
+
+// Shipper follows the logs of every running deployment's container into the Store.
+type Shipper struct {
+	store           *Store
+	deploymentStore *deployments.Store
+	appStore        *apps.Store
+	runner          *dockerrun.Runner
+	interval        time.Duration
+	lines           int
+
+	// mu guards following, the cancel functions of the running followers by deployment ID
+	mu        sync.Mutex
+	following map[int]context.CancelFunc
+}
+
+// NewShipper creates a Shipper that looks for new running deployments every interval and
+// keeps at most lines lines per deployment (less if its app asks for less).
+func NewShipper(store *Store, deploymentStore *deployments.Store, appStore *apps.Store, runner *dockerrun.Runner, interval time.Duration, lines int) *Shipper {
+	return &Shipper{
+		store:           store,
+		deploymentStore: deploymentStore,
+		appStore:        appStore,
+		runner:          runner,
+		interval:        interval,
+		lines:           lines,
+		following:       make(map[int]context.CancelFunc),
+	}
+}
+
+// Run ships logs until ctx is cancelled. A container's logs are followed while its deployment
+// runs; a container that stops, e.g. to be restarted, is followed again on a later tick from
+// the last line stored, so nothing is stored twice.
+func (s *Shipper) Run(ctx context.Context) {
+	log.Printf("Runtime log shipper started (keeping %d lines per deployment)", s.lines)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.sync(ctx)
+		select {
+		case <-ctx.Done():
+			log.Println("Runtime log shipper stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync starts following newly running deployments and stops following those no longer running
+func (s *Shipper) sync(ctx context.Context) {
+	running, err := s.deploymentStore.ListRunning(ctx)
+	if err != nil {
+		log.Printf("Error listing running deployments for log shipping: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[int]bool, len(running))
+	for _, d := range running {
+		wanted[d.ID] = true
+		if _, ok := s.following[d.ID]; ok {
+			continue
+		}
+		followCtx, cancel := context.WithCancel(ctx)
+		s.following[d.ID] = cancel
+		go s.follow(followCtx, d)
+	}
+	for id, cancel := range s.following {
+		if !wanted[id] {
+			cancel()
+		}
+	}
+}
+
+// follow stores a deployment's log lines as its container writes them, until the container
+// stops or ctx is cancelled
+func (s *Shipper) follow(ctx context.Context, d *deployments.Deployment) {
+	defer func() {
+		s.mu.Lock()
+		if cancel, ok := s.following[d.ID]; ok {
+			cancel()
+			delete(s.following, d.ID)
+		}
+		s.mu.Unlock()
+	}()
+
+	keep := s.lines
+	if app, err := s.appStore.GetByID(ctx, d.AppID); err == nil {
+		keep = RetentionLines(app.LogRetentionLines, s.lines)
+	}
+	since, err := s.store.LastLoggedAt(ctx, d.ID)
+	if err != nil {
+		log.Printf("Warning: failed to read stored logs of deployment %d: %v", d.ID, err)
+		return
+	}
+	reader, tty, err := s.runner.FollowLogs(ctx, d.ContainerID.String, since)
+	if err != nil {
+		log.Printf("Warning: failed to follow logs of deployment %d: %v", d.ID, err)
+		return
+	}
+	// Closing the stream stops the scan below if ctx ends first
+	defer reader.Close()
+
+	lines := make(chan Line, flushLines)
+	go func() {
+		defer close(lines)
+		err := logs.ScanRuntimeLog(reader, tty, func(stream, text string) {
+			at, message, ok := logs.SplitTimestamp(text)
+			if !ok {
+				at = time.Now()
+			} else if !at.After(since) {
+				// Docker's since is inclusive; the line is already stored
+				return
+			}
+			select {
+			case lines <- Line{Stream: stream, LoggedAt: at, Message: message}:
+			case <-ctx.Done():
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Warning: reading logs of deployment %d: %v", d.ID, err)
+		}
+	}()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []Line
+	flush := func() {
+		if err := s.store.Append(ctx, d.ID, batch, keep); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: failed to store logs of deployment %d: %v", d.ID, err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) >= flushLines {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package secrets keeps an app's runtime secrets: values such as API keys and database
+// passwords that are set in its containers like environment variables, but are stored
+// encrypted and are never returned by the API or written to logs.
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"mvp-be/internal/db"
+)
+
+// KeySize is the size of the encryption key, in bytes (AES-256)
+const KeySize = 32
+
+// ErrNoKey is returned when secrets must be encrypted or decrypted but no key is configured
+var ErrNoKey = errors.New("secrets are not available: SECRETS_KEY is not set")
+
+// Cipher encrypts and decrypts secret values with AES-256-GCM.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher for a base64-encoded KeySize-byte key, as generated by
+// `openssl rand -base64 32`. An empty key returns a nil Cipher, which refuses to encrypt
+// or decrypt with ErrNoKey.
+func NewCipher(key string) (*Cipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %w", err)
+	}
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns value encrypted under a fresh nonce, base64-encoded with the nonce first.
+// additional binds the ciphertext to its owner, so it can't be moved to another one.
+func (c *Cipher) Encrypt(value, additional string) (string, error) {
+	if c == nil {
+		return "", ErrNoKey
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(additional))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt. It fails if the value was encrypted with another key or for
+// another owner.
+func (c *Cipher) Decrypt(encrypted, additional string) (string, error) {
+	if c == nil {
+		return "", ErrNoKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	value, err := c.aead.Open(nil, nonce, ciphertext, []byte(additional))
+	if err != nil {
+		return "", errors.New("failed to decrypt secret; was SECRETS_KEY changed?")
+	}
+	return string(value), nil
+}
+
+// Secret describes a stored secret without its value
+type Secret struct {
+	Key       string    `json:"key"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store provides database operations for app secrets.
+type Store struct {
+	db     db.Querier
+	cipher *Cipher
+}
+
+// NewStore creates a Store that encrypts values with cipher. With a nil cipher secrets can
+// be listed and deleted, but not set or read.
+func NewStore(db *sql.DB, cipher *Cipher) *Store {
+	return &Store{db: db, cipher: cipher}
+}
+
+// WithTx returns a Store whose queries run inside tx.
+func (s *Store) WithTx(tx *sql.Tx) *Store {
+	return &Store{db: tx, cipher: s.cipher}
+}
+
+// Enabled reports whether secrets can be set and read.
+func (s *Store) Enabled() bool {
+	return s.cipher != nil
+}
+
+// additional is the data a secret's ciphertext is bound to: its app and key
+func additional(appID int, key string) string {
+	return fmt.Sprintf("%d/%s", appID, key)
+}
+
+// List returns an app's secrets by key, without their values.
+func (s *Store) List(ctx context.Context, appID int) ([]Secret, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT key, updated_at FROM app_secrets WHERE app_id = $1 ORDER BY key ASC", appID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []Secret{}
+	for rows.Next() {
+		var secret Secret
+		if err := rows.Scan(&secret.Key, &secret.UpdatedAt); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, rows.Err()
+}
+
+// Set creates or replaces a secret of an app.
+func (s *Store) Set(ctx context.Context, appID int, key, value string) error {
+	encrypted, err := s.cipher.Encrypt(value, additional(appID, key))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO app_secrets (app_id, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (app_id, key) DO UPDATE SET value = EXCLUDED.value, updated_at = CURRENT_TIMESTAMP`,
+		appID, key, encrypted,
+	)
+	return err
+}
+
+// Delete removes a secret of an app. Returns sql.ErrNoRows if the app has no secret with that key.
+func (s *Store) Delete(ctx context.Context, appID int, key string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM app_secrets WHERE app_id = $1 AND key = $2", appID, key)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Values returns an app's secrets with their decrypted values, keyed by key, for setting in
+// its containers. Returns an empty map if the app has none.
+func (s *Store) Values(ctx context.Context, appID int) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.QueryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT key, value FROM app_secrets WHERE app_id = $1", appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := map[string]string{}
+	for rows.Next() {
+		var key, encrypted string
+		if err := rows.Scan(&key, &encrypted); err != nil {
+			return nil, err
+		}
+		value, err := s.cipher.Decrypt(encrypted, additional(appID, key))
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", key, err)
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,408 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey and testAccept are the handshake example of RFC 6455, section 1.3
+const (
+	testKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	testAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+// client is the client end of a connection to an echo server
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	// done receives the error that ended the server's read loop
+	done chan error
+}
+
+// dial starts a server that echoes every message back and completes a handshake with it
+func dial(t *testing.T) *client {
+	t.Helper()
+	done := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			done <- err
+			return
+		}
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				done <- err
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	handshake := "GET /exec HTTP/1.1\r\n" +
+		"Host: " + server.Listener.Addr().String() + "\r\n" +
+		"Connection: keep-alive, Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != testAccept {
+		t.Fatalf("Sec-WebSocket-Accept = %q, want %q", got, testAccept)
+	}
+	return &client{t: t, conn: conn, reader: reader, done: done}
+}
+
+// frame encodes a client frame. Client frames are masked unless masked is false.
+func frame(fin bool, opcode int, payload []byte, masked bool) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	b := []byte{first}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		b = append(b, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = append(b, maskBit|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+	if !masked {
+		return append(b, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// send writes raw bytes to the server
+func (c *client) send(b []byte) {
+	c.t.Helper()
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read reads one server frame, checking that it is final and unmasked
+func (c *client) read() (opcode int, payload []byte) {
+	c.t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		c.t.Fatalf("failed to read frame: %v", err)
+	}
+	if header[0]&0x80 == 0 {
+		c.t.Errorf("server frame isn't final")
+	}
+	if header[1]&0x80 != 0 {
+		c.t.Errorf("server frame is masked")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		c.t.Fatalf("failed to read payload: %v", err)
+	}
+	return int(header[0] & 0x0f), payload
+}
+
+// expectClose reads the server's close frame, checks its status code and that the server
+// then closed the connection, and returns the error its read loop ended with
+func (c *client) expectClose(code int) error {
+	c.t.Helper()
+	opcode, payload := c.read()
+	if opcode != opClose {
+		c.t.Fatalf("opcode = %d, want close", opcode)
+	}
+	if len(payload) < 2 {
+		c.t.Fatalf("close frame has no status code")
+	}
+	if got := int(binary.BigEndian.Uint16(payload)); got != code {
+		c.t.Errorf("close code = %d (%q), want %d", got, payload[2:], code)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		c.t.Errorf("connection still open after close frame: %v", err)
+	}
+	return <-c.done
+}
+
+func TestUpgradeRejectsBadHandshakes(t *testing.T) {
+	valid := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/exec", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", testKey)
+		return r
+	}
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+	}{
+		{"POST", func(r *http.Request) { r.Method = http.MethodPost }},
+		{"no Upgrade header", func(r *http.Request) { r.Header.Del("Upgrade") }},
+		{"no Connection upgrade", func(r *http.Request) { r.Header.Set("Connection", "keep-alive") }},
+		{"old version", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }},
+		{"missing key", func(r *http.Request) { r.Header.Del("Sec-WebSocket-Key") }},
+		{"short key", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.modify(r)
+			w := httptest.NewRecorder()
+			_, err := Upgrade(w, r)
+			if !errors.Is(err, ErrBadHandshake) {
+				t.Fatalf("Upgrade() error = %v, want ErrBadHandshake", err)
+			}
+			// The caller must still be able to respond
+			if w.Body.Len() != 0 || len(w.Header()) != 0 {
+				t.Errorf("Upgrade() wrote a response: %q %v", w.Body.String(), w.Header())
+			}
+		})
+	}
+}
+
+func TestEcho(t *testing.T) {
+	c := dial(t)
+	for _, tt := range []struct {
+		opcode  int
+		payload []byte
+	}{
+		{TextMessage, []byte("hello")},
+		{BinaryMessage, []byte{0, 1, 2, 0xff}},
+		{TextMessage, []byte{}},
+		// 16-bit and 64-bit extended lengths
+		{BinaryMessage, bytes.Repeat([]byte("a"), 300)},
+		{BinaryMessage, bytes.Repeat([]byte("b"), MaxMessageSize)},
+	} {
+		c.send(frame(true, tt.opcode, tt.payload, true))
+		opcode, payload := c.read()
+		if opcode != tt.opcode || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("echo of %d-byte message = opcode %d, %d bytes; want opcode %d", len(tt.payload), opcode, len(payload), tt.opcode)
+		}
+	}
+}
+
+func TestFragmentedMessageWithPing(t *testing.T) {
+	c := dial(t)
+	c.send(frame(false, TextMessage, []byte("hel"), true))
+	// Control frames may come between the fragments of a message
+	c.send(frame(true, opPing, []byte("are you there"), true))
+	c.send(frame(false, opContinuation, []byte("lo, "), true))
+	c.send(frame(true, opPong, nil, true))
+	c.send(frame(true, opContinuation, []byte("world"), true))
+
+	opcode, payload := c.read()
+	if opcode != opPong || string(payload) != "are you there" {
+		t.Errorf("ping answer = opcode %d %q, want a pong with the ping's payload", opcode, payload)
+	}
+	opcode, payload = c.read()
+	if opcode != TextMessage || string(payload) != "hello, world" {
+		t.Errorf("message = opcode %d %q, want text \"hello, world\"", opcode, payload)
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	c := dial(t)
+	c.send(frame(true, opClose, binary.BigEndian.AppendUint16(nil, CloseNormal), true))
+	if err := c.expectClose(CloseNormal); err != io.EOF {
+		t.Errorf("ReadMessage() error = %v, want io.EOF", err)
+	}
+}
+
+func TestCloseWithoutStatus(t *testing.T) {
+	c := dial(t)
+	c.send(frame(true, opClose, nil, true))
+	if err := c.expectClose(CloseNormal); err != io.EOF {
+		t.Errorf("ReadMessage() error = %v, want io.EOF", err)
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	code := func(c int) []byte { return binary.BigEndian.AppendUint16(nil, uint16(c)) }
+	tests := []struct {
+		name    string
+		payload []byte
+		// want is the code the server closes with: the client's own, or a protocol error
+		want int
+	}{
+		{"going away", code(1001), 1001},
+		{"internal error with a reason", append(code(CloseInternalError), "oops"...), CloseInternalError},
+		{"registered", code(3000), 3000},
+		{"private", code(4999), 4999},
+		{"truncated code", []byte{0x03}, CloseProtocolError},
+		{"below the range", code(999), CloseProtocolError},
+		{"unassigned", code(1004), CloseProtocolError},
+		{"no status received", code(1005), CloseProtocolError},
+		{"abnormal closure", code(1006), CloseProtocolError},
+		{"TLS handshake", code(1015), CloseProtocolError},
+		{"reserved for the protocol", code(2999), CloseProtocolError},
+		{"above the range", code(5000), CloseProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t)
+			c.send(frame(true, opClose, tt.payload, true))
+			err := c.expectClose(tt.want)
+			if tt.want == CloseProtocolError && (err == nil || err == io.EOF) {
+				t.Errorf("ReadMessage() error = %v, want the protocol error", err)
+			}
+			if tt.want != CloseProtocolError && err != io.EOF {
+				t.Errorf("ReadMessage() error = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   int
+	}{
+		{
+			name:   "unmasked frame",
+			frames: [][]byte{frame(true, TextMessage, []byte("hi"), false)},
+			code:   CloseProtocolError,
+		},
+		{
+			name: "reserved bits",
+			frames: [][]byte{func() []byte {
+				b := frame(true, TextMessage, []byte("hi"), true)
+				b[0] |= 0x40
+				return b
+			}()},
+			code: CloseProtocolError,
+		},
+		{
+			name:   "unknown opcode",
+			frames: [][]byte{frame(true, 3, []byte("hi"), true)},
+			code:   CloseProtocolError,
+		},
+		{
+			name:   "continuation without a message",
+			frames: [][]byte{frame(true, opContinuation, []byte("hi"), true)},
+			code:   CloseProtocolError,
+		},
+		{
+			name: "new message inside a fragmented one",
+			frames: [][]byte{
+				frame(false, TextMessage, []byte("one"), true),
+				frame(true, BinaryMessage, []byte("two"), true),
+			},
+			code: CloseProtocolError,
+		},
+		{
+			name:   "fragmented control frame",
+			frames: [][]byte{frame(false, opPing, []byte("hi"), true)},
+			code:   CloseProtocolError,
+		},
+		{
+			name:   "control frame over 125 bytes",
+			frames: [][]byte{frame(true, opPing, bytes.Repeat([]byte("p"), 126), true)},
+			code:   CloseProtocolError,
+		},
+		{
+			name: "frame over MaxMessageSize",
+			// The length in the header is enough; sending the payload the server never reads
+			// would make its close reset the connection
+			frames: [][]byte{frame(true, BinaryMessage, make([]byte, MaxMessageSize+1), true)[:2+8+4]},
+			code:   CloseMessageTooBig,
+		},
+		{
+			name: "fragments over MaxMessageSize together",
+			frames: [][]byte{
+				frame(false, BinaryMessage, make([]byte, MaxMessageSize/2+1), true),
+				frame(true, opContinuation, make([]byte, MaxMessageSize/2+1), true),
+			},
+			code: CloseMessageTooBig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t)
+			for _, f := range tt.frames {
+				c.send(f)
+			}
+			err := c.expectClose(tt.code)
+			if err == nil || err == io.EOF {
+				t.Errorf("ReadMessage() error = %v, want the protocol error", err)
+			}
+		})
+	}
+}
+
+func TestCloseTruncatesLongReason(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	conn := &Conn{conn: server, reader: bufio.NewReader(server)}
+
+	read := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(peer)
+		read <- b
+	}()
+	conn.Close(CloseInternalError, strings.Repeat("x", 200))
+	// Closing again must not write a second frame
+	conn.Close(CloseNormal, "")
+
+	b := <-read
+	if len(b) != 2+125 {
+		t.Fatalf("close frame is %d bytes, want one frame with a 125-byte payload", len(b))
+	}
+	if b[0] != 0x80|opClose || b[1] != 125 {
+		t.Errorf("close frame header = % x, want final close frame of length 125", b[:2])
+	}
+	if got := binary.BigEndian.Uint16(b[2:]); got != CloseInternalError {
+		t.Errorf("close code = %d, want %d", got, CloseInternalError)
+	}
+}
@@ -1,11 +1,16 @@
 import { API_ENDPOINTS } from './config';
 import type { App, Deployment, DeploymentLogs, CreateAppRequest, CreateAppResponse } from './types';
 
+// Extract the message from an error response body: {"error": {"code", "message", "details"}}
+async function errorMessage(response: Response): Promise<string> {
+  const body = await response.json().catch(() => null);
+  return body?.error?.message || response.statusText || `HTTP error! status: ${response.status}`;
+}
+
 // Helper function to handle API responses
 async function handleResponse<T>(response: Response): Promise<T> {
   if (!response.ok) {
-    const error = await response.json().catch(() => ({ error: response.statusText }));
-    throw new Error(error.error || `HTTP error! status: ${response.status}`);
+    throw new Error(await errorMessage(response));
   }
   return response.json();
 }
@@ -70,8 +75,7 @@ export const appsApi = {
       method: 'DELETE',
     });
     if (!response.ok) {
-      const error = await response.json().catch(() => ({ error: response.statusText }));
-      throw new Error(error.error || `HTTP error! status: ${response.status}`);
+      throw new Error(await errorMessage(response));
     }
   },
 
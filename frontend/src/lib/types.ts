@@ -51,6 +51,7 @@ export interface DeploymentLogs {
   status: string;
   build_log?: string | null;
   error_message?: string | null;
+  failure_summary?: string | null;
 }
 
 export interface CreateAppRequest {
@@ -59,10 +60,17 @@ export interface CreateAppRequest {
   branch: string;
 }
 
+// ApiError is the body of every error response; branch on code, not message
+export interface ApiError {
+  code: string;
+  message: string;
+  details?: Record<string, unknown>;
+}
+
 export interface CreateAppResponse {
   app: App;
   deployment: Deployment;
-  error?: string;
+  error?: ApiError;
 }
 
 
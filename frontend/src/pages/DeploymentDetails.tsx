@@ -145,6 +145,13 @@ export default function DeploymentDetailsPage() {
         </div>
 
         <div className="space-y-6">
+          {logs?.failure_summary && (
+            <div className="p-4 bg-red-50 border border-red-200 rounded-lg">
+              <h3 className="text-sm font-medium text-red-800 mb-2">Build Failed</h3>
+              <p className="text-red-800 font-mono text-sm">{logs.failure_summary}</p>
+            </div>
+          )}
+
           {logs && extractString(logs.build_log) && (
             <div>
               <h2 className="text-xl font-bold text-gray-900 mb-4">Build Logs</h2>
@@ -20,7 +20,7 @@ export default function NewAppPage() {
     try {
       const response = await appsApi.create(formData);
       if (response.error) {
-        setError(response.error);
+        setError(response.error.message);
       } else {
         navigate(`/apps/${response.app.id}`);
       }